@@ -1,21 +1,38 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
 	"container/list"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"html"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 	"os/exec"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/charmbracelet/bubbles/textarea"
 	"github.com/charmbracelet/bubbles/textinput"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/x/ansi"
+	"github.com/charmbracelet/x/term"
 )
 
 type mode int
@@ -37,6 +54,30 @@ const (
 	vimCommand
 )
 
+type browserOp int
+
+const (
+	browserOpNone browserOp = iota
+	browserOpCreate
+	browserOpRename
+	browserOpDelete
+)
+
+type exAction int
+
+const (
+	exWrite exAction = iota
+	exQuit
+	exForceQuit
+	exWriteQuit
+	exGotoBlock
+)
+
+type exCommand struct {
+	action exAction
+	block  int
+}
+
 type viewMode int
 
 const (
@@ -45,6 +86,13 @@ const (
 	viewPreviewOnly
 )
 
+// Keys for the view modes in the splitRatios preference
+var viewModeNames = map[viewMode]string{
+	viewSplitPane:   "split",
+	viewEditorOnly:  "editor",
+	viewPreviewOnly: "preview",
+}
+
 type blockType string
 
 const (
@@ -55,19 +103,88 @@ const (
 	blockQuote    blockType = "quote"
 	blockList     blockType = "list"
 	blockRawLaTeX blockType = "rawlatex"
+	blockTable    blockType = "table"
+	blockImage    blockType = "image"
+	blockHR       blockType = "hr"
 )
 
 type exportFormat int
 
 const (
 	exportPDF exportFormat = iota
+	exportLaTeX
 	exportHTML
+	exportOfflineHTML
 	exportUnicode
 	exportMarkdown
+	exportEPUB
+	exportRST
+	exportAsciiDoc
+	exportOrg
+	exportJSON
+	// Every format in batchFormats, one after another
+	exportAll
 )
 
 type tickMsg time.Time
 
+// Outcome of the notification sent when a timer runs out
+type notifyResultMsg struct {
+	err error
+}
+
+type pomodoroPhase int
+
+const (
+	phaseWork pomodoroPhase = iota
+	phaseShortBreak
+	phaseLongBreak
+)
+
+type pomodoroState struct {
+	enabled   bool
+	phase     pomodoroPhase
+	completed int
+}
+
+type autosaveMsg time.Time
+
+type recoveryMsg time.Time
+
+// A recovery backup finished writing, generation is the document's save count when it started
+type recoveryWrittenMsg struct {
+	path       string
+	generation int
+}
+
+type exportResultMsg struct {
+	format string
+	path   string
+	err    error
+	// Left out of a batch export, err says why
+	skipped bool
+}
+
+type batchExportMsg struct {
+	results []exportResultMsg
+}
+
+type clearSavedMsg struct{}
+
+type documentSavedMsg struct {
+	path              string
+	blocks            []ContentBlock
+	notes             string
+	created, modified time.Time
+	err               error
+}
+
+type externalEditorMsg struct {
+	blockID string
+	path    string
+	err     error
+}
+
 type ContentBlock struct {
 	ID         string    `json:"id"`
 	Type       blockType `json:"type"`
@@ -76,6 +193,13 @@ type ContentBlock struct {
 	Numbered   bool      `json:"numbered,omitempty"`
 	Language   string    `json:"language,omitempty"`
 	Level      int       `json:"level,omitempty"`
+	// Code listing options for PDF export
+	NoWrap      bool `json:"noWrap,omitempty"`
+	LineNumbers bool `json:"lineNumbers,omitempty"`
+	// Text written as LaTeX, passed through unescaped in LaTeX and PDF export only
+	RawText bool `json:"rawText,omitempty"`
+	// Author's note on the block, kept in the .oath file and never exported
+	Comment string `json:"comment,omitempty"`
 }
 
 type Template struct {
@@ -85,6 +209,9 @@ type Template struct {
 	Variables   map[string]string `json:"variables"`
 }
 
+// Version written to saved documents. 1.1 guarantees unique block IDs
+const documentVersion = "1.1"
+
 type OathDocument struct {
 	Version   string            `json:"version"`
 	Template  string            `json:"template"`
@@ -92,9 +219,15 @@ type OathDocument struct {
 	Variables map[string]string `json:"variables"`
 	Created   time.Time         `json:"created"`
 	Modified  time.Time         `json:"modified"`
+	// Scratch notes from the notes panel and timer, never exported
+	Notes string `json:"notes,omitempty"`
+	// Only set in recovery backups, the document they were taken from
+	Source string `json:"source,omitempty"`
 }
 
 type Diagnostic struct {
+	// Block the problem was found in, empty when it isn't tied to one
+	BlockID  string
 	Line     int
 	Column   int
 	Message  string
@@ -107,6 +240,8 @@ type Completion struct {
 	InsertText string
 	Kind       string
 	Example    string
+	// Offset into InsertText where the cursor lands, 0 leaves it after the insertion
+	Cursor int
 }
 
 type RenderedBlock struct {
@@ -115,10 +250,20 @@ type RenderedBlock struct {
 	LastModified time.Time
 }
 
+type Stats struct {
+	Words       int
+	Characters  int
+	MathBlocks  int
+	BlockCounts map[blockType]int
+	ReadingTime int
+}
+
 type LRUCache struct {
 	capacity int
 	cache    map[string]*list.Element
 	order    *list.List
+	hits     int
+	misses   int
 }
 
 type cacheItem struct {
@@ -137,8 +282,13 @@ type lspModel struct {
 	activeCompletion int
 	showCompletions  bool
 	triggerPrefix    string
+	triggerStart     int
 	diagnostics      []Diagnostic
+	// Index into diagnostics last jumped to, -1 before the first jump
+	activeDiagnostic int
 	symbols          map[string]Completion
+	// Commands defined in the document's raw blocks, rebuilt by setMacros
+	macros map[string]Completion
 }
 
 type FileInfo struct {
@@ -147,14 +297,28 @@ type FileInfo struct {
 	IsDir   bool
 	Size    int64
 	ModTime time.Time
+	// Why the entry couldn't be read, such entries are listed but can't be opened
+	Err error
 }
 
 type browserModel struct {
 	currentPath string
 	files       []FileInfo
+	allFiles    []FileInfo
 	selected    int
 	showHidden  bool
 	errorMsg    string
+	filter      textinput.Model
+	filtering   bool
+	prompt      textinput.Model
+	pendingOp   browserOp
+	showRecent  bool
+	// With showRecent, the list holds recent directories rather than documents
+	recentDirs bool
+	// Backups left behind by a crash, offered one at a time
+	recoveries []recoveryFile
+	// Entries deleted to the trash this session, the last one is restored first
+	trashed []trashedFile
 }
 
 type vimState struct {
@@ -168,7 +332,6 @@ type vimState struct {
 	visualStart  int
 	visualEnd    int
 	cursorPos    int
-	yankBuffer   string
 }
 
 type documentModel struct {
@@ -183,12 +346,89 @@ type documentModel struct {
 	lsp          *lspModel
 	vim          *vimState
 	needsRefresh bool
+	showSaved    bool
+	saveError    string
+	showStats    bool
+	showCache    bool
+	command      textinput.Model
+	commandError string
+	variables    map[string]string
+	previewOffset int
+	// Long lines run off the side of the preview instead of wrapping, previewColumn is how far it's scrolled
+	previewNoWrap bool
+	previewColumn int
+	pinnedID      string
+	collapsed     map[string]bool
+	// Ratios of the view modes not on screen, splitRatio is the current one's
+	splitRatios map[viewMode]float64
+	// Rendered preview blocks from the last frame, a pointer so every copy of the model shares it
+	preview *previewCache
+	// The command line is asking for an image path rather than an ex command
+	imagePrompt bool
+	// Or for a file name to save to, overwritePath waits for a y when that file exists
+	saveAsPrompt  bool
+	overwritePath string
+	// Or for the current block's comment
+	commentPrompt bool
+	// Or for the current code block's language
+	languagePrompt bool
+	// Tidy is waiting for whether to merge runs of blocks as well
+	tidyPrompt bool
+	// Or for a line of the block being edited to jump to
+	linePrompt bool
+	// Or for a template name, templateName then waits for whether to keep the block text
+	templatePrompt bool
+	templateName   string
+
+	// Next block ID to hand out, never reused within a session
+	nextID int
+
+	// Blocks as last read from or written to disk, the diff view compares against these
+	saved      []ContentBlock
+	showDiff   bool
+	diff       []blockChange
+	diffOffset int
+
+	showOutline     bool
+	outline         []outlineEntry
+	outlineSelected int
+
+	// Block range picked in selection mode, the end follows the cursor
+	selecting      bool
+	selectionStart int
+	selectionEnd   int
+
+	// The notes panel has the shared notes textarea focused
+	showNotes bool
+
+	showComments    bool
+	commentSelected int
+
+	// Blocks and notes as of the last recovery backup, unchanged documents aren't rewritten
+	lastRecovery string
+	// Bumped on every save, a backup started before the save is deleted once it lands
+	recoveryGeneration int
+
+	// Confirmation such as where the last export went, shown until the next key. A failed export opens an overlay instead
+	notice      string
+	exportError string
+
+	// Renders just the current block under the editor, following it as it is typed
+	showMathPreview bool
+
+	// Timestamps from the .oath file, zero until the document has been saved once
+	created, savedAt time.Time
 }
 
 type menuModel struct {
 	templates []Template
 	selected  int
 	input     textinput.Model
+
+	// Variable prompts for the selected template, asked one at a time
+	pendingVars []string
+	varIndex    int
+	resolved    map[string]string
 }
 
 type exportModel struct {
@@ -196,6 +436,14 @@ type exportModel struct {
 	selected int
 	filename string
 	input    textinput.Model
+	// Set while an export command is in flight
+	running bool
+	// Selected blocks to export instead of the whole document
+	blocks []ContentBlock
+	// Outcome of a batch export, shown until dismissed
+	results []exportResultMsg
+	// A large document is waiting for a y before filename is exported to PDF
+	confirmLarge bool
 }
 
 type UserPreferences struct {
@@ -205,8 +453,65 @@ type UserPreferences struct {
 	ViewMode      int     `json:"viewMode"`
 	ShowHidden    bool    `json:"showHidden"`
 	VimMode       bool    `json:"vimMode"`
+	// Seconds between autosaves, 0 disables
+	AutosaveInterval int      `json:"autosaveInterval"`
+	RecentFiles      []string `json:"recentFiles"`
+	RecentDirs       []string `json:"recentDirs"`
+	AutoDetectBlocks bool     `json:"autoDetectBlocks"`
+
+	// Pomodoro phase lengths in minutes
+	PomodoroWork       int `json:"pomodoroWork"`
+	PomodoroShortBreak int `json:"pomodoroShortBreak"`
+	PomodoroLongBreak  int `json:"pomodoroLongBreak"`
+	PomodoroCycles     int `json:"pomodoroCycles"`
+
+	// TeX engine for PDF export and how many times it runs, references need at least two
+	LaTeXEngine string `json:"latexEngine"`
+	LaTeXPasses int    `json:"latexPasses"`
+	// Document class (article, report or book), its font size option and extra preamble lines
+	LaTeXClass    string `json:"latexClass"`
+	LaTeXFontSize string `json:"latexFontSize"`
+	LaTeXPreamble string `json:"latexPreamble"`
+	// Seconds one engine run may take before it is killed
+	LaTeXTimeout int `json:"latexTimeout"`
+	// Block count above which exporting to PDF asks first, 0 never asks
+	LargeDocumentBlocks int `json:"largeDocumentBlocks"`
+	// Image format math blocks are exported to on their own, svg or png
+	MathImageFormat string `json:"mathImageFormat"`
+	// Delete in the browser removes entries outright instead of moving them to the trash
+	PermanentDelete bool `json:"permanentDelete"`
+	// Leave the generated .tex next to the PDF for hand editing
+	KeepTeX bool `json:"keepTeX"`
+	// Columns per leading tab in code blocks
+	CodeTabWidth int `json:"codeTabWidth"`
+	// Rendered blocks kept in memory, raise it for very long documents
+	CacheCapacity int `json:"cacheCapacity"`
+	// Wrap long lines in PDF code listings, blocks can still opt out one by one
+	CodeBreakLines bool `json:"codeBreakLines"`
+	// Prefix numbered headings with their section number in Markdown exports
+	MarkdownSectionNumbers bool `json:"markdownSectionNumbers"`
+	// Editor share of the split for the three preset keys
+	SplitPresets []float64 `json:"splitPresets"`
+	// Split ratio each view mode was last left at, by split, editor and preview
+	SplitRatios map[string]float64 `json:"splitRatios"`
+	// How the end of a timer is announced: both, bell, desktop or none
+	TimerNotify string `json:"timerNotify"`
+	// Make preview links clickable with OSC 8, for terminals that support it
+	PreviewHyperlinks bool `json:"previewHyperlinks"`
+	// Line number gutter beside the block being edited
+	EditorLineNumbers bool `json:"editorLineNumbers"`
+	// Columns before the editor soft-wraps a line, 0 wraps at the pane edge
+	EditorWrapWidth int `json:"editorWrapWidth"`
+	// Type of the blocks the new block key creates
+	DefaultBlockType string `json:"defaultBlockType"`
+	// Enter continues list markers and keeps the indentation of code lines
+	AutoIndent bool `json:"autoIndent"`
+	// Start Markdown exports with YAML front matter for static site generators
+	MarkdownFrontMatter bool `json:"markdownFrontMatter"`
 }
 
+const maxRecentFiles = 10
+
 type model struct {
 	mode          mode
 	width, height int
@@ -220,25 +525,49 @@ type model struct {
 	remaining time.Duration
 	ticker    *time.Ticker
 	paused    bool
-	input     textinput.Model
-	notes     textarea.Model
-	theme     themeModel
+	pomodoro  pomodoroState
+	notifier  notifier
+	// Why the last timer notification couldn't be sent, shown on the timer screen
+	notifyError string
+	input       textinput.Model
+	notes       textarea.Model
+	theme       themeModel
 
 	preferences *UserPreferences
+	keys        keymap
+	// Problems with keybindings.json, shown in the status line until the first key
+	keyWarnings []string
+
+	// Set while asking whether to save unsaved changes before leaving
+	quitPrompt  quitAction
+	pendingQuit quitAction
+
+	palette   paletteModel
+	symbols   symbolPicker
+	search    documentSearch
+	clipboard clipboard
 }
 
+type quitAction int
+
+const (
+	quitNone quitAction = iota
+	quitToMenu
+	quitApp
+)
+
 type Theme struct {
-	Name        string
-	Primary     lipgloss.AdaptiveColor
-	Secondary   lipgloss.AdaptiveColor
-	Accent      lipgloss.AdaptiveColor
-	Background  lipgloss.AdaptiveColor
-	Foreground  lipgloss.AdaptiveColor
-	Success     lipgloss.AdaptiveColor
-	Warning     lipgloss.AdaptiveColor
-	Error       lipgloss.AdaptiveColor
-	Muted       lipgloss.AdaptiveColor
-	Border      lipgloss.AdaptiveColor
+	Name       string                 `json:"name"`
+	Primary    lipgloss.AdaptiveColor `json:"primary"`
+	Secondary  lipgloss.AdaptiveColor `json:"secondary"`
+	Accent     lipgloss.AdaptiveColor `json:"accent"`
+	Background lipgloss.AdaptiveColor `json:"background"`
+	Foreground lipgloss.AdaptiveColor `json:"foreground"`
+	Success    lipgloss.AdaptiveColor `json:"success"`
+	Warning    lipgloss.AdaptiveColor `json:"warning"`
+	Error      lipgloss.AdaptiveColor `json:"error"`
+	Muted      lipgloss.AdaptiveColor `json:"muted"`
+	Border     lipgloss.AdaptiveColor `json:"border"`
 }
 
 var themes = map[string]Theme{
@@ -296,6 +625,152 @@ var themes = map[string]Theme{
 	},
 }
 
+// How long to wait for the terminal to report its background colour
+const backgroundQueryTimeout = 200 * time.Millisecond
+
+// Asks the terminal for its background colour with OSC 11, followed by a device attributes
+// request that every terminal answers so ones without OSC 11 don't hold up startup. ok is
+// false when there's no terminal, no answer in time or the platform can't time out a read
+func queryDarkBackground(timeout time.Duration) (dark, ok bool) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return false, false
+	}
+	defer tty.Close()
+
+	state, err := term.MakeRaw(tty.Fd())
+	if err != nil {
+		return false, false
+	}
+	defer term.Restore(tty.Fd(), state)
+
+	if err := tty.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return false, false
+	}
+	if _, err := tty.WriteString("\x1b]11;?\x07\x1b[c"); err != nil {
+		return false, false
+	}
+
+	var response []byte
+	buf := make([]byte, 256)
+	for {
+		n, err := tty.Read(buf)
+		response = append(response, buf[:n]...)
+		if err != nil || deviceAttributesEnd(response) {
+			break
+		}
+	}
+	return parseBackgroundResponse(string(response))
+}
+
+// The device attributes reply, ESC [ ? ... c, comes last
+func deviceAttributesEnd(response []byte) bool {
+	start := bytes.LastIndex(response, []byte("\x1b[?"))
+	return start >= 0 && bytes.IndexByte(response[start:], 'c') >= 0
+}
+
+// Reads "ESC ] 11 ; rgb:RRRR/GGGG/BBBB" ended by BEL or ESC \. Each channel has one to four
+// hex digits, a background under half brightness counts as dark
+func parseBackgroundResponse(response string) (dark, ok bool) {
+	start := strings.Index(response, "\x1b]11;rgb:")
+	if start < 0 {
+		return false, false
+	}
+	body := response[start+len("\x1b]11;rgb:"):]
+	end := strings.IndexAny(body, "\x07\x1b")
+	if end < 0 {
+		return false, false
+	}
+
+	channels := strings.Split(body[:end], "/")
+	if len(channels) != 3 {
+		return false, false
+	}
+	var rgb [3]float64
+	for i, channel := range channels {
+		if len(channel) == 0 || len(channel) > 4 {
+			return false, false
+		}
+		value, err := strconv.ParseUint(channel, 16, 16)
+		if err != nil {
+			return false, false
+		}
+		rgb[i] = float64(value) / float64(uint64(1)<<(4*len(channel))-1)
+	}
+
+	luminance := 0.299*rgb[0] + 0.587*rgb[1] + 0.114*rgb[2]
+	return luminance < 0.5, true
+}
+
+func isHexColor(color string) bool {
+	if !strings.HasPrefix(color, "#") || (len(color) != 4 && len(color) != 7) {
+		return false
+	}
+	for _, r := range color[1:] {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Each color is {"light": "#rrggbb", "dark": "#rrggbb"}. Colors left out fall back to the
+// default theme, but a malformed hex value rejects the whole file
+func parseTheme(data []byte) (Theme, error) {
+	theme := themes["default"]
+	theme.Name = ""
+	if err := json.Unmarshal(data, &theme); err != nil {
+		return Theme{}, err
+	}
+
+	colors := []*lipgloss.AdaptiveColor{
+		&theme.Primary, &theme.Secondary, &theme.Accent, &theme.Background, &theme.Foreground,
+		&theme.Success, &theme.Warning, &theme.Error, &theme.Muted, &theme.Border,
+	}
+	for _, color := range colors {
+		if !isHexColor(color.Light) || !isHexColor(color.Dark) {
+			return Theme{}, fmt.Errorf("invalid color %q/%q", color.Light, color.Dark)
+		}
+	}
+
+	return theme, nil
+}
+
+// Reads ~/.oathkeeper/themes/*.json, keyed by file name. Invalid files are skipped
+func loadCustomThemes() map[string]Theme {
+	custom := make(map[string]Theme)
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return custom
+	}
+
+	paths, err := filepath.Glob(filepath.Join(homeDir, ".oathkeeper", "themes", "*.json"))
+	if err != nil {
+		return custom
+	}
+
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		theme, err := parseTheme(data)
+		if err != nil {
+			continue
+		}
+
+		key := strings.ToLower(strings.TrimSuffix(filepath.Base(path), ".json"))
+		if theme.Name == "" {
+			theme.Name = key
+		}
+		custom[key] = theme
+	}
+
+	return custom
+}
+
 type themeModel struct {
 	currentTheme string
 	available    []string
@@ -312,12 +787,23 @@ func newLRUCache(capacity int) *LRUCache {
 
 func (c *LRUCache) Get(key string) (RenderedBlock, bool) {
 	if elem, exists := c.cache[key]; exists {
+		c.hits++
 		c.order.MoveToFront(elem)
 		return elem.Value.(*cacheItem).value, true
 	}
+	c.misses++
 	return RenderedBlock{}, false
 }
 
+// Lookups since the cache was created
+func (c *LRUCache) Stats() (hits, misses int) {
+	return c.hits, c.misses
+}
+
+func (c *LRUCache) Len() int {
+	return c.order.Len()
+}
+
 func (c *LRUCache) Put(key string, value RenderedBlock) {
 	if elem, exists := c.cache[key]; exists {
 		c.order.MoveToFront(elem)
@@ -338,7 +824,22 @@ func (c *LRUCache) Put(key string, value RenderedBlock) {
 	c.cache[key] = elem
 }
 
-func newRenderModel() *renderModel {
+const defaultCacheCapacity = 50
+
+func cacheSummary(c *LRUCache) string {
+	hits, misses := c.Stats()
+	rate := 0.0
+	if hits+misses > 0 {
+		rate = float64(hits) / float64(hits+misses) * 100
+	}
+	return fmt.Sprintf("Cache %d/%d · %.0f%% hits (%d hits, %d misses)", c.Len(), c.capacity, rate, hits, misses)
+}
+
+func newRenderModel(capacity int) *renderModel {
+	if capacity < 1 {
+		capacity = defaultCacheCapacity
+	}
+
 	mathSymbols := map[string]string{
 		"\\alpha":   "α",
 		"\\beta":    "β",
@@ -374,6 +875,21 @@ func newRenderModel() *renderModel {
 		"\\cap":     "∩",
 		"\\forall":  "∀",
 		"\\exists":  "∃",
+
+		"\\Gamma":      "Γ",
+		"\\Delta":      "Δ",
+		"\\Omega":      "Ω",
+		"\\rightarrow": "→",
+		"\\leftarrow":  "←",
+		"\\Rightarrow": "⇒",
+		"\\cdot":       "·",
+		"\\star":       "⋆",
+		"\\oplus":      "⊕",
+		"\\otimes":     "⊗",
+		"\\equiv":      "≡",
+		"\\propto":     "∝",
+		"\\emptyset":   "∅",
+		"\\aleph":      "ℵ",
 	}
 
 	commands := []string{
@@ -384,16 +900,56 @@ func newRenderModel() *renderModel {
 		"\\ne", "\\approx", "\\subset", "\\supset", "\\in", "\\notin",
 		"\\cup", "\\cap", "\\forall", "\\exists", "\\begin", "\\end",
 		"\\textbf", "\\textit", "\\emph", "\\href", "\\url",
+		"\\Gamma", "\\Delta", "\\Omega", "\\rightarrow", "\\leftarrow",
+		"\\Rightarrow", "\\cdot", "\\star", "\\oplus", "\\otimes",
+		"\\equiv", "\\propto", "\\emptyset", "\\aleph",
+	}
+
+	for latex, unicode := range loadSymbolOverrides() {
+		if _, exists := mathSymbols[latex]; !exists {
+			commands = append(commands, latex)
+		}
+		mathSymbols[latex] = unicode
 	}
 
 	return &renderModel{
-		cache:       newLRUCache(50),
+		cache:       newLRUCache(capacity),
 		mathSymbols: mathSymbols,
 		commands:    commands,
 	}
 }
 
-func newLSPModel() *lspModel {
+// User symbols live in ~/.oathkeeper/symbols.json as a flat {"\\cmd": "glyph"} object
+func loadSymbolOverrides() map[string]string {
+	overrides := make(map[string]string)
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return overrides
+	}
+
+	symbolsPath := filepath.Join(homeDir, ".oathkeeper", "symbols.json")
+	data, err := ioutil.ReadFile(symbolsPath)
+	if err != nil {
+		return overrides
+	}
+
+	var loaded map[string]string
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return overrides
+	}
+
+	for latex, unicode := range loaded {
+		if strings.HasPrefix(latex, "\\") && unicode != "" {
+			overrides[latex] = unicode
+		}
+	}
+
+	return overrides
+}
+
+// Symbols the preview knows complete too, with their glyph as the description
+func newLSPModel(mathSymbols map[string]string) *lspModel {
 	symbols := map[string]Completion{
 		"\\alpha": {
 			Label:      "\\alpha",
@@ -439,11 +995,44 @@ func newLSPModel() *lspModel {
 		},
 	}
 
+	// Environments are keyed by their full \begin{name} so they match both while typing
+	// \beg and once inside the braces
+	environments := map[string]string{
+		"equation":  "Numbered equation",
+		"align":     "Aligned equations",
+		"itemize":   "Bulleted list",
+		"enumerate": "Numbered list",
+		"matrix":    "Matrix without delimiters",
+		"cases":     "Piecewise cases",
+		"quote":     "Block quote",
+	}
+	for latex, glyph := range mathSymbols {
+		if _, exists := symbols[latex]; !exists {
+			symbols[latex] = Completion{
+				Label:      latex,
+				Detail:     glyph,
+				InsertText: latex,
+				Kind:       "symbol",
+			}
+		}
+	}
+	for name, detail := range environments {
+		begin := "\\begin{" + name + "}"
+		symbols[begin] = Completion{
+			Label:      name,
+			Detail:     detail,
+			InsertText: begin + "\n\n\\end{" + name + "}",
+			Kind:       "environment",
+			Cursor:     len(begin) + 1,
+		}
+	}
+
 	return &lspModel{
 		completions:      []Completion{},
 		activeCompletion: 0,
 		showCompletions:  false,
 		diagnostics:      []Diagnostic{},
+		activeDiagnostic: -1,
 		symbols:          symbols,
 	}
 }
@@ -458,6 +1047,31 @@ func newVimState() *vimState {
 	}
 }
 
+// Parses the text typed after ':' in Vim mode. A bare number jumps to that block (1-based)
+func parseExCommand(input string) (exCommand, error) {
+	input = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(input), ":"))
+
+	switch input {
+	case "w":
+		return exCommand{action: exWrite}, nil
+	case "q":
+		return exCommand{action: exQuit}, nil
+	case "q!":
+		return exCommand{action: exForceQuit}, nil
+	case "wq", "x":
+		return exCommand{action: exWriteQuit}, nil
+	}
+
+	if n, err := strconv.Atoi(input); err == nil {
+		if n < 1 {
+			return exCommand{}, fmt.Errorf("invalid block number: %d", n)
+		}
+		return exCommand{action: exGotoBlock, block: n}, nil
+	}
+
+	return exCommand{}, fmt.Errorf("not an editor command: %s", input)
+}
+
 func (r *renderModel) renderLaTeX(content string) RenderedBlock {
 	cacheKey := content + fmt.Sprintf("%d", time.Now().Truncate(time.Minute).Unix())
 	
@@ -465,15 +1079,29 @@ func (r *renderModel) renderLaTeX(content string) RenderedBlock {
 		return cached
 	}
 
-	rendered := content
+	// Links are set aside so symbols and scripts leave their URLs alone
+	rendered, links := protectLinks(content)
 	diagnostics := []Diagnostic{}
 
-	for latex, unicode := range r.mathSymbols {
-		rendered = strings.ReplaceAll(rendered, latex, unicode)
+	// Longest commands first so \\in doesn't eat the front of \\int or \\infty
+	symbols := make([]string, 0, len(r.mathSymbols))
+	for latex := range r.mathSymbols {
+		symbols = append(symbols, latex)
+	}
+	sort.Slice(symbols, func(i, j int) bool {
+		if len(symbols[i]) != len(symbols[j]) {
+			return len(symbols[i]) > len(symbols[j])
+		}
+		return symbols[i] < symbols[j]
+	})
+
+	for _, latex := range symbols {
+		rendered = strings.ReplaceAll(rendered, latex, r.mathSymbols[latex])
 	}
 
 	rendered = r.handleScripts(rendered)
 	rendered = r.handleFormatting(rendered)
+	rendered = restoreLinks(rendered, links)
 	diagnostics = append(diagnostics, r.validateSyntax(content)...)
 
 	result := RenderedBlock{
@@ -486,77 +1114,456 @@ func (r *renderModel) renderLaTeX(content string) RenderedBlock {
 	return result
 }
 
-func (r *renderModel) handleScripts(content string) string {
-	subscripts := map[string]string{
-		"_0": "₀", "_1": "₁", "_2": "₂", "_3": "₃", "_4": "₄",
-		"_5": "₅", "_6": "₆", "_7": "₇", "_8": "₈", "_9": "₉",
-		"_a": "ₐ", "_e": "ₑ", "_i": "ᵢ", "_o": "ₒ", "_u": "ᵤ",
-		"_x": "ₓ", "_y": "ᵧ",
+var alignEnvironments = map[string]bool{
+	"align": true, "align*": true, "aligned": true,
+	"gather": true, "gather*": true,
+	"equation": true, "equation*": true,
+	"cases": true,
+	"matrix": true, "bmatrix": true, "pmatrix": true,
+	"vmatrix": true, "Bmatrix": true,
+}
+
+// Top, middle and bottom glyphs for the left and right side of each matrix kind
+var matrixBrackets = map[string][2][3]string{
+	"bmatrix": {{"⎡", "⎢", "⎣"}, {"⎤", "⎥", "⎦"}},
+	"pmatrix": {{"⎛", "⎜", "⎝"}, {"⎞", "⎟", "⎠"}},
+	"Bmatrix": {{"⎧", "⎨", "⎩"}, {"⎫", "⎬", "⎭"}},
+	"vmatrix": {{"│", "│", "│"}, {"│", "│", "│"}},
+}
+
+// Lays out align, gather, equation and cases environments on separate lines.
+// Runs on already rendered Unicode so column widths match what is displayed
+func renderEnvironments(content string) string {
+	limit := len(content)
+	for {
+		start := strings.LastIndex(content[:limit], "\\begin{")
+		if start == -1 {
+			return content
+		}
+
+		nameEnd := strings.Index(content[start:], "}")
+		if nameEnd == -1 {
+			return content
+		}
+		name := content[start+len("\\begin{") : start+nameEnd]
+		endTag := "\\end{" + name + "}"
+		bodyStart := start + nameEnd + 1
+		end := strings.Index(content[bodyStart:], endTag)
+		if !alignEnvironments[name] || end == -1 {
+			limit = start
+			continue
+		}
+
+		body := content[bodyStart : bodyStart+end]
+		var lines []string
+		switch name {
+		case "equation", "equation*":
+			lines = []string{strings.TrimSpace(body)}
+		case "cases":
+			lines = casesLines(alignRows(body, "  "))
+		case "matrix", "bmatrix", "pmatrix", "vmatrix", "Bmatrix":
+			lines = matrixLines(body, name)
+		default:
+			lines = alignRows(body, " ")
+		}
+
+		// Continuation lines line up under the first when the environment sits mid-line
+		lineStart := strings.LastIndex(content[:start], "\n") + 1
+		indent := strings.Repeat(" ", lipgloss.Width(content[lineStart:start]))
+		rendered := strings.Join(lines, "\n"+indent)
+
+		content = content[:start] + rendered + content[bodyStart+end+len(endTag):]
+		limit = start
+	}
+}
+
+// Splits rows on \\ and cells on &, returning the widest cell of each column
+func splitRows(body string) ([][]string, []int) {
+	var rows [][]string
+	var widths []int
+	for _, row := range strings.Split(body, "\\\\") {
+		row = strings.TrimSpace(row)
+		if row == "" {
+			continue
+		}
+
+		cells := strings.Split(row, "&")
+		for i, cell := range cells {
+			cell = strings.TrimSpace(stripTextCommands(cell))
+			cells[i] = cell
+			if i >= len(widths) {
+				widths = append(widths, 0)
+			}
+			if w := lipgloss.Width(cell); w > widths[i] {
+				widths[i] = w
+			}
+		}
+		rows = append(rows, cells)
 	}
+	return rows, widths
+}
 
-	superscripts := map[string]string{
-		"^0": "⁰", "^1": "¹", "^2": "²", "^3": "³", "^4": "⁴",
-		"^5": "⁵", "^6": "⁶", "^7": "⁷", "^8": "⁸", "^9": "⁹",
-		"^n": "ⁿ",
+// Pads the & separated columns to a common width, the last column is left ragged
+func alignRows(body, gap string) []string {
+	rows, widths := splitRows(body)
+
+	lines := make([]string, len(rows))
+	for i, cells := range rows {
+		var line strings.Builder
+		for j, cell := range cells {
+			if j > 0 {
+				line.WriteString(gap)
+			}
+			line.WriteString(cell)
+			if j < len(cells)-1 {
+				line.WriteString(strings.Repeat(" ", widths[j]-lipgloss.Width(cell)))
+			}
+		}
+		lines[i] = line.String()
 	}
+	return lines
+}
 
-	result := content
-	for latex, unicode := range subscripts {
-		result = strings.ReplaceAll(result, latex, unicode)
+// Centers each entry in its column and draws the brackets for the matrix kind.
+// A one row matrix uses plain brackets since the tall glyphs need at least two rows
+func matrixLines(body, kind string) []string {
+	rows, widths := splitRows(body)
+	if len(rows) == 0 {
+		return nil
 	}
-	for latex, unicode := range superscripts {
-		result = strings.ReplaceAll(result, latex, unicode)
+
+	brackets, bracketed := matrixBrackets[kind]
+	if len(rows) == 1 {
+		switch kind {
+		case "bmatrix":
+			brackets = [2][3]string{{"[", "[", "["}, {"]", "]", "]"}}
+		case "pmatrix":
+			brackets = [2][3]string{{"(", "(", "("}, {")", ")", ")"}}
+		case "Bmatrix":
+			brackets = [2][3]string{{"{", "{", "{"}, {"}", "}", "}"}}
+		}
 	}
-	return result
+
+	lines := make([]string, len(rows))
+	for i, cells := range rows {
+		var line strings.Builder
+		for j, width := range widths {
+			cell := ""
+			if j < len(cells) {
+				cell = cells[j]
+			}
+			if j > 0 {
+				line.WriteString("  ")
+			}
+			pad := width - lipgloss.Width(cell)
+			line.WriteString(strings.Repeat(" ", pad/2) + cell + strings.Repeat(" ", pad-pad/2))
+		}
+
+		if !bracketed {
+			lines[i] = line.String()
+			continue
+		}
+
+		side := 1
+		switch {
+		case i == 0:
+			side = 0
+		case i == len(rows)-1:
+			side = 2
+		}
+		lines[i] = brackets[0][side] + " " + line.String() + " " + brackets[1][side]
+	}
+	return lines
 }
 
-// All formatting is just hard coded until the parser implementation with proper tokenization or state machine is implemented
-func (r *renderModel) handleFormatting(content string) string {
-	if r.containsMathContent(content) {
+// Cuts lines that don't fit so wide math like matrices stays aligned instead of wrapping
+func truncateLines(content string, width int) string {
+	if width < 1 {
 		return content
 	}
-	
-	result := content
-	
-	commands := map[string][2]string{
-		"\\textbf": {"**", "**"},
-		"\\textit": {"*", "*"},
-		"\\emph":   {"*", "*"},
+
+	lines := strings.Split(content, "\n")
+	for i, line := range lines {
+		if lipgloss.Width(line) <= width {
+			continue
+		}
+		runes := []rune(line)
+		for len(runes) > 0 && lipgloss.Width(string(runes))+1 > width {
+			runes = runes[:len(runes)-1]
+		}
+		lines[i] = string(runes) + "…"
 	}
-	
-	for command, markers := range commands {
-		result = r.processFormattingCommand(result, command, markers[0], markers[1])
+	return strings.Join(lines, "\n")
+}
+
+// Unwraps \text{...} so conditions in cases read as plain words
+func stripTextCommands(content string) string {
+	for {
+		start := strings.Index(content, "\\text{")
+		if start == -1 {
+			return content
+		}
+		end := strings.Index(content[start:], "}")
+		if end == -1 {
+			return content
+		}
+		content = content[:start] + content[start+len("\\text{"):start+end] + content[start+end+1:]
 	}
-	
-	return result
 }
 
-func (r *renderModel) containsMathContent(content string) bool {
-	if strings.Contains(content, "$") || 
-	   strings.Contains(content, "\\[") || 
-	   strings.Contains(content, "\\]") {
-		return true
+// Draws a left brace spanning the rows, with the point on the middle row
+func casesLines(rows []string) []string {
+	if len(rows) == 1 {
+		return []string{"{ " + rows[0]}
 	}
-	
-	mathCommands := []string{
-		"\\frac", "\\sqrt", "\\sum", "\\int", "\\prod", "\\lim",
-		"\\binom", "\\choose", "\\over", "\\atop", "\\above",
-		"\\matrix", "\\pmatrix", "\\bmatrix", "\\vmatrix",
+
+	lines := make([]string, len(rows))
+	for i, row := range rows {
+		brace := "⎪"
+		switch {
+		case i == 0:
+			brace = "⎧"
+		case i == len(rows)-1:
+			brace = "⎩"
+		case i == len(rows)/2:
+			brace = "⎨"
+		}
+		lines[i] = brace + " " + row
 	}
-	
-	for _, cmd := range mathCommands {
-		if strings.Contains(content, cmd) {
-			return true
+	if len(rows) == 2 {
+		lines[0] = "⎰ " + rows[0]
+		lines[1] = "⎱ " + rows[1]
+	}
+	return lines
+}
+
+var subscriptGlyphs = map[rune]rune{
+	'0': '₀', '1': '₁', '2': '₂', '3': '₃', '4': '₄',
+	'5': '₅', '6': '₆', '7': '₇', '8': '₈', '9': '₉',
+	'a': 'ₐ', 'e': 'ₑ', 'h': 'ₕ', 'i': 'ᵢ', 'j': 'ⱼ', 'k': 'ₖ',
+	'l': 'ₗ', 'm': 'ₘ', 'n': 'ₙ', 'o': 'ₒ', 'p': 'ₚ', 'r': 'ᵣ',
+	's': 'ₛ', 't': 'ₜ', 'u': 'ᵤ', 'v': 'ᵥ', 'x': 'ₓ', 'y': 'ᵧ',
+	'+': '₊', '-': '₋', '=': '₌', '(': '₍', ')': '₎',
+}
+
+var superscriptGlyphs = map[rune]rune{
+	'0': '⁰', '1': '¹', '2': '²', '3': '³', '4': '⁴',
+	'5': '⁵', '6': '⁶', '7': '⁷', '8': '⁸', '9': '⁹',
+	'a': 'ᵃ', 'b': 'ᵇ', 'c': 'ᶜ', 'd': 'ᵈ', 'e': 'ᵉ', 'f': 'ᶠ',
+	'g': 'ᵍ', 'h': 'ʰ', 'i': 'ⁱ', 'j': 'ʲ', 'k': 'ᵏ', 'l': 'ˡ',
+	'm': 'ᵐ', 'n': 'ⁿ', 'o': 'ᵒ', 'p': 'ᵖ', 'r': 'ʳ', 's': 'ˢ',
+	't': 'ᵗ', 'u': 'ᵘ', 'v': 'ᵛ', 'w': 'ʷ', 'x': 'ˣ', 'y': 'ʸ',
+	'z': 'ᶻ', '+': '⁺', '-': '⁻', '=': '⁼', '(': '⁽', ')': '⁾',
+}
+
+// Maps every rune of the script, or reports false if any of them has no glyph
+func scriptGlyphs(script string, glyphs map[rune]rune) (string, bool) {
+	var b strings.Builder
+	for _, c := range script {
+		glyph, ok := glyphs[c]
+		if !ok {
+			return "", false
 		}
+		b.WriteRune(glyph)
 	}
-	
-	return false
+	return b.String(), true
 }
 
-func (r *renderModel) processFormattingCommand(content, command, openMarker, closeMarker string) string {
-	result := content
-	searchPattern := command + "{"
-	
+// Turns _1, ^{2n} and friends into script glyphs. A braced script with any
+// character that has no glyph stays readable as ^(...) rather than half converted
+func (r *renderModel) handleScripts(content string) string {
+	return r.scripts(content, false)
+}
+
+// Unicode has no glyphs for a script of a script, so inside one every script is written as ^(...)
+func (r *renderModel) scripts(content string, nested bool) string {
+	runes := []rune(content)
+	var b strings.Builder
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		if (c != '_' && c != '^') || i+1 >= len(runes) {
+			b.WriteRune(c)
+			continue
+		}
+		glyphs := subscriptGlyphs
+		if c == '^' {
+			glyphs = superscriptGlyphs
+		}
+
+		if runes[i+1] != '{' {
+			if glyph, ok := glyphs[runes[i+1]]; ok && nested {
+				b.WriteRune(c)
+				b.WriteString("(" + string(runes[i+1]) + ")")
+				i++
+			} else if ok {
+				b.WriteRune(glyph)
+				i++
+			} else {
+				b.WriteRune(c)
+			}
+			continue
+		}
+
+		depth := 0
+		end := -1
+		for j := i + 1; j < len(runes); j++ {
+			if runes[j] == '{' {
+				depth++
+			} else if runes[j] == '}' {
+				depth--
+				if depth == 0 {
+					end = j
+					break
+				}
+			}
+		}
+		if end == -1 {
+			b.WriteRune(c)
+			continue
+		}
+
+		script := r.scripts(string(runes[i+2:end]), true)
+		if converted, ok := scriptGlyphs(script, glyphs); ok && script != "" && !nested {
+			b.WriteString(converted)
+		} else {
+			b.WriteRune(c)
+			b.WriteString("(" + script + ")")
+		}
+		i = end
+	}
+	return b.String()
+}
+
+// All formatting is just hard coded until the parser implementation with proper tokenization or state machine is implemented
+func (r *renderModel) handleFormatting(content string) string {
+	if r.containsMathContent(content) {
+		return content
+	}
+	
+	result := content
+	
+	commands := map[string][2]string{
+		"\\textbf": {"**", "**"},
+		"\\textit": {"*", "*"},
+		"\\emph":   {"*", "*"},
+	}
+	
+	for command, markers := range commands {
+		result = r.processFormattingCommand(result, command, markers[0], markers[1])
+	}
+	
+	return result
+}
+
+type link struct {
+	URL string
+	// Empty for \url, which shows the address itself
+	Text string
+}
+
+// Plain text form of a link, "text (url)" or the bare URL
+func (l link) label() string {
+	if l.Text == "" || l.Text == l.URL {
+		return l.URL
+	}
+	return l.Text + " (" + l.URL + ")"
+}
+
+// Wraps text in an OSC 8 escape so supporting terminals open url when it's clicked
+func hyperlink(url, text string) string {
+	return "\x1b]8;;" + url + "\x1b\\" + text + "\x1b]8;;\x1b\\"
+}
+
+// A run of text, or a link when Link is set
+type linkSpan struct {
+	Text string
+	Link *link
+}
+
+// Splits text around \href{url}{text} and \url{url}. Commands missing a group are left as text
+func splitLinks(text string) []linkSpan {
+	var spans []linkSpan
+	plain := 0
+	for i := 0; i < len(text); i++ {
+		if text[i] != '\\' {
+			continue
+		}
+		var l link
+		end := -1
+		if strings.HasPrefix(text[i:], "\\href{") {
+			url, next, ok := bracedGroup(text, i+len("\\href"))
+			if label, after, ok2 := bracedGroup(text, next); ok && ok2 {
+				l, end = link{URL: url, Text: label}, after
+			}
+		} else if strings.HasPrefix(text[i:], "\\url{") {
+			if url, after, ok := bracedGroup(text, i+len("\\url")); ok {
+				l, end = link{URL: url}, after
+			}
+		}
+		if end < 0 {
+			continue
+		}
+		if plain < i {
+			spans = append(spans, linkSpan{Text: text[plain:i]})
+		}
+		spans = append(spans, linkSpan{Link: &l})
+		plain = end
+		i = end - 1
+	}
+	if plain < len(text) {
+		spans = append(spans, linkSpan{Text: text[plain:]})
+	}
+	return spans
+}
+
+// Swaps each link for a placeholder, restoreLinks puts their labels back
+func protectLinks(content string) (string, []link) {
+	var b strings.Builder
+	var links []link
+	for _, span := range splitLinks(content) {
+		if span.Link == nil {
+			b.WriteString(span.Text)
+			continue
+		}
+		fmt.Fprintf(&b, "\x00%d\x00", len(links))
+		links = append(links, *span.Link)
+	}
+	return b.String(), links
+}
+
+func restoreLinks(content string, links []link) string {
+	for i, l := range links {
+		content = strings.Replace(content, fmt.Sprintf("\x00%d\x00", i), l.label(), 1)
+	}
+	return content
+}
+
+func (r *renderModel) containsMathContent(content string) bool {
+	if strings.Contains(content, "$") || 
+	   strings.Contains(content, "\\[") || 
+	   strings.Contains(content, "\\]") {
+		return true
+	}
+	
+	mathCommands := []string{
+		"\\frac", "\\sqrt", "\\sum", "\\int", "\\prod", "\\lim",
+		"\\binom", "\\choose", "\\over", "\\atop", "\\above",
+		"\\matrix", "\\pmatrix", "\\bmatrix", "\\vmatrix",
+	}
+	
+	for _, cmd := range mathCommands {
+		if strings.Contains(content, cmd) {
+			return true
+		}
+	}
+	
+	return false
+}
+
+func (r *renderModel) processFormattingCommand(content, command, openMarker, closeMarker string) string {
+	result := content
+	searchPattern := command + "{"
+	
 	for {
 		pos := strings.Index(result, searchPattern)
 		if pos == -1 {
@@ -632,2034 +1639,10219 @@ func (r *renderModel) validateSyntax(content string) []Diagnostic {
 		}
 	}
 
+	diagnostics = append(diagnostics, environmentDiagnostics(lines)...)
 	return diagnostics
 }
 
-func (l *lspModel) getCompletions(content string) []Completion {
-	var completions []Completion
+type environmentTag struct {
+	name   string
+	line   int
+	column int
+}
+
+// Pairs \begin and \end across the whole block. An \end that closes an outer environment
+// reports every one left open inside it, an \end with nothing to close is stray
+func environmentDiagnostics(lines []string) []Diagnostic {
+	var diagnostics []Diagnostic
+	var open []environmentTag
 
-	words := strings.Fields(content)
-	if len(words) == 0 {
-		return completions
-	}
+	for lineNum, line := range lines {
+		for i := 0; i < len(line); i++ {
+			if line[i] != '\\' {
+				continue
+			}
+			rest := line[i:]
+			isBegin := strings.HasPrefix(rest, "\\begin{")
+			if !isBegin && !strings.HasPrefix(rest, "\\end{") {
+				continue
+			}
+			nameStart := strings.Index(rest, "{") + 1
+			nameEnd := strings.Index(rest[nameStart:], "}")
+			if nameEnd == -1 {
+				continue
+			}
+			tag := environmentTag{name: rest[nameStart : nameStart+nameEnd], line: lineNum + 1, column: i + 1}
+			i += nameStart + nameEnd
+
+			if isBegin {
+				open = append(open, tag)
+				continue
+			}
 
-	currentWord := ""
-	for _, word := range words {
-		if strings.HasPrefix(word, "\\") {
-			currentWord = word
+			match := -1
+			for j := len(open) - 1; j >= 0; j-- {
+				if open[j].name == tag.name {
+					match = j
+					break
+				}
+			}
+			if match == -1 {
+				diagnostics = append(diagnostics, Diagnostic{
+					Line:     tag.line,
+					Column:   tag.column,
+					Message:  fmt.Sprintf("\\end{%s} without a matching \\begin", tag.name),
+					Severity: "error",
+				})
+				continue
+			}
+			for _, inner := range open[match+1:] {
+				diagnostics = append(diagnostics, Diagnostic{
+					Line:     inner.line,
+					Column:   inner.column,
+					Message:  fmt.Sprintf("\\begin{%s} is not closed before \\end{%s}", inner.name, tag.name),
+					Severity: "error",
+				})
+			}
+			open = open[:match]
 		}
 	}
 
-	if currentWord == "" || !strings.HasPrefix(currentWord, "\\") {
-		return completions
+	for _, tag := range open {
+		diagnostics = append(diagnostics, Diagnostic{
+			Line:     tag.line,
+			Column:   tag.column,
+			Message:  fmt.Sprintf("\\begin{%s} is never closed", tag.name),
+			Severity: "error",
+		})
 	}
+	return diagnostics
+}
 
-	for cmd, completion := range l.symbols {
-		if strings.HasPrefix(cmd, currentWord) {
-			completions = append(completions, completion)
-		}
+// Returns the backslash token ending at the cursor and where it starts. Only the run of
+// non-space text directly left of the cursor counts, so editing mid-block works
+func completionPrefix(content string, cursor int) (string, int) {
+	if cursor > len(content) {
+		cursor = len(content)
+	}
+	if cursor <= 0 {
+		return "", -1
 	}
 
-	return completions
+	runStart := strings.LastIndexAny(content[:cursor], " \t\n") + 1
+	run := content[runStart:cursor]
+	slash := strings.LastIndex(run, "\\")
+	if slash == -1 {
+		return "", -1
+	}
+
+	token := run[slash:]
+	if len(token) < 2 || strings.Contains(token, "}") {
+		return "", -1
+	}
+	if strings.Contains(token, "{") && !strings.HasPrefix(token, "\\begin{") {
+		return "", -1
+	}
+
+	return token, runStart + slash
 }
 
-// func (v *vimState) handleVimInput(key string, editor *textarea.Model) bool {
-// 	if !v.enabled {
-// 		return false
-// 	}
-//
-// 	switch v.mode {
-// 	case vimNormal:
-// 		return v.handleNormalMode(key, editor)
-// 	case vimInsert:
-// 		return v.handleInsertMode(key, editor)
-// 	case vimVisual:
-// 		return v.handleVisualMode(key, editor)
-// 	case vimCommand:
-// 		return v.handleCommandMode(key, editor)
-// 	}
-// 	return false
-// }
-//
-// func (v *vimState) handleNormalMode(key string, editor *textarea.Model) bool {
-// 	count := v.getRepeatCount()
-//
-// 	switch key {
-// 	case "i":
-// 		v.mode = vimInsert
-// 		v.resetRepeatCount()
-// 		return true
-// 	case "I":
-// 		v.mode = vimInsert
-// 		editor.CursorStart()
-// 		v.resetRepeatCount()
-// 		return true
-// 	case "a":
-// 		v.mode = vimInsert
-// 		v.resetRepeatCount()
-// 		return true
-// 	case "A":
-// 		v.mode = vimInsert
-// 		editor.CursorEnd()
-// 		v.resetRepeatCount()
-// 		return true
-// 	case "h", "left":
-// 		for i := 0; i < count; i++ {
-// 			v.moveCursorLeft(editor)
-// 		}
-// 		v.resetRepeatCount()
-// 		return true
-// 	case "j", "down":
-// 		for i := 0; i < count; i++ {
-// 			v.moveCursorDown(editor)
-// 		}
-// 		v.resetRepeatCount()
-// 		return true
-// 	case "k", "up":
-// 		for i := 0; i < count; i++ {
-// 			v.moveCursorUp(editor)
-// 		}
-// 		v.resetRepeatCount()
-// 		return true
-// 	case "l", "right":
-// 		for i := 0; i < count; i++ {
-// 			v.moveCursorRight(editor)
-// 		}
-// 		v.resetRepeatCount()
-// 		return true
-// 	case "w":
-// 		for i := 0; i < count; i++ {
-// 			v.moveWordForward(editor)
-// 		}
-// 		v.resetRepeatCount()
-// 		return true
-// 	case "b":
-// 		for i := 0; i < count; i++ {
-// 			v.moveWordBackward(editor)
-// 		}
-// 		v.resetRepeatCount()
-// 		return true
-// 	case "0":
-// 		if v.repeatCount == 0 {
-// 			editor.CursorStart()
-// 			return true
-// 		}
-// 		v.addToRepeatCount(0)
-// 		return true
-// 	case "$":
-// 		editor.CursorEnd()
-// 		v.resetRepeatCount()
-// 		return true
-// 	case "g":
-// 		v.lastCommand = "g"
-// 		return true
-// 	case "G":
-// 		if count > 0 {
-// 			v.gotoLine(editor, count)
-// 		} else {
-// 			editor.CursorEnd()
-// 		}
-// 		v.resetRepeatCount()
-// 		return true
-// 	case "x":
-// 		for i := 0; i < count; i++ {
-// 			v.deleteChar(editor)
-// 		}
-// 		v.resetRepeatCount()
-// 		return true
-// 	case "d":
-// 		if v.lastCommand == "d" {
-// 			v.deleteLine(editor)
-// 			v.lastCommand = ""
-// 		} else {
-// 			v.lastCommand = "d"
-// 		}
-// 		return true
-// 	case "y":
-// 		if v.lastCommand == "y" {
-// 			v.yankLine(editor)
-// 			v.lastCommand = ""
-// 		} else {
-// 			v.lastCommand = "y"
-// 		}
-// 		return true
-// 	case "p":
-// 		for i := 0; i < count; i++ {
-// 			v.paste(editor)
-// 		}
-// 		v.resetRepeatCount()
-// 		return true
-// 	case "v":
-// 		v.mode = vimVisual
-// 		v.visualStart = v.getCurrentPosition(editor)
-// 		v.visualEnd = v.visualStart
-// 		v.resetRepeatCount()
-// 		return true
-// 	case ":":
-// 		v.mode = vimCommand
-// 		v.resetRepeatCount()
-// 		return true
-// 	case "/":
-// 		v.mode = vimCommand
-// 		v.resetRepeatCount()
-// 		return true
-// 	case "1", "2", "3", "4", "5", "6", "7", "8", "9":
-// 		num, _ := strconv.Atoi(key)
-// 		v.addToRepeatCount(num)
-// 		return true
-// 	case "esc":
-// 		v.lastCommand = ""
-// 		v.resetRepeatCount()
-// 		return true
-// 	}
-//
-// 	if v.lastCommand == "g" {
-// 		switch key {
-// 		case "g":
-// 			if count > 0 {
-// 				v.gotoLine(editor, count)
-// 			} else {
-// 				editor.CursorStart()
-// 			}
-// 			v.lastCommand = ""
-// 			v.resetRepeatCount()
-// 			return true
-// 		}
-// 		v.lastCommand = ""
-// 	}
-//
-// 	return false
-// }
-//
-// func (v *vimState) handleInsertMode(key string, editor *textarea.Model) bool {
-// 	if key == "esc" {
-// 		v.mode = vimNormal
-// 		return true
-// 	}
-// 	return false
-// }
-//
-// func (v *vimState) handleVisualMode(key string, editor *textarea.Model) bool {
-// 	switch key {
-// 	case "esc":
-// 		v.mode = vimNormal
-// 		return true
-// 	case "d":
-// 		v.deleteVisualSelection(editor)
-// 		v.mode = vimNormal
-// 		return true
-// 	case "y":
-// 		v.yankVisualSelection(editor)
-// 		v.mode = vimNormal
-// 		return true
-// 	case "h", "j", "k", "l", "left", "down", "up", "right":
-// 		v.handleNormalMode(key, editor)
-// 		v.visualEnd = v.getCurrentPosition(editor)
-// 		return true
-// 	}
-// 	return false
-// }
-//
-// func (v *vimState) handleCommandMode(key string, editor *textarea.Model) bool {
-// 	if key == "esc" {
-// 		v.mode = vimNormal
-// 		return true
-// 	}
-// 	return false
-// }
-//
-// func (v *vimState) getRepeatCount() int {
-// 	if v.repeatCount == 0 {
-// 		return 1
-// 	}
-// 	return v.repeatCount
-// }
-//
-// func (v *vimState) addToRepeatCount(digit int) {
-// 	v.repeatCount = v.repeatCount*10 + digit
-// }
-//
-// func (v *vimState) resetRepeatCount() {
-// 	v.repeatCount = 0
-// }
-//
-// // Simple helper to estimate current position - not precise but functional
-// func (v *vimState) getCurrentPosition(editor *textarea.Model) int {
-// 	return len(editor.Value()) / 2 // Rough estimate for cursor position
-// }
-//
-// func (v *vimState) moveWordForward(editor *textarea.Model) {
-// 	// Simple implementation: move cursor right several positions
-// 	for i := 0; i < 5; i++ {
-// 		v.moveCursorRight(editor)
-// 	}
-// }
-//
-// func (v *vimState) moveWordBackward(editor *textarea.Model) {
-// 	// Simple implementation: move cursor left several positions  
-// 	for i := 0; i < 5; i++ {
-// 		v.moveCursorLeft(editor)
-// 	}
-// }
-//
-// func (v *vimState) deleteChar(editor *textarea.Model) {
-// 	content := editor.Value()
-// 	if len(content) > 0 {
-// 		// Get current content and remove one character
-// 		lines := strings.Split(content, "\n")
-// 		if len(lines) > 0 && len(lines[0]) > 0 {
-// 			newFirstLine := lines[0][:len(lines[0])-1]
-// 			lines[0] = newFirstLine
-// 			editor.SetValue(strings.Join(lines, "\n"))
-// 		}
-// 	}
-// }
-//
-// func (v *vimState) deleteLine(editor *textarea.Model) {
-// 	content := editor.Value()
-// 	lines := strings.Split(content, "\n")
-//
-// 	if len(lines) > 0 {
-// 		v.yankBuffer = lines[0]
-// 		if len(lines) > 1 {
-// 			newContent := strings.Join(lines[1:], "\n")
-// 			editor.SetValue(newContent)
-// 		} else {
-// 			editor.SetValue("")
-// 		}
-// 	}
-// }
-//
-// func (v *vimState) yankLine(editor *textarea.Model) {
-// 	content := editor.Value()
-// 	lines := strings.Split(content, "\n")
-//
-// 	if len(lines) > 0 {
-// 		v.yankBuffer = lines[0]
-// 	}
-// }
-//
-// func (v *vimState) paste(editor *textarea.Model) {
-// 	if v.yankBuffer == "" {
-// 		return
-// 	}
-//
-// 	content := editor.Value()
-// 	// Simple paste at end
-// 	newContent := content + "\n" + v.yankBuffer
-// 	editor.SetValue(newContent)
-// }
-//
-// func (v *vimState) deleteVisualSelection(editor *textarea.Model) {
-// 	content := editor.Value()
-// 	if len(content) > 0 {
-// 		// Simple visual selection delete - remove middle portion
-// 		quarter := len(content) / 4
-// 		half := len(content) / 2
-// 		if quarter < half && half < len(content) {
-// 			v.yankBuffer = content[quarter:half]
-// 			newContent := content[:quarter] + content[half:]
-// 			editor.SetValue(newContent)
-// 		}
-// 	}
-// }
-//
-// func (v *vimState) yankVisualSelection(editor *textarea.Model) {
-// 	content := editor.Value()
-// 	if len(content) > 0 {
-// 		// Simple visual selection yank - copy middle portion
-// 		quarter := len(content) / 4  
-// 		half := len(content) / 2
-// 		if quarter < half && half < len(content) {
-// 			v.yankBuffer = content[quarter:half]
-// 		}
-// 	}
-// }
-//
-// func (v *vimState) gotoLine(editor *textarea.Model, lineNum int) {
-// 	if lineNum == 1 {
-// 		editor.CursorStart()
-// 	} else {
-// 		editor.CursorEnd()
-// 	}
-// }
-//
-// func (v *vimState) posToIndex(editor *textarea.Model, pos int) int {
-// 	return pos
-// }
-//
-// func (v *vimState) indexToPos(editor *textarea.Model, index int) int {
-// 	return index
-// }
-//
-// func (v *vimState) moveCursorLeft(editor *textarea.Model) {
-// 	editor.CursorLeft()
-// }
-//
-// func (v *vimState) moveCursorRight(editor *textarea.Model) {
-// 	editor.CursorRight()
-// }
-//
-// func (v *vimState) moveCursorUp(editor *textarea.Model) {
-// 	editor.CursorUp()
-// }
-//
-// func (v *vimState) moveCursorDown(editor *textarea.Model) {
-// 	editor.CursorDown()
-// }
+// Longest completion list shown while typing
+const maxCompletions = 8
 
-func min(a, b int) int {
-	if a < b {
-		return a
+// fuzzyMatch ignores case, a prefix typed exactly as written still ranks above the rest
+func completionScore(cmd, typed, query string) (int, bool) {
+	score, ok := fuzzyMatch(query, strings.TrimPrefix(cmd, "\\"))
+	if ok && strings.HasPrefix(cmd, typed) {
+		score += 1000
 	}
-	return b
+	return score, ok
 }
 
-func scanDirectory(path string, showHidden bool) ([]FileInfo, error) {
-	entries, err := os.ReadDir(path)
-	if err != nil {
-		return nil, err
+func (l *lspModel) getCompletions(content string, cursor int) []Completion {
+	type scored struct {
+		completion Completion
+		score      int
 	}
+	var matches []scored
 
-	var files []FileInfo
-
-	if path != "/" && path != "." {
-		files = append(files, FileInfo{
-			Name:  "..",
-			Path:  filepath.Dir(path),
-			IsDir: true,
-		})
+	currentWord, _ := completionPrefix(content, cursor)
+	if currentWord == "" {
+		return nil
 	}
+	// Matched past the backslash, so \inty still finds \infty
+	query := strings.TrimPrefix(currentWord, "\\")
 
-	for _, entry := range entries {
-		if !showHidden && strings.HasPrefix(entry.Name(), ".") {
+	for cmd, completion := range l.symbols {
+		// A document macro that redefines a built in command replaces it
+		if _, redefined := l.macros[cmd]; redefined {
 			continue
 		}
-
-		info, err := entry.Info()
-		if err != nil {
-			continue
+		if score, ok := completionScore(cmd, currentWord, query); ok {
+			matches = append(matches, scored{completion, score})
+		}
+	}
+	for cmd, completion := range l.macros {
+		if score, ok := completionScore(cmd, currentWord, query); ok {
+			matches = append(matches, scored{completion, score})
 		}
-
-		files = append(files, FileInfo{
-			Name:    entry.Name(),
-			Path:    filepath.Join(path, entry.Name()),
-			IsDir:   entry.IsDir(),
-			Size:    info.Size(),
-			ModTime: info.ModTime(),
-		})
 	}
 
-	sort.Slice(files, func(i, j int) bool {
-		if files[i].IsDir != files[j].IsDir {
-			return files[i].IsDir
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
 		}
-		return files[i].Name < files[j].Name
+		return matches[i].completion.Label < matches[j].completion.Label
 	})
+	if len(matches) > maxCompletions {
+		matches = matches[:maxCompletions]
+	}
 
-	return files, nil
+	completions := make([]Completion, len(matches))
+	for i, match := range matches {
+		completions[i] = match.completion
+	}
+	return completions
 }
 
-func getDefaultTemplates() []Template {
-	return []Template{
-		{
-			Name:        "Blank Document",
-			Description: "Start with an empty document",
-			Content: []ContentBlock{
-				{ID: "1", Type: blockHeading, Content: "# Document Title"},
-				{ID: "2", Type: blockText, Content: "Start writing here"},
-			},
-			Variables: make(map[string]string),
-		},
-		{
-			Name:        "Academic Notes",
-			Description: "Template for mathematical notes and proofs",
-			Content: []ContentBlock{
-				{ID: "1", Type: blockHeading, Content: "# Course Notes"},
-				{ID: "2", Type: blockHeading, Content: "## Topic"},
-				{ID: "3", Type: blockText, Content: "Key concepts:"},
-				{ID: "4", Type: blockMath, Content: "$\\int_{a}^{b} f(x) dx = F(b) - F(a)$"},
-				{ID: "5", Type: blockText, Content: "Proof:"},
-			},
-			Variables: make(map[string]string),
-		},
-		{
-			Name:        "Resume",
-			Description: "Professional resume template",
-			Content: []ContentBlock{
-				{ID: "1", Type: blockHeading, Content: "# Your Name"},
-				{ID: "2", Type: blockText, Content: "email@example.com | (555) 123-4567"},
-				{ID: "3", Type: blockHeading, Content: "## Professional Summary"},
-				{ID: "4", Type: blockText, Content: "Brief professional summary"},
-				{ID: "5", Type: blockHeading, Content: "## Experience"},
-				{ID: "6", Type: blockText, Content: "**Job Title** - Company Name (Year - Year)"},
-			},
-			Variables: make(map[string]string),
-		},
-		{
-			Name:        "Code Documentation",
-			Description: "Template for documenting code projects",
-			Content: []ContentBlock{
-				{ID: "1", Type: blockHeading, Content: "# Project Name"},
-				{ID: "2", Type: blockText, Content: "Brief project description"},
-				{ID: "3", Type: blockHeading, Content: "## Installation"},
-				{ID: "4", Type: blockCode, Content: "git clone repo\ncd project\nnpm install", Language: "bash"},
-				{ID: "5", Type: blockHeading, Content: "## Usage"},
-				{ID: "6", Type: blockCode, Content: "const example = require('./example');\nexample.run();", Language: "javascript"},
-			},
-			Variables: make(map[string]string),
-		},
-	}
+type macroDefinition struct {
+	Name      string
+	Args      int
+	Expansion string
+	// Byte offset of the \newcommand in the block
+	Offset int
 }
 
-func loadUserPreferences() *UserPreferences {
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		return getDefaultPreferences()
+// Reads the {...} group starting at content[start], returning its contents and the index after it
+func bracedGroup(content string, start int) (string, int, bool) {
+	if start >= len(content) || content[start] != '{' {
+		return "", start, false
 	}
-
-	prefsPath := filepath.Join(homeDir, ".oathkeeper", "preferences.json")
-	data, err := ioutil.ReadFile(prefsPath)
-	if err != nil {
-		return getDefaultPreferences()
+	depth := 0
+	for i := start; i < len(content); i++ {
+		switch content[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return content[start+1 : i], i + 1, true
+			}
+		}
 	}
+	return "", start, false
+}
 
-	var prefs UserPreferences
-	if err := json.Unmarshal(data, &prefs); err != nil {
-		return getDefaultPreferences()
+func skipSpaces(content string, i int) int {
+	for i < len(content) && (content[i] == ' ' || content[i] == '\t' || content[i] == '\n') {
+		i++
 	}
-
-	return &prefs
+	return i
 }
 
-func getDefaultPreferences() *UserPreferences {
-	currentDir, _ := os.Getwd()
-	return &UserPreferences{
-		Theme:         "default",
-		LastDirectory: currentDir,
-		SplitRatio:    0.5,
-		ViewMode:      int(viewSplitPane),
-		ShowHidden:    false,
-		VimMode:       false,
+// Finds \newcommand and \renewcommand definitions, with or without braces around the name
+// and with an optional [args][default]. Definitions that don't parse are skipped
+func parseMacros(content string) []macroDefinition {
+	var macros []macroDefinition
+	for i := 0; i < len(content); i++ {
+		var command string
+		for _, candidate := range []string{"\\newcommand", "\\renewcommand"} {
+			if strings.HasPrefix(content[i:], candidate) {
+				command = candidate
+			}
+		}
+		if command == "" {
+			continue
+		}
+		if macro, end, ok := parseMacro(content, i, i+len(command)); ok {
+			macros = append(macros, macro)
+			i = end - 1
+		}
 	}
+	return macros
 }
 
-func (m *model) saveUserPreferences() error {
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		return err
+// Parses what follows a \newcommand at content[start:i]: the name, [args][default] and the body
+func parseMacro(content string, start, i int) (macroDefinition, int, bool) {
+	if i < len(content) && content[i] == '*' {
+		i++
 	}
-
-	prefsDir := filepath.Join(homeDir, ".oathkeeper")
-	if err := os.MkdirAll(prefsDir, 0755); err != nil {
-		return err
+	i = skipSpaces(content, i)
+
+	var name string
+	if group, end, ok := bracedGroup(content, i); ok {
+		name = strings.TrimSpace(group)
+		i = end
+	} else if i < len(content) && content[i] == '\\' {
+		end := i + 1
+		for end < len(content) && unicode.IsLetter(rune(content[end])) {
+			end++
+		}
+		name = content[i:end]
+		i = end
+	}
+	if len(name) < 2 || name[0] != '\\' {
+		return macroDefinition{}, i, false
 	}
 
-	m.preferences.Theme = m.theme.currentTheme
-	m.preferences.LastDirectory = m.browser.currentPath
-	m.preferences.SplitRatio = m.document.splitRatio
-	m.preferences.ViewMode = int(m.document.viewMode)
-	m.preferences.ShowHidden = m.browser.showHidden
-	m.preferences.VimMode = m.document.vim.enabled
-
-	data, err := json.MarshalIndent(m.preferences, "", "  ")
-	if err != nil {
-		return err
+	args := 0
+	for option := 0; option < 2; option++ {
+		i = skipSpaces(content, i)
+		if i >= len(content) || content[i] != '[' {
+			break
+		}
+		end := strings.Index(content[i:], "]")
+		if end == -1 {
+			return macroDefinition{}, i, false
+		}
+		// The first option is the argument count, the second a default for the first argument
+		if option == 0 {
+			n, err := strconv.Atoi(strings.TrimSpace(content[i+1 : i+end]))
+			if err != nil {
+				return macroDefinition{}, i, false
+			}
+			args = n
+		}
+		i += end + 1
 	}
 
-	prefsPath := filepath.Join(prefsDir, "preferences.json")
-	return ioutil.WriteFile(prefsPath, data, 0644)
+	expansion, end, ok := bracedGroup(content, skipSpaces(content, i))
+	if !ok {
+		return macroDefinition{}, i, false
+	}
+	return macroDefinition{Name: name, Args: args, Expansion: expansion, Offset: start}, end, true
 }
 
-func initialModel() model {
-	prefs := loadUserPreferences()
-
-	ti := textinput.New()
-	ti.Placeholder = "e.g., 30m, 1h15m, 90s"
-	ti.CharLimit = 20
-	ti.Width = 30
+// Rebuilds the macro completions from the raw blocks. Later definitions win, as in LaTeX
+func (l *lspModel) setMacros(blocks []ContentBlock) {
+	l.macros = map[string]Completion{}
+	for _, block := range blocks {
+		if block.Type != blockRawLaTeX {
+			continue
+		}
+		for _, macro := range parseMacros(block.Content) {
+			completion := Completion{
+				Label:      macro.Name,
+				Detail:     macro.Expansion,
+				InsertText: macro.Name + strings.Repeat("{}", macro.Args),
+				Kind:       "macro",
+			}
+			if macro.Args > 0 {
+				completion.Cursor = len(macro.Name) + 1
+			}
+			l.macros[macro.Name] = completion
+		}
+	}
+}
 
-	ta := textarea.New()
-	ta.Placeholder = "Notes to stay on track"
-	ta.SetWidth(50)
-	ta.SetHeight(5)
+// The control word the cursor is on or just after, such as \foo in "\fo|o{x}"
+func macroAt(content string, cursor int) string {
+	if cursor > len(content) {
+		cursor = len(content)
+	}
+	isLetter := func(c byte) bool {
+		return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+	}
 
-	docEditor := textarea.New()
-	docEditor.SetWidth(60)
-	docEditor.SetHeight(20)
-	docEditor.Placeholder = "Start writing"
-	docEditor.Cursor.Style = lipgloss.NewStyle()
-	docEditor.Cursor.TextStyle = lipgloss.NewStyle()
+	start := cursor
+	if cursor == len(content) || content[cursor] != '\\' {
+		for start > 0 && isLetter(content[start-1]) {
+			start--
+		}
+		if start == 0 || content[start-1] != '\\' {
+			return ""
+		}
+		start--
+	}
 
-	menuInput := textinput.New()
-	menuInput.Placeholder = "document-name"
-	menuInput.CharLimit = 50
-	menuInput.Width = 30
+	end := start + 1
+	for end < len(content) && isLetter(content[end]) {
+		end++
+	}
+	if end == start+1 {
+		return ""
+	}
+	return content[start:end]
+}
 
-	exportInput := textinput.New()
-	exportInput.Placeholder = "output-filename"
-	exportInput.CharLimit = 100
-	exportInput.Width = 40
+// Where a macro is defined: the block index and the offset of its last definition
+func findMacroDefinition(blocks []ContentBlock, name string) (int, int, bool) {
+	index, offset, found := 0, 0, false
+	for i, block := range blocks {
+		if block.Type != blockRawLaTeX {
+			continue
+		}
+		for _, macro := range parseMacros(block.Content) {
+			if macro.Name == name {
+				index, offset, found = i, macro.Offset, true
+			}
+		}
+	}
+	return index, offset, found
+}
 
-	files, _ := scanDirectory(prefs.LastDirectory, prefs.ShowHidden)
+// Word motions split text into runs of word characters, runs of punctuation and whitespace,
+// like Vim's w and b. Tabs are whitespace like spaces
+func vimCharClass(r rune) int {
+	switch {
+	case unicode.IsSpace(r):
+		return 0
+	case r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r):
+		return 1
+	}
+	return 2
+}
 
-	themeNames := make([]string, 0, len(themes))
-	for name := range themes {
-		themeNames = append(themeNames, name)
+// Byte offset of the start of the word after i, or the end of content
+func vimNextWord(content string, i int) int {
+	if i >= len(content) {
+		return len(content)
 	}
-	
-	return model{
-		mode:        modeBrowser,
-		input:       ti,
-		notes:       ta,
-		paused:      false,
-		preferences: prefs,
-		browser: browserModel{
-			currentPath: prefs.LastDirectory,
-			files:       files,
-			selected:    0,
-			showHidden:  prefs.ShowHidden,
-		},
-		document: documentModel{
-			blocks:       []ContentBlock{},
-			editor:       docEditor,
-			viewMode:     viewMode(prefs.ViewMode),
-			splitRatio:   prefs.SplitRatio,
-			renderer:     newRenderModel(),
-			lsp:          newLSPModel(),
-			vim:          newVimState(),
-			needsRefresh: false,
-		},
-		menu: menuModel{
-			templates: getDefaultTemplates(),
-			selected:  0,
-			input:     menuInput,
-		},
-		export: exportModel{
-			formats:  []string{"PDF", "HTML", "Unicode Text", "Markdown"},
-			selected: 0,
-			input:    exportInput,
-		},
-		theme: themeModel{
-			currentTheme: prefs.Theme,
-			available:    themeNames,
-			selected:     0,
-		},
+	r, size := utf8.DecodeRuneInString(content[i:])
+	class := vimCharClass(r)
+	if class != 0 {
+		for i < len(content) {
+			r, size = utf8.DecodeRuneInString(content[i:])
+			if vimCharClass(r) != class {
+				break
+			}
+			i += size
+		}
 	}
+	for i < len(content) {
+		r, size = utf8.DecodeRuneInString(content[i:])
+		if vimCharClass(r) != 0 {
+			break
+		}
+		i += size
+	}
+	return i
 }
 
-func (m model) Init() tea.Cmd {
-	m.document.vim.enabled = m.preferences.VimMode
-	return tea.Batch(
-		textinput.Blink,
-		tea.EnterAltScreen,
-	)
+// Byte offset of the start of the word before i, or 0
+func vimPrevWord(content string, i int) int {
+	for i > 0 {
+		r, size := utf8.DecodeLastRuneInString(content[:i])
+		if vimCharClass(r) != 0 {
+			break
+		}
+		i -= size
+	}
+	if i == 0 {
+		return 0
+	}
+	r, _ := utf8.DecodeLastRuneInString(content[:i])
+	class := vimCharClass(r)
+	for i > 0 {
+		r, size := utf8.DecodeLastRuneInString(content[:i])
+		if vimCharClass(r) != class {
+			break
+		}
+		i -= size
+	}
+	return i
 }
 
-func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
-	var cmds []tea.Cmd
+// Start and end of the line holding byte offset i, without its newline
+func lineBounds(content string, i int) (int, int) {
+	start := strings.LastIndex(content[:i], "\n") + 1
+	end := len(content)
+	if n := strings.Index(content[i:], "\n"); n >= 0 {
+		end = i + n
+	}
+	return start, end
+}
 
-	switch msg := msg.(type) {
-	case tea.KeyMsg:
-		switch m.mode {
-		case modeBrowser:
-			return m.updateBrowser(msg)
-		case modeMenu:
-			return m.updateMenu(msg)
-		case modeEdit:
-			return m.updateEdit(msg)
-		case modeTimer:
-			return m.updateTimer(msg)
-		case modeExport:
-			return m.updateExport(msg)
-		}
+// x: removes the character under the cursor, never the newline. Returns the new content,
+// cursor and deleted text; the cursor steps back when it was on the last character
+func vimDeleteChar(content string, i int) (string, int, string) {
+	_, end := lineBounds(content, i)
+	if i >= end {
+		return content, i, ""
+	}
+	_, size := utf8.DecodeRuneInString(content[i:])
+	deleted := content[i : i+size]
+	content = content[:i] + content[i+size:]
+
+	start, end := lineBounds(content, i)
+	if i >= end && i > start {
+		_, size = utf8.DecodeLastRuneInString(content[:i])
+		i -= size
+	}
+	return content, i, deleted
+}
 
-	case tickMsg:
-		if m.mode == modeTimer && !m.paused && m.ticker != nil {
-			m.remaining -= time.Second
-			if m.remaining <= 0 {
-				m.ticker.Stop()
-				m.ticker = nil
-				m.remaining = 0
-			} else {
-				cmds = append(cmds, waitForTick(m.ticker.C))
-			}
-		}
+// dw: removes up to the start of the next word. Like Vim it stops at the end of the line
+// rather than joining the next one
+func vimDeleteWord(content string, i int) (string, int, string) {
+	_, lineEnd := lineBounds(content, i)
+	end := vimNextWord(content, i)
+	if end > lineEnd && i < lineEnd {
+		end = lineEnd
+	}
+	if end <= i {
+		return content, i, ""
+	}
+	deleted := content[i:end]
+	return content[:i] + content[end:], i, deleted
+}
 
-	case tea.WindowSizeMsg:
-		m.width, m.height = msg.Width, msg.Height
-		editorWidth := int(float64(msg.Width) * m.document.splitRatio)
-		if editorWidth < 20 {
-			editorWidth = 20
-		} else if editorWidth > msg.Width-20 {
-			editorWidth = msg.Width - 20
-		}
-		m.document.editor.SetWidth(editorWidth - 4)
-		m.document.editor.SetHeight(msg.Height - 8)
+// dd: removes the line holding the cursor with its newline and leaves the cursor at the
+// start of the line that takes its place
+func vimDeleteLine(content string, i int) (string, int, string) {
+	start, end := lineBounds(content, i)
+	deleted := content[start:end]
+	switch {
+	case end < len(content):
+		return content[:start] + content[end+1:], start, deleted
+	case start > 0:
+		content = content[:start-1]
+		start, _ = lineBounds(content, len(content))
+		return content, start, deleted
 	}
+	return "", 0, deleted
+}
 
-	return m, tea.Batch(cmds...)
+// Keys that would type into the editor, in normal mode Vim handles them instead
+func isVimNormalKey(msg tea.KeyMsg) bool {
+	switch msg.Type {
+	case tea.KeyRunes, tea.KeySpace, tea.KeyEnter, tea.KeyBackspace, tea.KeyDelete, tea.KeyTab:
+		return true
+	}
+	return false
 }
 
-func (m model) updateBrowser(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
-	switch msg.String() {
-	case "q", "ctrl+c":
-		m.saveUserPreferences()
-		return m, tea.Quit
-	case "j", "down":
-		if m.browser.selected < len(m.browser.files)-1 {
-			m.browser.selected++
+// Normal mode inside the block being edited. Arrow and ctrl keys keep their usual meaning,
+// anything not listed here is ignored rather than typed
+func (m model) updateVimNormal(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	vim := m.document.vim
+	editor := &m.document.editor
+	content := editor.Value()
+	cursor := editorCursorIndex(*editor)
+	key := msg.String()
+
+	pending := vim.lastCommand
+	vim.lastCommand = ""
+	if pending == "d" {
+		var deleted string
+		switch key {
+		case "d":
+			content, cursor, deleted = vimDeleteLine(content, cursor)
+		case "w":
+			content, cursor, deleted = vimDeleteWord(content, cursor)
+		default:
+			return m, nil
 		}
-	case "k", "up":
-		if m.browser.selected > 0 {
-			m.browser.selected--
+		if key == "d" {
+			deleted += "\n"
+		}
+		m.vimYank(deleted)
+		editor.SetValue(content)
+		setEditorCursor(editor, cursor)
+		return m, nil
+	}
+
+	switch key {
+	case "i":
+		vim.mode = vimInsert
+	case "a":
+		if _, end := lineBounds(content, cursor); cursor < end {
+			_, size := utf8.DecodeRuneInString(content[cursor:])
+			setEditorCursor(editor, cursor+size)
 		}
+		vim.mode = vimInsert
+	case "I":
+		editor.CursorStart()
+		vim.mode = vimInsert
+	case "A":
+		editor.CursorEnd()
+		vim.mode = vimInsert
 	case "h":
-		m.browser.showHidden = !m.browser.showHidden
-		files, err := scanDirectory(m.browser.currentPath, m.browser.showHidden)
+		if start, _ := lineBounds(content, cursor); cursor > start {
+			_, size := utf8.DecodeLastRuneInString(content[:cursor])
+			setEditorCursor(editor, cursor-size)
+		}
+	case "l":
+		if _, end := lineBounds(content, cursor); cursor < end {
+			_, size := utf8.DecodeRuneInString(content[cursor:])
+			setEditorCursor(editor, cursor+size)
+		}
+	case "j", "enter":
+		editor.CursorDown()
+	case "k":
+		editor.CursorUp()
+	case "w":
+		setEditorCursor(editor, vimNextWord(content, cursor))
+	case "b":
+		setEditorCursor(editor, vimPrevWord(content, cursor))
+	case "0":
+		editor.CursorStart()
+	case "$":
+		editor.CursorEnd()
+	case "x":
+		var deleted string
+		content, cursor, deleted = vimDeleteChar(content, cursor)
+		if deleted != "" {
+			m.vimYank(deleted)
+			editor.SetValue(content)
+			setEditorCursor(editor, cursor)
+		}
+	case "d":
+		vim.lastCommand = "d"
+	case "p", "P":
+		text, err := m.clipboard.Paste()
 		if err != nil {
-			m.browser.errorMsg = err.Error()
-		} else {
-			m.browser.files = files
-			if m.browser.selected >= len(files) {
-				m.browser.selected = len(files) - 1
-			}
+			m.document.commandError = err.Error()
+			break
 		}
-	case "enter":
-		if len(m.browser.files) > m.browser.selected {
-			selectedFile := m.browser.files[m.browser.selected]
-			if selectedFile.IsDir {
-				files, err := scanDirectory(selectedFile.Path, m.browser.showHidden)
-				if err != nil {
-					m.browser.errorMsg = err.Error()
-				} else {
-					m.browser.currentPath = selectedFile.Path
-					m.browser.files = files
-					m.browser.selected = 0
-					m.browser.errorMsg = ""
-				}
-			} else if strings.HasSuffix(selectedFile.Name, ".oath") {
-				return m.loadDocument(selectedFile.Path)
-			}
+		if text == "" {
+			break
 		}
-	case " ":
-		m.mode = modeMenu
+		content, cursor = vimPaste(content, cursor, text, key == "P")
+		editor.SetValue(content)
+		setEditorCursor(editor, cursor)
 	}
 	return m, nil
 }
 
-func (m model) loadDocument(filepath string) (tea.Model, tea.Cmd) {
-	data, err := ioutil.ReadFile(filepath)
-	if err != nil {
-		m.browser.errorMsg = fmt.Sprintf("Error loading file: %v", err)
-		return m, nil
+// Deleted text goes to the clipboard like a yank, so p and the block paste key can bring it back
+func (m *model) vimYank(text string) {
+	if err := m.clipboard.Copy(text); err != nil {
+		m.document.commandError = fmt.Sprintf("Clipboard unavailable, copied for this session only: %v", err)
 	}
+}
 
-	var doc OathDocument
-	if err := json.Unmarshal(data, &doc); err != nil {
-		m.browser.errorMsg = fmt.Sprintf("Error parsing file: %v", err)
-		return m, nil
+// p/P: text ending in a newline (what dd deletes) goes in as whole lines below / above the
+// cursor line, anything else after / before the cursor. Returns the content and where the
+// cursor lands, on the first pasted line or the last pasted character
+func vimPaste(content string, i int, text string, before bool) (string, int) {
+	start, end := lineBounds(content, i)
+	if strings.HasSuffix(text, "\n") {
+		if before {
+			return content[:start] + text + content[start:], start
+		}
+		return content[:end] + "\n" + strings.TrimSuffix(text, "\n") + content[end:], end + 1
 	}
 
-	m.document.blocks = doc.Content
-	m.document.filepath = filepath
-	m.document.modified = false
-	m.document.currentBlock = 0
-	m.document.needsRefresh = true
+	at := i
+	if !before && i < end {
+		_, size := utf8.DecodeRuneInString(content[i:])
+		at += size
+	}
+	_, last := utf8.DecodeLastRuneInString(text)
+	return content[:at] + text + content[at:], at + len(text) - last
+}
 
-	if len(m.document.blocks) > 0 {
-		m.document.editor.SetValue(m.document.blocks[0].Content)
+// Byte offset of the textarea cursor into its value
+func editorCursorIndex(editor textarea.Model) int {
+	lines := strings.Split(editor.Value(), "\n")
+	row := editor.Line()
+	if row >= len(lines) {
+		return len(editor.Value())
 	}
 
-	m.mode = modeEdit
-	return m, textarea.Blink
+	offset := 0
+	for _, line := range lines[:row] {
+		offset += len(line) + 1
+	}
+
+	info := editor.LineInfo()
+	runes := []rune(lines[row])
+	col := info.StartColumn + info.ColumnOffset
+	if col > len(runes) {
+		col = len(runes)
+	}
+	return offset + len(string(runes[:col]))
 }
 
-func (m model) updateMenu(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
-	switch msg.String() {
-	case "q":
-		m.mode = modeBrowser
-	case "ctrl+c":
-		m.saveUserPreferences()
-		return m, tea.Quit
-	case "j", "down":
-		if m.menu.selected < len(m.menu.templates)-1 {
-			m.menu.selected++
-		}
-	case "k", "up":
-		if m.menu.selected > 0 {
-			m.menu.selected--
+// Hands out the next numeric ID, repairing the counter if blocks were added without it
+func (d *documentModel) newBlockID() string {
+	if d.nextID <= len(d.blocks) {
+		_, d.nextID, _ = uniqueBlockIDs(d.blocks)
+	}
+	id := strconv.Itoa(d.nextID)
+	d.nextID++
+	return id
+}
+
+// Reassigns empty and duplicate IDs, which older versions produced after deleting blocks.
+// Returns the next free numeric ID and whether anything was changed
+func uniqueBlockIDs(blocks []ContentBlock) ([]ContentBlock, int, bool) {
+	next := 1
+	for _, block := range blocks {
+		if n, err := strconv.Atoi(block.ID); err == nil && n >= next {
+			next = n + 1
 		}
-	case "enter":
-		template := m.menu.templates[m.menu.selected]
-		m.document.blocks = make([]ContentBlock, len(template.Content))
-		copy(m.document.blocks, template.Content)
-		m.document.currentBlock = 0
-		m.document.filepath = ""
-		m.document.modified = true
-		m.document.needsRefresh = true
+	}
 
-		if len(m.document.blocks) > 0 {
-			m.document.editor.SetValue(m.document.blocks[0].Content)
-		}
-		m.mode = modeEdit
-		return m, textarea.Blink
-	case "t":
-		m.mode = modeTimer
-		m.input.Focus()
-		return m, textinput.Blink
-	case "v":
-		m.document.vim.enabled = !m.document.vim.enabled
-		if m.document.vim.enabled {
-			m.document.vim.mode = vimNormal
+	changed := false
+	seen := make(map[string]bool)
+	result := make([]ContentBlock, len(blocks))
+	for i, block := range blocks {
+		if block.ID == "" || seen[block.ID] {
+			block.ID = strconv.Itoa(next)
+			next++
+			changed = true
 		}
+		seen[block.ID] = true
+		result[i] = block
 	}
-	return m, nil
+
+	return result, next, changed
 }
 
-func (m model) updateEdit(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
-	// if m.document.vim.enabled && m.document.editor.Focused() {
-	// 	if handled := m.document.vim.handleVimInput(msg.String(), &m.document.editor); handled {
-	// 		if len(m.document.blocks) > m.document.currentBlock {
-	// 			m.document.blocks[m.document.currentBlock].Content = m.document.editor.Value()
-	// 			m.document.modified = true
-	// 			m.document.needsRefresh = true
-	// 		}
-	// 		return m, nil
-	// 	}
-	//
-	// 	if m.document.vim.mode != vimInsert && m.document.vim.mode != vimCommand {
-	// 		return m, nil
-	// 	}
-	// }
+// Numbers a copy of blocks "1", "2", ... in order and returns the next free ID. Templates go
+// through this, their IDs are hand written and user templates can repeat them
+func renumberBlocks(blocks []ContentBlock) ([]ContentBlock, int) {
+	result := make([]ContentBlock, len(blocks))
+	for i, block := range blocks {
+		block.ID = strconv.Itoa(i + 1)
+		result[i] = block
+	}
+	return result, len(blocks) + 1
+}
 
-	if m.document.lsp.showCompletions {
-		switch msg.String() {
-		case "j", "down":
-			if m.document.lsp.activeCompletion < len(m.document.lsp.completions)-1 {
-				m.document.lsp.activeCompletion++
-			}
-			return m, nil
-		case "k", "up":
-			if m.document.lsp.activeCompletion > 0 {
-				m.document.lsp.activeCompletion--
-			}
-			return m, nil
-		case "enter", "tab":
-			if len(m.document.lsp.completions) > m.document.lsp.activeCompletion {
-				completion := m.document.lsp.completions[m.document.lsp.activeCompletion]
-				currentContent := m.document.editor.Value()
+// Splits a closing "— Author" or "-- Author" line off a quote. author is empty when the
+// last line isn't an attribution
+func splitAttribution(content string) (quote, author string) {
+	trimmed := strings.TrimRight(content, " \t\n")
+	start := strings.LastIndex(trimmed, "\n") + 1
+	last := strings.TrimSpace(trimmed[start:])
+	if !strings.HasPrefix(last, "—") && !strings.HasPrefix(last, "--") {
+		return content, ""
+	}
+	author = strings.TrimSpace(strings.TrimLeft(last, "—-"))
+	if author == "" {
+		return content, ""
+	}
+	return strings.TrimRight(trimmed[:start], " \t\n"), author
+}
 
-				if strings.Contains(currentContent, m.document.lsp.triggerPrefix) {
-					newContent := strings.Replace(currentContent, m.document.lsp.triggerPrefix, completion.InsertText, 1)
-					m.document.editor.SetValue(newContent)
-				}
+func blockIndicator(t blockType) string {
+	switch t {
+	case blockMath:
+		return "[MATH] "
+	case blockCode:
+		return "[CODE] "
+	case blockQuote:
+		return "[QUOTE] "
+	case blockList:
+		return "[LIST] "
+	case blockTable:
+		return "[TABLE] "
+	case blockImage:
+		return "[IMAGE] "
+	case blockHR:
+		return "[RULE] "
+	case blockRawLaTeX:
+		return "[RAW] "
+	case blockHeading:
+		return "[HEAD] "
+	}
+	return "[TEXT] "
+}
 
-				m.document.lsp.showCompletions = false
-				m.document.lsp.completions = []Completion{}
-			}
-			return m, nil
-		case "esc":
-			m.document.lsp.showCompletions = false
-			m.document.lsp.completions = []Completion{}
-			return m, nil
-		}
+// Editor hint for an empty block, showing what the block type expects
+func blockPlaceholder(t blockType) string {
+	switch t {
+	case blockMath:
+		return "$ ... $"
+	case blockCode:
+		return "// code here"
+	case blockQuote:
+		return "quoted text"
+	case blockList:
+		return "- item"
+	case blockTable:
+		return "| a | b |"
+	case blockImage:
+		return "path|alt text"
+	case blockRawLaTeX:
+		return "\\begin{...}"
+	case blockHeading:
+		return "# Title"
 	}
+	return "Start writing"
+}
 
-	if m.document.editor.Focused() {
-		if msg.Type == tea.KeyEsc && !m.document.lsp.showCompletions {
-			if len(m.document.blocks) > m.document.currentBlock {
-				m.document.blocks[m.document.currentBlock].Content = m.document.editor.Value()
-				m.document.modified = true
-				m.document.needsRefresh = true
+// Image blocks store "path|alt text", the alt text is optional and doubles as the caption
+type imageRef struct {
+	Path string
+	Alt  string
+}
 
-				content := m.document.editor.Value()
-				rendered := m.document.renderer.renderLaTeX(content)
-				m.document.lsp.diagnostics = rendered.Errors
-			}
-			m.document.editor.Blur()
-			if m.document.vim.enabled {
-				m.document.vim.mode = vimNormal
-			}
-			return m, nil
-		}
+func parseImage(content string) imageRef {
+	path, alt, _ := strings.Cut(strings.TrimSpace(content), "|")
+	return imageRef{Path: strings.TrimSpace(path), Alt: strings.TrimSpace(alt)}
+}
 
-		var cmd tea.Cmd
-		m.document.editor, cmd = m.document.editor.Update(msg)
+func (i imageRef) String() string {
+	if i.Alt == "" {
+		return i.Path
+	}
+	return i.Path + "|" + i.Alt
+}
 
-		content := m.document.editor.Value()
-		words := strings.Fields(content)
-		if len(words) > 0 {
-			lastWord := words[len(words)-1]
-			if strings.HasPrefix(lastWord, "\\") && len(lastWord) > 1 {
-				completions := m.document.lsp.getCompletions(content)
-				if len(completions) > 0 {
-					m.document.lsp.completions = completions
-					m.document.lsp.showCompletions = true
-					m.document.lsp.activeCompletion = 0
-					m.document.lsp.triggerPrefix = lastWord
-				}
-			} else {
-				m.document.lsp.showCompletions = false
-			}
-		}
+// Text shown wherever the image itself can't be, falling back to the file name
+func (i imageRef) label() string {
+	if i.Alt != "" {
+		return i.Alt
+	}
+	return filepath.Base(i.Path)
+}
 
-		return m, cmd
+func latexImage(image imageRef) string {
+	var b strings.Builder
+	b.WriteString("\\begin{figure}[h]\n\\centering\n")
+	// \detokenize keeps _, # and ~ in file names from being read as markup
+	b.WriteString(fmt.Sprintf("\\includegraphics[width=0.8\\linewidth]{\\detokenize{%s}}\n", image.Path))
+	if image.Alt != "" {
+		b.WriteString(fmt.Sprintf("\\caption{%s}\n", escapeLaTeX(image.Alt)))
 	}
+	b.WriteString("\\end{figure}\n")
+	return b.String()
+}
 
-	switch msg.String() {
-	case "q":
-		m.mode = modeMenu
-	case "ctrl+c":
-		m.saveUserPreferences()
-		return m, tea.Quit
-	case "j", "down":
-		if m.document.currentBlock < len(m.document.blocks)-1 {
-			m.document.currentBlock++
-			m.document.editor.SetValue(m.document.blocks[m.document.currentBlock].Content)
-		}
-	case "k", "up":
-		if m.document.currentBlock > 0 {
-			m.document.currentBlock--
-			m.document.editor.SetValue(m.document.blocks[m.document.currentBlock].Content)
-		}
-	case "enter":
-		if len(m.document.blocks) > m.document.currentBlock {
-			m.document.editor.Focus()
-			if m.document.vim.enabled {
-				m.document.vim.mode = vimNormal
-			}
-			return m, textarea.Blink
-		}
-	case "n":
-		newBlock := ContentBlock{
-			ID:      fmt.Sprintf("%d", len(m.document.blocks)+1),
-			Type:    blockText,
-			Content: "",
-		}
-		m.document.blocks = append(m.document.blocks, newBlock)
-		m.document.currentBlock = len(m.document.blocks) - 1
-		m.document.editor.SetValue("")
-		m.document.modified = true
-		m.document.needsRefresh = true
-		m.document.editor.Focus()
-		if m.document.vim.enabled {
-			m.document.vim.mode = vimInsert
-		}
-		return m, textarea.Blink
-	case "m":
-		if len(m.document.blocks) > m.document.currentBlock {
-			m.document.blocks[m.document.currentBlock].Type = blockMath
-			m.document.modified = true
-			m.document.needsRefresh = true
-		}
-	case "c":
-		if len(m.document.blocks) > m.document.currentBlock {
-			m.document.blocks[m.document.currentBlock].Type = blockCode
-			m.document.modified = true
-			m.document.needsRefresh = true
+func htmlImage(image imageRef) string {
+	var b strings.Builder
+	b.WriteString("<figure>\n")
+	b.WriteString(fmt.Sprintf("<img src=\"%s\" alt=\"%s\">\n", html.EscapeString(image.Path), html.EscapeString(image.Alt)))
+	if image.Alt != "" {
+		b.WriteString(fmt.Sprintf("<figcaption>%s</figcaption>\n", html.EscapeString(image.Alt)))
+	}
+	b.WriteString("</figure>\n")
+	return b.String()
+}
+
+// Footnotes are referenced as [^label] in text blocks and defined on a line of their
+// own as "[^label]: text". Defined notes are numbered in order of first reference
+type footnotes struct {
+	defs    map[string]string
+	numbers map[string]int
+	order   []string
+}
+
+type footnoteSegment struct {
+	Text  string
+	Label string
+}
+
+func parseFootnoteDef(line string) (string, string, bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "[^") {
+		return "", "", false
+	}
+	end := strings.Index(line, "]:")
+	if end < 3 || strings.ContainsAny(line[2:end], " ]") {
+		return "", "", false
+	}
+	return line[2:end], strings.TrimSpace(line[end+2:]), true
+}
+
+// Splits text into literal runs and [^label] references
+func splitFootnoteRefs(text string) []footnoteSegment {
+	var segments []footnoteSegment
+	for {
+		start := strings.Index(text, "[^")
+		if start == -1 {
+			break
 		}
-	case "l":
-		if len(m.document.blocks) > m.document.currentBlock {
-			m.document.blocks[m.document.currentBlock].Type = blockList
-			m.document.modified = true
-			m.document.needsRefresh = true
+		end := strings.Index(text[start:], "]")
+		label := ""
+		if end > 2 {
+			label = text[start+2 : start+end]
 		}
-	case "r":
-		if len(m.document.blocks) > m.document.currentBlock {
-			m.document.blocks[m.document.currentBlock].Type = blockRawLaTeX
-			m.document.modified = true
-			m.document.needsRefresh = true
+		if label == "" || strings.ContainsAny(label, " [") {
+			segments = append(segments, footnoteSegment{Text: text[:start+2]})
+			text = text[start+2:]
+			continue
 		}
-	case "s":
-		if m.document.filepath == "" || strings.Contains(m.document.filepath, "document.oath") {
-			return m, m.saveDocument()
+
+		if start > 0 {
+			segments = append(segments, footnoteSegment{Text: text[:start]})
 		}
-		return m, m.saveDocument()
-	case "T":
-		m.theme.selected = (m.theme.selected + 1) % len(m.theme.available)
-		m.theme.currentTheme = m.theme.available[m.theme.selected]
-	case "V":
-		m.document.vim.enabled = !m.document.vim.enabled
-		if m.document.vim.enabled {
-			m.document.vim.mode = vimNormal
+		segments = append(segments, footnoteSegment{Label: label})
+		text = text[start+end+1:]
+	}
+	if text != "" {
+		segments = append(segments, footnoteSegment{Text: text})
+	}
+	return segments
+}
+
+func stripFootnoteDefs(text string) string {
+	var kept []string
+	for _, line := range strings.Split(text, "\n") {
+		if _, _, ok := parseFootnoteDef(line); !ok {
+			kept = append(kept, line)
 		}
-	case "e":
-		m.mode = modeExport
-		m.export.input.Focus()
-		return m, textinput.Blink
-	case "t":
-		m.mode = modeTimer
-		m.input.Focus()
-		return m, textinput.Blink
-	case "1":
-		m.document.viewMode = viewEditorOnly
-	case "2":
-		m.document.viewMode = viewSplitPane
-	case "3":
-		m.document.viewMode = viewPreviewOnly
-	case "=":
-		if m.document.splitRatio < 0.8 {
-			m.document.splitRatio += 0.1
-			editorWidth := int(float64(m.width) * m.document.splitRatio)
-			if editorWidth < 20 {
-				editorWidth = 20
-			}
-			m.document.editor.SetWidth(editorWidth - 4)
-		}
-	case "-":
-		if m.document.splitRatio > 0.2 {
-			m.document.splitRatio -= 0.1
-			editorWidth := int(float64(m.width) * m.document.splitRatio)
-			if editorWidth < 20 {
-				editorWidth = 20
-			}
-			m.document.editor.SetWidth(editorWidth - 4)
+	}
+	return strings.TrimRight(strings.Join(kept, "\n"), "\n")
+}
+
+func collectFootnotes(blocks []ContentBlock) footnotes {
+	notes := footnotes{defs: make(map[string]string), numbers: make(map[string]int)}
+	var refs []string
+	for _, block := range blocks {
+		if block.Type != blockText {
+			continue
 		}
-	case "d":
-		if len(m.document.blocks) > 1 && m.document.currentBlock < len(m.document.blocks) {
-			m.document.blocks = append(m.document.blocks[:m.document.currentBlock],
-				m.document.blocks[m.document.currentBlock+1:]...)
-			if m.document.currentBlock >= len(m.document.blocks) {
-				m.document.currentBlock = len(m.document.blocks) - 1
+		for _, line := range strings.Split(block.Content, "\n") {
+			if label, def, ok := parseFootnoteDef(line); ok {
+				notes.defs[label] = def
+				continue
 			}
-			if len(m.document.blocks) > m.document.currentBlock {
-				m.document.editor.SetValue(m.document.blocks[m.document.currentBlock].Content)
+			for _, segment := range splitFootnoteRefs(line) {
+				if segment.Label != "" {
+					refs = append(refs, segment.Label)
+				}
 			}
-			m.document.modified = true
-			m.document.needsRefresh = true
 		}
-	case "ctrl+l":
-		m.document.needsRefresh = true
 	}
 
-	return m, nil
+	for _, label := range refs {
+		if _, defined := notes.defs[label]; defined && notes.numbers[label] == 0 {
+			notes.order = append(notes.order, label)
+			notes.numbers[label] = len(notes.order)
+		}
+	}
+	return notes
 }
 
-func (m model) updateTimer(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
-	var cmds []tea.Cmd
-	var cmd tea.Cmd
-
-	if m.notes.Focused() {
-		if msg.Type == tea.KeyEsc {
-			m.notes.Blur()
-			return m, nil
+// Rewrites each defined reference with render and drops the definition lines.
+// Undefined references are left as written, footnoteDiagnostics reports them
+func (f footnotes) replace(text string, render func(label string, number int) string) string {
+	var result strings.Builder
+	for _, segment := range splitFootnoteRefs(stripFootnoteDefs(text)) {
+		if n := f.numbers[segment.Label]; segment.Label != "" && n > 0 {
+			result.WriteString(render(segment.Label, n))
+		} else if segment.Label != "" {
+			result.WriteString("[^" + segment.Label + "]")
+		} else {
+			result.WriteString(segment.Text)
 		}
-		m.notes, cmd = m.notes.Update(msg)
-		return m, cmd
 	}
+	return result.String()
+}
 
-	switch msg.String() {
-	case "q":
-		m.mode = modeEdit
-	case "ctrl+c":
-		m.saveUserPreferences()
-		return m, tea.Quit
-	case "enter":
-		if !m.input.Focused() {
-			return m, nil
-		}
-		d, err := time.ParseDuration(m.input.Value())
-		if err == nil && d > 0 {
-			m.duration = d
-			m.remaining = d
-			m.paused = false
-			m.ticker = time.NewTicker(time.Second)
-			cmds = append(cmds, waitForTick(m.ticker.C))
+func footnoteDiagnostics(content string, notes footnotes) []Diagnostic {
+	var diagnostics []Diagnostic
+	for i, line := range strings.Split(content, "\n") {
+		if _, _, ok := parseFootnoteDef(line); ok {
+			continue
 		}
-		return m, tea.Batch(cmds...)
-	case "p":
-		if m.ticker != nil {
-			m.paused = true
-			m.ticker.Stop()
-			m.ticker = nil
+		column := 0
+		for _, segment := range splitFootnoteRefs(line) {
+			if segment.Label == "" {
+				column += len(segment.Text)
+				continue
+			}
+			if _, defined := notes.defs[segment.Label]; !defined {
+				diagnostics = append(diagnostics, Diagnostic{
+					Line:     i + 1,
+					Column:   column + 1,
+					Message:  fmt.Sprintf("Footnote [^%s] is never defined", segment.Label),
+					Severity: "warning",
+				})
+			}
+			column += len(segment.Label) + 3
 		}
-	case "r":
-		if m.paused && m.remaining > 0 {
-			m.paused = false
-			m.ticker = time.NewTicker(time.Second)
-			cmds = append(cmds, waitForTick(m.ticker.C))
+	}
+	return diagnostics
+}
+
+func superscriptNumber(n int) string {
+	digits := []rune("⁰¹²³⁴⁵⁶⁷⁸⁹")
+	var result strings.Builder
+	for _, digit := range strconv.Itoa(n) {
+		result.WriteRune(digits[digit-'0'])
+	}
+	return result.String()
+}
+
+// Definitions stay where they were written in the preview, marked with their number
+func (f footnotes) previewText(text string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if label, def, ok := parseFootnoteDef(line); ok {
+			number := "?"
+			if n := f.numbers[label]; n > 0 {
+				number = superscriptNumber(n)
+			}
+			lines[i] = number + " " + def
+			continue
 		}
-	case "w":
-		if m.ticker != nil {
-			m.ticker.Stop()
-			m.ticker = nil
+
+		var result strings.Builder
+		for _, segment := range splitFootnoteRefs(line) {
+			if segment.Label == "" {
+				result.WriteString(segment.Text)
+			} else if _, defined := f.defs[segment.Label]; defined {
+				result.WriteString(superscriptNumber(f.numbers[segment.Label]))
+			} else {
+				result.WriteString("[^" + segment.Label + "]")
+			}
 		}
-		m.input.Focus()
-	case "n":
-		m.notes.Focus()
-		cmds = append(cmds, textarea.Blink)
+		lines[i] = result.String()
 	}
+	return strings.Join(lines, "\n")
+}
 
-	if m.input.Focused() {
-		m.input, cmd = m.input.Update(msg)
-		cmds = append(cmds, cmd)
+func (f footnotes) htmlList() string {
+	if len(f.order) == 0 {
+		return ""
 	}
-
-	return m, tea.Batch(cmds...)
+	var b strings.Builder
+	b.WriteString("<section class=\"footnotes\">\n<hr>\n<ol>\n")
+	for _, label := range f.order {
+		n := f.numbers[label]
+		b.WriteString(fmt.Sprintf("<li id=\"fn-%d\">%s <a href=\"#fnref-%d\">↩</a></li>\n", n, html.EscapeString(f.defs[label]), n))
+	}
+	b.WriteString("</ol>\n</section>\n")
+	return b.String()
 }
 
-func (m model) updateExport(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
-	if m.export.input.Focused() {
-		if msg.Type == tea.KeyEsc {
-			m.export.input.Blur()
-			return m, nil
-		}
-		if msg.Type == tea.KeyEnter {
-			filename := strings.TrimSpace(m.export.input.Value())
-			if filename == "" {
-				filename = m.getSmartFilename()
+// Tracks which notes have been referenced already, repeats point back at the first one
+type footnoteRefs map[string]bool
+
+func (r footnoteRefs) html(label string, number int) string {
+	if r[label] {
+		return fmt.Sprintf("<sup><a href=\"#fn-%d\">%d</a></sup>", number, number)
+	}
+	r[label] = true
+	return fmt.Sprintf("<sup id=\"fnref-%d\"><a href=\"#fn-%d\">%d</a></sup>", number, number, number)
+}
+
+func (r footnoteRefs) latex(label string, number int, def string) string {
+	if r[label] {
+		return fmt.Sprintf("\\footnotemark[%d]", number)
+	}
+	r[label] = true
+	return "\\footnote{" + def + "}"
+}
+
+const foldSummaryLength = 40
+
+// One line stand-in for a folded block: its type and the start of its content
+func blockSummary(block ContentBlock) string {
+	text := strings.Join(strings.Fields(block.Content), " ")
+	if text == "" {
+		return blockIndicator(block.Type) + fmt.Sprintf("[Empty %s block]", block.Type)
+	}
+
+	runes := []rune(text)
+	if len(runes) > foldSummaryLength {
+		text = string(runes[:foldSummaryLength]) + "…"
+	}
+	return blockIndicator(block.Type) + text
+}
+
+type changeKind int
+
+const (
+	blockAdded changeKind = iota
+	blockRemoved
+	blockChanged
+)
+
+type blockChange struct {
+	kind  changeKind
+	block ContentBlock
+	// One-based position in the current document, 0 for removed blocks
+	index int
+}
+
+// Matches blocks by ID. Removed blocks are listed just before the first surviving block
+// that followed them on disk so the result reads in document order
+func diffBlocks(saved, current []ContentBlock) []blockChange {
+	savedIndex := make(map[string]int, len(saved))
+	for i, block := range saved {
+		savedIndex[block.ID] = i
+	}
+	currentIDs := make(map[string]bool, len(current))
+	for _, block := range current {
+		currentIDs[block.ID] = true
+	}
+
+	var changes []blockChange
+	next := 0
+	flushRemoved := func(upTo int) {
+		for ; next < upTo; next++ {
+			if !currentIDs[saved[next].ID] {
+				changes = append(changes, blockChange{kind: blockRemoved, block: saved[next]})
 			}
-			return m, m.exportDocument(filename, exportFormat(m.export.selected))
 		}
-		var cmd tea.Cmd
-		m.export.input, cmd = m.export.input.Update(msg)
-		return m, cmd
 	}
 
-	switch msg.String() {
-	case "q":
-		m.mode = modeEdit
-	case "ctrl+c":
-		m.saveUserPreferences()
-		return m, tea.Quit
-	case "j", "down":
-		if m.export.selected < len(m.export.formats)-1 {
-			m.export.selected++
+	for i, block := range current {
+		si, ok := savedIndex[block.ID]
+		if !ok {
+			changes = append(changes, blockChange{kind: blockAdded, block: block, index: i + 1})
+			continue
 		}
-	case "k", "up":
-		if m.export.selected > 0 {
-			m.export.selected--
+		if si >= next {
+			flushRemoved(si)
+			next = si + 1
+		}
+		old := saved[si]
+		if old.Type != block.Type || old.Content != block.Content || old.Language != block.Language ||
+			old.Level != block.Level || old.Numbered != block.Numbered ||
+			old.NoWrap != block.NoWrap || old.LineNumbers != block.LineNumbers || old.RawText != block.RawText || old.Comment != block.Comment {
+			changes = append(changes, blockChange{kind: blockChanged, block: block, index: i + 1})
 		}
-	case "enter":
-		m.export.input.Focus()
-		return m, textinput.Blink
 	}
-	return m, nil
+	flushRemoved(len(saved))
+
+	return changes
 }
 
-func waitForTick(c <-chan time.Time) tea.Cmd {
-	return func() tea.Msg {
-		return tickMsg(<-c)
+// Inclusive bounds of the selection, in document order
+func (d *documentModel) selectionRange() (int, int) {
+	lo, hi := d.selectionStart, d.selectionEnd
+	if lo > hi {
+		lo, hi = hi, lo
+	}
+	if lo < 0 {
+		lo = 0
 	}
+	if hi >= len(d.blocks) {
+		hi = len(d.blocks) - 1
+	}
+	return lo, hi
 }
 
-func (m model) getSmartFilename() string {
-	for _, block := range m.document.blocks {
-		if block.Type == blockHeading && strings.TrimSpace(block.Content) != "" {
-			title := strings.TrimSpace(block.Content)
-			title = strings.TrimLeft(title, "#")
-			title = strings.TrimSpace(title)
-			
-			if title != "" && title != "Document Title" {
-				filename := strings.ToLower(title)
-				filename = strings.ReplaceAll(filename, " ", "-")
-				var cleanName strings.Builder
-				for _, r := range filename {
-					if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
-						cleanName.WriteRune(r)
-					}
-				}
-				result := cleanName.String()
-				result = strings.Trim(result, "-")
-				if result != "" {
-					return result
-				}
-			}
-		}
+func (d *documentModel) setSelectionType(t blockType) {
+	lo, hi := d.selectionRange()
+	for i := lo; i <= hi; i++ {
+		d.blocks[i].Type = t
 	}
-	
-	if m.document.filepath != "" {
-		base := filepath.Base(m.document.filepath)
-		return strings.TrimSuffix(base, ".oath")
+}
+
+// Refuses to leave the document without blocks, like deleting a single block
+func (d *documentModel) deleteSelection() bool {
+	lo, hi := d.selectionRange()
+	if hi-lo+1 >= len(d.blocks) {
+		return false
 	}
-	
-	return "document"
+
+	d.blocks = append(d.blocks[:lo], d.blocks[hi+1:]...)
+	if lo >= len(d.blocks) {
+		lo = len(d.blocks) - 1
+	}
+	d.currentBlock = lo
+	d.selectionStart, d.selectionEnd = lo, lo
+	return true
 }
 
-func (m model) saveDocument() tea.Cmd {
-	return func() tea.Msg {
-		doc := OathDocument{
-			Version:   "1.0",
-			Template:  "custom",
-			Content:   m.document.blocks,
-			Variables: make(map[string]string),
-			Created:   time.Now(),
-			Modified:  time.Now(),
-		}
+// Shifts the selected blocks one place up (-1) or down (1), carrying the cursor with them
+func (d *documentModel) moveSelection(delta int) bool {
+	lo, hi := d.selectionRange()
+	if lo+delta < 0 || hi+delta >= len(d.blocks) {
+		return false
+	}
 
-		data, err := json.MarshalIndent(doc, "", "  ")
-		if err != nil {
-			return nil
-		}
+	selected := append([]ContentBlock(nil), d.blocks[lo:hi+1]...)
+	if delta < 0 {
+		d.blocks[hi] = d.blocks[lo-1]
+	} else {
+		d.blocks[lo] = d.blocks[hi+1]
+	}
+	copy(d.blocks[lo+delta:], selected)
 
-		filename := m.getSmartFilename() + ".oath"
-		if m.document.filepath != "" {
-			filename = m.document.filepath
-		} else {
-			filename = filepath.Join(m.browser.currentPath, filename)
+	d.selectionStart += delta
+	d.selectionEnd += delta
+	d.currentBlock += delta
+	return true
+}
+
+type outlineEntry struct {
+	index int
+	level int
+	title string
+}
+
+// Heading blocks in document order. The level comes from the leading #s, falling back
+// to the block's Level for headings written without them
+func buildOutline(blocks []ContentBlock) []outlineEntry {
+	var outline []outlineEntry
+	for i, block := range blocks {
+		if block.Type != blockHeading {
+			continue
 		}
-		
-		err = ioutil.WriteFile(filename, data, 0644)
-		if err == nil {
-			m.document.filepath = filename
-			m.document.modified = false
+		content := strings.TrimSpace(block.Content)
+		title := strings.TrimLeft(content, "#")
+		level := len(content) - len(title)
+		if level == 0 {
+			level = block.Level
 		}
-		return nil
+		if level < 1 {
+			level = 1
+		}
+		outline = append(outline, outlineEntry{index: i, level: level, title: strings.TrimSpace(title)})
 	}
+	return outline
 }
 
-func (m model) exportDocument(filename string, format exportFormat) tea.Cmd {
-	return func() tea.Msg {
-		switch format {
-		case exportPDF:
-			return m.generatePDF(filename)
-		case exportHTML:
-			content := m.generateHTML()
-			fullPath := filepath.Join(m.browser.currentPath, filename+".html")
-			return ioutil.WriteFile(fullPath, []byte(content), 0644)
-		case exportUnicode:
-			content := m.generateUnicode()
-			fullPath := filepath.Join(m.browser.currentPath, filename+".txt")
-			return ioutil.WriteFile(fullPath, []byte(content), 0644)
-		case exportMarkdown:
-			content := m.generateMarkdown()
-			fullPath := filepath.Join(m.browser.currentPath, filename+".md")
-			return ioutil.WriteFile(fullPath, []byte(content), 0644)
+// The entry whose section contains the given block, -1 before the first heading
+func outlineSection(outline []outlineEntry, block int) int {
+	section := -1
+	for i, entry := range outline {
+		if entry.index > block {
+			break
 		}
-		return nil
+		section = i
 	}
+	return section
 }
 
-func (m model) generatePDF(filename string) error {
-	latexContent := m.generateLaTeX()
-	
-	currentDir := m.browser.currentPath
-	texPath := filepath.Join(currentDir, filename+".tex")
-	pdfPath := filepath.Join(currentDir, filename+".pdf")
-	
-	err := ioutil.WriteFile(texPath, []byte(latexContent), 0644)
-	if err != nil {
-		return fmt.Errorf("failed to write LaTeX file: %v", err)
+func (d *documentModel) toggleFold(id string) {
+	if d.collapsed == nil {
+		d.collapsed = make(map[string]bool)
 	}
-	
-	_, err = exec.LookPath("pdflatex")
-	if err != nil {
-		return fmt.Errorf("pdflatex not found. LaTeX file saved as %s.tex", filename)
+	if d.collapsed[id] {
+		delete(d.collapsed, id)
+	} else {
+		d.collapsed[id] = true
 	}
-	
-	oldDir, _ := os.Getwd()
-	err = os.Chdir(currentDir)
-	if err != nil {
-		return fmt.Errorf("failed to change directory: %v", err)
+}
+
+func (d *documentModel) foldAll(fold bool) {
+	d.collapsed = make(map[string]bool)
+	if !fold {
+		return
 	}
-	defer os.Chdir(oldDir)
-	
-	cmd := exec.Command("pdflatex", "-interaction=nonstopmode", filename+".tex")
-	output, err := cmd.CombinedOutput()
-	
-	if err != nil {
-		m.forceCleanupFiles(currentDir, filename)
-		return fmt.Errorf("pdflatex failed: %v\nOutput: %s", err, string(output))
+	for _, block := range d.blocks {
+		d.collapsed[block.ID] = true
 	}
-	
-	if _, err := os.Stat(pdfPath); os.IsNotExist(err) {
-		m.forceCleanupFiles(currentDir, filename)
-		return fmt.Errorf("PDF was not created despite successful compilation")
+}
+
+// Splits a block at a byte offset into two blocks of the same type, dropping the line break at the cut
+func splitBlock(block ContentBlock, at int) (ContentBlock, ContentBlock) {
+	if at < 0 {
+		at = 0
 	}
-	
-	m.forceCleanupFiles(currentDir, filename)
-	
-	return nil
+	if at > len(block.Content) {
+		at = len(block.Content)
+	}
+
+	first, second := block, block
+	first.Content = strings.TrimSuffix(block.Content[:at], "\n")
+	second.Content = strings.TrimPrefix(block.Content[at:], "\n")
+	first.Rendered, second.Rendered = "", ""
+	return first, second
+}
+
+// One-based line and column of the cursor, the column counts runes rather than bytes
+func editorPosition(ta textarea.Model) (line, col int) {
+	info := ta.LineInfo()
+	return ta.Line() + 1, info.StartColumn + info.ColumnOffset + 1
 }
 
-func (m model) forceCleanupFiles(dir, filename string) {
-	auxExtensions := []string{
-		".aux", ".log", ".tex", ".out", ".toc", ".lof", ".lot", 
-		".fls", ".fdb_latexmk", ".synctex.gz", ".bbl", ".blg",
-		".idx", ".ind", ".ilg", ".nav", ".snm", ".vrb", ".figlist",
-		".makefile", ".figs", ".pyg", ".pytxcode", ".pytxmcr",
+// Moves the textarea cursor to a byte offset into its value. The textarea only exposes
+// relative movement, so walk the logical rows and then set the column
+func setEditorCursor(editor *textarea.Model, offset int) {
+	value := editor.Value()
+	if offset > len(value) {
+		offset = len(value)
 	}
-	
-	for _, ext := range auxExtensions {
-		filePath := filepath.Join(dir, filename+ext)
-		
-		for attempts := 0; attempts < 3; attempts++ {
-			err := os.Remove(filePath)
-			if err == nil || os.IsNotExist(err) {
-				break 
-			}
-			
-			time.Sleep(50 * time.Millisecond)
-		}
+	if offset < 0 {
+		offset = 0
 	}
-	
 
-	entries, err := os.ReadDir(dir)
-	if err != nil {
-		return
+	before := value[:offset]
+	row := strings.Count(before, "\n")
+	col := utf8.RuneCountInString(before[strings.LastIndex(before, "\n")+1:])
+
+	for i := 0; editor.Line() > row && i < len(value); i++ {
+		editor.CursorUp()
 	}
-	
-	for _, entry := range entries {
-		name := entry.Name()
-		if strings.HasPrefix(name, filename+".") && !strings.HasSuffix(name, ".pdf") && !strings.HasSuffix(name, ".oath") {
-			filePath := filepath.Join(dir, name)
-			for attempts := 0; attempts < 3; attempts++ {
-				err := os.Remove(filePath)
-				if err == nil || os.IsNotExist(err) {
-					break
-				}
-				time.Sleep(50 * time.Millisecond)
-			}
-		}
+	for i := 0; editor.Line() < row && i < len(value); i++ {
+		editor.CursorDown()
 	}
+	editor.SetCursor(col)
 }
 
-func (m model) generateLaTeX() string {
-	var content strings.Builder
-	content.WriteString("\\documentclass{article}\n")
-	content.WriteString("\\usepackage{amsmath}\n")
-	content.WriteString("\\usepackage{amsfonts}\n")
-	content.WriteString("\\usepackage{amssymb}\n")
-	content.WriteString("\\usepackage[utf8]{inputenc}\n")
-	content.WriteString("\\usepackage{url}\n")
-	content.WriteString("\\usepackage{hyperref}\n")
-	content.WriteString("\\usepackage{listings}\n")
-	content.WriteString("\\usepackage{xcolor}\n")
-	content.WriteString("\\lstset{basicstyle=\\ttfamily,breaklines=true}\n")
-	content.WriteString("\\begin{document}\n\n")
+// Line to jump to for the go to line prompt: a number, g or gg for the first line, G or $ for
+// the last. Numbers past either end are clamped to the block
+func parseLineTarget(input string, lines int) (int, error) {
+	input = strings.TrimSpace(input)
+	switch input {
+	case "g", "gg":
+		return 1, nil
+	case "G", "$":
+		return lines, nil
+	}
+	n, err := strconv.Atoi(input)
+	if err != nil {
+		return 0, fmt.Errorf("Not a line number: %s", input)
+	}
+	if n < 1 {
+		n = 1
+	}
+	if n > lines {
+		n = lines
+	}
+	return n, nil
+}
 
-	for i, block := range m.document.blocks {
-		switch block.Type {
-		case blockHeading:
-			level := strings.Count(strings.TrimSpace(block.Content), "#")
-			title := strings.TrimSpace(strings.TrimLeft(block.Content, "#"))
-			
-			if block.Numbered {
-				switch level {
-				case 1:
-					content.WriteString(fmt.Sprintf("\\section{%s}\n", title))
-				case 2:
-					content.WriteString(fmt.Sprintf("\\subsection{%s}\n", title))
-				case 3:
-					content.WriteString(fmt.Sprintf("\\subsubsection{%s}\n", title))
-				default:
-					content.WriteString(fmt.Sprintf("\\paragraph{%s}\n", title))
-				}
-			} else {
-				switch level {
-				case 1:
-					content.WriteString(fmt.Sprintf("\\section*{%s}\n", title))
-				case 2:
-					content.WriteString(fmt.Sprintf("\\subsection*{%s}\n", title))
-				case 3:
-					content.WriteString(fmt.Sprintf("\\subsubsection*{%s}\n", title))
-				default:
-					content.WriteString(fmt.Sprintf("\\paragraph*{%s}\n", title))
-				}
-			}
-		case blockMath:
-			content.WriteString(processDelimiterBasedMath(block.Content))
-		case blockCode:
-			language := block.Language
-			if language == "" {
-				language = "text"
-			}
-			content.WriteString(fmt.Sprintf("\\begin{lstlisting}[language=%s]\n%s\n\\end{lstlisting}\n", language, block.Content))
-		case blockQuote:
-			content.WriteString(fmt.Sprintf("\\begin{quote}\n%s\n\\end{quote}\n", block.Content))
-		case blockList:
-			content.WriteString("\\begin{itemize}\n")
-			lines := strings.Split(block.Content, "\n")
-			for _, line := range lines {
-				line = strings.TrimSpace(line)
-				if strings.HasPrefix(line, "- ") || strings.HasPrefix(line, "* ") {
-					item := strings.TrimSpace(line[2:])
-					content.WriteString(fmt.Sprintf("\\item %s\n", item))
-				}
-			}
-			content.WriteString("\\end{itemize}\n")
-		case blockRawLaTeX:
-			content.WriteString(block.Content)
-			content.WriteString("\n")
-		default:
-			text := block.Content
-			text = convertInlineMath(text)
-			text = smartFormatText(text)
-			
-			if strings.Contains(text, "http") {
-				words := strings.Fields(text)
-				for j, word := range words {
-					if strings.HasPrefix(word, "http") {
-						words[j] = "\\url{" + word + "}"
-					}
-				}
-				text = strings.Join(words, " ")
-			}
-			
-			content.WriteString(text)
-			content.WriteString("\n")
-		}
-		
-		if i < len(m.document.blocks)-1 {
-			content.WriteString("\\vspace{0.8em}\n\n")
+// Puts the cursor at the start of a one-based line of the editor
+func gotoEditorLine(editor *textarea.Model, line int) {
+	offset := 0
+	for i, text := range strings.Split(editor.Value(), "\n") {
+		if i == line-1 {
+			break
 		}
+		offset += len(text) + 1
 	}
-
-	content.WriteString("\\end{document}\n")
-	return content.String()
+	setEditorCursor(editor, offset)
 }
 
-func convertInlineMath(text string) string {
-	result := strings.Builder{}
-	inMath := false
-	
-	for i, char := range text {
-		if char == '$' {
-			if i > 0 && text[i-1] == '\\' {
-				result.WriteRune(char)
-				continue
-			}
-			
-			if !inMath {
-				result.WriteString("\\(")
-				inMath = true
-			} else {
-				result.WriteString("\\)")
-				inMath = false
-			}
-		} else {
-			result.WriteRune(char)
+func (m model) updateLinePrompt(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.Type {
+	case tea.KeyEsc:
+		m.document.linePrompt = false
+		m.document.command.Blur()
+		return m, nil
+	case tea.KeyEnter:
+		m.document.linePrompt = false
+		m.document.command.Blur()
+
+		lines := strings.Count(m.document.editor.Value(), "\n") + 1
+		line, err := parseLineTarget(m.document.command.Value(), lines)
+		if err != nil {
+			m.document.commandError = err.Error()
+			return m, nil
 		}
+		gotoEditorLine(&m.document.editor, line)
+		return m, nil
 	}
-	
-	return result.String()
+
+	var cmd tea.Cmd
+	m.document.command, cmd = m.document.command.Update(msg)
+	return m, cmd
 }
 
-func smartFormatText(text string) string {
-	result := strings.Builder{}
-	inMath := false
-	i := 0
-	
-	for i < len(text) {
-		if i < len(text)-1 && text[i:i+2] == "\\(" {
-			result.WriteString("\\(")
-			inMath = true
-			i += 2
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func scanDirectory(path string, showHidden bool) ([]FileInfo, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s", accessError(path, err))
+	}
+	return listEntries(path, entries, showHidden), nil
+}
+
+// Explains a failed read, calling out permission problems by name
+func accessError(path string, err error) string {
+	if os.IsPermission(err) {
+		return "Permission denied: " + path
+	}
+	return err.Error()
+}
+
+// Entries of a directory listing, with the parent first and directories before files
+func listEntries(path string, entries []os.DirEntry, showHidden bool) []FileInfo {
+	var files []FileInfo
+
+	if path != "/" && path != "." {
+		files = append(files, FileInfo{
+			Name:  "..",
+			Path:  filepath.Dir(path),
+			IsDir: true,
+		})
+	}
+
+	for _, entry := range entries {
+		if !showHidden && strings.HasPrefix(entry.Name(), ".") {
 			continue
 		}
-		if i < len(text)-1 && text[i:i+2] == "\\)" {
-			result.WriteString("\\)")
-			inMath = false
-			i += 2
+
+		file := FileInfo{
+			Name:  entry.Name(),
+			Path:  filepath.Join(path, entry.Name()),
+			IsDir: entry.IsDir(),
+		}
+		if info, err := entry.Info(); err != nil {
+			file.Err = err
+		} else {
+			file.Size = info.Size()
+			file.ModTime = info.ModTime()
+		}
+		files = append(files, file)
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].IsDir != files[j].IsDir {
+			return files[i].IsDir
+		}
+		return files[i].Name < files[j].Name
+	})
+
+	return files
+}
+
+// Case-insensitive subsequence match. Exact prefixes score highest, then contiguous
+// substrings, then scattered matches with fewer gaps ranking first
+func fuzzyMatch(query, name string) (int, bool) {
+	query = strings.ToLower(query)
+	name = strings.ToLower(name)
+
+	if query == "" {
+		return 0, true
+	}
+	if strings.HasPrefix(name, query) {
+		return 1000 - len(name), true
+	}
+	if idx := strings.Index(name, query); idx != -1 {
+		return 500 - idx, true
+	}
+
+	queryRunes := []rune(query)
+	qi := 0
+	gaps := 0
+	last := -1
+	for i, r := range []rune(name) {
+		if qi < len(queryRunes) && r == queryRunes[qi] {
+			if last != -1 && i != last+1 {
+				gaps++
+			}
+			last = i
+			qi++
+		}
+	}
+	if qi < len(queryRunes) {
+		return 0, false
+	}
+	return 100 - gaps, true
+}
+
+func (b *browserModel) setFiles(files []FileInfo) {
+	b.allFiles = files
+	b.applyFilter()
+}
+
+// Rebuilds the visible list from allFiles. The parent entry and directories stay
+// reachable while filtering so navigation never dead-ends
+func (b *browserModel) applyFilter() {
+	query := strings.TrimSpace(b.filter.Value())
+	if query == "" {
+		b.files = b.allFiles
+		if b.selected >= len(b.files) {
+			b.selected = len(b.files) - 1
+		}
+		if b.selected < 0 {
+			b.selected = 0
+		}
+		return
+	}
+
+	type scored struct {
+		file  FileInfo
+		score int
+	}
+
+	var parent []FileInfo
+	var matches []scored
+	var dirs []FileInfo
+	for _, file := range b.allFiles {
+		if file.Name == ".." {
+			parent = append(parent, file)
 			continue
 		}
-		
-		if inMath {
-			result.WriteByte(text[i])
-			i++
+		if score, ok := fuzzyMatch(query, file.Name); ok {
+			matches = append(matches, scored{file, score})
+		} else if file.IsDir {
+			dirs = append(dirs, file)
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].score > matches[j].score
+	})
+
+	files := make([]FileInfo, 0, len(parent)+len(matches)+len(dirs))
+	files = append(files, parent...)
+	for _, match := range matches {
+		files = append(files, match.file)
+	}
+	files = append(files, dirs...)
+
+	b.files = files
+	b.selected = 0
+	if len(matches) > 0 {
+		b.selected = len(parent)
+	}
+}
+
+func (b *browserModel) clearFilter() {
+	b.filter.SetValue("")
+	b.filter.Blur()
+	b.filtering = false
+	b.applyFilter()
+}
+
+// A trailing slash creates a directory instead of a file
+func createEntry(dir, name string) (string, error) {
+	isDir := strings.HasSuffix(name, "/")
+	name = strings.TrimSuffix(strings.TrimSpace(name), "/")
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, filepath.Separator) {
+		return "", fmt.Errorf("invalid name %q", name)
+	}
+
+	path := filepath.Join(dir, name)
+	if _, err := os.Stat(path); err == nil {
+		return "", fmt.Errorf("%s already exists", name)
+	}
+
+	if isDir {
+		return path, os.Mkdir(path, 0755)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	return path, file.Close()
+}
+
+func renameEntry(path, newName string) (string, error) {
+	newName = strings.TrimSpace(newName)
+	if newName == "" || newName == "." || newName == ".." || strings.ContainsRune(newName, filepath.Separator) {
+		return "", fmt.Errorf("invalid name %q", newName)
+	}
+
+	newPath := filepath.Join(filepath.Dir(path), newName)
+	if _, err := os.Stat(newPath); err == nil {
+		return "", fmt.Errorf("%s already exists", newName)
+	}
+	return newPath, os.Rename(path, newPath)
+}
+
+func deleteEntry(file FileInfo) error {
+	if file.Name == ".." || file.Name == "." {
+		return fmt.Errorf("refusing to delete %s", file.Name)
+	}
+	return os.RemoveAll(file.Path)
+}
+
+type trashedFile struct {
+	Original string
+	Trashed  string
+}
+
+func trashDir() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, ".oathkeeper", "trash"), nil
+}
+
+// Moves an entry into trash under a timestamped name, so deleting the same name twice keeps both
+func trashEntry(file FileInfo, trash string, now time.Time) (trashedFile, error) {
+	if file.Name == ".." || file.Name == "." {
+		return trashedFile{}, fmt.Errorf("refusing to delete %s", file.Name)
+	}
+	if err := os.MkdirAll(trash, 0755); err != nil {
+		return trashedFile{}, err
+	}
+
+	stamp := now.Format("20060102-150405")
+	dest := filepath.Join(trash, stamp+"-"+filepath.Base(file.Path))
+	for i := 2; ; i++ {
+		if _, err := os.Lstat(dest); os.IsNotExist(err) {
+			break
+		}
+		dest = filepath.Join(trash, fmt.Sprintf("%s-%d-%s", stamp, i, filepath.Base(file.Path)))
+	}
+
+	if err := moveEntry(file.Path, dest); err != nil {
+		return trashedFile{}, fmt.Errorf("cannot move %s to the trash: %v", file.Name, err)
+	}
+	return trashedFile{Original: file.Path, Trashed: dest}, nil
+}
+
+// Puts a trashed entry back where it came from, unless something has taken its place since
+func restoreEntry(t trashedFile) error {
+	if _, err := os.Lstat(t.Original); err == nil {
+		return fmt.Errorf("%s already exists", filepath.Base(t.Original))
+	}
+	if err := os.MkdirAll(filepath.Dir(t.Original), 0755); err != nil {
+		return err
+	}
+	return moveEntry(t.Trashed, t.Original)
+}
+
+// Renames src to dst, copying and then removing it when they sit on different filesystems
+func moveEntry(src, dst string) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyEntry(src, dst); err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// Copies a file, symlink or whole directory tree, keeping permission bits
+func copyEntry(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, dst)
+	case info.IsDir():
+		if err := os.Mkdir(dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+		entries, err := os.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := copyEntry(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Deletes the selected entry, to the trash unless permanentDelete is set
+func (m *model) deleteSelected() error {
+	target := m.browser.files[m.browser.selected]
+	if m.preferences.PermanentDelete {
+		return deleteEntry(target)
+	}
+	trash, err := trashDir()
+	if err != nil {
+		return err
+	}
+	trashed, err := trashEntry(target, trash, time.Now())
+	if err != nil {
+		return err
+	}
+	m.browser.trashed = append(m.browser.trashed, trashed)
+	return nil
+}
+
+// Brings back the entry trashed last this session and selects it when it's in view
+func (m *model) restoreTrashed() error {
+	if len(m.browser.trashed) == 0 {
+		return fmt.Errorf("nothing to restore")
+	}
+	last := m.browser.trashed[len(m.browser.trashed)-1]
+	if err := restoreEntry(last); err != nil {
+		return err
+	}
+	m.browser.trashed = m.browser.trashed[:len(m.browser.trashed)-1]
+	m.browser.refresh(last.Original)
+	return nil
+}
+
+// Rescans the current directory and moves the cursor onto path, or keeps it near
+// the previous index when path is gone
+func (b *browserModel) refresh(path string) {
+	files, err := scanDirectory(b.currentPath, b.showHidden)
+	if err != nil {
+		b.errorMsg = err.Error()
+		return
+	}
+	b.setFiles(files)
+
+	for i, file := range b.files {
+		if file.Path == path {
+			b.selected = i
+			return
+		}
+	}
+	if b.selected >= len(b.files) {
+		b.selected = len(b.files) - 1
+	}
+	if b.selected < 0 {
+		b.selected = 0
+	}
+}
+
+// Replaces {{name}} placeholders. {{date}} is built in and resolves to today unless the
+// variables override it; unknown placeholders are left as they are
+func applyVariables(blocks []ContentBlock, vars map[string]string) []ContentBlock {
+	values := map[string]string{
+		"date": time.Now().Format("2006-01-02"),
+	}
+	for name, value := range vars {
+		values[name] = value
+	}
+
+	result := make([]ContentBlock, len(blocks))
+	for i, block := range blocks {
+		for name, value := range values {
+			block.Content = strings.ReplaceAll(block.Content, "{{"+name+"}}", value)
+		}
+		result[i] = block
+	}
+	return result
+}
+
+// Built in templates followed by the ones saved from documents
+func getDefaultTemplates() []Template {
+	return mergeTemplates(builtinTemplates(), loadUserTemplates())
+}
+
+// User templates come after the built-ins, which are always kept even when a name repeats
+func mergeTemplates(builtin, user []Template) []Template {
+	merged := append([]Template{}, builtin...)
+	return append(merged, user...)
+}
+
+func templatesDir() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, ".oathkeeper", "templates"), nil
+}
+
+// Templates saved with the save template key, sorted by file name. Files that don't parse are skipped
+func loadUserTemplates() []Template {
+	dir, err := templatesDir()
+	if err != nil {
+		return nil
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	var templates []Template
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var template Template
+		if err := json.Unmarshal(data, &template); err != nil || len(template.Content) == 0 {
 			continue
 		}
-		
-		if i < len(text)-3 && text[i:i+2] == "**" {
-			end := strings.Index(text[i+2:], "**")
-			if end != -1 && end > 0 { 
-				content := text[i+2 : i+2+end]
-				result.WriteString("\\textbf{" + content + "}")
-				i += 4 + end
-				continue
+		if template.Name == "" {
+			template.Name = strings.TrimSuffix(entry.Name(), ".json")
+		}
+		if template.Variables == nil {
+			template.Variables = make(map[string]string)
+		}
+		templates = append(templates, template)
+	}
+	return templates
+}
+
+// The document's structure as a template. Blanking keeps headings and block types but drops
+// the text of everything else. Comments are the author's own and never carried over
+func documentTemplate(name string, blocks []ContentBlock, variables map[string]string, blank bool) Template {
+	content := make([]ContentBlock, len(blocks))
+	for i, block := range blocks {
+		block.Comment = ""
+		block.Rendered = ""
+		if blank && block.Type != blockHeading {
+			block.Content = ""
+		}
+		content[i] = block
+	}
+
+	vars := make(map[string]string, len(variables))
+	for key, value := range variables {
+		vars[key] = value
+	}
+
+	description := fmt.Sprintf("Saved from a document, %d blocks", len(blocks))
+	if blank {
+		description = fmt.Sprintf("Outline saved from a document, %d blocks", len(blocks))
+	}
+	return Template{Name: name, Description: description, Content: content, Variables: vars}
+}
+
+func saveUserTemplate(template Template) (string, error) {
+	dir, err := templatesDir()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	slug := slugify(template.Name)
+	if slug == "" {
+		slug = "template"
+	}
+	data, err := json.MarshalIndent(template, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, slug+".json")
+	return path, ioutil.WriteFile(path, data, 0644)
+}
+
+func builtinTemplates() []Template {
+	return []Template{
+		{
+			Name:        "Blank Document",
+			Description: "Start with an empty document",
+			Content: []ContentBlock{
+				{ID: "1", Type: blockHeading, Content: "# Document Title"},
+				{ID: "2", Type: blockText, Content: "Start writing here"},
+			},
+			Variables: make(map[string]string),
+		},
+		{
+			Name:        "Academic Notes",
+			Description: "Template for mathematical notes and proofs",
+			Content: []ContentBlock{
+				{ID: "1", Type: blockHeading, Content: "# {{course}} Notes"},
+				{ID: "2", Type: blockHeading, Content: "## {{topic}}"},
+				{ID: "3", Type: blockText, Content: "{{date}}"},
+				{ID: "4", Type: blockText, Content: "Key concepts:"},
+				{ID: "5", Type: blockMath, Content: "$\\int_{a}^{b} f(x) dx = F(b) - F(a)$"},
+				{ID: "6", Type: blockText, Content: "Proof:"},
+			},
+			Variables: map[string]string{
+				"course": "Course",
+				"topic":  "Topic",
+			},
+		},
+		{
+			Name:        "Resume",
+			Description: "Professional resume template",
+			Content: []ContentBlock{
+				{ID: "1", Type: blockHeading, Content: "# {{name}}"},
+				{ID: "2", Type: blockText, Content: "{{email}} | {{phone}}"},
+				{ID: "3", Type: blockHeading, Content: "## Professional Summary"},
+				{ID: "4", Type: blockText, Content: "Brief professional summary"},
+				{ID: "5", Type: blockHeading, Content: "## Experience"},
+				{ID: "6", Type: blockText, Content: "**Job Title** - Company Name (Year - Year)"},
+			},
+			Variables: map[string]string{
+				"name":  "Your Name",
+				"email": "email@example.com",
+				"phone": "(555) 123-4567",
+			},
+		},
+		{
+			Name:        "Code Documentation",
+			Description: "Template for documenting code projects",
+			Content: []ContentBlock{
+				{ID: "1", Type: blockHeading, Content: "# Project Name"},
+				{ID: "2", Type: blockText, Content: "Brief project description"},
+				{ID: "3", Type: blockHeading, Content: "## Installation"},
+				{ID: "4", Type: blockCode, Content: "git clone repo\ncd project\nnpm install", Language: "bash"},
+				{ID: "5", Type: blockHeading, Content: "## Usage"},
+				{ID: "6", Type: blockCode, Content: "const example = require('./example');\nexample.run();", Language: "javascript"},
+			},
+			Variables: make(map[string]string),
+		},
+	}
+}
+
+func loadUserPreferences() *UserPreferences {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return getDefaultPreferences()
+	}
+
+	prefsPath := filepath.Join(homeDir, ".oathkeeper", "preferences.json")
+	data, err := ioutil.ReadFile(prefsPath)
+	if err != nil {
+		return getDefaultPreferences()
+	}
+
+	// Start from the defaults so fields missing from older files keep sane values
+	prefs := getDefaultPreferences()
+	if err := json.Unmarshal(data, prefs); err != nil {
+		return getDefaultPreferences()
+	}
+
+	return prefs
+}
+
+func getDefaultPreferences() *UserPreferences {
+	currentDir, _ := os.Getwd()
+	return &UserPreferences{
+		Theme:         "default",
+		LastDirectory: currentDir,
+		SplitRatio:    0.5,
+		SplitPresets:  []float64{0.3, 0.5, 0.7},
+		ViewMode:      int(viewSplitPane),
+		ShowHidden:    false,
+		VimMode:       false,
+
+		AutosaveInterval: 30,
+
+		PomodoroWork:       25,
+		PomodoroShortBreak: 5,
+		PomodoroLongBreak:  15,
+		PomodoroCycles:     4,
+
+		LaTeXEngine: "pdflatex",
+		LaTeXPasses: 2,
+		LaTeXClass:  "article",
+
+		LaTeXTimeout:        defaultLaTeXTimeout,
+		LargeDocumentBlocks: 1000,
+		MathImageFormat:     "svg",
+
+		CodeTabWidth:  4,
+		CacheCapacity: defaultCacheCapacity,
+
+		CodeBreakLines: true,
+
+		TimerNotify: "both",
+
+		EditorLineNumbers: true,
+		DefaultBlockType:  string(blockText),
+		AutoIndent:        true,
+	}
+}
+
+// Puts path at the front of a recent list, most recent first, deduplicated and capped at maxRecentFiles
+func pushRecent(recent []string, path string) []string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	pushed := []string{path}
+	for _, existing := range recent {
+		if existing != path && len(pushed) < maxRecentFiles {
+			pushed = append(pushed, existing)
+		}
+	}
+	return pushed
+}
+
+// Drops entries that no longer exist
+func pruneRecent(recent []string) []string {
+	var kept []string
+	for _, path := range recent {
+		if _, err := os.Stat(path); err == nil {
+			kept = append(kept, path)
+		}
+	}
+	return kept
+}
+
+func (p *UserPreferences) pushRecentFile(path string) {
+	p.RecentFiles = pushRecent(p.RecentFiles, path)
+}
+
+func (p *UserPreferences) pruneRecentFiles() {
+	p.RecentFiles = pruneRecent(p.RecentFiles)
+}
+
+func (p *UserPreferences) pushRecentDir(path string) {
+	p.RecentDirs = pushRecent(p.RecentDirs, path)
+}
+
+func recentFileInfos(paths []string) []FileInfo {
+	homeDir, _ := os.UserHomeDir()
+
+	var files []FileInfo
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+
+		name := path
+		if homeDir != "" && strings.HasPrefix(path, homeDir+string(filepath.Separator)) {
+			name = "~" + strings.TrimPrefix(path, homeDir)
+		}
+
+		files = append(files, FileInfo{
+			Name:    name,
+			Path:    path,
+			IsDir:   info.IsDir(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+	return files
+}
+
+func (m *model) showRecentFiles() {
+	m.preferences.pruneRecentFiles()
+	m.browser.showRecent = true
+	m.browser.recentDirs = false
+	m.browser.filter.SetValue("")
+	m.browser.setFiles(recentFileInfos(m.preferences.RecentFiles))
+	m.browser.selected = 0
+}
+
+func (m *model) showRecentDirs() {
+	m.preferences.RecentDirs = pruneRecent(m.preferences.RecentDirs)
+	m.browser.showRecent = true
+	m.browser.recentDirs = true
+	m.browser.filter.SetValue("")
+	m.browser.setFiles(recentFileInfos(m.preferences.RecentDirs))
+	m.browser.selected = 0
+}
+
+func (m *model) showDirectory() {
+	m.browser.showRecent = false
+	m.browser.recentDirs = false
+	m.browser.filter.SetValue("")
+	m.browser.refresh("")
+	m.browser.selected = 0
+}
+
+func (m *model) saveUserPreferences() error {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+
+	prefsDir := filepath.Join(homeDir, ".oathkeeper")
+	if err := os.MkdirAll(prefsDir, 0755); err != nil {
+		return err
+	}
+
+	m.preferences.Theme = m.theme.currentTheme
+	m.preferences.LastDirectory = m.browser.currentPath
+	m.preferences.SplitRatio = m.document.splitRatio
+	m.preferences.SplitRatios = m.document.savedSplitRatios()
+	m.preferences.ViewMode = int(m.document.viewMode)
+	m.preferences.ShowHidden = m.browser.showHidden
+	m.preferences.VimMode = m.document.vim.enabled
+
+	data, err := json.MarshalIndent(m.preferences, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	prefsPath := filepath.Join(prefsDir, "preferences.json")
+	return ioutil.WriteFile(prefsPath, data, 0644)
+}
+
+func initialModel() model {
+	prefs := loadUserPreferences()
+
+	ti := textinput.New()
+	ti.Placeholder = "e.g., 30m, 1h15m, 90s"
+	ti.CharLimit = 20
+	ti.Width = 30
+
+	ta := textarea.New()
+	ta.Placeholder = "Notes to stay on track"
+	ta.SetWidth(50)
+	ta.SetHeight(5)
+
+	docEditor := textarea.New()
+	docEditor.SetWidth(60)
+	docEditor.SetHeight(20)
+	docEditor.Placeholder = blockPlaceholder(blockText)
+	docEditor.Cursor.Style = lipgloss.NewStyle()
+	docEditor.Cursor.TextStyle = lipgloss.NewStyle()
+
+	menuInput := textinput.New()
+	menuInput.Placeholder = "document-name"
+	menuInput.CharLimit = 50
+	menuInput.Width = 30
+
+	renderer := newRenderModel(prefs.CacheCapacity)
+
+	splitRatios := loadSplitRatios(prefs.SplitRatios)
+	splitRatio := prefs.SplitRatio
+	if ratio, ok := splitRatios[viewMode(prefs.ViewMode)]; ok {
+		splitRatio = ratio
+	}
+
+	commandInput := textinput.New()
+	commandInput.Prompt = ""
+	commandInput.CharLimit = 50
+	commandInput.Width = 30
+
+	exportInput := textinput.New()
+	exportInput.Placeholder = "output-filename"
+	exportInput.CharLimit = 100
+	exportInput.Width = 40
+
+	browserFilter := textinput.New()
+	browserFilter.Placeholder = "filter"
+	browserFilter.CharLimit = 100
+	browserFilter.Width = 30
+
+	browserPrompt := textinput.New()
+	browserPrompt.CharLimit = 255
+	browserPrompt.Width = 40
+
+	files, _ := scanDirectory(prefs.LastDirectory, prefs.ShowHidden)
+
+	// Surface recent documents first when there are any, ~ flips back to the directory
+	prefs.pruneRecentFiles()
+	showRecent := len(prefs.RecentFiles) > 0
+	if showRecent {
+		files = recentFileInfos(prefs.RecentFiles)
+	}
+
+	for name, theme := range loadCustomThemes() {
+		themes[name] = theme
+	}
+
+	themeNames := make([]string, 0, len(themes))
+	for name := range themes {
+		themeNames = append(themeNames, name)
+	}
+	sort.Strings(themeNames)
+
+	selectedTheme := 0
+	for i, name := range themeNames {
+		if name == prefs.Theme {
+			selectedTheme = i
+		}
+	}
+
+	keys, keyWarnings := loadKeymap()
+	
+	return model{
+		mode:        modeBrowser,
+		input:       ti,
+		notes:       ta,
+		paused:      false,
+		preferences: prefs,
+		keys:        keys,
+		keyWarnings: keyWarnings,
+		browser: browserModel{
+			currentPath: prefs.LastDirectory,
+			files:       files,
+			allFiles:    files,
+			selected:    0,
+			showHidden:  prefs.ShowHidden,
+			filter:      browserFilter,
+			prompt:      browserPrompt,
+			showRecent:  showRecent,
+			recoveries:  findRecoveries(),
+		},
+		document: documentModel{
+			blocks:       []ContentBlock{},
+			editor:       docEditor,
+			viewMode:     viewMode(prefs.ViewMode),
+			splitRatio:   clampSplitRatio(splitRatio),
+			splitRatios:  splitRatios,
+			renderer:     renderer,
+			preview:      &previewCache{},
+			lsp:          newLSPModel(renderer.mathSymbols),
+			vim:          newVimState(),
+			needsRefresh: false,
+			command:      commandInput,
+		},
+		menu: menuModel{
+			templates: getDefaultTemplates(),
+			selected:  0,
+			input:     menuInput,
+		},
+		export: exportModel{
+			formats:  []string{"PDF", "LaTeX source", "HTML", "HTML (offline)", "Unicode Text", "Markdown", "EPUB", "reStructuredText", "AsciiDoc", "Org", "JSON", "All (PDF, HTML, Markdown, Unicode)"},
+			selected: 0,
+			input:    exportInput,
+		},
+		theme: themeModel{
+			currentTheme: prefs.Theme,
+			available:    themeNames,
+			selected:     selectedTheme,
+		},
+		clipboard: newClipboard(),
+		notifier:  newNotifier(prefs.TimerNotify),
+	}
+}
+
+func (m model) Init() tea.Cmd {
+	m.document.vim.enabled = m.preferences.VimMode
+	return tea.Batch(
+		textinput.Blink,
+		tea.EnterAltScreen,
+		m.autosaveTick(),
+		recoveryTick(),
+	)
+}
+
+// How often unsaved changes are copied to the recovery directory
+const recoveryInterval = 5 * time.Second
+
+func recoveryTick() tea.Cmd {
+	return tea.Tick(recoveryInterval, func(t time.Time) tea.Msg {
+		return recoveryMsg(t)
+	})
+}
+
+type recoveryFile struct {
+	Path     string
+	Source   string
+	Modified time.Time
+}
+
+func (r recoveryFile) name() string {
+	if r.Source == "" {
+		return "an untitled document"
+	}
+	return filepath.Base(r.Source)
+}
+
+func recoveryDir() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, ".oathkeeper", "recovery"), nil
+}
+
+// Backup location for a document, documents that were never saved share untitled.oath.bak
+func recoveryPath(docPath string) string {
+	dir, err := recoveryDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, recoveryName(docPath))
+}
+
+// Backups are named after the document with a hash of its absolute path in front, so
+// documents sharing a name in different directories don't overwrite each other's backup
+func recoveryName(docPath string) string {
+	if docPath == "" {
+		return "untitled.oath.bak"
+	}
+	if abs, err := filepath.Abs(docPath); err == nil {
+		docPath = abs
+	}
+	sum := sha256.Sum256([]byte(docPath))
+	return hex.EncodeToString(sum[:8]) + "-" + filepath.Base(docPath) + ".bak"
+}
+
+func removeRecovery(docPath string) {
+	if path := recoveryPath(docPath); path != "" {
+		os.Remove(path)
+	}
+}
+
+// A backup is only worth offering when it holds something the saved document doesn't
+func recoveryIsStale(backup, saved time.Time, savedExists bool) bool {
+	return !savedExists || backup.After(saved)
+}
+
+// Backups that are newer than their document. Outdated ones are cleaned up on the way
+func findRecoveries() []recoveryFile {
+	dir, err := recoveryDir()
+	if err != nil {
+		return nil
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	var recoveries []recoveryFile
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".oath.bak") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		doc, err := readDocument(path)
+		if err != nil {
+			continue
+		}
+
+		saved, err := os.Stat(doc.Source)
+		exists := doc.Source != "" && err == nil
+		var savedTime time.Time
+		if exists {
+			savedTime = saved.ModTime()
+		}
+		if !recoveryIsStale(entry.ModTime(), savedTime, exists) {
+			os.Remove(path)
+			continue
+		}
+		recoveries = append(recoveries, recoveryFile{Path: path, Source: doc.Source, Modified: entry.ModTime()})
+	}
+	return recoveries
+}
+
+// Snapshot key and file contents for the current document, written off the update loop
+func (m model) writeRecovery() (string, tea.Cmd) {
+	blocks, _ := json.Marshal(m.document.blocks)
+	key := string(blocks) + "\x00" + m.notes.Value()
+	if key == m.document.lastRecovery {
+		return key, nil
+	}
+
+	doc := OathDocument{
+		Version:   documentVersion,
+		Template:  "custom",
+		Content:   append([]ContentBlock(nil), m.document.blocks...),
+		Variables: m.document.variables,
+		Created:   m.document.created,
+		Modified:  time.Now(),
+		Notes:     m.notes.Value(),
+		Source:    m.document.filepath,
+	}
+	path := recoveryPath(m.document.filepath)
+	generation := m.document.recoveryGeneration
+	return key, func() tea.Msg {
+		if path == "" {
+			return nil
+		}
+		var buf bytes.Buffer
+		if err := SaveDocumentToWriter(&buf, doc); err != nil {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil
+		}
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			return nil
+		}
+		return recoveryWrittenMsg{path: path, generation: generation}
+	}
+}
+
+// Opens a backup as an unsaved edit of its document, saving writes back to the original path
+func (m model) restoreRecovery(recovery recoveryFile) (tea.Model, tea.Cmd) {
+	doc, err := readDocument(recovery.Path)
+	if err != nil {
+		m.browser.errorMsg = err.Error()
+		return m, nil
+	}
+
+	opened, cmd := m.openDocument(doc, recovery.Source)
+	m = opened.(model)
+	m.document.saved = nil
+	if saved, err := readDocument(recovery.Source); recovery.Source != "" && err == nil {
+		m.document.saved = saved.Content
+	}
+	m.document.modified = true
+	return m, cmd
+}
+
+func (m model) autosaveTick() tea.Cmd {
+	if m.preferences.AutosaveInterval <= 0 {
+		return nil
+	}
+	interval := time.Duration(m.preferences.AutosaveInterval) * time.Second
+	return tea.Tick(interval, func(t time.Time) tea.Msg {
+		return autosaveMsg(t)
+	})
+}
+
+// Refits the editor after every message, its gutter grows with the number of lines
+func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	next, cmd := m.update(msg)
+	if updated, ok := next.(model); ok {
+		updated.fitEditor()
+		return updated, cmd
+	}
+	return next, cmd
+}
+
+func (m model) update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	var cmds []tea.Cmd
+
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		m.keyWarnings = nil
+		if m.quitPrompt != quitNone {
+			return m.updateQuitPrompt(msg)
+		}
+		if m.palette.active {
+			return m.updatePalette(msg)
+		}
+		if m.symbols.active {
+			return m.updateSymbols(msg)
+		}
+		if m.search.active {
+			return m.updateSearch(msg)
+		}
+
+		switch m.mode {
+		case modeBrowser:
+			return m.updateBrowser(msg)
+		case modeMenu:
+			return m.updateMenu(msg)
+		case modeEdit:
+			return m.updateEdit(msg)
+		case modeTimer:
+			return m.updateTimer(msg)
+		case modeExport:
+			return m.updateExport(msg)
+		}
+
+	case tickMsg:
+		if m.mode == modeTimer && !m.paused && m.ticker != nil {
+			m.remaining -= time.Second
+			if m.remaining <= 0 {
+				cmds = append(cmds, m.notifyTimerDone())
+			}
+			if m.remaining <= 0 && m.pomodoro.enabled {
+				m.pomodoro = m.pomodoro.next(m.preferences.PomodoroCycles)
+				cmds = append(cmds, m.startPhase())
+			} else if m.remaining <= 0 {
+				m.ticker.Stop()
+				m.ticker = nil
+				m.remaining = 0
+			} else {
+				cmds = append(cmds, waitForTick(m.ticker.C))
+			}
+		}
+
+	case notifyResultMsg:
+		m.notifyError = ""
+		if msg.err != nil {
+			m.notifyError = fmt.Sprintf("Notification failed: %v", msg.err)
+		}
+
+	case autosaveMsg:
+		// Autosave never prompts, documents without a path are left for an explicit save
+		if m.mode == modeEdit && m.document.modified && m.document.filepath != "" {
+			cmds = append(cmds, m.saveDocument())
+		}
+		cmds = append(cmds, m.autosaveTick())
+
+	case batchExportMsg:
+		m.export.running = false
+		m.export.results = msg.results
+		m.document.notice = batchSummary(msg.results)
+
+	case exportResultMsg:
+		m.export.running = false
+		m.mode = modeEdit
+		if msg.err != nil {
+			m.document.exportError = fmt.Sprintf("%s export failed: %v", msg.format, msg.err)
+			m.document.notice = ""
+		} else {
+			m.document.notice = fmt.Sprintf("Exported %s to %s", msg.format, msg.path)
+		}
+
+	case recoveryMsg:
+		if m.mode == modeEdit && m.document.modified {
+			key, cmd := m.writeRecovery()
+			m.document.lastRecovery = key
+			cmds = append(cmds, cmd)
+		}
+		cmds = append(cmds, recoveryTick())
+
+	case recoveryWrittenMsg:
+		// A save went through while this was being written, so it backs up nothing
+		if msg.generation != m.document.recoveryGeneration {
+			os.Remove(msg.path)
+			m.document.lastRecovery = ""
+		}
+
+	case documentSavedMsg:
+		if msg.err != nil {
+			m.document.saveError = msg.err.Error()
+			m.pendingQuit = quitNone
+			break
+		}
+		removeRecovery(m.document.filepath)
+		removeRecovery(msg.path)
+		m.document.lastRecovery = ""
+		m.document.recoveryGeneration++
+		m.document.filepath = msg.path
+		m.document.saved = msg.blocks
+		m.document.created = msg.created
+		m.document.savedAt = msg.modified
+		m.preferences.pushRecentFile(msg.path)
+		// Edits made while the write was in flight aren't in the file yet
+		m.document.modified = !slices.Equal(msg.blocks, m.document.blocks) || msg.notes != m.notes.Value()
+		m.document.saveError = ""
+		m.document.showSaved = true
+		cmds = append(cmds, tea.Tick(2*time.Second, func(time.Time) tea.Msg {
+			return clearSavedMsg{}
+		}))
+
+		if m.pendingQuit != quitNone {
+			action := m.pendingQuit
+			m.pendingQuit = quitNone
+			return m.performQuit(action)
+		}
+
+	case clearSavedMsg:
+		m.document.showSaved = false
+
+	case externalEditorMsg:
+		if msg.err != nil {
+			m.document.commandError = msg.err.Error()
+			break
+		}
+
+		content, err := readBlockFile(msg.path)
+		if err != nil {
+			m.document.commandError = err.Error()
+			break
+		}
+
+		for i := range m.document.blocks {
+			if m.document.blocks[i].ID != msg.blockID {
+				continue
+			}
+			if m.document.blocks[i].Content != content {
+				m.document.blocks[i].Content = content
+				m.document.modified = true
+				m.document.needsRefresh = true
+			}
+			if i == m.document.currentBlock {
+				m.document.editor.SetValue(content)
+			}
+			break
+		}
+
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+		m.document.editor.SetHeight(msg.Height - 8)
+	}
+
+	return m, tea.Batch(cmds...)
+}
+
+func (m model) updateBrowser(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	if m.browser.pendingOp != browserOpNone {
+		return m.updateBrowserPrompt(msg)
+	}
+
+	if m.browser.filtering {
+		switch msg.String() {
+		case "esc":
+			m.browser.clearFilter()
+			return m, nil
+		case "enter":
+			m.browser.filter.Blur()
+			m.browser.filtering = false
+			return m, nil
+		case "up":
+			if m.browser.selected > 0 {
+				m.browser.selected--
+			}
+			return m, nil
+		case "down":
+			if m.browser.selected < len(m.browser.files)-1 {
+				m.browser.selected++
+			}
+			return m, nil
+		case "ctrl+c":
+			m.saveUserPreferences()
+			return m, tea.Quit
+		}
+
+		var cmd tea.Cmd
+		m.browser.filter, cmd = m.browser.filter.Update(msg)
+		m.browser.applyFilter()
+		return m, cmd
+	}
+
+	if len(m.browser.recoveries) > 0 {
+		recovery := m.browser.recoveries[0]
+		switch msg.String() {
+		case "r":
+			m.browser.recoveries = m.browser.recoveries[1:]
+			return m.restoreRecovery(recovery)
+		case "x":
+			os.Remove(recovery.Path)
+			m.browser.recoveries = m.browser.recoveries[1:]
+			return m, nil
+		}
+	}
+
+	if m.browser.showRecent {
+		switch msg.String() {
+		// Each key leaves its own list, from the other one it switches lists
+		case "~":
+			if !m.browser.recentDirs {
+				m.showDirectory()
+				return m, nil
+			}
+		case "g":
+			if m.browser.recentDirs {
+				m.showDirectory()
+				return m, nil
+			}
+		case "esc":
+			if m.browser.filter.Value() == "" {
+				m.showDirectory()
+				return m, nil
+			}
+		case "h", "a", "R", "D", "u":
+			return m, nil
+		}
+	}
+
+	switch msg.String() {
+	case "~":
+		m.showRecentFiles()
+	case "g":
+		m.showRecentDirs()
+	case "/":
+		m.browser.filtering = true
+		m.browser.filter.Focus()
+		return m, textinput.Blink
+	case "esc":
+		if m.browser.filter.Value() != "" {
+			m.browser.clearFilter()
+		}
+	case "q", "ctrl+c":
+		m.saveUserPreferences()
+		return m, tea.Quit
+	case "j", "down":
+		if m.browser.selected < len(m.browser.files)-1 {
+			m.browser.selected++
+		}
+	case "k", "up":
+		if m.browser.selected > 0 {
+			m.browser.selected--
+		}
+	case "h":
+		m.browser.showHidden = !m.browser.showHidden
+		files, err := scanDirectory(m.browser.currentPath, m.browser.showHidden)
+		if err != nil {
+			m.browser.errorMsg = err.Error()
+		} else {
+			m.browser.setFiles(files)
+		}
+	case "enter":
+		if len(m.browser.files) > m.browser.selected {
+			selectedFile := m.browser.files[m.browser.selected]
+			if selectedFile.Err != nil {
+				m.browser.errorMsg = fmt.Sprintf("Cannot open %s: %s", selectedFile.Name, accessError(selectedFile.Path, selectedFile.Err))
+			} else if selectedFile.IsDir {
+				files, err := scanDirectory(selectedFile.Path, m.browser.showHidden)
+				if err != nil {
+					m.browser.errorMsg = err.Error()
+				} else {
+					m.browser.currentPath = selectedFile.Path
+					m.browser.showRecent = false
+					m.browser.recentDirs = false
+					m.browser.filter.SetValue("")
+					m.browser.setFiles(files)
+					m.browser.selected = 0
+					m.browser.errorMsg = ""
+					m.preferences.pushRecentDir(selectedFile.Path)
+				}
+			} else if strings.HasSuffix(selectedFile.Name, ".oath") {
+				return m.loadDocument(selectedFile.Path)
+			}
+		}
+	case " ":
+		m.mode = modeMenu
+	case "a":
+		m.browser.pendingOp = browserOpCreate
+		m.browser.prompt.SetValue("")
+		m.browser.prompt.Placeholder = "name (end with / for a directory)"
+		m.browser.prompt.Focus()
+		return m, textinput.Blink
+	case "R":
+		if len(m.browser.files) > m.browser.selected && m.browser.files[m.browser.selected].Name != ".." {
+			m.browser.pendingOp = browserOpRename
+			m.browser.prompt.SetValue(m.browser.files[m.browser.selected].Name)
+			m.browser.prompt.CursorEnd()
+			m.browser.prompt.Focus()
+			return m, textinput.Blink
+		}
+	case "D":
+		if len(m.browser.files) > m.browser.selected && m.browser.files[m.browser.selected].Name != ".." {
+			m.browser.pendingOp = browserOpDelete
+		}
+	case "u":
+		if err := m.restoreTrashed(); err != nil {
+			m.browser.errorMsg = err.Error()
+		} else {
+			m.browser.errorMsg = ""
+		}
+	}
+	return m, nil
+}
+
+func (m model) updateBrowserPrompt(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	if msg.String() == "ctrl+c" {
+		m.saveUserPreferences()
+		return m, tea.Quit
+	}
+
+	if msg.Type == tea.KeyEsc {
+		m.browser.pendingOp = browserOpNone
+		m.browser.prompt.Blur()
+		return m, nil
+	}
+
+	if m.browser.pendingOp == browserOpDelete {
+		switch msg.String() {
+		case "y", "Y":
+			if err := m.deleteSelected(); err != nil {
+				m.browser.errorMsg = err.Error()
+			} else {
+				m.browser.errorMsg = ""
+				m.browser.refresh("")
+			}
+			m.browser.pendingOp = browserOpNone
+		case "n", "N":
+			m.browser.pendingOp = browserOpNone
+		}
+		return m, nil
+	}
+
+	if msg.Type == tea.KeyEnter {
+		value := m.browser.prompt.Value()
+		var path string
+		var err error
+
+		switch m.browser.pendingOp {
+		case browserOpCreate:
+			path, err = createEntry(m.browser.currentPath, value)
+		case browserOpRename:
+			path, err = renameEntry(m.browser.files[m.browser.selected].Path, value)
+		}
+
+		if err != nil {
+			m.browser.errorMsg = err.Error()
+		} else {
+			m.browser.errorMsg = ""
+			m.browser.refresh(path)
+		}
+		m.browser.pendingOp = browserOpNone
+		m.browser.prompt.Blur()
+		return m, nil
+	}
+
+	var cmd tea.Cmd
+	m.browser.prompt, cmd = m.browser.prompt.Update(msg)
+	return m, cmd
+}
+
+// Decodes an .oath document and brings it up to the current version
+func LoadDocumentFromReader(r io.Reader) (OathDocument, error) {
+	var doc OathDocument
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return doc, fmt.Errorf("invalid document: %v", err)
+	}
+	if err := migrateDocument(&doc); err != nil {
+		return doc, err
+	}
+	return doc, nil
+}
+
+// Encodes a document the way .oath files are written, indented JSON
+func SaveDocumentToWriter(w io.Writer, doc OathDocument) error {
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func readDocument(path string) (OathDocument, error) {
+	file, err := os.Open(path)
+	if os.IsPermission(err) {
+		return OathDocument{}, fmt.Errorf("Permission denied: cannot read %s", path)
+	}
+	if err != nil {
+		return OathDocument{}, fmt.Errorf("Error loading file: %v", err)
+	}
+	defer file.Close()
+
+	doc, err := LoadDocumentFromReader(file)
+	if err != nil {
+		return doc, fmt.Errorf("Error loading file: %v", err)
+	}
+	return doc, nil
+}
+
+func (m model) loadDocument(filepath string) (tea.Model, tea.Cmd) {
+	doc, err := readDocument(filepath)
+	if err != nil {
+		m.browser.errorMsg = err.Error()
+		return m, nil
+	}
+
+	m.preferences.pushRecentFile(filepath)
+	return m.openDocument(doc, filepath)
+}
+
+func (m model) openDocument(doc OathDocument, filepath string) (tea.Model, tea.Cmd) {
+	blocks, nextID, changed := uniqueBlockIDs(doc.Content)
+	m.document.blocks = blocks
+	m.document.saved = append([]ContentBlock(nil), blocks...)
+	m.document.nextID = nextID
+	m.document.variables = doc.Variables
+	m.notes.SetValue(doc.Notes)
+	m.document.filepath = filepath
+	m.document.created = doc.Created
+	m.document.savedAt = doc.Modified
+	m.document.lastRecovery = ""
+	m.document.modified = changed
+	m.document.currentBlock = 0
+	m.document.previewOffset = 0
+	m.document.collapsed = nil
+	m.document.needsRefresh = true
+
+	if len(m.document.blocks) > 0 {
+		m.document.editor.SetValue(m.document.blocks[0].Content)
+	}
+
+	m.mode = modeEdit
+	return m, textarea.Blink
+}
+
+// Splits Markdown into blocks at blank lines, keeping fenced code and $$ math whole even
+// across blank lines. Each block is typed the way a pasted one is detected
+func markdownToBlocks(source string) []ContentBlock {
+	var blocks []ContentBlock
+	var chunk []string
+	fence := ""
+
+	flush := func() {
+		text := strings.Trim(strings.Join(chunk, "\n"), "\n")
+		chunk = nil
+		if strings.TrimSpace(text) == "" {
+			return
+		}
+		block := ContentBlock{Type: blockText, Content: text}
+		if detected := detectBlockType(text); detected != blockText {
+			block = convertDetectedBlock(block, detected)
+		}
+		blocks = append(blocks, block)
+	}
+
+	for _, line := range strings.Split(strings.ReplaceAll(source, "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if fence != "" {
+			chunk = append(chunk, line)
+			if (fence == "```" && trimmed == "```") || (fence == "$$" && strings.HasSuffix(trimmed, "$$")) {
+				fence = ""
+				flush()
+			}
+			continue
+		}
+
+		switch {
+		case trimmed == "":
+			flush()
+		case strings.HasPrefix(trimmed, "```"):
+			flush()
+			chunk = []string{line}
+			fence = "```"
+		case strings.HasPrefix(trimmed, "$$"):
+			flush()
+			chunk = []string{line}
+			if len(trimmed) > 2 && strings.HasSuffix(trimmed, "$$") {
+				flush()
+			} else {
+				fence = "$$"
+			}
+		case detectBlockType(trimmed) == blockHeading:
+			// Headings stand alone even when text follows without a blank line
+			flush()
+			chunk = []string{line}
+			flush()
+		default:
+			chunk = append(chunk, line)
+		}
+	}
+	flush()
+
+	blocks, _ = renumberBlocks(blocks)
+	return blocks
+}
+
+func readMarkdownDocument(path string) (OathDocument, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return OathDocument{}, fmt.Errorf("Error loading file: %v", err)
+	}
+	return OathDocument{
+		Version:   documentVersion,
+		Content:   markdownToBlocks(string(data)),
+		Variables: make(map[string]string),
+	}, nil
+}
+
+// The model oathkeeper starts with for a path given on the command line. An empty path is
+// the usual browser, a directory opens the browser there, an .oath document opens in the
+// editor and Markdown is imported as a new unsaved document next to the file
+func modelForPath(path string) (model, error) {
+	m := initialModel()
+	if path == "" {
+		return m, nil
+	}
+
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return m, fmt.Errorf("%s does not exist", path)
+	}
+	if err != nil {
+		return m, fmt.Errorf("%s", accessError(path, err))
+	}
+
+	if info.IsDir() {
+		files, err := scanDirectory(path, m.browser.showHidden)
+		if err != nil {
+			return m, err
+		}
+		m.browser.currentPath = path
+		m.browser.showRecent = false
+		m.browser.setFiles(files)
+		m.preferences.pushRecentDir(path)
+		return m, nil
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".oath":
+		doc, err := readDocument(path)
+		if err != nil {
+			return m, err
+		}
+		m.preferences.pushRecentFile(path)
+		opened, _ := m.openDocument(doc, path)
+		return opened.(model), nil
+	case ".md", ".markdown":
+		doc, err := readMarkdownDocument(path)
+		if err != nil {
+			return m, err
+		}
+		// Saving writes an .oath document beside the Markdown rather than over it
+		m.browser.currentPath = filepath.Dir(path)
+		opened, _ := m.openDocument(doc, "")
+		imported := opened.(model)
+		imported.document.modified = true
+		imported.document.notice = fmt.Sprintf("Imported %s, save to keep it as an .oath document", filepath.Base(path))
+		return imported, nil
+	}
+	return m, fmt.Errorf("cannot open %s: only .oath and Markdown files are supported", path)
+}
+
+// Upgrades a document read from disk to documentVersion. Files from before versioning
+// have no version at all and are treated as 0.9
+func migrateDocument(doc *OathDocument) error {
+	version := doc.Version
+	if version == "" {
+		version = "0.9"
+	}
+
+	current, _ := parseDocumentVersion(documentVersion)
+	v, err := parseDocumentVersion(version)
+	if err != nil {
+		return err
+	}
+	if compareVersions(v, current) > 0 {
+		return fmt.Errorf("document format %s is newer than this version of oathkeeper supports (%s), please upgrade", version, documentVersion)
+	}
+
+	if compareVersions(v, [2]int{1, 0}) < 0 {
+		for i := range doc.Content {
+			if doc.Content[i].Type == "" {
+				doc.Content[i].Type = blockText
+			}
+		}
+		if doc.Variables == nil {
+			doc.Variables = make(map[string]string)
+		}
+	}
+
+	if compareVersions(v, [2]int{1, 1}) < 0 {
+		doc.Content, _, _ = uniqueBlockIDs(doc.Content)
+	}
+
+	doc.Version = documentVersion
+	return nil
+}
+
+func parseDocumentVersion(version string) ([2]int, error) {
+	var v [2]int
+	parts := strings.Split(version, ".")
+	if len(parts) != 2 {
+		return v, fmt.Errorf("unrecognized document version %q", version)
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, fmt.Errorf("unrecognized document version %q", version)
+		}
+		v[i] = n
+	}
+	return v, nil
+}
+
+func compareVersions(a, b [2]int) int {
+	for i := range a {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func (m model) updateMenu(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	if m.menu.input.Focused() {
+		return m.updateMenuVariables(msg)
+	}
+
+	switch msg.String() {
+	case "q":
+		m.mode = modeBrowser
+	case "ctrl+c":
+		m.saveUserPreferences()
+		return m, tea.Quit
+	case "j", "down":
+		if m.menu.selected < len(m.menu.templates)-1 {
+			m.menu.selected++
+		}
+	case "k", "up":
+		if m.menu.selected > 0 {
+			m.menu.selected--
+		}
+	case "enter":
+		template := m.menu.templates[m.menu.selected]
+		if len(template.Variables) == 0 {
+			return m.openTemplate(template, map[string]string{})
+		}
+
+		m.menu.pendingVars = make([]string, 0, len(template.Variables))
+		for name := range template.Variables {
+			m.menu.pendingVars = append(m.menu.pendingVars, name)
+		}
+		sort.Strings(m.menu.pendingVars)
+		m.menu.varIndex = 0
+		m.menu.resolved = make(map[string]string)
+		m.menu.input.SetValue("")
+		m.menu.input.Placeholder = template.Variables[m.menu.pendingVars[0]]
+		m.menu.input.Focus()
+		return m, textinput.Blink
+	case "t":
+		m.mode = modeTimer
+		m.input.Focus()
+		return m, textinput.Blink
+	case "v":
+		m.document.vim.enabled = !m.document.vim.enabled
+		if m.document.vim.enabled {
+			m.document.vim.mode = vimNormal
+		}
+	}
+	return m, nil
+}
+
+// Empty answers keep the template's default value
+func (m model) updateMenuVariables(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	template := m.menu.templates[m.menu.selected]
+
+	switch msg.Type {
+	case tea.KeyCtrlC:
+		m.saveUserPreferences()
+		return m, tea.Quit
+	case tea.KeyEsc:
+		m.menu.input.Blur()
+		m.menu.pendingVars = nil
+		return m, nil
+	case tea.KeyEnter:
+		name := m.menu.pendingVars[m.menu.varIndex]
+		value := strings.TrimSpace(m.menu.input.Value())
+		if value == "" {
+			value = template.Variables[name]
+		}
+		m.menu.resolved[name] = value
+
+		m.menu.varIndex++
+		if m.menu.varIndex >= len(m.menu.pendingVars) {
+			m.menu.input.Blur()
+			m.menu.pendingVars = nil
+			return m.openTemplate(template, m.menu.resolved)
+		}
+
+		m.menu.input.SetValue("")
+		m.menu.input.Placeholder = template.Variables[m.menu.pendingVars[m.menu.varIndex]]
+		return m, nil
+	}
+
+	var cmd tea.Cmd
+	m.menu.input, cmd = m.menu.input.Update(msg)
+	return m, cmd
+}
+
+func (m model) openTemplate(template Template, vars map[string]string) (tea.Model, tea.Cmd) {
+	m.document.blocks, m.document.nextID = renumberBlocks(applyVariables(template.Content, vars))
+	m.document.variables = vars
+	m.notes.Reset()
+	m.document.saved = nil
+	m.document.collapsed = nil
+	m.document.pinnedID = ""
+	m.document.currentBlock = 0
+	m.document.filepath = ""
+	m.document.created = time.Time{}
+	m.document.savedAt = time.Time{}
+	m.document.modified = true
+	m.document.needsRefresh = true
+
+	if len(m.document.blocks) > 0 {
+		m.document.editor.SetValue(m.document.blocks[0].Content)
+	}
+	m.mode = modeEdit
+	return m, textarea.Blink
+}
+
+func (m model) updateEdit(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	if m.document.linePrompt {
+		return m.updateLinePrompt(msg)
+	}
+
+	if m.document.lsp.showCompletions {
+		switch msg.String() {
+		case "j", "down":
+			if m.document.lsp.activeCompletion < len(m.document.lsp.completions)-1 {
+				m.document.lsp.activeCompletion++
+			}
+			return m, nil
+		case "k", "up":
+			if m.document.lsp.activeCompletion > 0 {
+				m.document.lsp.activeCompletion--
+			}
+			return m, nil
+		case "enter", "tab":
+			if len(m.document.lsp.completions) > m.document.lsp.activeCompletion {
+				completion := m.document.lsp.completions[m.document.lsp.activeCompletion]
+				currentContent := m.document.editor.Value()
+
+				start := m.document.lsp.triggerStart
+				end := start + len(m.document.lsp.triggerPrefix)
+				if start >= 0 && end <= len(currentContent) && currentContent[start:end] == m.document.lsp.triggerPrefix {
+					newContent := currentContent[:start] + completion.InsertText + currentContent[end:]
+					m.document.editor.SetValue(newContent)
+
+					cursor := start + len(completion.InsertText)
+					if completion.Cursor > 0 {
+						cursor = start + completion.Cursor
+					}
+					setEditorCursor(&m.document.editor, cursor)
+				}
+
+				m.document.lsp.showCompletions = false
+				m.document.lsp.completions = []Completion{}
+			}
+			return m, nil
+		case "esc":
+			m.document.lsp.showCompletions = false
+			m.document.lsp.completions = []Completion{}
+			return m, nil
+		}
+	}
+
+	if m.document.editor.Focused() {
+		m.document.commandError = ""
+		// With Vim on, esc in insert mode only drops to normal mode, a second one leaves the block
+		if m.document.vim.enabled && m.document.vim.mode == vimInsert && msg.Type == tea.KeyEsc {
+			m.document.vim.mode = vimNormal
+			return m, nil
+		}
+		if m.document.vim.enabled && m.document.vim.mode == vimNormal && isVimNormalKey(msg) {
+			return m.updateVimNormal(msg)
+		}
+		if msg.Type == tea.KeyEsc && !m.document.lsp.showCompletions {
+			if len(m.document.blocks) > m.document.currentBlock {
+				m.document.blocks[m.document.currentBlock].Content = m.document.editor.Value()
+				m.document.modified = true
+				m.document.needsRefresh = true
+
+				// Only plain text blocks are converted, an explicitly typed block is left alone
+				block := m.document.blocks[m.document.currentBlock]
+				if m.preferences.AutoDetectBlocks && block.Type == blockText {
+					if detected := detectBlockType(block.Content); detected != blockText {
+						block = convertDetectedBlock(block, detected)
+						m.document.blocks[m.document.currentBlock] = block
+						m.document.editor.SetValue(block.Content)
+					}
+				}
+
+				m.document.lsp.setMacros(m.document.blocks)
+				content := m.document.editor.Value()
+				rendered := m.document.renderer.renderLaTeX(content)
+				// Copied, the rendered errors belong to the cache
+				diagnostics := append([]Diagnostic(nil), rendered.Errors...)
+				if block.Type == blockText {
+					notes := collectFootnotes(m.document.blocks)
+					diagnostics = append(diagnostics, footnoteDiagnostics(content, notes)...)
+				}
+				for i := range diagnostics {
+					diagnostics[i].BlockID = block.ID
+				}
+				m.document.lsp.diagnostics = diagnostics
+				m.document.lsp.activeDiagnostic = -1
+			}
+			m.document.editor.Blur()
+			if m.document.vim.enabled {
+				m.document.vim.mode = vimNormal
+			}
+			return m, nil
+		}
+
+		if msg.String() == "ctrl+r" {
+			m.document.showMathPreview = !m.document.showMathPreview
+			return m, nil
+		}
+
+		if msg.String() == "ctrl+]" && len(m.document.blocks) > m.document.currentBlock {
+			return m.gotoMacroDefinition()
+		}
+
+		if msg.String() == "ctrl+g" {
+			m.document.linePrompt = true
+			m.document.lsp.showCompletions = false
+			m.document.command.SetValue("")
+			m.document.command.Focus()
+			return m, textinput.Blink
+		}
+
+		if msg.String() == "ctrl+y" && len(m.document.blocks) > m.document.currentBlock &&
+			m.document.blocks[m.document.currentBlock].Type == blockList {
+			content, cursor, ok := toggleChecklistItem(m.document.editor.Value(), editorCursorIndex(m.document.editor))
+			if ok {
+				m.document.editor.SetValue(content)
+				setEditorCursor(&m.document.editor, cursor)
+			}
+			return m, nil
+		}
+
+		if msg.Type == tea.KeyEnter && m.preferences.AutoIndent && len(m.document.blocks) > m.document.currentBlock {
+			if content, cursor, ok := autoIndent(m.document.editor.Value(), editorCursorIndex(m.document.editor), m.document.blocks[m.document.currentBlock].Type); ok {
+				m.document.editor.SetValue(content)
+				setEditorCursor(&m.document.editor, cursor)
+				return m, nil
+			}
+		}
+
+		if msg.String() == "ctrl+s" {
+			m.symbols.open(m.document.renderer.mathSymbols)
+			m.document.lsp.showCompletions = false
+			return m, textinput.Blink
+		}
+
+		if msg.String() == "ctrl+x" && len(m.document.blocks) > m.document.currentBlock {
+			block := m.document.blocks[m.document.currentBlock]
+			block.Content = m.document.editor.Value()
+			first, second := splitBlock(block, editorCursorIndex(m.document.editor))
+			second.ID = m.document.newBlockID()
+
+			blocks := append([]ContentBlock{}, m.document.blocks[:m.document.currentBlock]...)
+			blocks = append(blocks, first, second)
+			m.document.blocks = append(blocks, m.document.blocks[m.document.currentBlock+1:]...)
+			m.document.currentBlock++
+			m.document.editor.SetValue(second.Content)
+			setEditorCursor(&m.document.editor, 0)
+			m.document.modified = true
+			m.document.needsRefresh = true
+			m.document.lsp.showCompletions = false
+			m.revealCurrentBlock()
+			return m, nil
+		}
+
+		var cmd tea.Cmd
+		m.document.editor, cmd = m.document.editor.Update(msg)
+
+		content := m.document.editor.Value()
+		cursor := editorCursorIndex(m.document.editor)
+		completions := m.document.lsp.getCompletions(content, cursor)
+		if len(completions) > 0 {
+			m.document.lsp.completions = completions
+			m.document.lsp.showCompletions = true
+			m.document.lsp.activeCompletion = 0
+			m.document.lsp.triggerPrefix, m.document.lsp.triggerStart = completionPrefix(content, cursor)
+		} else {
+			m.document.lsp.showCompletions = false
+		}
+
+		return m, cmd
+	}
+
+	if m.document.imagePrompt {
+		return m.updateImagePrompt(msg)
+	}
+	if m.document.saveAsPrompt || m.document.overwritePath != "" {
+		return m.updateSaveAsPrompt(msg)
+	}
+	if m.document.templatePrompt || m.document.templateName != "" {
+		return m.updateTemplatePrompt(msg)
+	}
+	if m.document.commentPrompt {
+		return m.updateCommentPrompt(msg)
+	}
+	if m.document.languagePrompt {
+		return m.updateLanguagePrompt(msg)
+	}
+	if m.document.tidyPrompt {
+		return m.updateTidyPrompt(msg)
+	}
+	if m.document.showComments {
+		return m.updateComments(msg)
+	}
+	if m.document.exportError != "" {
+		switch msg.String() {
+		case "esc", "enter", "q":
+			m.document.exportError = ""
+		case "ctrl+c":
+			return m.requestQuit(quitApp)
+		}
+		return m, nil
+	}
+	if m.document.showDiff {
+		return m.updateDiff(msg)
+	}
+	if m.document.showOutline {
+		return m.updateOutline(msg)
+	}
+	if m.document.selecting {
+		return m.updateSelection(msg)
+	}
+	if m.document.showNotes {
+		return m.updateNotes(msg)
+	}
+	if m.document.vim.enabled && m.document.vim.mode == vimCommand {
+		return m.updateExCommand(msg)
+	}
+	m.document.commandError = ""
+	m.document.notice = ""
+
+	switch msg.String() {
+	case "ctrl+p":
+		m.palette.open(m.editPaletteEntries())
+		return m, textinput.Blink
+	case ":":
+		if m.document.vim.enabled {
+			m.document.vim.mode = vimCommand
+			m.document.command.SetValue("")
+			m.document.command.Focus()
+			return m, textinput.Blink
+		}
+	case m.keys.Quit:
+		return m.requestQuit(quitToMenu)
+	case "ctrl+c":
+		return m.requestQuit(quitApp)
+	case m.keys.NextBlock, "down":
+		if m.document.currentBlock < len(m.document.blocks)-1 {
+			m.document.currentBlock++
+			m.document.editor.SetValue(m.document.blocks[m.document.currentBlock].Content)
+			m.revealCurrentBlock()
+		}
+	case m.keys.PrevBlock, "up":
+		if m.document.currentBlock > 0 {
+			m.document.currentBlock--
+			m.document.editor.SetValue(m.document.blocks[m.document.currentBlock].Content)
+			m.revealCurrentBlock()
+		}
+	case m.keys.ScrollDown:
+		m.scrollPreview(m.previewViewport(m.previewWidth(), m.documentHeight()) / 2)
+	case m.keys.ScrollUp:
+		m.scrollPreview(-m.previewViewport(m.previewWidth(), m.documentHeight()) / 2)
+	case "pgdown":
+		m.scrollPreview(m.previewViewport(m.previewWidth(), m.documentHeight()))
+	case "pgup":
+		m.scrollPreview(-m.previewViewport(m.previewWidth(), m.documentHeight()))
+	case m.keys.PreviewWrap:
+		m.document.previewNoWrap = !m.document.previewNoWrap
+		m.document.previewColumn = 0
+		m.document.previewOffset = 0
+		m.revealCurrentBlock()
+	case "left":
+		if m.document.previewNoWrap {
+			m.scrollPreviewColumn(-previewColumnStep)
+		}
+	case "right":
+		if m.document.previewNoWrap {
+			m.scrollPreviewColumn(previewColumnStep)
+		}
+	case "enter":
+		if len(m.document.blocks) > m.document.currentBlock {
+			m.document.lsp.setMacros(m.document.blocks)
+			m.document.editor.Placeholder = blockPlaceholder(m.document.blocks[m.document.currentBlock].Type)
+			m.document.editor.Focus()
+			if m.document.vim.enabled {
+				m.document.vim.mode = vimNormal
+			}
+			return m, textarea.Blink
+		}
+	case m.keys.NewBlock:
+		return m.appendBlock(newBlockType(m.preferences.DefaultBlockType))
+	case m.keys.SameTypeBlock:
+		t := newBlockType(m.preferences.DefaultBlockType)
+		if len(m.document.blocks) > m.document.currentBlock {
+			if current := m.document.blocks[m.document.currentBlock].Type; current != blockImage && current != blockHR {
+				t = current
+			}
+		}
+		return m.appendBlock(t)
+	case m.keys.DuplicateBlock:
+		if len(m.document.blocks) > m.document.currentBlock {
+			duplicate := m.document.blocks[m.document.currentBlock]
+			duplicate.ID = m.document.newBlockID()
+
+			blocks := append([]ContentBlock{}, m.document.blocks[:m.document.currentBlock+1]...)
+			blocks = append(blocks, duplicate)
+			m.document.blocks = append(blocks, m.document.blocks[m.document.currentBlock+1:]...)
+			m.document.currentBlock++
+			m.document.editor.SetValue(duplicate.Content)
+			m.document.modified = true
+			m.document.needsRefresh = true
+			m.revealCurrentBlock()
+		}
+	case m.keys.MathBlock:
+		if len(m.document.blocks) > m.document.currentBlock {
+			m.document.blocks[m.document.currentBlock].Type = blockMath
+			m.document.modified = true
+			m.document.needsRefresh = true
+		}
+	case m.keys.CodeBlock:
+		if len(m.document.blocks) > m.document.currentBlock {
+			m.document.blocks[m.document.currentBlock].Type = blockCode
+			m.document.modified = true
+			m.document.needsRefresh = true
+		}
+	case m.keys.ListBlock:
+		if len(m.document.blocks) > m.document.currentBlock {
+			m.document.blocks[m.document.currentBlock].Type = blockList
+			m.document.modified = true
+			m.document.needsRefresh = true
+		}
+	case m.keys.RawBlock:
+		if len(m.document.blocks) > m.document.currentBlock {
+			m.document.blocks[m.document.currentBlock].Type = blockRawLaTeX
+			m.document.modified = true
+			m.document.needsRefresh = true
+		}
+	case m.keys.ExportMath:
+		if len(m.document.blocks) > m.document.currentBlock {
+			block := m.document.blocks[m.document.currentBlock]
+			if block.Type != blockMath {
+				m.document.commandError = "Only math blocks can be exported as an image"
+				break
+			}
+			engine, _, err := latexCommand(m.preferences.LaTeXEngine, "")
+			if err != nil {
+				m.document.commandError = err.Error()
+				break
+			}
+			if missing := missingTools(engine, mathImageConverter); len(missing) > 0 {
+				m.document.commandError = fmt.Sprintf("Math image export needs %s and %s, not found: %s", engine, mathImageConverter, strings.Join(missing, ", "))
+				break
+			}
+			m.document.notice = "Exporting math block…"
+			return m, m.exportMathImage(block)
+		}
+	case m.keys.CycleBlockType:
+		if len(m.document.blocks) > m.document.currentBlock {
+			block := &m.document.blocks[m.document.currentBlock]
+			block.Type = nextBlockType(block.Type)
+			m.document.notice = fmt.Sprintf("Block type: %s", block.Type)
+			m.document.modified = true
+			m.document.needsRefresh = true
+		}
+	case m.keys.ImageBlock:
+		if len(m.document.blocks) > m.document.currentBlock {
+			block := m.document.blocks[m.document.currentBlock]
+			m.document.imagePrompt = true
+			m.document.command.SetValue("")
+			if block.Type == blockImage {
+				m.document.command.SetValue(parseImage(block.Content).Path)
+			}
+			m.document.command.Focus()
+			return m, textinput.Blink
+		}
+	case m.keys.TableBlock:
+		if len(m.document.blocks) > m.document.currentBlock {
+			m.document.blocks[m.document.currentBlock].Type = blockTable
+			m.document.modified = true
+			m.document.needsRefresh = true
+		}
+	case m.keys.SaveDocument:
+		if m.document.filepath == "" || strings.Contains(m.document.filepath, "document.oath") {
+			return m, m.saveDocument()
+		}
+		return m, m.saveDocument()
+	case m.keys.Comment:
+		if len(m.document.blocks) > m.document.currentBlock {
+			m.document.commentPrompt = true
+			m.document.command.SetValue(m.document.blocks[m.document.currentBlock].Comment)
+			m.document.command.CursorEnd()
+			m.document.command.Focus()
+			return m, textinput.Blink
+		}
+	case m.keys.CodeLanguage:
+		if len(m.document.blocks) > m.document.currentBlock && m.document.blocks[m.document.currentBlock].Type == blockCode {
+			m.document.languagePrompt = true
+			m.document.command.SetValue(codeLanguage(m.document.blocks[m.document.currentBlock]))
+			m.document.command.CursorEnd()
+			m.document.command.Focus()
+			return m, textinput.Blink
+		}
+	case m.keys.Tidy:
+		m.document.tidyPrompt = true
+	case m.keys.Comments:
+		m.document.showComments = true
+		m.document.commentSelected = 0
+	case m.keys.SaveTemplate:
+		m.document.templatePrompt = true
+		m.document.command.SetValue(m.getSmartFilename())
+		m.document.command.CursorEnd()
+		m.document.command.Focus()
+		return m, textinput.Blink
+	case m.keys.SaveAs:
+		m.document.saveAsPrompt = true
+		m.document.command.SetValue(m.defaultSavePath())
+		m.document.command.CursorEnd()
+		m.document.command.Focus()
+		return m, textinput.Blink
+	case m.keys.CycleTheme:
+		m.theme.selected = (m.theme.selected + 1) % len(m.theme.available)
+		m.theme.currentTheme = m.theme.available[m.theme.selected]
+	case m.keys.ToggleVim:
+		m.document.vim.enabled = !m.document.vim.enabled
+		if m.document.vim.enabled {
+			m.document.vim.mode = vimNormal
+		}
+	case m.keys.Export:
+		m.mode = modeExport
+		m.export.blocks = nil
+		m.export.input.Focus()
+		return m, textinput.Blink
+	case m.keys.Timer:
+		m.mode = modeTimer
+		m.input.Focus()
+		return m, textinput.Blink
+	case m.keys.EditorOnly:
+		m.setViewMode(viewEditorOnly)
+	case m.keys.SplitView:
+		m.setViewMode(viewSplitPane)
+	case m.keys.PreviewOnly:
+		m.setViewMode(viewPreviewOnly)
+	case m.keys.GrowSplit:
+		m.setSplitRatio(m.document.splitRatio + splitStep)
+	case m.keys.ShrinkSplit:
+		m.setSplitRatio(m.document.splitRatio - splitStep)
+	case m.keys.FineGrowSplit:
+		m.setSplitRatio(m.document.splitRatio + fineSplitStep)
+	case m.keys.FineShrinkSplit:
+		m.setSplitRatio(m.document.splitRatio - fineSplitStep)
+	case m.keys.SplitPreset1:
+		m.applySplitPreset(0)
+	case m.keys.SplitPreset2:
+		m.applySplitPreset(1)
+	case m.keys.SplitPreset3:
+		m.applySplitPreset(2)
+	case m.keys.ResetSplit:
+		m.setSplitRatio(defaultSplitRatio)
+	case m.keys.DeleteBlock:
+		if len(m.document.blocks) > 1 && m.document.currentBlock < len(m.document.blocks) {
+			m.document.blocks = append(m.document.blocks[:m.document.currentBlock],
+				m.document.blocks[m.document.currentBlock+1:]...)
+			if m.document.currentBlock >= len(m.document.blocks) {
+				m.document.currentBlock = len(m.document.blocks) - 1
+			}
+			if len(m.document.blocks) > m.document.currentBlock {
+				m.document.editor.SetValue(m.document.blocks[m.document.currentBlock].Content)
+			}
+			m.document.modified = true
+			m.document.needsRefresh = true
+		}
+	case m.keys.ToggleFold:
+		if len(m.document.blocks) > m.document.currentBlock {
+			m.document.toggleFold(m.document.blocks[m.document.currentBlock].ID)
+		}
+	case m.keys.FoldAll:
+		m.document.foldAll(true)
+	case m.keys.UnfoldAll:
+		m.document.foldAll(false)
+	case m.keys.NumberHeading:
+		if len(m.document.blocks) > m.document.currentBlock && m.document.blocks[m.document.currentBlock].Type == blockHeading {
+			m.document.blocks[m.document.currentBlock].Numbered = !m.document.blocks[m.document.currentBlock].Numbered
+			m.document.modified = true
+			m.document.needsRefresh = true
+		}
+	case m.keys.ToggleWrap:
+		if len(m.document.blocks) > m.document.currentBlock && m.document.blocks[m.document.currentBlock].Type == blockCode {
+			m.document.blocks[m.document.currentBlock].NoWrap = !m.document.blocks[m.document.currentBlock].NoWrap
+			m.document.modified = true
+		}
+	case m.keys.LineNumbers:
+		if len(m.document.blocks) > m.document.currentBlock && m.document.blocks[m.document.currentBlock].Type == blockCode {
+			m.document.blocks[m.document.currentBlock].LineNumbers = !m.document.blocks[m.document.currentBlock].LineNumbers
+			m.document.modified = true
+		}
+	case m.keys.RawText:
+		if len(m.document.blocks) > m.document.currentBlock && m.document.blocks[m.document.currentBlock].Type == blockText {
+			m.document.blocks[m.document.currentBlock].RawText = !m.document.blocks[m.document.currentBlock].RawText
+			m.document.modified = true
+		}
+	case m.keys.Search:
+		m.search.open(m.document.blocks)
+		return m, textinput.Blink
+	case m.keys.NextDiagnostic:
+		if len(m.document.blocks) > 0 {
+			m.jumpToDiagnostic(1)
+		}
+	case m.keys.PrevDiagnostic:
+		if len(m.document.blocks) > 0 {
+			m.jumpToDiagnostic(-1)
+		}
+	case m.keys.RuleBlock:
+		at := m.document.currentBlock + 1
+		if at > len(m.document.blocks) {
+			at = len(m.document.blocks)
+		}
+		rule := ContentBlock{ID: m.document.newBlockID(), Type: blockHR, Content: "---"}
+		blocks := append([]ContentBlock{}, m.document.blocks[:at]...)
+		blocks = append(blocks, rule)
+		m.document.blocks = append(blocks, m.document.blocks[at:]...)
+		m.document.currentBlock = at
+		m.document.editor.SetValue(rule.Content)
+		m.document.modified = true
+		m.document.needsRefresh = true
+		m.revealCurrentBlock()
+	case m.keys.MathPreview:
+		m.document.showMathPreview = !m.document.showMathPreview
+	case m.keys.CopyBlock:
+		if len(m.document.blocks) > m.document.currentBlock {
+			if err := m.clipboard.Copy(m.document.blocks[m.document.currentBlock].Content); err != nil {
+				m.document.commandError = fmt.Sprintf("Clipboard unavailable, copied for this session only: %v", err)
+			} else {
+				m.document.notice = "Copied block to the clipboard"
+			}
+		}
+	case m.keys.PasteBlock:
+		text, err := m.clipboard.Paste()
+		text = strings.TrimRight(text, "\n")
+		if err != nil {
+			m.document.commandError = err.Error()
+			break
+		}
+		if text == "" {
+			m.document.commandError = "The clipboard is empty"
+			break
+		}
+
+		// Pasted text gets the same type detection as a typed block
+		pasted := ContentBlock{ID: m.document.newBlockID(), Type: blockText, Content: text}
+		if m.preferences.AutoDetectBlocks {
+			if detected := detectBlockType(text); detected != blockText {
+				pasted = convertDetectedBlock(pasted, detected)
+			}
+		}
+
+		at := m.document.currentBlock + 1
+		if at > len(m.document.blocks) {
+			at = len(m.document.blocks)
+		}
+		blocks := append([]ContentBlock{}, m.document.blocks[:at]...)
+		blocks = append(blocks, pasted)
+		m.document.blocks = append(blocks, m.document.blocks[at:]...)
+		m.document.currentBlock = at
+		m.document.editor.SetValue(pasted.Content)
+		m.document.modified = true
+		m.document.needsRefresh = true
+		m.revealCurrentBlock()
+	case m.keys.PinBlock:
+		if len(m.document.blocks) > m.document.currentBlock {
+			id := m.document.blocks[m.document.currentBlock].ID
+			if m.document.pinnedID == id {
+				m.document.pinnedID = ""
+			} else {
+				m.document.pinnedID = id
+			}
+		}
+	case m.keys.ExternalEditor:
+		if len(m.document.blocks) > m.document.currentBlock {
+			cmd := m.openExternalEditor(m.document.blocks[m.document.currentBlock])
+			return m, cmd
+		}
+	case m.keys.Refresh:
+		m.document.needsRefresh = true
+		m.document.preview.clear()
+	case m.keys.Stats:
+		m.document.showStats = !m.document.showStats
+	case m.keys.CacheStats:
+		m.document.showCache = !m.document.showCache
+	case m.keys.Notes:
+		m.document.showNotes = true
+		m.notes.Focus()
+		return m, textarea.Blink
+	case m.keys.SelectBlocks:
+		m.document.selecting = true
+		m.document.selectionStart = m.document.currentBlock
+		m.document.selectionEnd = m.document.currentBlock
+	case m.keys.Outline:
+		m.document.outline = buildOutline(m.document.blocks)
+		m.document.outlineSelected = outlineSection(m.document.outline, m.document.currentBlock)
+		if m.document.outlineSelected < 0 {
+			m.document.outlineSelected = 0
+		}
+		m.document.showOutline = true
+	case m.keys.DiffView:
+		m.document.diff = diffBlocks(m.document.saved, m.document.blocks)
+		m.document.diffOffset = 0
+		m.document.showDiff = true
+	}
+
+	return m, nil
+}
+
+// Next diagnostic after from in direction delta, wrapping around. Diagnostics whose block has
+// since been deleted are skipped, -1 when none is left to visit
+func nextDiagnostic(diagnostics []Diagnostic, blocks []ContentBlock, from, delta int) int {
+	n := len(diagnostics)
+	if n == 0 {
+		return -1
+	}
+	if from < 0 && delta < 0 {
+		from = 0
+	}
+	for step := 1; step <= n; step++ {
+		i := ((from+delta*step)%n + n) % n
+		if diagnostics[i].BlockID == "" || blockIndex(blocks, diagnostics[i].BlockID) != -1 {
+			return i
+		}
+	}
+	return -1
+}
+
+func blockIndex(blocks []ContentBlock, id string) int {
+	for i, block := range blocks {
+		if block.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Byte offset of a one-based line and column, clamped to the content
+func diagnosticOffset(content string, line, column int) int {
+	lines := strings.Split(content, "\n")
+	if line < 1 {
+		line = 1
+	}
+	if line > len(lines) {
+		return len(content)
+	}
+
+	offset := 0
+	for _, previous := range lines[:line-1] {
+		offset += len(previous) + 1
+	}
+	if column > 1 {
+		col := column - 1
+		if col > len(lines[line-1]) {
+			col = len(lines[line-1])
+		}
+		offset += col
+	}
+	return offset
+}
+
+// Order the cycle key steps through, types outside it join at the start
+var blockTypeCycle = []blockType{blockText, blockHeading, blockMath, blockCode, blockQuote, blockList, blockRawLaTeX}
+
+func nextBlockType(t blockType) blockType {
+	for i, cycled := range blockTypeCycle {
+		if cycled == t {
+			return blockTypeCycle[(i+1)%len(blockTypeCycle)]
+		}
+	}
+	return blockTypeCycle[0]
+}
+
+// The defaultBlockType preference as a block type. Images and rules need more than an empty
+// editor, so they and unknown names give text
+func newBlockType(name string) blockType {
+	switch t := blockType(name); t {
+	case blockText, blockMath, blockHeading, blockCode, blockQuote, blockList, blockRawLaTeX, blockTable:
+		return t
+	}
+	return blockText
+}
+
+// Adds an empty block of type t at the end of the document and starts editing it
+func (m model) appendBlock(t blockType) (tea.Model, tea.Cmd) {
+	newBlock := ContentBlock{
+		ID:      m.document.newBlockID(),
+		Type:    t,
+		Content: "",
+	}
+	m.document.blocks = append(m.document.blocks, newBlock)
+	m.document.currentBlock = len(m.document.blocks) - 1
+	m.document.editor.SetValue("")
+	m.revealCurrentBlock()
+	m.document.modified = true
+	m.document.needsRefresh = true
+	m.document.lsp.setMacros(m.document.blocks)
+	m.document.editor.Placeholder = blockPlaceholder(newBlock.Type)
+	m.document.editor.Focus()
+	if m.document.vim.enabled {
+		m.document.vim.mode = vimInsert
+	}
+	return m, textarea.Blink
+}
+
+// Moves to the block of the next or previous diagnostic and puts the editor cursor on it
+func (m *model) jumpToDiagnostic(delta int) {
+	i := nextDiagnostic(m.document.lsp.diagnostics, m.document.blocks, m.document.lsp.activeDiagnostic, delta)
+	if i == -1 {
+		m.document.commandError = "No diagnostics"
+		return
+	}
+	m.document.lsp.activeDiagnostic = i
+
+	diag := m.document.lsp.diagnostics[i]
+	if index := blockIndex(m.document.blocks, diag.BlockID); index != -1 {
+		m.document.currentBlock = index
+	}
+	content := m.document.blocks[m.document.currentBlock].Content
+	m.document.editor.SetValue(content)
+	setEditorCursor(&m.document.editor, diagnosticOffset(content, diag.Line, diag.Column))
+	m.revealCurrentBlock()
+}
+
+// Saves the block being edited and moves the editor onto the \newcommand for the macro
+// under the cursor, which may be in another block
+func (m model) gotoMacroDefinition() (tea.Model, tea.Cmd) {
+	content := m.document.editor.Value()
+	name := macroAt(content, editorCursorIndex(m.document.editor))
+	if name == "" {
+		m.document.commandError = "No macro under the cursor"
+		return m, nil
+	}
+
+	if m.document.blocks[m.document.currentBlock].Content != content {
+		m.document.blocks[m.document.currentBlock].Content = content
+		m.document.modified = true
+		m.document.needsRefresh = true
+	}
+
+	index, offset, ok := findMacroDefinition(m.document.blocks, name)
+	if !ok {
+		m.document.commandError = fmt.Sprintf("%s is not defined in a raw block", name)
+		return m, nil
+	}
+	m.document.lsp.showCompletions = false
+	m.document.currentBlock = index
+	m.document.editor.SetValue(m.document.blocks[index].Content)
+	setEditorCursor(&m.document.editor, offset)
+	m.revealCurrentBlock()
+	return m, nil
+}
+
+func (m model) updateSelection(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	m.document.commandError = ""
+	changed := false
+	switch msg.String() {
+	case "esc", m.keys.SelectBlocks:
+		m.document.selecting = false
+	case m.keys.NextBlock, "down":
+		if m.document.currentBlock < len(m.document.blocks)-1 {
+			m.document.currentBlock++
+			m.document.selectionEnd = m.document.currentBlock
+		}
+	case m.keys.PrevBlock, "up":
+		if m.document.currentBlock > 0 {
+			m.document.currentBlock--
+			m.document.selectionEnd = m.document.currentBlock
+		}
+	case "J":
+		changed = m.document.moveSelection(1)
+	case "K":
+		changed = m.document.moveSelection(-1)
+	case m.keys.MathBlock:
+		m.document.setSelectionType(blockMath)
+		changed = true
+	case m.keys.CodeBlock:
+		m.document.setSelectionType(blockCode)
+		changed = true
+	case m.keys.ListBlock:
+		m.document.setSelectionType(blockList)
+		changed = true
+	case m.keys.TableBlock:
+		m.document.setSelectionType(blockTable)
+		changed = true
+	case m.keys.RawBlock:
+		m.document.setSelectionType(blockRawLaTeX)
+		changed = true
+	case m.keys.DeleteBlock:
+		if !m.document.deleteSelection() {
+			m.document.commandError = "Cannot delete every block"
+			break
+		}
+		m.document.selecting = false
+		changed = true
+	case m.keys.Export:
+		lo, hi := m.document.selectionRange()
+		m.document.selecting = false
+		m.mode = modeExport
+		m.export.blocks = append([]ContentBlock(nil), m.document.blocks[lo:hi+1]...)
+		m.export.input.Focus()
+		return m, textinput.Blink
+	case "ctrl+c":
+		return m.requestQuit(quitApp)
+	}
+
+	if changed {
+		m.document.modified = true
+		m.document.needsRefresh = true
+	}
+	if len(m.document.blocks) > m.document.currentBlock {
+		m.document.editor.SetValue(m.document.blocks[m.document.currentBlock].Content)
+	}
+	m.revealCurrentBlock()
+	return m, nil
+}
+
+func (m model) updateOutline(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "esc", "q", m.keys.Outline:
+		m.document.showOutline = false
+	case "j", "down":
+		if m.document.outlineSelected < len(m.document.outline)-1 {
+			m.document.outlineSelected++
+		}
+	case "k", "up":
+		if m.document.outlineSelected > 0 {
+			m.document.outlineSelected--
+		}
+	case "enter":
+		m.document.showOutline = false
+		if m.document.outlineSelected < len(m.document.outline) {
+			index := m.document.outline[m.document.outlineSelected].index
+			if index < len(m.document.blocks) {
+				m.document.currentBlock = index
+				m.document.editor.SetValue(m.document.blocks[index].Content)
+				m.revealCurrentBlock()
+			}
+		}
+	}
+	return m, nil
+}
+
+func (m model) updateDiff(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "esc", "q", m.keys.DiffView:
+		m.document.showDiff = false
+	case "j", "down":
+		if m.document.diffOffset < len(m.document.diff)-1 {
+			m.document.diffOffset++
+		}
+	case "k", "up":
+		if m.document.diffOffset > 0 {
+			m.document.diffOffset--
+		}
+	}
+	return m, nil
+}
+
+// Block navigation keys, remappable through ~/.oathkeeper/keybindings.json
+type keymap struct {
+	NextBlock       string `json:"nextBlock"`
+	PrevBlock       string `json:"prevBlock"`
+	NewBlock        string `json:"newBlock"`
+	DuplicateBlock  string `json:"duplicateBlock"`
+	DeleteBlock     string `json:"deleteBlock"`
+	MathBlock       string `json:"mathBlock"`
+	CodeBlock       string `json:"codeBlock"`
+	ListBlock       string `json:"listBlock"`
+	TableBlock      string `json:"tableBlock"`
+	RawBlock        string `json:"rawBlock"`
+	SaveDocument    string `json:"saveDocument"`
+	Export          string `json:"export"`
+	CycleTheme      string `json:"cycleTheme"`
+	ToggleVim       string `json:"toggleVim"`
+	Timer           string `json:"timer"`
+	EditorOnly      string `json:"editorOnly"`
+	SplitView       string `json:"splitView"`
+	PreviewOnly     string `json:"previewOnly"`
+	GrowSplit       string `json:"growSplit"`
+	ShrinkSplit     string `json:"shrinkSplit"`
+	FineGrowSplit   string `json:"fineGrowSplit"`
+	FineShrinkSplit string `json:"fineShrinkSplit"`
+	SplitPreset1    string `json:"splitPreset1"`
+	SplitPreset2    string `json:"splitPreset2"`
+	SplitPreset3    string `json:"splitPreset3"`
+	ResetSplit      string `json:"resetSplit"`
+	ScrollDown      string `json:"scrollDown"`
+	ScrollUp        string `json:"scrollUp"`
+	Refresh         string `json:"refresh"`
+	Stats           string `json:"stats"`
+	Quit            string `json:"quit"`
+	ExternalEditor  string `json:"externalEditor"`
+	PinBlock        string `json:"pinBlock"`
+	ToggleFold      string `json:"toggleFold"`
+	FoldAll         string `json:"foldAll"`
+	UnfoldAll       string `json:"unfoldAll"`
+	ImageBlock      string `json:"imageBlock"`
+	DiffView        string `json:"diffView"`
+	CacheStats      string `json:"cacheStats"`
+	ToggleWrap      string `json:"toggleWrap"`
+	LineNumbers     string `json:"lineNumbers"`
+	RawText         string `json:"rawText"`
+	CopyBlock       string `json:"copyBlock"`
+	PasteBlock      string `json:"pasteBlock"`
+	MathPreview     string `json:"mathPreview"`
+	SaveTemplate    string `json:"saveTemplate"`
+	RuleBlock       string `json:"ruleBlock"`
+	NextDiagnostic  string `json:"nextDiagnostic"`
+	PrevDiagnostic  string `json:"prevDiagnostic"`
+	Outline         string `json:"outline"`
+	NumberHeading   string `json:"numberHeading"`
+	SelectBlocks    string `json:"selectBlocks"`
+	Notes           string `json:"notes"`
+	SaveAs          string `json:"saveAs"`
+	Comment         string `json:"comment"`
+	Comments        string `json:"comments"`
+	CodeLanguage    string `json:"codeLanguage"`
+	Tidy            string `json:"tidy"`
+	Search          string `json:"search"`
+	SameTypeBlock   string `json:"sameTypeBlock"`
+	PreviewWrap     string `json:"previewWrap"`
+	CycleBlockType  string `json:"cycleBlockType"`
+	ExportMath      string `json:"exportMath"`
+}
+
+// Keys handled outside the keymap, binding an action to one of them would shadow it
+var reservedKeys = []string{"up", "down", "left", "right", "enter", "esc", "pgup", "pgdown", "ctrl+c", "ctrl+p", ":"}
+
+// Names keys that would be invisible in help text
+func keyLabel(key string) string {
+	if key == " " {
+		return "space"
+	}
+	return key
+}
+
+func defaultKeymap() keymap {
+	return keymap{
+		NextBlock:       "j",
+		PrevBlock:       "k",
+		NewBlock:        "n",
+		DuplicateBlock:  "y",
+		DeleteBlock:     "d",
+		MathBlock:       "m",
+		CodeBlock:       "c",
+		ListBlock:       "l",
+		TableBlock:      "b",
+		RawBlock:        "r",
+		SaveDocument:    "s",
+		Export:          "e",
+		CycleTheme:      "T",
+		ToggleVim:       "V",
+		Timer:           "t",
+		EditorOnly:      "1",
+		SplitView:       "2",
+		PreviewOnly:     "3",
+		GrowSplit:       "=",
+		ShrinkSplit:     "-",
+		FineGrowSplit:   ">",
+		FineShrinkSplit: "<",
+		SplitPreset1:    "!",
+		SplitPreset2:    "@",
+		SplitPreset3:    "$",
+		ResetSplit:      "0",
+		ScrollDown:      "ctrl+d",
+		ScrollUp:        "ctrl+u",
+		Refresh:         "ctrl+l",
+		Stats:           "ctrl+g",
+		Quit:            "q",
+		ExternalEditor:  "E",
+		PinBlock:        "p",
+		ToggleFold:      " ",
+		FoldAll:         "z",
+		UnfoldAll:       "Z",
+		ImageBlock:      "i",
+		DiffView:        "D",
+		CacheStats:      "ctrl+o",
+		ToggleWrap:      "w",
+		LineNumbers:     "#",
+		RawText:         "R",
+		CopyBlock:       "Y",
+		PasteBlock:      "P",
+		MathPreview:     "ctrl+r",
+		SaveTemplate:    "M",
+		RuleBlock:       "_",
+		NextDiagnostic:  "]",
+		PrevDiagnostic:  "[",
+		Outline:         "o",
+		NumberHeading:   "N",
+		SelectBlocks:    "v",
+		Notes:           "ctrl+n",
+		SaveAs:          "S",
+		Comment:         "C",
+		Comments:        "ctrl+t",
+		CodeLanguage:    "L",
+		Tidy:            "X",
+		Search:          "/",
+		SameTypeBlock:   "+",
+		PreviewWrap:     "W",
+		CycleBlockType:  "tab",
+		ExportMath:      "ctrl+e",
+	}
+}
+
+// Action names as used in keybindings.json, pointing at the matching field
+func (k *keymap) actions() map[string]*string {
+	return map[string]*string{
+		"nextBlock":       &k.NextBlock,
+		"prevBlock":       &k.PrevBlock,
+		"newBlock":        &k.NewBlock,
+		"duplicateBlock":  &k.DuplicateBlock,
+		"deleteBlock":     &k.DeleteBlock,
+		"mathBlock":       &k.MathBlock,
+		"codeBlock":       &k.CodeBlock,
+		"listBlock":       &k.ListBlock,
+		"tableBlock":      &k.TableBlock,
+		"rawBlock":        &k.RawBlock,
+		"saveDocument":    &k.SaveDocument,
+		"export":          &k.Export,
+		"cycleTheme":      &k.CycleTheme,
+		"toggleVim":       &k.ToggleVim,
+		"timer":           &k.Timer,
+		"editorOnly":      &k.EditorOnly,
+		"splitView":       &k.SplitView,
+		"previewOnly":     &k.PreviewOnly,
+		"growSplit":       &k.GrowSplit,
+		"shrinkSplit":     &k.ShrinkSplit,
+		"fineGrowSplit":   &k.FineGrowSplit,
+		"fineShrinkSplit": &k.FineShrinkSplit,
+		"splitPreset1":    &k.SplitPreset1,
+		"splitPreset2":    &k.SplitPreset2,
+		"splitPreset3":    &k.SplitPreset3,
+		"resetSplit":      &k.ResetSplit,
+		"scrollDown":      &k.ScrollDown,
+		"scrollUp":        &k.ScrollUp,
+		"refresh":         &k.Refresh,
+		"stats":           &k.Stats,
+		"quit":            &k.Quit,
+		"externalEditor":  &k.ExternalEditor,
+		"pinBlock":        &k.PinBlock,
+		"toggleFold":      &k.ToggleFold,
+		"foldAll":         &k.FoldAll,
+		"unfoldAll":       &k.UnfoldAll,
+		"imageBlock":      &k.ImageBlock,
+		"diffView":        &k.DiffView,
+		"cacheStats":      &k.CacheStats,
+		"toggleWrap":      &k.ToggleWrap,
+		"lineNumbers":     &k.LineNumbers,
+		"rawText":         &k.RawText,
+		"copyBlock":       &k.CopyBlock,
+		"pasteBlock":      &k.PasteBlock,
+		"mathPreview":     &k.MathPreview,
+		"saveTemplate":    &k.SaveTemplate,
+		"ruleBlock":       &k.RuleBlock,
+		"nextDiagnostic":  &k.NextDiagnostic,
+		"prevDiagnostic":  &k.PrevDiagnostic,
+		"outline":         &k.Outline,
+		"numberHeading":   &k.NumberHeading,
+		"selectBlocks":    &k.SelectBlocks,
+		"notes":           &k.Notes,
+		"saveAs":          &k.SaveAs,
+		"comment":         &k.Comment,
+		"comments":        &k.Comments,
+		"codeLanguage":    &k.CodeLanguage,
+		"tidy":            &k.Tidy,
+		"search":          &k.Search,
+		"sameTypeBlock":   &k.SameTypeBlock,
+		"previewWrap":     &k.PreviewWrap,
+		"cycleBlockType":  &k.CycleBlockType,
+		"exportMath":      &k.ExportMath,
+	}
+}
+
+// Applies overrides on top of the defaults. Unknown actions, reserved keys and keys that
+// end up shared with another action are rejected with a warning and the default is kept.
+// Clashes are checked against the merged bindings so swapping two keys works
+func parseKeymap(data []byte) (keymap, []string) {
+	keys := defaultKeymap()
+
+	var overrides map[string]string
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return keys, []string{fmt.Sprintf("keybindings.json: %v", err)}
+	}
+
+	names := make([]string, 0, len(overrides))
+	for name := range overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var warnings []string
+	original := defaultKeymap()
+	defaults := original.actions()
+	actions := keys.actions()
+	changed := make(map[string]bool)
+	for _, name := range names {
+		field, ok := actions[name]
+		if !ok {
+			warnings = append(warnings, fmt.Sprintf("keybindings.json: unknown action %q", name))
+			continue
+		}
+
+		key := overrides[name]
+		if key == "" || key == *field {
+			continue
+		}
+		if slices.Contains(reservedKeys, key) {
+			warnings = append(warnings, fmt.Sprintf("keybindings.json: %q for %s is a built-in key", key, name))
+			continue
+		}
+		*field = key
+		changed[name] = true
+	}
+
+	// Reverting one override can free or take a key, so keep going until nothing clashes
+	for {
+		var clashes []string
+		for _, name := range names {
+			if !changed[name] {
+				continue
+			}
+			key := *actions[name]
+			if other := keys.boundTo(key, name); other != "" {
+				warnings = append(warnings, fmt.Sprintf("keybindings.json: %q for %s is also bound to %s", key, name, other))
+				clashes = append(clashes, name)
+			}
+		}
+		if len(clashes) == 0 {
+			return keys, warnings
+		}
+		for _, name := range clashes {
+			*actions[name] = *defaults[name]
+			delete(changed, name)
+		}
+	}
+}
+
+// Names another action using a key, empty when no other action has it
+func (k *keymap) boundTo(key, except string) string {
+	var names []string
+	for name, field := range k.actions() {
+		if name != except && *field == key {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	sort.Strings(names)
+	return names[0]
+}
+
+// Reads ~/.oathkeeper/keybindings.json, the warnings are shown once the UI is up
+func loadKeymap() (keymap, []string) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return defaultKeymap(), nil
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(homeDir, ".oathkeeper", "keybindings.json"))
+	if err != nil {
+		return defaultKeymap(), nil
+	}
+
+	return parseKeymap(data)
+}
+
+type clipboard interface {
+	Copy(text string) error
+	Paste() (string, error)
+}
+
+// Keeps copied text for this session only, used when there's no clipboard tool to talk to
+type memoryClipboard struct {
+	text string
+}
+
+func (c *memoryClipboard) Copy(text string) error {
+	c.text = text
+	return nil
+}
+
+func (c *memoryClipboard) Paste() (string, error) {
+	return c.text, nil
+}
+
+// Talks to the system clipboard through a command line tool. Everything copied is also
+// kept in memory, so pasting still works when the tool fails (no display, for instance)
+type commandClipboard struct {
+	copy, paste []string
+	fallback    memoryClipboard
+}
+
+func (c *commandClipboard) Copy(text string) error {
+	c.fallback.Copy(text)
+	cmd := exec.Command(c.copy[0], c.copy[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	return cmd.Run()
+}
+
+func (c *commandClipboard) Paste() (string, error) {
+	output, err := exec.Command(c.paste[0], c.paste[1:]...).Output()
+	if err != nil {
+		return c.fallback.Paste()
+	}
+	return string(output), nil
+}
+
+// The first copy/paste pair found on PATH, Wayland's tools first when running under it
+func newClipboard() clipboard {
+	tools := [][2][]string{
+		{{"pbcopy"}, {"pbpaste"}},
+		{{"xclip", "-selection", "clipboard"}, {"xclip", "-selection", "clipboard", "-o"}},
+		{{"xsel", "--clipboard", "--input"}, {"xsel", "--clipboard", "--output"}},
+	}
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		tools = append([][2][]string{{{"wl-copy"}, {"wl-paste", "--no-newline"}}}, tools...)
+	}
+
+	for _, tool := range tools {
+		if _, err := exec.LookPath(tool[0][0]); err != nil {
+			continue
+		}
+		if _, err := exec.LookPath(tool[1][0]); err != nil {
+			continue
+		}
+		return &commandClipboard{copy: tool[0], paste: tool[1]}
+	}
+	return &memoryClipboard{}
+}
+
+// Suspends the TUI and edits the block in $EDITOR, the result comes back as an externalEditorMsg
+func (m *model) openExternalEditor(block ContentBlock) tea.Cmd {
+	editor := strings.Fields(os.Getenv("EDITOR"))
+	if len(editor) == 0 {
+		m.document.commandError = "$EDITOR is not set"
+		return nil
+	}
+
+	path, err := writeBlockFile(block)
+	if err != nil {
+		m.document.commandError = err.Error()
+		return nil
+	}
+
+	cmd := exec.Command(editor[0], append(editor[1:], path)...)
+	return tea.ExecProcess(cmd, func(err error) tea.Msg {
+		if err != nil {
+			os.Remove(path)
+		}
+		return externalEditorMsg{blockID: block.ID, path: path, err: err}
+	})
+}
+
+// Writes the block to a temp file whose extension gives the editor a hint for highlighting
+func writeBlockFile(block ContentBlock) (string, error) {
+	ext := ".md"
+	switch block.Type {
+	case blockMath, blockRawLaTeX:
+		ext = ".tex"
+	}
+
+	file, err := ioutil.TempFile("", "oathkeeper-*"+ext)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if _, err := file.WriteString(block.Content); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// Reads the edited block back and removes the temp file. Editors usually add a final
+// newline, which is dropped so an untouched block comes back unchanged
+func readBlockFile(path string) (string, error) {
+	defer os.Remove(path)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(data), "\n"), nil
+}
+
+type paletteEntry struct {
+	Name string
+	// Shown next to the name, empty for actions without a binding
+	Key string
+	Run func(m model) (tea.Model, tea.Cmd)
+}
+
+// Filterable list of actions drawn over the current view
+type paletteModel struct {
+	active   bool
+	entries  []paletteEntry
+	matches  []paletteEntry
+	selected int
+	input    textinput.Model
+}
+
+func (p *paletteModel) open(entries []paletteEntry) {
+	p.active = true
+	p.entries = entries
+	p.input = textinput.New()
+	p.input.Placeholder = "Type to filter actions"
+	p.input.Focus()
+	p.filter()
+}
+
+func (p *paletteModel) close() {
+	p.active = false
+	p.input.Blur()
+}
+
+// Best fuzzy matches first, ties keep their original order
+func (p *paletteModel) filter() {
+	query := strings.TrimSpace(p.input.Value())
+
+	type scored struct {
+		entry paletteEntry
+		score int
+	}
+	var matches []scored
+	for _, entry := range p.entries {
+		if score, ok := fuzzyMatch(query, entry.Name); ok {
+			matches = append(matches, scored{entry, score})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].score > matches[j].score
+	})
+
+	p.matches = p.matches[:0]
+	for _, match := range matches {
+		p.matches = append(p.matches, match.entry)
+	}
+	p.selected = 0
+}
+
+func (p *paletteModel) move(delta int) {
+	p.selected += delta
+	if p.selected >= len(p.matches) {
+		p.selected = len(p.matches) - 1
+	}
+	if p.selected < 0 {
+		p.selected = 0
+	}
+}
+
+func (p paletteModel) current() (paletteEntry, bool) {
+	if p.selected < len(p.matches) {
+		return p.matches[p.selected], true
+	}
+	return paletteEntry{}, false
+}
+
+func (m model) updatePalette(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "esc", "ctrl+p":
+		m.palette.close()
+		return m, nil
+	case "ctrl+c":
+		m.palette.close()
+		return m.requestQuit(quitApp)
+	case "up", "ctrl+k":
+		m.palette.move(-1)
+		return m, nil
+	case "down", "ctrl+j":
+		m.palette.move(1)
+		return m, nil
+	case "enter":
+		entry, ok := m.palette.current()
+		m.palette.close()
+		if !ok {
+			return m, nil
+		}
+		return entry.Run(m)
+	}
+
+	var cmd tea.Cmd
+	m.palette.input, cmd = m.palette.input.Update(msg)
+	m.palette.filter()
+	return m, cmd
+}
+
+type symbolEntry struct {
+	Command  string
+	Glyph    string
+	Category string
+}
+
+// Display order of the symbol picker groups, anything uncategorised lands in Other
+var symbolCategoryOrder = []string{"Greek", "Operators", "Relations", "Sets", "Logic", "Arrows", "Other"}
+
+var symbolCategories = map[string]string{
+	"\\int": "Operators", "\\sum": "Operators", "\\prod": "Operators", "\\sqrt": "Operators",
+	"\\partial": "Operators", "\\nabla": "Operators", "\\pm": "Operators", "\\times": "Operators",
+	"\\div": "Operators", "\\cdot": "Operators", "\\star": "Operators", "\\oplus": "Operators",
+	"\\otimes": "Operators",
+
+	"\\le": "Relations", "\\ge": "Relations", "\\ne": "Relations", "\\approx": "Relations",
+	"\\equiv": "Relations", "\\propto": "Relations",
+
+	"\\subset": "Sets", "\\supset": "Sets", "\\in": "Sets", "\\notin": "Sets",
+	"\\cup": "Sets", "\\cap": "Sets", "\\emptyset": "Sets",
+
+	"\\forall": "Logic", "\\exists": "Logic", "\\Rightarrow": "Logic",
+
+	"\\rightarrow": "Arrows", "\\leftarrow": "Arrows",
+}
+
+func symbolCategory(command, glyph string) string {
+	if category, ok := symbolCategories[command]; ok {
+		return category
+	}
+	if r, _ := utf8.DecodeRuneInString(glyph); unicode.Is(unicode.Greek, r) {
+		return "Greek"
+	}
+	return "Other"
+}
+
+// Every symbol, grouped in symbolCategoryOrder and sorted by command within a group
+func symbolGroups(symbols map[string]string) []symbolEntry {
+	rank := make(map[string]int, len(symbolCategoryOrder))
+	for i, category := range symbolCategoryOrder {
+		rank[category] = i
+	}
+
+	entries := make([]symbolEntry, 0, len(symbols))
+	for command, glyph := range symbols {
+		entries = append(entries, symbolEntry{command, glyph, symbolCategory(command, glyph)})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Category != entries[j].Category {
+			return rank[entries[i].Category] < rank[entries[j].Category]
+		}
+		return entries[i].Command < entries[j].Command
+	})
+	return entries
+}
+
+// Substring match on the command name, or the whole group when the query names it.
+// Results keep the grouped order, scattered fuzzy matches would drown short names
+func filterSymbols(entries []symbolEntry, query string) []symbolEntry {
+	query = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(query), "\\"))
+	var matches []symbolEntry
+	for _, entry := range entries {
+		byName := strings.Contains(strings.ToLower(entry.Command), query)
+		if byName || strings.EqualFold(query, entry.Category) {
+			matches = append(matches, entry)
+		}
+	}
+	return matches
+}
+
+// Searchable list of math symbols, the chosen command is typed at the editor cursor
+type symbolPicker struct {
+	active   bool
+	entries  []symbolEntry
+	matches  []symbolEntry
+	selected int
+	input    textinput.Model
+}
+
+func (p *symbolPicker) open(symbols map[string]string) {
+	p.active = true
+	p.entries = symbolGroups(symbols)
+	p.input = textinput.New()
+	p.input.Placeholder = "Search symbols"
+	p.input.Focus()
+	p.filter()
+}
+
+func (p *symbolPicker) filter() {
+	p.matches = filterSymbols(p.entries, p.input.Value())
+	p.selected = 0
+}
+
+func (m model) updateSymbols(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "esc", "ctrl+s":
+		m.symbols.active = false
+		return m, nil
+	case "ctrl+c":
+		m.symbols.active = false
+		return m.requestQuit(quitApp)
+	case "up", "ctrl+k":
+		if m.symbols.selected > 0 {
+			m.symbols.selected--
+		}
+		return m, nil
+	case "down", "ctrl+j":
+		if m.symbols.selected < len(m.symbols.matches)-1 {
+			m.symbols.selected++
+		}
+		return m, nil
+	case "enter":
+		m.symbols.active = false
+		if m.symbols.selected < len(m.symbols.matches) {
+			m.document.editor.InsertString(m.symbols.matches[m.symbols.selected].Command)
+		}
+		return m, nil
+	}
+
+	var cmd tea.Cmd
+	m.symbols.input, cmd = m.symbols.input.Update(msg)
+	m.symbols.filter()
+	return m, cmd
+}
+
+func (m model) viewSymbols() string {
+	theme := m.getCurrentTheme()
+
+	boxStyle := lipgloss.NewStyle().
+		Border(lipgloss.RoundedBorder()).
+		BorderForeground(theme.Primary).
+		Padding(0, 1).
+		Width(40)
+
+	groupStyle := lipgloss.NewStyle().Foreground(theme.Primary).Bold(true)
+	nameStyle := lipgloss.NewStyle().Foreground(theme.Foreground)
+	selectedStyle := lipgloss.NewStyle().Foreground(theme.Accent).Bold(true)
+	mutedStyle := lipgloss.NewStyle().Foreground(theme.Muted)
+
+	var content strings.Builder
+	content.WriteString(m.symbols.input.View())
+	content.WriteString("\n")
+
+	const visible = 12
+	start := 0
+	if m.symbols.selected >= visible {
+		start = m.symbols.selected - visible + 1
+	}
+	end := start + visible
+	if end > len(m.symbols.matches) {
+		end = len(m.symbols.matches)
+	}
+
+	if len(m.symbols.matches) == 0 {
+		content.WriteString("\n" + mutedStyle.Render("No matching symbols"))
+	}
+	group := ""
+	for i := start; i < end; i++ {
+		entry := m.symbols.matches[i]
+		if entry.Category != group {
+			group = entry.Category
+			content.WriteString("\n" + groupStyle.Render(group) + "\n")
+		}
+		style, prefix := nameStyle, "  "
+		if i == m.symbols.selected {
+			style, prefix = selectedStyle, "> "
+		}
+		content.WriteString(style.Render(fmt.Sprintf("%s%s  %s", prefix, entry.Glyph, entry.Command)))
+		if i < end-1 {
+			content.WriteString("\n")
+		}
+	}
+
+	return lipgloss.Place(m.width, m.height, lipgloss.Center, lipgloss.Center, boxStyle.Render(content.String()))
+}
+
+// Characters of context shown on each side of a search match
+const searchContext = 20
+
+type searchMatch struct {
+	Block int
+	Type  blockType
+	// Byte offsets of the match in the block content
+	Start, End int
+	// One line snippet around the match, which sits at Context[Before:After]
+	Context       string
+	Before, After int
+}
+
+// End of query when content starts with it ignoring case, -1 otherwise. Compared rune by
+// rune since lower-casing can change a string's length
+func prefixFold(content, query string) int {
+	i := 0
+	for _, q := range query {
+		if i >= len(content) {
+			return -1
+		}
+		r, size := utf8.DecodeRuneInString(content[i:])
+		if r != q && unicode.ToLower(r) != unicode.ToLower(q) {
+			return -1
+		}
+		i += size
+	}
+	return i
+}
+
+// Every occurrence of query in the blocks, in document order. Matches don't overlap
+func findMatches(blocks []ContentBlock, query string, caseSensitive bool) []searchMatch {
+	if query == "" {
+		return nil
+	}
+
+	var matches []searchMatch
+	for index, block := range blocks {
+		content := block.Content
+		for i := 0; i < len(content); {
+			end := -1
+			if caseSensitive {
+				if strings.HasPrefix(content[i:], query) {
+					end = i + len(query)
+				}
+			} else {
+				end = prefixFold(content[i:], query)
+				if end >= 0 {
+					end += i
+				}
+			}
+			if end < 0 {
+				_, size := utf8.DecodeRuneInString(content[i:])
+				i += size
+				continue
+			}
+
+			match := searchMatch{Block: index, Type: block.Type, Start: i, End: end}
+			match.Context, match.Before, match.After = matchContext(content, i, end)
+			matches = append(matches, match)
+			i = end
+		}
+	}
+	return matches
+}
+
+// Up to searchContext runes either side of content[start:end], with newlines flattened and
+// an ellipsis where the snippet was cut
+func matchContext(content string, start, end int) (string, int, int) {
+	before := []rune(content[:start])
+	after := []rune(content[end:])
+
+	prefix := ""
+	if len(before) > searchContext {
+		before = before[len(before)-searchContext:]
+		prefix = "…"
+	}
+	suffix := ""
+	if len(after) > searchContext {
+		after = after[:searchContext]
+		suffix = "…"
+	}
+
+	flatten := strings.NewReplacer("\n", " ", "\t", " ")
+	head := prefix + flatten.Replace(string(before))
+	match := flatten.Replace(content[start:end])
+	return head + match + flatten.Replace(string(after)) + suffix, len(head), len(head) + len(match)
+}
+
+// Document-wide search, enter moves to the block of the selected match
+type documentSearch struct {
+	active        bool
+	blocks        []ContentBlock
+	matches       []searchMatch
+	selected      int
+	caseSensitive bool
+	input         textinput.Model
+}
+
+func (s *documentSearch) open(blocks []ContentBlock) {
+	s.active = true
+	s.blocks = blocks
+	s.input = textinput.New()
+	s.input.Placeholder = "Search the document"
+	s.input.Focus()
+	s.filter()
+}
+
+func (s *documentSearch) filter() {
+	s.matches = findMatches(s.blocks, s.input.Value(), s.caseSensitive)
+	s.selected = 0
+}
+
+func (m model) updateSearch(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "esc":
+		m.search.active = false
+		return m, nil
+	case "ctrl+c":
+		m.search.active = false
+		return m.requestQuit(quitApp)
+	case "up", "ctrl+k":
+		if m.search.selected > 0 {
+			m.search.selected--
+		}
+		return m, nil
+	case "down", "ctrl+j":
+		if m.search.selected < len(m.search.matches)-1 {
+			m.search.selected++
+		}
+		return m, nil
+	case "tab":
+		m.search.caseSensitive = !m.search.caseSensitive
+		m.search.filter()
+		return m, nil
+	case "enter":
+		m.search.active = false
+		if m.search.selected < len(m.search.matches) {
+			match := m.search.matches[m.search.selected]
+			if match.Block < len(m.document.blocks) {
+				m.document.currentBlock = match.Block
+				m.document.editor.SetValue(m.document.blocks[match.Block].Content)
+				setEditorCursor(&m.document.editor, match.Start)
+				m.revealCurrentBlock()
+			}
+		}
+		return m, nil
+	}
+
+	var cmd tea.Cmd
+	m.search.input, cmd = m.search.input.Update(msg)
+	m.search.filter()
+	return m, cmd
+}
+
+func (m model) viewSearch() string {
+	theme := m.getCurrentTheme()
+
+	boxStyle := lipgloss.NewStyle().
+		Border(lipgloss.RoundedBorder()).
+		BorderForeground(theme.Primary).
+		Padding(0, 1).
+		Width(70)
+
+	entryStyle := lipgloss.NewStyle().Foreground(theme.Foreground)
+	selectedStyle := lipgloss.NewStyle().Foreground(theme.Accent).Bold(true)
+	highlightStyle := lipgloss.NewStyle().Background(theme.Accent).Foreground(theme.Background)
+	mutedStyle := lipgloss.NewStyle().Foreground(theme.Muted)
+
+	var content strings.Builder
+	content.WriteString(m.search.input.View())
+	content.WriteString("\n")
+
+	caseLabel := "ignoring case"
+	if m.search.caseSensitive {
+		caseLabel = "matching case"
+	}
+	count := len(m.search.matches)
+	summary := fmt.Sprintf("%d %s, %s", count, plural(count, "match", "matches"), caseLabel)
+	content.WriteString(mutedStyle.Render(summary) + "\n\n")
+
+	const visible = 12
+	start := 0
+	if m.search.selected >= visible {
+		start = m.search.selected - visible + 1
+	}
+	end := start + visible
+	if end > len(m.search.matches) {
+		end = len(m.search.matches)
+	}
+
+	if m.search.input.Value() != "" && len(m.search.matches) == 0 {
+		content.WriteString(mutedStyle.Render("No matches") + "\n")
+	}
+	for i := start; i < end; i++ {
+		match := m.search.matches[i]
+		style, prefix := entryStyle, "  "
+		if i == m.search.selected {
+			style, prefix = selectedStyle, "> "
+		}
+		label := fmt.Sprintf("%sBlock %d (%s): ", prefix, match.Block+1, match.Type)
+		content.WriteString(style.Render(label+match.Context[:match.Before]) +
+			highlightStyle.Render(match.Context[match.Before:match.After]) +
+			style.Render(match.Context[match.After:]) + "\n")
+	}
+
+	content.WriteString("\n")
+	content.WriteString(mutedStyle.Render("up/down: move | enter: jump | tab: match case | esc: close"))
+
+	return lipgloss.Place(m.width, m.height, lipgloss.Center, lipgloss.Center, boxStyle.Render(content.String()))
+}
+
+// Runs an edit action by replaying its key binding, so the palette can't drift from the keys
+func replayKey(key string) func(model) (tea.Model, tea.Cmd) {
+	return func(m model) (tea.Model, tea.Cmd) {
+		return m.updateEdit(keyMsgFor(key))
+	}
+}
+
+func keyMsgFor(key string) tea.KeyMsg {
+	for t := tea.KeyType(-100); t <= 127; t++ {
+		if t != tea.KeyRunes && t != tea.KeySpace && (tea.KeyMsg{Type: t}).String() == key {
+			return tea.KeyMsg{Type: t}
+		}
+	}
+	if key == " " {
+		return tea.KeyMsg{Type: tea.KeySpace, Runes: []rune(" ")}
+	}
+	return tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(key)}
+}
+
+func (m model) editPaletteEntries() []paletteEntry {
+	k := m.keys
+	actions := []struct{ name, key string }{
+		{"New block", k.NewBlock},
+		{"New block of the current type", k.SameTypeBlock},
+		{"Duplicate block", k.DuplicateBlock},
+		{"Select blocks", k.SelectBlocks},
+		{"Delete block", k.DeleteBlock},
+		{"Convert to math", k.MathBlock},
+		{"Convert to code", k.CodeBlock},
+		{"Convert to list", k.ListBlock},
+		{"Convert to table", k.TableBlock},
+		{"Convert to raw LaTeX", k.RawBlock},
+		{"Cycle block type", k.CycleBlockType},
+		{"Convert to image", k.ImageBlock},
+		{"Save document", k.SaveDocument},
+		{"Save as", k.SaveAs},
+		{"Export", k.Export},
+		{"Export math block as an image", k.ExportMath},
+		{"Toggle vim mode", k.ToggleVim},
+		{"Switch theme", k.CycleTheme},
+		{"Start timer", k.Timer},
+		{"Document notes", k.Notes},
+		{"Editor only view", k.EditorOnly},
+		{"Split view", k.SplitView},
+		{"Preview only view", k.PreviewOnly},
+		{"Split preset 1", k.SplitPreset1},
+		{"Split preset 2", k.SplitPreset2},
+		{"Split preset 3", k.SplitPreset3},
+		{"Reset split", k.ResetSplit},
+		{"Fold block", k.ToggleFold},
+		{"Fold all blocks", k.FoldAll},
+		{"Unfold all blocks", k.UnfoldAll},
+		{"Pin block", k.PinBlock},
+		{"Comment on block", k.Comment},
+		{"List block comments", k.Comments},
+		{"Search the document", k.Search},
+		{"Toggle heading numbering", k.NumberHeading},
+		{"Toggle code wrapping", k.ToggleWrap},
+		{"Toggle preview wrapping", k.PreviewWrap},
+		{"Toggle code line numbers", k.LineNumbers},
+		{"Set code language", k.CodeLanguage},
+		{"Tidy empty and split blocks", k.Tidy},
+		{"Toggle raw LaTeX text", k.RawText},
+		{"Copy block to clipboard", k.CopyBlock},
+		{"Paste clipboard as block", k.PasteBlock},
+		{"Quick preview of the current block", k.MathPreview},
+		{"Save as template", k.SaveTemplate},
+		{"Insert horizontal rule", k.RuleBlock},
+		{"Next diagnostic", k.NextDiagnostic},
+		{"Previous diagnostic", k.PrevDiagnostic},
+		{"Edit block in $EDITOR", k.ExternalEditor},
+		{"Document statistics", k.Stats},
+		{"Go to heading", k.Outline},
+		{"Changes since last save", k.DiffView},
+		{"Render cache statistics", k.CacheStats},
+		{"Back to menu", k.Quit},
+	}
+
+	entries := make([]paletteEntry, len(actions))
+	for i, action := range actions {
+		entries[i] = paletteEntry{Name: action.name, Key: keyLabel(action.key), Run: replayKey(action.key)}
+	}
+	return entries
+}
+
+func (m model) viewPalette() string {
+	theme := m.getCurrentTheme()
+
+	boxStyle := lipgloss.NewStyle().
+		Border(lipgloss.RoundedBorder()).
+		BorderForeground(theme.Primary).
+		Padding(0, 1).
+		Width(50)
+
+	nameStyle := lipgloss.NewStyle().Foreground(theme.Foreground)
+	selectedStyle := lipgloss.NewStyle().Foreground(theme.Accent).Bold(true)
+	keyStyle := lipgloss.NewStyle().Foreground(theme.Muted)
+
+	var content strings.Builder
+	content.WriteString(m.palette.input.View())
+	content.WriteString("\n\n")
+
+	// Keep the selection inside a window of ten rows
+	const visible = 10
+	start := 0
+	if m.palette.selected >= visible {
+		start = m.palette.selected - visible + 1
+	}
+	end := start + visible
+	if end > len(m.palette.matches) {
+		end = len(m.palette.matches)
+	}
+
+	if len(m.palette.matches) == 0 {
+		content.WriteString(keyStyle.Render("No matching actions"))
+	}
+	for i := start; i < end; i++ {
+		entry := m.palette.matches[i]
+		style, prefix := nameStyle, "  "
+		if i == m.palette.selected {
+			style, prefix = selectedStyle, "> "
+		}
+		name := style.Render(prefix + entry.Name)
+		gap := 48 - lipgloss.Width(name) - lipgloss.Width(entry.Key)
+		if gap < 1 {
+			gap = 1
+		}
+		content.WriteString(name + strings.Repeat(" ", gap) + keyStyle.Render(entry.Key))
+		if i < end-1 {
+			content.WriteString("\n")
+		}
+	}
+
+	return lipgloss.Place(m.width, m.height, lipgloss.Center, lipgloss.Center, boxStyle.Render(content.String()))
+}
+
+// A failed export keeps the whole reason on screen, for PDF that includes the tail of the LaTeX log
+func (m model) viewExportError() string {
+	theme := m.getCurrentTheme()
+
+	boxStyle := lipgloss.NewStyle().
+		Border(lipgloss.RoundedBorder()).
+		BorderForeground(theme.Error).
+		Padding(0, 1).
+		Width(80)
+
+	titleStyle := lipgloss.NewStyle().Foreground(theme.Error).Bold(true)
+	mutedStyle := lipgloss.NewStyle().Foreground(theme.Muted)
+
+	lines := strings.Split(m.document.exportError, "\n")
+	// The first line says what went wrong, the end of a long log is what's worth keeping
+	if limit := m.height - 8; limit > 1 && len(lines) > limit {
+		lines = append(lines[:1:1], lines[len(lines)-limit+1:]...)
+	}
+
+	var content strings.Builder
+	content.WriteString(titleStyle.Render("Export failed"))
+	content.WriteString("\n\n")
+	content.WriteString(strings.Join(lines, "\n"))
+	content.WriteString("\n\n")
+	content.WriteString(mutedStyle.Render("esc: close"))
+
+	return lipgloss.Place(m.width, m.height, lipgloss.Center, lipgloss.Center, boxStyle.Render(content.String()))
+}
+
+func (m model) viewComments() string {
+	theme := m.getCurrentTheme()
+
+	boxStyle := lipgloss.NewStyle().
+		Border(lipgloss.RoundedBorder()).
+		BorderForeground(theme.Primary).
+		Padding(0, 1).
+		Width(60)
+
+	titleStyle := lipgloss.NewStyle().Foreground(theme.Primary).Bold(true)
+	mutedStyle := lipgloss.NewStyle().Foreground(theme.Muted)
+	commentStyle := lipgloss.NewStyle().Foreground(theme.Foreground)
+	selectedStyle := lipgloss.NewStyle().Foreground(theme.Accent).Bold(true)
+
+	commented := commentedBlocks(m.document.blocks)
+
+	var content strings.Builder
+	content.WriteString(titleStyle.Render("Comments"))
+	content.WriteString("\n\n")
+
+	if len(commented) == 0 {
+		content.WriteString(mutedStyle.Render("No block has a comment"))
+		content.WriteString("\n")
+	}
+
+	// Two lines per comment, keep the selection inside the visible window
+	visible := (m.height - 8) / 2
+	if visible < 2 {
+		visible = 2
+	}
+	start := 0
+	if m.document.commentSelected >= visible {
+		start = m.document.commentSelected - visible + 1
+	}
+	end := start + visible
+	if end > len(commented) {
+		end = len(commented)
+	}
+
+	for i := start; i < end; i++ {
+		block := m.document.blocks[commented[i]]
+		style, prefix := commentStyle, "  "
+		if i == m.document.commentSelected {
+			style, prefix = selectedStyle, "> "
+		}
+		content.WriteString(style.Render(prefix + block.Comment))
+		content.WriteString("\n")
+		content.WriteString(mutedStyle.Render(fmt.Sprintf("    block %d · %s", commented[i]+1, blockSummary(block))))
+		content.WriteString("\n")
+	}
+
+	content.WriteString("\n")
+	content.WriteString(mutedStyle.Render("j/k: move | enter: jump | esc: close"))
+
+	return lipgloss.Place(m.width, m.height, lipgloss.Center, lipgloss.Center, boxStyle.Render(content.String()))
+}
+
+func (m model) viewNotes() string {
+	theme := m.getCurrentTheme()
+
+	boxStyle := lipgloss.NewStyle().
+		Border(lipgloss.RoundedBorder()).
+		BorderForeground(theme.Primary).
+		Padding(0, 1)
+
+	titleStyle := lipgloss.NewStyle().Foreground(theme.Primary).Bold(true)
+	mutedStyle := lipgloss.NewStyle().Foreground(theme.Muted)
+
+	var content strings.Builder
+	content.WriteString(titleStyle.Render("Notes"))
+	content.WriteString("\n\n")
+	content.WriteString(m.notes.View())
+	content.WriteString("\n\n")
+	content.WriteString(mutedStyle.Render("Saved with the document, left out of exports | esc: close"))
+
+	return lipgloss.Place(m.width, m.height, lipgloss.Center, lipgloss.Center, boxStyle.Render(content.String()))
+}
+
+func (m model) viewOutline() string {
+	theme := m.getCurrentTheme()
+
+	boxStyle := lipgloss.NewStyle().
+		Border(lipgloss.RoundedBorder()).
+		BorderForeground(theme.Primary).
+		Padding(0, 1).
+		Width(60)
+
+	titleStyle := lipgloss.NewStyle().Foreground(theme.Primary).Bold(true)
+	mutedStyle := lipgloss.NewStyle().Foreground(theme.Muted)
+	entryStyle := lipgloss.NewStyle().Foreground(theme.Foreground)
+	currentStyle := lipgloss.NewStyle().Foreground(theme.Primary)
+	selectedStyle := lipgloss.NewStyle().Foreground(theme.Accent).Bold(true)
+
+	var content strings.Builder
+	content.WriteString(titleStyle.Render("Outline"))
+	content.WriteString("\n\n")
+
+	if len(m.document.outline) == 0 {
+		content.WriteString(mutedStyle.Render("No headings in this document"))
+		content.WriteString("\n")
+	}
+
+	// Keep the selection inside the visible window
+	visible := m.height - 8
+	if visible < 3 {
+		visible = 3
+	}
+	start := 0
+	if m.document.outlineSelected >= visible {
+		start = m.document.outlineSelected - visible + 1
+	}
+	end := start + visible
+	if end > len(m.document.outline) {
+		end = len(m.document.outline)
+	}
+
+	section := outlineSection(m.document.outline, m.document.currentBlock)
+	for i := start; i < end; i++ {
+		entry := m.document.outline[i]
+		style, prefix := entryStyle, "  "
+		if i == section {
+			style = currentStyle
+		}
+		if i == m.document.outlineSelected {
+			style, prefix = selectedStyle, "> "
+		}
+		title := entry.title
+		if title == "" {
+			title = "(untitled)"
+		}
+		content.WriteString(style.Render(prefix + strings.Repeat("  ", entry.level-1) + title))
+		content.WriteString("\n")
+	}
+
+	content.WriteString("\n")
+	content.WriteString(mutedStyle.Render("j/k: move | enter: jump | esc: close"))
+
+	return lipgloss.Place(m.width, m.height, lipgloss.Center, lipgloss.Center, boxStyle.Render(content.String()))
+}
+
+func (m model) viewDiff() string {
+	theme := m.getCurrentTheme()
+
+	boxStyle := lipgloss.NewStyle().
+		Border(lipgloss.RoundedBorder()).
+		BorderForeground(theme.Primary).
+		Padding(0, 1).
+		Width(60)
+
+	titleStyle := lipgloss.NewStyle().Foreground(theme.Primary).Bold(true)
+	mutedStyle := lipgloss.NewStyle().Foreground(theme.Muted)
+	markers := map[changeKind]lipgloss.Style{
+		blockAdded:   lipgloss.NewStyle().Foreground(theme.Success).Bold(true),
+		blockRemoved: lipgloss.NewStyle().Foreground(theme.Error).Bold(true),
+		blockChanged: lipgloss.NewStyle().Foreground(theme.Warning).Bold(true),
+	}
+	symbols := map[changeKind]string{blockAdded: "+", blockRemoved: "-", blockChanged: "~"}
+
+	var content strings.Builder
+	if m.document.saved == nil {
+		content.WriteString(titleStyle.Render("Changes (never saved)"))
+	} else {
+		content.WriteString(titleStyle.Render("Changes since last save"))
+	}
+	content.WriteString("\n\n")
+
+	visible := m.height - 8
+	if visible < 3 {
+		visible = 3
+	}
+	start := m.document.diffOffset
+	end := start + visible
+	if end > len(m.document.diff) {
+		end = len(m.document.diff)
+	}
+
+	if len(m.document.diff) == 0 {
+		content.WriteString(mutedStyle.Render("No changes"))
+		content.WriteString("\n")
+	}
+	for _, change := range m.document.diff[start:end] {
+		position := "removed"
+		if change.kind != blockRemoved {
+			position = fmt.Sprintf("block %d", change.index)
+		}
+		content.WriteString(markers[change.kind].Render(symbols[change.kind]))
+		content.WriteString(" " + mutedStyle.Render(fmt.Sprintf("%-9s", position)) + " " + blockSummary(change.block))
+		content.WriteString("\n")
+	}
+	if end < len(m.document.diff) {
+		content.WriteString(mutedStyle.Render(fmt.Sprintf("… %d more", len(m.document.diff)-end)))
+		content.WriteString("\n")
+	}
+
+	content.WriteString("\n")
+	content.WriteString(mutedStyle.Render("j/k: scroll | esc: close"))
+
+	return lipgloss.Place(m.width, m.height, lipgloss.Center, lipgloss.Center, boxStyle.Render(content.String()))
+}
+
+// Leaves right away when the document is clean, otherwise asks to save or discard first
+func (m model) requestQuit(action quitAction) (tea.Model, tea.Cmd) {
+	if m.document.modified {
+		m.quitPrompt = action
+		return m, nil
+	}
+	return m.performQuit(action)
+}
+
+func (m model) performQuit(action quitAction) (tea.Model, tea.Cmd) {
+	// Leaving with nothing unsaved, whether saved or discarded, makes the backup obsolete
+	if !m.document.modified && (m.mode == modeEdit || action == quitApp) {
+		removeRecovery(m.document.filepath)
+	}
+
+	switch action {
+	case quitToMenu:
+		m.mode = modeMenu
+	case quitApp:
+		m.saveUserPreferences()
+		return m, tea.Quit
+	}
+	return m, nil
+}
+
+func (m model) updateQuitPrompt(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	action := m.quitPrompt
+
+	switch msg.String() {
+	case "s":
+		// The quit goes ahead once the save has landed, a failed save keeps the document open
+		m.quitPrompt = quitNone
+		m.pendingQuit = action
+		m.mode = modeEdit
+		return m, m.saveDocument()
+	case "d":
+		m.quitPrompt = quitNone
+		m.document.modified = false
+		return m.performQuit(action)
+	case "esc":
+		m.quitPrompt = quitNone
+	}
+	return m, nil
+}
+
+// Confirming the path turns the current block into an image, keeping any alt text it had
+func (m model) updateImagePrompt(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.Type {
+	case tea.KeyEsc:
+		m.document.imagePrompt = false
+		m.document.command.Blur()
+		return m, nil
+	case tea.KeyEnter:
+		m.document.imagePrompt = false
+		m.document.command.Blur()
+
+		path := strings.TrimSpace(m.document.command.Value())
+		if path == "" || len(m.document.blocks) <= m.document.currentBlock {
+			return m, nil
+		}
+
+		block := &m.document.blocks[m.document.currentBlock]
+		image := imageRef{Path: path}
+		if block.Type == blockImage {
+			image.Alt = parseImage(block.Content).Alt
+		}
+		block.Type = blockImage
+		block.Content = image.String()
+		m.document.editor.SetValue(block.Content)
+		m.document.modified = true
+		m.document.needsRefresh = true
+		return m, nil
+	}
+
+	var cmd tea.Cmd
+	m.document.command, cmd = m.document.command.Update(msg)
+	return m, cmd
+}
+
+func (m model) updateCommentPrompt(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.Type {
+	case tea.KeyEsc:
+		m.document.commentPrompt = false
+		m.document.command.Blur()
+		return m, nil
+	case tea.KeyEnter:
+		m.document.commentPrompt = false
+		m.document.command.Blur()
+
+		// An empty answer removes the comment
+		comment := strings.TrimSpace(m.document.command.Value())
+		if len(m.document.blocks) > m.document.currentBlock && m.document.blocks[m.document.currentBlock].Comment != comment {
+			m.document.blocks[m.document.currentBlock].Comment = comment
+			m.document.modified = true
+		}
+		return m, nil
+	}
+
+	var cmd tea.Cmd
+	m.document.command, cmd = m.document.command.Update(msg)
+	return m, cmd
+}
+
+func (m model) updateLanguagePrompt(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.Type {
+	case tea.KeyEsc:
+		m.document.languagePrompt = false
+		m.document.command.Blur()
+		return m, nil
+	case tea.KeyEnter:
+		m.document.languagePrompt = false
+		m.document.command.Blur()
+
+		// An empty answer goes back to detecting the language
+		language := strings.ToLower(strings.TrimSpace(m.document.command.Value()))
+		if len(m.document.blocks) > m.document.currentBlock && m.document.blocks[m.document.currentBlock].Language != language {
+			m.document.blocks[m.document.currentBlock].Language = language
+			m.document.modified = true
+			m.document.needsRefresh = true
+		}
+		return m, nil
+	}
+
+	var cmd tea.Cmd
+	m.document.command, cmd = m.document.command.Update(msg)
+	return m, cmd
+}
+
+func (m model) updateTidyPrompt(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	var merge bool
+	switch msg.String() {
+	case "y":
+		merge = true
+	case "n":
+		merge = false
+	case "esc":
+		m.document.tidyPrompt = false
+		return m, nil
+	default:
+		return m, nil
+	}
+	m.document.tidyPrompt = false
+
+	currentID := ""
+	if len(m.document.blocks) > m.document.currentBlock {
+		currentID = m.document.blocks[m.document.currentBlock].ID
+	}
+	blocks, ids, result := tidyBlocks(m.document.blocks, merge)
+	if result.removed == 0 && result.merged == 0 && !result.renumbered {
+		m.document.notice = "Nothing to tidy"
+		return m, nil
+	}
+
+	m.document.blocks = blocks
+	m.document.nextID = len(blocks) + 1
+	if m.document.pinnedID != "" {
+		m.document.pinnedID = ids[m.document.pinnedID]
+	}
+	collapsed := make(map[string]bool)
+	for id, folded := range m.document.collapsed {
+		if newID, ok := ids[id]; ok && folded {
+			collapsed[newID] = true
+		}
+	}
+	m.document.collapsed = collapsed
+
+	// Stay on the block the cursor was in, or where it was when that block went away
+	if index := blockIndex(blocks, ids[currentID]); index >= 0 {
+		m.document.currentBlock = index
+	} else if m.document.currentBlock >= len(blocks) {
+		m.document.currentBlock = len(blocks) - 1
+	}
+	m.document.editor.SetValue(blocks[m.document.currentBlock].Content)
+	m.document.modified = true
+	m.document.needsRefresh = true
+	m.document.notice = result.String()
+	return m, nil
+}
+
+type tidyResult struct {
+	removed, merged int
+	renumbered      bool
+}
+
+func (r tidyResult) String() string {
+	var parts []string
+	if r.removed > 0 {
+		parts = append(parts, fmt.Sprintf("removed %d empty %s", r.removed, plural(r.removed, "block", "blocks")))
+	}
+	if r.merged > 0 {
+		parts = append(parts, fmt.Sprintf("merged %d %s into the one before", r.merged, plural(r.merged, "block", "blocks")))
+	}
+	if r.renumbered {
+		parts = append(parts, "renumbered block IDs")
+	}
+	return "Tidied: " + strings.Join(parts, ", ")
+}
+
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return one
+	}
+	return many
+}
+
+// Whether next can be folded into block by tidy. Headings, tables, images and rules stay
+// separate, and code only merges with code in the same language and listing options
+func mergeableBlocks(block, next ContentBlock) bool {
+	if block.Type != next.Type {
+		return false
+	}
+	// Code blocks stay apart, each is its own listing with its own language
+	switch block.Type {
+	case blockText, blockMath, blockList, blockRawLaTeX:
+	default:
+		return false
+	}
+	return block.NoWrap == next.NoWrap &&
+		block.LineNumbers == next.LineNumbers && block.RawText == next.RawText
+}
+
+// Removes empty blocks, merges runs of mergeable blocks when asked and renumbers the IDs from 1.
+// The only block of a document is never removed. ids maps every old ID to the new ID of the
+// block it ended up in, removed blocks are left out
+func tidyBlocks(blocks []ContentBlock, merge bool) ([]ContentBlock, map[string]string, tidyResult) {
+	var result tidyResult
+	var tidied []ContentBlock
+	// Old IDs folded into each kept block, in order
+	var sources [][]string
+
+	for _, block := range blocks {
+		if strings.TrimSpace(block.Content) == "" && block.Type != blockHR {
+			result.removed++
+			continue
+		}
+		if last := len(tidied) - 1; merge && last >= 0 && mergeableBlocks(tidied[last], block) {
+			separator := "\n"
+			if block.Type == blockText {
+				separator = "\n\n"
+			}
+			tidied[last].Content += separator + block.Content
+			tidied[last].Rendered = ""
+			if tidied[last].Comment != "" && block.Comment != "" {
+				tidied[last].Comment += "; " + block.Comment
+			} else if block.Comment != "" {
+				tidied[last].Comment = block.Comment
+			}
+			sources[last] = append(sources[last], block.ID)
+			result.merged++
+			continue
+		}
+		tidied = append(tidied, block)
+		sources = append(sources, []string{block.ID})
+	}
+	if len(tidied) == 0 && len(blocks) > 0 {
+		tidied = []ContentBlock{blocks[0]}
+		sources = [][]string{{blocks[0].ID}}
+		result.removed--
+	}
+
+	ids := make(map[string]string)
+	for i := range tidied {
+		id := strconv.Itoa(i + 1)
+		if tidied[i].ID != id {
+			result.renumbered = true
+		}
+		tidied[i].ID = id
+		for _, old := range sources[i] {
+			ids[old] = id
+		}
+	}
+	return tidied, ids, result
+}
+
+// Indexes of blocks carrying a comment, in document order
+func commentedBlocks(blocks []ContentBlock) []int {
+	var indexes []int
+	for i, block := range blocks {
+		if block.Comment != "" {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+func (m model) updateComments(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	commented := commentedBlocks(m.document.blocks)
+	switch msg.String() {
+	case "esc", "q", m.keys.Comments:
+		m.document.showComments = false
+	case "j", "down":
+		if m.document.commentSelected < len(commented)-1 {
+			m.document.commentSelected++
+		}
+	case "k", "up":
+		if m.document.commentSelected > 0 {
+			m.document.commentSelected--
+		}
+	case "enter":
+		m.document.showComments = false
+		if m.document.commentSelected < len(commented) {
+			index := commented[m.document.commentSelected]
+			m.document.currentBlock = index
+			m.document.editor.SetValue(m.document.blocks[index].Content)
+			m.revealCurrentBlock()
+		}
+	}
+	return m, nil
+}
+
+func (m model) updateSaveAsPrompt(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	// Second step, the path is known and exists already
+	if m.document.overwritePath != "" {
+		path := m.document.overwritePath
+		m.document.overwritePath = ""
+		if msg.String() == "y" {
+			return m, m.saveDocumentAs(path)
+		}
+		return m, nil
+	}
+
+	switch msg.Type {
+	case tea.KeyEsc:
+		m.document.saveAsPrompt = false
+		m.document.command.Blur()
+		return m, nil
+	case tea.KeyEnter:
+		m.document.saveAsPrompt = false
+		m.document.command.Blur()
+
+		path := resolveSavePath(m.document.command.Value(), m.browser.currentPath)
+		if path == "" {
+			return m, nil
+		}
+		if needsOverwriteConfirm(path, m.document.filepath) {
+			m.document.overwritePath = path
+			return m, nil
+		}
+		return m, m.saveDocumentAs(path)
+	}
+
+	var cmd tea.Cmd
+	m.document.command, cmd = m.document.command.Update(msg)
+	return m, cmd
+}
+
+func (m model) updateTemplatePrompt(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	// Second step, the name is known and y keeps the text of every block
+	if m.document.templateName != "" {
+		name := m.document.templateName
+		var blank bool
+		switch msg.String() {
+		case "y":
+			blank = false
+		case "n":
+			blank = true
+		case "esc":
+			m.document.templateName = ""
+			return m, nil
+		default:
+			return m, nil
+		}
+		m.document.templateName = ""
+
+		template := documentTemplate(name, m.document.blocks, m.document.variables, blank)
+		path, err := saveUserTemplate(template)
+		if err != nil {
+			m.document.commandError = fmt.Sprintf("Could not save template: %v", err)
+			return m, nil
+		}
+		m.menu.templates = getDefaultTemplates()
+		m.document.notice = fmt.Sprintf("Saved template %q to %s", name, path)
+		return m, nil
+	}
+
+	switch msg.Type {
+	case tea.KeyEsc:
+		m.document.templatePrompt = false
+		m.document.command.Blur()
+		return m, nil
+	case tea.KeyEnter:
+		m.document.templatePrompt = false
+		m.document.command.Blur()
+		m.document.templateName = strings.TrimSpace(m.document.command.Value())
+		return m, nil
+	}
+
+	var cmd tea.Cmd
+	m.document.command, cmd = m.document.command.Update(msg)
+	return m, cmd
+}
+
+func (m model) updateExCommand(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.Type {
+	case tea.KeyEsc:
+		m.document.vim.mode = vimNormal
+		m.document.command.Blur()
+		return m, nil
+	case tea.KeyEnter:
+		m.document.vim.mode = vimNormal
+		m.document.command.Blur()
+
+		ex, err := parseExCommand(m.document.command.Value())
+		if err != nil {
+			m.document.commandError = err.Error()
+			return m, nil
+		}
+
+		switch ex.action {
+		case exWrite:
+			return m, m.saveDocument()
+		case exQuit:
+			if m.document.modified {
+				m.document.commandError = "No write since last change (add ! to override)"
+				return m, nil
+			}
+			m.mode = modeMenu
+		case exForceQuit:
+			m.mode = modeMenu
+		case exWriteQuit:
+			// Leaves once the save has landed, like the quit prompt, so a failed write keeps the document open
+			m.pendingQuit = quitToMenu
+			return m, m.saveDocument()
+		case exGotoBlock:
+			if ex.block > len(m.document.blocks) {
+				m.document.commandError = fmt.Sprintf("Block %d does not exist", ex.block)
+				return m, nil
+			}
+			m.document.currentBlock = ex.block - 1
+			m.document.editor.SetValue(m.document.blocks[m.document.currentBlock].Content)
+			m.revealCurrentBlock()
+		}
+		return m, nil
+	}
+
+	var cmd tea.Cmd
+	m.document.command, cmd = m.document.command.Update(msg)
+	return m, cmd
+}
+
+// Notes are saved with the document, so typing in them counts as a change
+func (m model) updateNotesInput(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	before := m.notes.Value()
+	var cmd tea.Cmd
+	m.notes, cmd = m.notes.Update(msg)
+	if m.notes.Value() != before {
+		m.document.modified = true
+	}
+	return m, cmd
+}
+
+func (m model) updateNotes(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "esc":
+		m.document.showNotes = false
+		m.notes.Blur()
+		return m, nil
+	case "ctrl+c":
+		return m.requestQuit(quitApp)
+	}
+	return m.updateNotesInput(msg)
+}
+
+func (m model) updateTimer(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	var cmds []tea.Cmd
+	var cmd tea.Cmd
+
+	if m.notes.Focused() {
+		if msg.Type == tea.KeyEsc {
+			m.notes.Blur()
+			return m, nil
+		}
+		return m.updateNotesInput(msg)
+	}
+
+	switch msg.String() {
+	case "q":
+		m.mode = modeEdit
+	case "ctrl+c":
+		return m.requestQuit(quitApp)
+	case "enter":
+		if !m.input.Focused() {
+			return m, nil
+		}
+		d, err := time.ParseDuration(m.input.Value())
+		if err == nil && d > 0 {
+			m.pomodoro.enabled = false
+			m.duration = d
+			m.remaining = d
+			m.paused = false
+			m.ticker = time.NewTicker(time.Second)
+			cmds = append(cmds, waitForTick(m.ticker.C))
+		}
+		return m, tea.Batch(cmds...)
+	case "p":
+		if m.ticker != nil {
+			m.paused = true
+			m.ticker.Stop()
+			m.ticker = nil
+		}
+	case "r":
+		if m.paused && m.remaining > 0 {
+			m.paused = false
+			m.ticker = time.NewTicker(time.Second)
+			cmds = append(cmds, waitForTick(m.ticker.C))
+		}
+	case "w":
+		if m.ticker != nil {
+			m.ticker.Stop()
+			m.ticker = nil
+		}
+		m.input.Focus()
+	case "n":
+		m.notes.Focus()
+		cmds = append(cmds, textarea.Blink)
+	case "P":
+		m.input.Blur()
+		m.pomodoro = pomodoroState{enabled: true, phase: phaseWork}
+		return m, m.startPhase()
+	case "s":
+		if m.pomodoro.enabled && !m.input.Focused() {
+			m.pomodoro = m.pomodoro.next(m.preferences.PomodoroCycles)
+			return m, m.startPhase()
+		}
+	case "x":
+		if m.pomodoro.enabled && !m.input.Focused() {
+			m.pomodoro = pomodoroState{enabled: true, phase: phaseWork}
+			return m, m.startPhase()
+		}
+	}
+
+	if m.input.Focused() {
+		m.input, cmd = m.input.Update(msg)
+		cmds = append(cmds, cmd)
+	}
+
+	return m, tea.Batch(cmds...)
+}
+
+func (m model) updateExport(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	if m.export.input.Focused() {
+		if msg.Type == tea.KeyEsc {
+			m.export.input.Blur()
+			return m, nil
+		}
+		if msg.Type == tea.KeyEnter {
+			if m.export.running {
+				return m, nil
+			}
+			filename := strings.TrimSpace(m.export.input.Value())
+			if filename == "" {
+				filename = m.getSmartFilename()
+			}
+			m.export.input.Blur()
+			if m.isLargeExport() {
+				m.export.filename = filename
+				m.export.confirmLarge = true
+				return m, nil
+			}
+			return m.startExport(filename)
+		}
+		var cmd tea.Cmd
+		m.export.input, cmd = m.export.input.Update(msg)
+		return m, cmd
+	}
+
+	if m.export.running {
+		if msg.String() == "ctrl+c" {
+			return m.requestQuit(quitApp)
+		}
+		return m, nil
+	}
+
+	if m.export.confirmLarge {
+		switch msg.String() {
+		case "y":
+			m.export.confirmLarge = false
+			return m.startExport(m.export.filename)
+		case "n", "esc":
+			m.export.confirmLarge = false
+			m.export.input.Focus()
+			return m, textinput.Blink
+		case "ctrl+c":
+			return m.requestQuit(quitApp)
+		}
+		return m, nil
+	}
+
+	if m.export.results != nil {
+		switch msg.String() {
+		case "esc", "enter", "q":
+			m.export.results = nil
+			m.mode = modeEdit
+		case "ctrl+c":
+			return m.requestQuit(quitApp)
+		}
+		return m, nil
+	}
+
+	switch msg.String() {
+	case "q":
+		m.mode = modeEdit
+	case "ctrl+c":
+		return m.requestQuit(quitApp)
+	case "j", "down":
+		if m.export.selected < len(m.export.formats)-1 {
+			m.export.selected++
+		}
+	case "k", "up":
+		if m.export.selected > 0 {
+			m.export.selected--
+		}
+	case "enter":
+		m.export.input.Focus()
+		return m, textinput.Blink
+	}
+	return m, nil
+}
+
+func (m model) startExport(filename string) (tea.Model, tea.Cmd) {
+	m.export.running = true
+	if exportFormat(m.export.selected) == exportAll {
+		return m, m.exportBatch(filename)
+	}
+	return m, m.exportDocument(filename, exportFormat(m.export.selected))
+}
+
+func (m model) exportBlockCount() int {
+	if m.export.blocks != nil {
+		return len(m.export.blocks)
+	}
+	return len(m.document.blocks)
+}
+
+// PDF exports of documents past largeDocumentBlocks ask first, TeX can take minutes on them
+func (m model) isLargeExport() bool {
+	format := exportFormat(m.export.selected)
+	if format != exportPDF && format != exportAll {
+		return false
+	}
+	limit := m.preferences.LargeDocumentBlocks
+	return limit > 0 && m.exportBlockCount() > limit
+}
+
+// Work always leads to a break; every cycles-th completed work phase earns the long one
+func (p pomodoroState) next(cycles int) pomodoroState {
+	if cycles < 1 {
+		cycles = 1
+	}
+
+	if p.phase != phaseWork {
+		p.phase = phaseWork
+		return p
+	}
+
+	p.completed++
+	if p.completed%cycles == 0 {
+		p.phase = phaseLongBreak
+	} else {
+		p.phase = phaseShortBreak
+	}
+	return p
+}
+
+func (p pomodoroPhase) String() string {
+	switch p {
+	case phaseShortBreak:
+		return "Short break"
+	case phaseLongBreak:
+		return "Long break"
+	}
+	return "Work"
+}
+
+func (m model) phaseDuration(phase pomodoroPhase) time.Duration {
+	minutes := m.preferences.PomodoroWork
+	switch phase {
+	case phaseShortBreak:
+		minutes = m.preferences.PomodoroShortBreak
+	case phaseLongBreak:
+		minutes = m.preferences.PomodoroLongBreak
+	}
+	if minutes <= 0 {
+		minutes = 1
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+func (m *model) startPhase() tea.Cmd {
+	if m.ticker != nil {
+		m.ticker.Stop()
+	}
+	m.duration = m.phaseDuration(m.pomodoro.phase)
+	m.remaining = m.duration
+	m.paused = false
+	m.ticker = time.NewTicker(time.Second)
+	return waitForTick(m.ticker.C)
+}
+
+// Called once as the countdown reaches zero, the plain timer stops there and Pomodoro
+// starts the next phase. The notification goes out off the update loop and reports back
+// with a notifyResultMsg
+func (m model) notifyTimerDone() tea.Cmd {
+	if m.notifier == nil {
+		return nil
+	}
+	message := "Time's up"
+	if m.pomodoro.enabled {
+		next := m.pomodoro.next(m.preferences.PomodoroCycles)
+		message = fmt.Sprintf("%s finished, %s next", m.pomodoro.phase, strings.ToLower(next.phase.String()))
+	}
+	notifier := m.notifier
+	return func() tea.Msg {
+		return notifyResultMsg{err: notifier.Notify("Oathkeeper", message)}
+	}
+}
+
+type notifier interface {
+	Notify(title, message string) error
+}
+
+// Rings the terminal bell
+type bellNotifier struct {
+	out io.Writer
+}
+
+func (n bellNotifier) Notify(title, message string) error {
+	_, err := io.WriteString(n.out, "\a")
+	return err
+}
+
+// Shows a desktop notification through a command line tool. The tool is started and left
+// to finish on its own so a slow notification daemon never holds up the timer
+type commandNotifier struct {
+	command func(title, message string) []string
+}
+
+func (n commandNotifier) Notify(title, message string) error {
+	args := n.command(title, message)
+	cmd := exec.Command(args[0], args[1:]...)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
+
+// Tells every notifier, reporting the first failure
+type multiNotifier []notifier
+
+func (n multiNotifier) Notify(title, message string) error {
+	var first error
+	for _, each := range n {
+		if err := each.Notify(title, message); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// The desktop notification tool for this system, nil when none is installed
+func desktopNotifier() notifier {
+	quoted := func(text string) string {
+		return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(text)
+	}
+	tools := []struct {
+		name    string
+		command func(title, message string) []string
+	}{
+		{"notify-send", func(title, message string) []string {
+			return []string{"notify-send", title, message}
+		}},
+		{"osascript", func(title, message string) []string {
+			return []string{"osascript", "-e", fmt.Sprintf(`display notification "%s" with title "%s"`, quoted(message), quoted(title))}
+		}},
+		{"powershell", func(title, message string) []string {
+			single := func(text string) string { return strings.ReplaceAll(text, "'", "''") }
+			script := "Add-Type -AssemblyName System.Windows.Forms; $n = New-Object System.Windows.Forms.NotifyIcon; " +
+				"$n.Icon = [System.Drawing.SystemIcons]::Information; $n.Visible = $true; " +
+				fmt.Sprintf("$n.ShowBalloonTip(5000, '%s', '%s', 'Info'); Start-Sleep 6; $n.Dispose()", single(title), single(message))
+			return []string{"powershell", "-NoProfile", "-Command", script}
+		}},
+	}
+	for _, tool := range tools {
+		if _, err := exec.LookPath(tool.name); err == nil {
+			return commandNotifier{command: tool.command}
+		}
+	}
+	return nil
+}
+
+// Builds the notifier for the timerNotify preference, unknown values ring the bell
+func newNotifier(method string) notifier {
+	bell := bellNotifier{out: os.Stdout}
+	switch method {
+	case "none":
+		return nil
+	case "desktop", "both":
+		desktop := desktopNotifier()
+		if desktop == nil {
+			return bell
+		}
+		if method == "desktop" {
+			return desktop
+		}
+		return multiNotifier{bell, desktop}
+	}
+	return bell
+}
+
+func waitForTick(c <-chan time.Time) tea.Cmd {
+	return func() tea.Msg {
+		return tickMsg(<-c)
+	}
+}
+
+// Text of a heading without its #s, empty for other blocks and the template placeholder
+func headingTitle(block ContentBlock) string {
+	if block.Type != blockHeading {
+		return ""
+	}
+	title := strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(block.Content), "#"))
+	if title == "Document Title" {
+		return ""
+	}
+	return title
+}
+
+// The first real heading, which also names the file when saving
+func documentTitle(blocks []ContentBlock) string {
+	for _, block := range blocks {
+		if title := headingTitle(block); title != "" {
+			return title
+		}
+	}
+	return ""
+}
+
+func (m model) getSmartFilename() string {
+	for _, block := range m.document.blocks {
+		if title := headingTitle(block); title != "" {
+			if result := slugify(title); result != "" {
+				return result
+			}
+		}
+	}
+	
+	if m.document.filepath != "" {
+		base := filepath.Base(m.document.filepath)
+		return strings.TrimSuffix(base, ".oath")
+	}
+	
+	return "document"
+}
+
+// Lowercase, dashes for spaces and nothing but letters, digits and dashes
+func slugify(title string) string {
+	filename := strings.ToLower(title)
+	filename = strings.ReplaceAll(filename, " ", "-")
+	var cleanName strings.Builder
+	for _, r := range filename {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+			cleanName.WriteRune(r)
+		}
+	}
+	return strings.Trim(cleanName.String(), "-")
+}
+
+func (m model) defaultSavePath() string {
+	if m.document.filepath != "" {
+		return m.document.filepath
+	}
+	return filepath.Join(m.browser.currentPath, m.getSmartFilename()+".oath")
+}
+
+func (m model) saveDocument() tea.Cmd {
+	return m.saveDocumentAs(m.defaultSavePath())
+}
+
+// Relative names are taken from the browser directory and .oath is added when there is no extension
+func resolveSavePath(input, base string) string {
+	path := strings.TrimSpace(input)
+	if path == "" {
+		return ""
+	}
+	if strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, path[2:])
+		}
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(base, path)
+	}
+	if filepath.Ext(path) == "" {
+		path += ".oath"
+	}
+	return filepath.Clean(path)
+}
+
+// Saving over the document's own file is a normal save, any other existing file needs a yes first
+func needsOverwriteConfirm(path, current string) bool {
+	if current != "" && filepath.Clean(current) == path {
+		return false
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Creation time to save with: the one the document was opened with, else the one in its own
+// file on disk, else now for a first save. A file being overwritten by save as doesn't count
+func documentCreated(created time.Time, ownPath string, now time.Time) time.Time {
+	if !created.IsZero() {
+		return created
+	}
+	if ownPath == "" {
+		return now
+	}
+	if existing, err := readDocument(ownPath); err == nil && !existing.Created.IsZero() {
+		return existing.Created
+	}
+	return now
+}
+
+func (m model) saveDocumentAs(filename string) tea.Cmd {
+	// Copied up front, edits made while the write is in flight must not end up in the snapshot
+	blocks := append([]ContentBlock(nil), m.document.blocks...)
+	notes := m.notes.Value()
+	created := m.document.created
+	ownPath := ""
+	if m.document.filepath != "" && filepath.Clean(m.document.filepath) == filepath.Clean(filename) {
+		ownPath = filename
+	}
+	return func() tea.Msg {
+		variables := m.document.variables
+		if variables == nil {
+			variables = make(map[string]string)
+		}
+
+		modified := time.Now()
+		doc := OathDocument{
+			Version:   documentVersion,
+			Template:  "custom",
+			Content:   blocks,
+			Variables: variables,
+			Created:   documentCreated(created, ownPath, modified),
+			Modified:  modified,
+			Notes:     notes,
+		}
+
+		var buf bytes.Buffer
+		if err := SaveDocumentToWriter(&buf, doc); err != nil {
+			return documentSavedMsg{err: err}
+		}
+
+		if err := ioutil.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+			return documentSavedMsg{err: err}
+		}
+		return documentSavedMsg{path: filename, blocks: blocks, notes: notes, created: doc.Created, modified: modified}
+	}
+}
+
+// The document as the JSON export writes it: the .oath structure without notes and comments,
+// which are never exported
+func (m model) publicDocument(blocks []ContentBlock) OathDocument {
+	public := make([]ContentBlock, len(blocks))
+	for i, block := range blocks {
+		block.Comment = ""
+		public[i] = block
+	}
+	variables := m.document.variables
+	if variables == nil {
+		variables = make(map[string]string)
+	}
+	modified := m.document.savedAt
+	if m.document.modified || modified.IsZero() {
+		modified = time.Now()
+	}
+	created := m.document.created
+	if created.IsZero() {
+		created = modified
+	}
+	return OathDocument{
+		Version:   documentVersion,
+		Template:  "custom",
+		Content:   public,
+		Variables: variables,
+		Created:   created,
+		Modified:  modified,
+	}
+}
+
+func (m model) exportDocument(filename string, format exportFormat) tea.Cmd {
+	name := m.export.formats[format]
+	blocks := m.export.blocks
+	if blocks == nil {
+		blocks = m.document.blocks
+	}
+	return func() tea.Msg {
+		path, err := m.writeExport(filename, format, blocks)
+		return exportResultMsg{format: name, path: path, err: err}
+	}
+}
+
+// Formats the All entry exports
+var batchFormats = []exportFormat{exportPDF, exportHTML, exportMarkdown, exportUnicode}
+
+// Runs every batch format in turn off the main loop. PDF is skipped when the TeX engine
+// isn't installed, so a machine without TeX still gets the other formats
+func (m model) exportBatch(filename string) tea.Cmd {
+	blocks := m.export.blocks
+	if blocks == nil {
+		blocks = m.document.blocks
+	}
+	return func() tea.Msg {
+		var results []exportResultMsg
+		for _, format := range batchFormats {
+			result := exportResultMsg{format: m.export.formats[format]}
+			if format == exportPDF {
+				if engine, _, err := latexCommand(m.preferences.LaTeXEngine, ""); err != nil {
+					result.err, result.skipped = err, true
+				} else if _, err := exec.LookPath(engine); err != nil {
+					result.err, result.skipped = fmt.Errorf("%s is not installed", engine), true
+				}
+			}
+			if !result.skipped {
+				result.path, result.err = m.writeExport(filename, format, blocks)
+			}
+			results = append(results, result)
+		}
+		return batchExportMsg{results: results}
+	}
+}
+
+// One line verdict on a batch export, e.g. "Exported 3 of 4 formats, 1 skipped"
+func batchSummary(results []exportResultMsg) string {
+	exported, failed, skipped := 0, 0, 0
+	for _, result := range results {
+		switch {
+		case result.skipped:
+			skipped++
+		case result.err != nil:
+			failed++
+		default:
+			exported++
+		}
+	}
+
+	summary := fmt.Sprintf("Exported %d of %d formats", exported, len(results))
+	if failed > 0 {
+		summary += fmt.Sprintf(", %d failed", failed)
+	}
+	if skipped > 0 {
+		summary += fmt.Sprintf(", %d skipped", skipped)
+	}
+	return summary
+}
+
+// Writes blocks as an export next to the browser directory and returns the file it produced
+func (m model) writeExport(filename string, format exportFormat, blocks []ContentBlock) (string, error) {
+	write := func(ext, content string) (string, error) {
+		fullPath := filepath.Join(m.browser.currentPath, filename+ext)
+		return fullPath, ioutil.WriteFile(fullPath, []byte(content), 0644)
+	}
+
+	switch format {
+	case exportPDF:
+		return filepath.Join(m.browser.currentPath, filename+".pdf"), m.generatePDF(blocks, filename)
+	case exportLaTeX:
+		return write(".tex", m.generateLaTeX(blocks))
+	case exportHTML:
+		return write(".html", m.generateHTML(blocks))
+	case exportOfflineHTML:
+		return write(".html", m.generateOfflineHTML(blocks, filename))
+	case exportUnicode:
+		return write(".txt", m.generateUnicode(blocks))
+	case exportMarkdown:
+		return write(".md", m.generateMarkdown(blocks))
+	case exportEPUB:
+		return filepath.Join(m.browser.currentPath, filename+".epub"), m.generateEPUB(blocks, filename)
+	case exportRST:
+		return write(".rst", m.generateRST(blocks))
+	case exportAsciiDoc:
+		return write(".adoc", m.generateAsciiDoc(blocks))
+	case exportOrg:
+		return write(".org", m.generateOrg(blocks))
+	case exportJSON:
+		var buf bytes.Buffer
+		if err := SaveDocumentToWriter(&buf, m.publicDocument(blocks)); err != nil {
+			return "", err
+		}
+		return write(".json", buf.String())
+	}
+	return "", fmt.Errorf("unknown export format %d", format)
+}
+
+var latexEngines = []string{"pdflatex", "xelatex", "lualatex"}
+
+// How many log lines a failed export reports
+const latexLogTail = 20
+
+type latexError struct {
+	Engine  string
+	Pass    int
+	Err     error
+	LogPath string
+	LogTail []string
+}
+
+func (e *latexError) Error() string {
+	msg := fmt.Sprintf("%s failed on pass %d: %v", e.Engine, e.Pass, e.Err)
+	if e.LogPath != "" {
+		msg += "\nLog kept at " + e.LogPath
+	}
+	if len(e.LogTail) > 0 {
+		msg += "\n" + strings.Join(e.LogTail, "\n")
+	}
+	return msg
+}
+
+func (e *latexError) Unwrap() error {
+	return e.Err
+}
+
+// Arguments for one engine run, rejecting engines we don't know how to drive
+func latexCommand(engine, texFile string) (string, []string, error) {
+	for _, known := range latexEngines {
+		if engine == known {
+			return engine, []string{"-interaction=nonstopmode", "-halt-on-error", texFile}, nil
+		}
+	}
+	return "", nil, fmt.Errorf("unsupported LaTeX engine %q (use %s)", engine, strings.Join(latexEngines, ", "))
+}
+
+func latexPasses(passes int) int {
+	if passes < 1 {
+		return 1
+	}
+	if passes > 5 {
+		return 5
+	}
+	return passes
+}
+
+// Options for one lstlisting, only what differs from the \lstset defaults is spelled out
+func listingOptions(block ContentBlock, breakLines bool) string {
+	language := codeLanguage(block)
+	if language == "" {
+		language = "text"
+	}
+
+	options := []string{"language=" + language}
+	if breakLines && block.NoWrap {
+		options = append(options, "breaklines=false")
+	}
+	if block.LineNumbers {
+		options = append(options, "numbers=left")
+	}
+	return strings.Join(options, ",")
+}
+
+// The language set on the block, or a guess from its content when there is none
+func codeLanguage(block ContentBlock) string {
+	if block.Language != "" {
+		return block.Language
+	}
+	return detectLanguage(block.Content)
+}
+
+// Clues for detectLanguage, each line that is, starts with or contains one scores a point
+var languageClues = map[string]struct{ lines, prefixes, contains []string }{
+	"python": {
+		prefixes: []string{"def ", "class ", "import ", "from ", "elif ", "print(", "@"},
+		contains: []string{"self.", "__name__", "None", "True:", "):"},
+	},
+	"go": {
+		prefixes: []string{"package ", "func ", "import (", "type ", "defer ", "go func"},
+		contains: []string{":= ", "fmt.", "err != nil", "chan ", "interface{"},
+	},
+	"javascript": {
+		prefixes: []string{"const ", "let ", "var ", "function ", "export ", "import "},
+		contains: []string{"=> ", "console.log", "require(", "document.", "===", "});"},
+	},
+	"bash": {
+		lines:    []string{"fi", "done", "then", "esac", "ls"},
+		prefixes: []string{"echo ", "cd ", "export ", "sudo ", "git ", "npm ", "apt ", "ls ", "mkdir ", "if [", "while ["},
+		contains: []string{"$(", "${", " | ", " && ", "; then", "; do"},
+	},
+}
+
+// Best guess at a code block's language, empty when nothing stands out. A shebang decides
+// on its own, otherwise every language scores a point per line that looks like it
+func detectLanguage(content string) string {
+	lines := strings.Split(strings.TrimSpace(content), "\n")
+	if first := lines[0]; strings.HasPrefix(first, "#!") {
+		switch {
+		case strings.Contains(first, "python"):
+			return "python"
+		case strings.Contains(first, "node"):
+			return "javascript"
+		case strings.Contains(first, "sh"):
+			return "bash"
+		}
+	}
+
+	scores := map[string]int{}
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		for language, clues := range languageClues {
+			for _, whole := range clues.lines {
+				if line == whole {
+					scores[language]++
+					break
+				}
+			}
+			for _, prefix := range clues.prefixes {
+				if strings.HasPrefix(line, prefix) {
+					scores[language]++
+					break
+				}
+			}
+			for _, clue := range clues.contains {
+				if strings.Contains(line, clue) {
+					scores[language]++
+					break
+				}
+			}
+		}
+	}
+
+	best, bestScore, tied := "", 0, false
+	for language, score := range scores {
+		switch {
+		case score > bestScore:
+			best, bestScore, tied = language, score, false
+		case score == bestScore:
+			tied = true
+		}
+	}
+	if tied {
+		return ""
+	}
+	return best
+}
+
+type tokenKind int
+
+const (
+	tokenPlain tokenKind = iota
+	tokenKeyword
+	tokenString
+	tokenComment
+	tokenNumber
+)
+
+type codeToken struct {
+	Kind tokenKind
+	Text string
+}
+
+// What the preview highlighter needs to know about a language
+type syntax struct {
+	keywords     map[string]bool
+	lineComment  string
+	blockComment [2]string
+	// Characters that open and close a string, backquoted strings take no escapes
+	quotes string
+}
+
+func wordSet(words string) map[string]bool {
+	set := make(map[string]bool)
+	for _, word := range strings.Fields(words) {
+		set[word] = true
+	}
+	return set
+}
+
+var syntaxes = map[string]syntax{
+	"go": {
+		keywords: wordSet(`break case chan const continue default defer else fallthrough for func go goto if
+			import interface map package range return select struct switch type var nil true false iota`),
+		lineComment:  "//",
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"'`",
+	},
+	"python": {
+		keywords: wordSet(`False None True and as assert async await break class continue def del elif else
+			except finally for from global if import in is lambda nonlocal not or pass raise return try while
+			with yield`),
+		lineComment: "#",
+		quotes:      "\"'",
+	},
+	"javascript": {
+		keywords: wordSet(`async await break case catch class const continue debugger default delete do else
+			export extends false finally for function if import in instanceof let new null of return super
+			switch this throw true try typeof undefined var void while with yield`),
+		lineComment:  "//",
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"'`",
+	},
+	"bash": {
+		keywords: wordSet(`if then else elif fi for while until do done case esac in function return local
+			export readonly`),
+		lineComment: "#",
+		quotes:      "\"'",
+	},
+}
+
+var languageAliases = map[string]string{
+	"golang":     "go",
+	"py":         "python",
+	"python3":    "python",
+	"js":         "javascript",
+	"ts":         "javascript",
+	"typescript": "javascript",
+	"sh":         "bash",
+	"shell":      "bash",
+	"zsh":        "bash",
+}
+
+func lookupSyntax(language string) (syntax, bool) {
+	language = strings.ToLower(strings.TrimSpace(language))
+	if alias, ok := languageAliases[language]; ok {
+		language = alias
+	}
+	s, ok := syntaxes[language]
+	return s, ok
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// Splits code into keywords, strings, comments, numbers and the plain text between them.
+// Strings end at their line unless backquoted, unterminated comments and strings run to
+// the end
+func tokenizeCode(content string, lang syntax) []codeToken {
+	var tokens []codeToken
+	emit := func(kind tokenKind, text string) {
+		if last := len(tokens) - 1; kind == tokenPlain && last >= 0 && tokens[last].Kind == tokenPlain {
+			tokens[last].Text += text
+			return
+		}
+		tokens = append(tokens, codeToken{Kind: kind, Text: text})
+	}
+
+	for i := 0; i < len(content); {
+		rest := content[i:]
+		r, size := utf8.DecodeRuneInString(rest)
+
+		switch {
+		case lang.lineComment != "" && strings.HasPrefix(rest, lang.lineComment):
+			end := strings.IndexByte(rest, '\n')
+			if end < 0 {
+				end = len(rest)
+			}
+			emit(tokenComment, rest[:end])
+			i += end
+		case lang.blockComment[0] != "" && strings.HasPrefix(rest, lang.blockComment[0]):
+			end := len(rest)
+			if n := strings.Index(rest[len(lang.blockComment[0]):], lang.blockComment[1]); n >= 0 {
+				end = len(lang.blockComment[0]) + n + len(lang.blockComment[1])
+			}
+			emit(tokenComment, rest[:end])
+			i += end
+		case strings.ContainsRune(lang.quotes, r):
+			end := 1
+			for end < len(rest) {
+				c := rest[end]
+				if c == '\\' && r != '`' {
+					end += 2
+					continue
+				}
+				if c == '\n' && r != '`' {
+					break
+				}
+				end++
+				if rune(c) == r {
+					break
+				}
+			}
+			if end > len(rest) {
+				end = len(rest)
+			}
+			emit(tokenString, rest[:end])
+			i += end
+		case isIdentRune(r):
+			end := 0
+			for end < len(rest) {
+				c, n := utf8.DecodeRuneInString(rest[end:])
+				if !isIdentRune(c) && !(c == '.' && unicode.IsDigit(r)) {
+					break
+				}
+				end += n
+			}
+			word := rest[:end]
+			switch {
+			case unicode.IsDigit(r):
+				emit(tokenNumber, word)
+			case lang.keywords[word]:
+				emit(tokenKeyword, word)
+			default:
+				emit(tokenPlain, word)
+			}
+			i += end
+		default:
+			emit(tokenPlain, rest[:size])
+			i += size
+		}
+	}
+	return tokens
+}
+
+// Colours code for the preview, false for languages the highlighter doesn't know. Results are
+// cached by language, theme and content so unchanged blocks aren't tokenized again
+func (r *renderModel) highlightCode(content, language string, theme Theme) (string, bool) {
+	lang, ok := lookupSyntax(language)
+	if !ok {
+		return "", false
+	}
+
+	cacheKey := "code\x00" + language + "\x00" + theme.Name + "\x00" + content
+	if cached, found := r.cache.Get(cacheKey); found {
+		return cached.Unicode, true
+	}
+
+	styles := map[tokenKind]lipgloss.Style{
+		tokenPlain:   lipgloss.NewStyle().Foreground(theme.Foreground),
+		tokenKeyword: lipgloss.NewStyle().Foreground(theme.Primary).Bold(true),
+		tokenString:  lipgloss.NewStyle().Foreground(theme.Success),
+		tokenComment: lipgloss.NewStyle().Foreground(theme.Muted).Italic(true),
+		tokenNumber:  lipgloss.NewStyle().Foreground(theme.Warning),
+	}
+
+	var out strings.Builder
+	for _, token := range tokenizeCode(content, lang) {
+		// Line by line, lipgloss would pad a multi-line token out to a block
+		for j, line := range strings.Split(token.Text, "\n") {
+			if j > 0 {
+				out.WriteString("\n")
+			}
+			if line != "" {
+				out.WriteString(styles[token.Kind].Render(line))
+			}
+		}
+	}
+
+	r.cache.Put(cacheKey, RenderedBlock{Unicode: out.String()})
+	return out.String(), true
+}
+
+func codeTabWidth(width int) int {
+	if width < 1 {
+		return 4
+	}
+	return width
+}
+
+// Only the indentation is expanded, tabs after the first non-blank character
+// may sit inside string literals and are left alone
+func expandLeadingTabs(code string, width int) string {
+	width = codeTabWidth(width)
+	lines := strings.Split(code, "\n")
+	for i, line := range lines {
+		column := 0
+		var indent strings.Builder
+		j := 0
+		for ; j < len(line); j++ {
+			if line[j] == ' ' {
+				indent.WriteByte(' ')
+				column++
+			} else if line[j] == '\t' {
+				pad := width - column%width
+				indent.WriteString(strings.Repeat(" ", pad))
+				column += pad
+			} else {
+				break
+			}
+		}
+		lines[i] = indent.String() + line[j:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Turns the cropped PDF of a math block into SVG or PNG, part of poppler
+const mathImageConverter = "pdftocairo"
+
+// Resolution of PNG math images
+const mathImageDPI = 300
+
+func missingTools(tools ...string) []string {
+	var missing []string
+	for _, tool := range tools {
+		if _, err := exec.LookPath(tool); err != nil {
+			missing = append(missing, tool)
+		}
+	}
+	return missing
+}
+
+func mathImageFormat(format string) string {
+	if strings.ToLower(format) == "png" {
+		return "png"
+	}
+	return "svg"
+}
+
+// A standalone document holding one math block, cropped to the formula. Macros from the
+// document's raw LaTeX blocks and the custom preamble come along so it compiles as in the PDF
+func mathStandalone(content string, macros []macroDefinition, preamble string) string {
+	var b strings.Builder
+	b.WriteString("\\documentclass[border=4pt,varwidth]{standalone}\n")
+	b.WriteString("\\usepackage{amsmath}\n\\usepackage{amsfonts}\n\\usepackage{amssymb}\n")
+	if custom := userPreamble(preamble); custom != "" {
+		b.WriteString(custom + "\n")
+	}
+	for _, macro := range macros {
+		// Declared rather than \newcommand so redefining a built in command works too
+		if macro.Args > 0 {
+			b.WriteString(fmt.Sprintf("\\DeclareRobustCommand{%s}[%d]{%s}\n", macro.Name, macro.Args, macro.Expansion))
+		} else {
+			b.WriteString(fmt.Sprintf("\\DeclareRobustCommand{%s}{%s}\n", macro.Name, macro.Expansion))
+		}
+	}
+	b.WriteString("\\begin{document}\n")
+
+	content = strings.TrimSpace(content)
+	segments := splitMathSegments(content)
+	delimited := false
+	for _, segment := range segments {
+		delimited = delimited || segment.Math || segment.Display
+	}
+	switch {
+	case !delimited && strings.HasPrefix(content, "\\begin{"):
+		b.WriteString(content + "\n")
+	case !delimited:
+		// A math block written without delimiters is one display formula
+		b.WriteString("\\[" + content + "\\]\n")
+	default:
+		for _, segment := range segments {
+			switch {
+			case segment.Display:
+				b.WriteString("\\[" + segment.Text + "\\]")
+			case segment.Math:
+				b.WriteString("\\(" + segment.Text + "\\)")
+			default:
+				b.WriteString(segment.Text)
+			}
+		}
+		b.WriteString("\n")
+	}
+
+	b.WriteString("\\end{document}\n")
+	return b.String()
+}
+
+// Writes the math block as <document>-math-<id>.svg or .png next to the document. The TeX
+// run happens in a temporary directory so nothing else is left behind
+func (m model) exportMathImage(block ContentBlock) tea.Cmd {
+	format := mathImageFormat(m.preferences.MathImageFormat)
+	dir := m.browser.currentPath
+	if m.document.filepath != "" {
+		dir = filepath.Dir(m.document.filepath)
+	}
+	output := filepath.Join(dir, fmt.Sprintf("%s-math-%s.%s", m.getSmartFilename(), block.ID, format))
+
+	var macros []macroDefinition
+	for _, b := range m.document.blocks {
+		if b.Type == blockRawLaTeX {
+			macros = append(macros, parseMacros(b.Content)...)
+		}
+	}
+	source := mathStandalone(block.Content, macros, m.preferences.LaTeXPreamble)
+	engine, args, _ := latexCommand(m.preferences.LaTeXEngine, "math.tex")
+	timeout := latexTimeout(m.preferences.LaTeXTimeout)
+	name := "Math " + strings.ToUpper(format)
+
+	return func() tea.Msg {
+		work, err := ioutil.TempDir("", "oathkeeper-math")
+		if err != nil {
+			return exportResultMsg{format: name, err: err}
+		}
+		defer os.RemoveAll(work)
+
+		if err := ioutil.WriteFile(filepath.Join(work, "math.tex"), []byte(source), 0644); err != nil {
+			return exportResultMsg{format: name, err: err}
+		}
+		if out, err := runLaTeX(work, engine, args, timeout); err != nil {
+			failure := &latexError{Engine: engine, Pass: 1, Err: err}
+			if data, readErr := ioutil.ReadFile(filepath.Join(work, "math.log")); readErr == nil {
+				out = data
+			}
+			failure.LogTail = tailLines(string(out), latexLogTail)
+			return exportResultMsg{format: name, err: failure}
+		}
+
+		convert := []string{"-svg", "math.pdf", output}
+		if format == "png" {
+			convert = []string{"-png", "-singlefile", "-transp", "-r", strconv.Itoa(mathImageDPI), "math.pdf", strings.TrimSuffix(output, ".png")}
+		}
+		cmd := exec.Command(mathImageConverter, convert...)
+		cmd.Dir = work
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return exportResultMsg{format: name, err: fmt.Errorf("%s failed: %v\n%s", mathImageConverter, err, strings.TrimSpace(string(out)))}
+		}
+		return exportResultMsg{format: name, path: output}
+	}
+}
+
+// How long one engine run may take when latexTimeout isn't set
+const defaultLaTeXTimeout = 30
+
+func latexTimeout(seconds int) time.Duration {
+	if seconds < 1 {
+		seconds = defaultLaTeXTimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Runs one TeX pass in dir, killing it once timeout passes. A run that never finishes
+// usually sits waiting on input nonstopmode can't answer, or loops on a bad macro
+func runLaTeX(dir, engine string, args []string, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, engine, args...)
+	cmd.Dir = dir
+	// Children that inherited the output pipes must not keep us waiting after the kill
+	cmd.WaitDelay = time.Second
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return output, fmt.Errorf("timed out after %s", timeout)
+	}
+	return output, err
+}
+
+func tailLines(text string, n int) []string {
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+
+func (m model) generatePDF(blocks []ContentBlock, filename string) error {
+	latexContent := m.generateLaTeX(blocks)
+	
+	currentDir := m.browser.currentPath
+	texPath := filepath.Join(currentDir, filename+".tex")
+	pdfPath := filepath.Join(currentDir, filename+".pdf")
+	logPath := filepath.Join(currentDir, filename+".log")
+	
+	existing := existingAuxFiles(currentDir, filename)
+	cleanup := func(failed bool) {
+		forceCleanupFiles(latexCleanupPaths(currentDir, filename, existing, keptLaTeXFiles(m.preferences.KeepTeX, failed)...))
+	}
+
+	err := ioutil.WriteFile(texPath, []byte(latexContent), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write LaTeX file: %v", err)
+	}
+	
+	engine, args, err := latexCommand(m.preferences.LaTeXEngine, filename+".tex")
+	if err != nil {
+		return fmt.Errorf("%v. LaTeX file saved as %s.tex", err, filename)
+	}
+
+	_, err = exec.LookPath(engine)
+	if err != nil {
+		return fmt.Errorf("%s not found. LaTeX file saved as %s.tex", engine, filename)
+	}
+	
+	for pass := 1; pass <= latexPasses(m.preferences.LaTeXPasses); pass++ {
+		output, err := runLaTeX(currentDir, engine, args, latexTimeout(m.preferences.LaTeXTimeout))
+		if err == nil {
+			continue
+		}
+
+		// The log is left behind so the failure can be looked into
+		cleanup(true)
+		failure := &latexError{Engine: engine, Pass: pass, Err: err}
+		if data, readErr := ioutil.ReadFile(logPath); readErr == nil {
+			failure.LogPath = logPath
+			failure.LogTail = tailLines(string(data), latexLogTail)
+		} else {
+			failure.LogTail = tailLines(string(output), latexLogTail)
+		}
+		return failure
+	}
+	
+	if _, err := os.Stat(pdfPath); os.IsNotExist(err) {
+		cleanup(true)
+		return fmt.Errorf("PDF was not created despite successful compilation, see %s", logPath)
+	}
+	
+	cleanup(false)
+	
+	return nil
+}
+
+// Extensions that survive cleanup after a PDF export. A failed run keeps the source
+// as well as the log, since the log's line numbers point into the .tex
+func keptLaTeXFiles(keepTeX, failed bool) []string {
+	var keep []string
+	if keepTeX || failed {
+		keep = append(keep, ".tex")
+	}
+	if failed {
+		keep = append(keep, ".log")
+	}
+	return keep
+}
+
+// Files TeX may leave next to the PDF
+var auxExtensions = []string{
+	".aux", ".log", ".tex", ".out", ".toc", ".lof", ".lot",
+	".fls", ".fdb_latexmk", ".synctex.gz", ".bbl", ".blg",
+	".idx", ".ind", ".ilg", ".nav", ".snm", ".vrb", ".figlist",
+	".makefile", ".figs", ".pyg", ".pytxcode", ".pytxmcr",
+}
+
+// The aux extensions already present for filename, which cleanup must leave alone since
+// they belong to the user (an earlier LaTeX source export, say)
+func existingAuxFiles(dir, filename string) map[string]bool {
+	existing := make(map[string]bool)
+	for _, ext := range auxExtensions {
+		if _, err := os.Lstat(filepath.Join(dir, filename+ext)); err == nil {
+			existing[ext] = true
+		}
+	}
+	return existing
+}
+
+// Paths cleanup removes after a PDF export: the aux files this run created, except for
+// the extensions in keep
+func latexCleanupPaths(dir, filename string, existing map[string]bool, keep ...string) []string {
+	var paths []string
+	for _, ext := range auxExtensions {
+		if existing[ext] || slices.Contains(keep, ext) {
+			continue
+		}
+		paths = append(paths, filepath.Join(dir, filename+ext))
+	}
+	return paths
+}
+
+// Removes the files TeX leaves next to the PDF, retrying briefly for files a
+// viewer or antivirus still has open
+func forceCleanupFiles(paths []string) {
+	for _, path := range paths {
+		for attempts := 0; attempts < 3; attempts++ {
+			err := os.Remove(path)
+			if err == nil || os.IsNotExist(err) {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+}
+
+// Guesses a block type from Markdown-style cues. Anything without a clear cue stays text
+func detectBlockType(content string) blockType {
+	trimmed := strings.TrimSpace(content)
+	if trimmed == "" {
+		return blockText
+	}
+
+	switch {
+	case isHorizontalRule(trimmed):
+		return blockHR
+	case strings.HasPrefix(trimmed, "```"):
+		return blockCode
+	case strings.HasPrefix(trimmed, "$$"):
+		return blockMath
+	case strings.HasPrefix(trimmed, "#"):
+		level := len(trimmed) - len(strings.TrimLeft(trimmed, "#"))
+		if level <= 6 && strings.HasPrefix(trimmed[level:], " ") {
+			return blockHeading
+		}
+	case strings.HasPrefix(trimmed, "> "):
+		return blockQuote
+	}
+
+	lines := strings.Split(trimmed, "\n")
+
+	isTable := len(lines) >= 2
+	isList := true
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "|") {
+			isTable = false
+		}
+		if _, ordered := orderedListText(line); !ordered && !strings.HasPrefix(line, "- ") && !strings.HasPrefix(line, "* ") {
+			isList = false
+		}
+	}
+
+	if isTable && parseTable(trimmed).Header != nil {
+		return blockTable
+	}
+	if isList {
+		return blockList
+	}
+	return blockText
+}
+
+// Three or more of the same -, * or _ on a line of their own, spaces between them allowed
+func isHorizontalRule(line string) bool {
+	line = strings.ReplaceAll(strings.TrimSpace(line), " ", "")
+	if len(line) < 3 || strings.Contains(line, "\n") {
+		return false
+	}
+	for _, marker := range []string{"-", "*", "_"} {
+		if strings.Trim(line, marker) == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Converts a block to the detected type, stripping the Markdown cue where the new type makes it redundant
+func convertDetectedBlock(block ContentBlock, detected blockType) ContentBlock {
+	block.Type = detected
+
+	switch detected {
+	case blockCode:
+		lines := strings.Split(strings.TrimSpace(block.Content), "\n")
+		block.Language = strings.TrimSpace(strings.TrimPrefix(lines[0], "```"))
+		lines = lines[1:]
+		if len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "```" {
+			lines = lines[:len(lines)-1]
+		}
+		block.Content = strings.Join(lines, "\n")
+	case blockQuote:
+		lines := strings.Split(block.Content, "\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimPrefix(strings.TrimPrefix(line, ">"), " ")
+		}
+		block.Content = strings.Join(lines, "\n")
+	}
+
+	return block
+}
+
+type tableData struct {
+	Header []string
+	Rows   [][]string
+}
+
+func isTableSeparator(cells []string) bool {
+	if len(cells) == 0 {
+		return false
+	}
+	for _, cell := range cells {
+		cell = strings.Trim(cell, ":")
+		if cell == "" || strings.Trim(cell, "-") != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Parses pipe-delimited Markdown tables. The row above a --- separator becomes the
+// header, and ragged rows are padded with empty cells to the widest row
+func parseTable(content string) tableData {
+	var table tableData
+	var rows [][]string
+
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		line = strings.TrimPrefix(line, "|")
+		line = strings.TrimSuffix(line, "|")
+
+		var cells []string
+		for _, cell := range strings.Split(line, "|") {
+			cells = append(cells, strings.TrimSpace(cell))
+		}
+
+		if isTableSeparator(cells) {
+			if table.Header == nil && len(rows) == 1 {
+				table.Header = rows[0]
+				rows = nil
+			}
+			continue
+		}
+		rows = append(rows, cells)
+	}
+	table.Rows = rows
+
+	columns := len(table.Header)
+	for _, row := range table.Rows {
+		if len(row) > columns {
+			columns = len(row)
+		}
+	}
+
+	pad := func(row []string) []string {
+		for len(row) < columns {
+			row = append(row, "")
+		}
+		return row
+	}
+	if table.Header != nil {
+		table.Header = pad(table.Header)
+	}
+	for i, row := range table.Rows {
+		table.Rows[i] = pad(row)
+	}
+
+	return table
+}
+
+func (t tableData) columns() int {
+	if len(t.Header) > 0 {
+		return len(t.Header)
+	}
+	if len(t.Rows) > 0 {
+		return len(t.Rows[0])
+	}
+	return 0
+}
+
+func latexTable(table tableData) string {
+	columns := table.columns()
+	if columns == 0 {
+		return ""
+	}
+
+	var content strings.Builder
+	content.WriteString("\\begin{tabular}{|" + strings.Repeat("l|", columns) + "}\n\\hline\n")
+
+	writeRow := func(row []string, bold bool) {
+		cells := make([]string, len(row))
+		for i, cell := range row {
+			cells[i] = escapeLaTeX(cell)
+			if bold && cells[i] != "" {
+				cells[i] = "\\textbf{" + cells[i] + "}"
+			}
+		}
+		content.WriteString(strings.Join(cells, " & ") + " \\\\\n\\hline\n")
+	}
+
+	if table.Header != nil {
+		writeRow(table.Header, true)
+	}
+	for _, row := range table.Rows {
+		writeRow(row, false)
+	}
+
+	content.WriteString("\\end{tabular}\n")
+	return content.String()
+}
+
+// Cells are escaped, so the caller passes them as written
+func htmlTable(table tableData) string {
+	if table.columns() == 0 {
+		return ""
+	}
+
+	var content strings.Builder
+	content.WriteString("<table>\n")
+	if table.Header != nil {
+		content.WriteString("<thead>\n<tr>")
+		for _, cell := range table.Header {
+			content.WriteString("<th>" + html.EscapeString(cell) + "</th>")
+		}
+		content.WriteString("</tr>\n</thead>\n")
+	}
+	content.WriteString("<tbody>\n")
+	for _, row := range table.Rows {
+		content.WriteString("<tr>")
+		for _, cell := range row {
+			content.WriteString("<td>" + html.EscapeString(cell) + "</td>")
+		}
+		content.WriteString("</tr>\n")
+	}
+	content.WriteString("</tbody>\n</table>\n")
+	return content.String()
+}
+
+// Plain aligned columns, shared by the preview and the Unicode export
+func formatTable(table tableData, headerStyle lipgloss.Style) string {
+	columns := table.columns()
+	if columns == 0 {
+		return ""
+	}
+
+	widths := make([]int, columns)
+	measure := func(row []string) {
+		for i, cell := range row {
+			if w := lipgloss.Width(cell); w > widths[i] {
+				widths[i] = w
+			}
+		}
+	}
+	measure(table.Header)
+	for _, row := range table.Rows {
+		measure(row)
+	}
+
+	formatRow := func(row []string) string {
+		cells := make([]string, len(row))
+		for i, cell := range row {
+			cells[i] = cell + strings.Repeat(" ", widths[i]-lipgloss.Width(cell))
+		}
+		return strings.Join(cells, " │ ")
+	}
+
+	var lines []string
+	if table.Header != nil {
+		lines = append(lines, headerStyle.Render(formatRow(table.Header)))
+		rule := make([]string, columns)
+		for i, w := range widths {
+			rule[i] = strings.Repeat("─", w)
+		}
+		lines = append(lines, strings.Join(rule, "─┼─"))
+	}
+	for _, row := range table.Rows {
+		lines = append(lines, formatRow(row))
+	}
+	return strings.Join(lines, "\n")
+}
+
+type listItem struct {
+	Level   int
+	Ordered bool
+	Text    string
+	// Checklist items, written "- [ ] task" or "- [x] done"
+	Task bool
+	Done bool
+}
+
+// The marker for a checklist item, empty for ordinary items
+func (item listItem) checkbox(open, done string) string {
+	switch {
+	case !item.Task:
+		return ""
+	case item.Done:
+		return done
+	}
+	return open
+}
+
+// Splits a leading "[ ]", "[x]" or "[X]" off an item's text
+func checkboxText(text string) (rest string, task, done bool) {
+	if len(text) < 3 || text[0] != '[' || text[2] != ']' || (len(text) > 3 && text[3] != ' ') {
+		return text, false, false
+	}
+	switch text[1] {
+	case ' ':
+	case 'x', 'X':
+		done = true
+	default:
+		return text, false, false
+	}
+	return strings.TrimSpace(text[3:]), true, done
+}
+
+// Length of the "- ", "* " or "1. " marker that starts a list line, 0 when there isn't one
+func listMarkerLength(line string) int {
+	if strings.HasPrefix(line, "- ") || strings.HasPrefix(line, "* ") {
+		return 2
+	}
+	if _, ok := orderedListText(line); ok {
+		return strings.IndexAny(line, ".)") + 2
+	}
+	return 0
+}
+
+// How the line after line starts: its indentation, and in a list the next marker. Numbered
+// markers count up and checklist items continue with an empty box
+func autoIndentPrefix(line string, t blockType) string {
+	indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+	if t != blockList {
+		return indent
+	}
+
+	item := line[len(indent):]
+	marker := listMarkerLength(item)
+	if marker == 0 {
+		return indent
+	}
+	next := item[:marker]
+	if _, ok := orderedListText(item); ok {
+		digits := strings.IndexAny(item, ".)")
+		n, _ := strconv.Atoi(item[:digits])
+		next = strconv.Itoa(n+1) + item[digits:marker]
+	}
+	if _, task, _ := checkboxText(item[marker:]); task {
+		next += "[ ] "
+	}
+	return indent + next
+}
+
+// Splits the line at the cursor for enter in list and code blocks, the new line starting
+// with autoIndentPrefix. Enter on a list item with no text ends the list by clearing the
+// marker instead. ok is false for other block types, which take enter as it is
+func autoIndent(content string, cursor int, t blockType) (string, int, bool) {
+	if t != blockList && t != blockCode {
+		return content, cursor, false
+	}
+	if cursor > len(content) {
+		cursor = len(content)
+	}
+	start := strings.LastIndex(content[:cursor], "\n") + 1
+	end := len(content)
+	if i := strings.Index(content[start:], "\n"); i >= 0 {
+		end = start + i
+	}
+	line := content[start:end]
+
+	// Enter inside the indentation or marker itself just opens a plain line above
+	lead := len(line) - len(strings.TrimLeft(line, " \t"))
+	if t == blockList {
+		item := line[lead:]
+		if marker := listMarkerLength(item); marker > 0 {
+			if rest, _, _ := checkboxText(item[marker:]); strings.TrimSpace(rest) == "" {
+				return content[:start] + content[end:], start, true
+			}
+			lead += marker
+		}
+	}
+	if cursor-start < lead {
+		return content, cursor, false
+	}
+
+	prefix := autoIndentPrefix(line, t)
+	return content[:cursor] + "\n" + prefix + content[cursor:], cursor + 1 + len(prefix), true
+}
+
+// Ticks or clears the checkbox on the line holding the cursor, a plain item gets an empty
+// one. Returns the new content and cursor, ok is false when the line isn't a list item
+func toggleChecklistItem(content string, cursor int) (string, int, bool) {
+	if cursor > len(content) {
+		cursor = len(content)
+	}
+	start := strings.LastIndex(content[:cursor], "\n") + 1
+	end := len(content)
+	if i := strings.Index(content[start:], "\n"); i >= 0 {
+		end = start + i
+	}
+	line := content[start:end]
+
+	indent := len(line) - len(strings.TrimLeft(line, " \t"))
+	marker := listMarkerLength(line[indent:])
+	if marker == 0 {
+		return content, cursor, false
+	}
+
+	box := start + indent + marker
+	_, task, done := checkboxText(content[box:end])
+	switch {
+	case !task:
+		if cursor >= box {
+			cursor += len("[ ] ")
+		}
+		return content[:box] + "[ ] " + content[box:], cursor, true
+	case done:
+		return content[:box] + "[ ]" + content[box+3:], cursor, true
+	}
+	return content[:box] + "[x]" + content[box+3:], cursor, true
+}
+
+// Two spaces (or a tab) of indentation per level. Lines without a marker continue the previous item
+func parseListItems(content string) []listItem {
+	var items []listItem
+
+	for _, line := range strings.Split(content, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		indent := 0
+		for _, r := range line {
+			if r == ' ' {
+				indent++
+			} else if r == '\t' {
+				indent += 2
+			} else {
+				break
+			}
+		}
+		level := indent / 2
+		trimmed := strings.TrimSpace(line)
+
+		item := listItem{Level: level}
+		if strings.HasPrefix(trimmed, "- ") || strings.HasPrefix(trimmed, "* ") {
+			item.Text, item.Task, item.Done = checkboxText(strings.TrimSpace(trimmed[2:]))
+		} else if text, ok := orderedListText(trimmed); ok {
+			item.Ordered = true
+			item.Text, item.Task, item.Done = checkboxText(text)
+		} else if len(items) > 0 {
+			items[len(items)-1].Text += " " + trimmed
+			continue
+		} else {
+			item.Text = trimmed
+		}
+
+		// A level can only go one deeper than the item before it
+		maxLevel := 0
+		if len(items) > 0 {
+			maxLevel = items[len(items)-1].Level + 1
+		}
+		if item.Level > maxLevel {
+			item.Level = maxLevel
+		}
+
+		items = append(items, item)
+	}
+
+	return items
+}
+
+func orderedListText(line string) (string, bool) {
+	digits := 0
+	for digits < len(line) && line[digits] >= '0' && line[digits] <= '9' {
+		digits++
+	}
+	if digits == 0 || digits+1 >= len(line) {
+		return "", false
+	}
+	if (line[digits] != '.' && line[digits] != ')') || line[digits+1] != ' ' {
+		return "", false
+	}
+	return strings.TrimSpace(line[digits+2:]), true
+}
+
+func latexList(items []listItem) string {
+	var content strings.Builder
+	var stack []bool
+
+	env := func(ordered bool) string {
+		if ordered {
+			return "enumerate"
+		}
+		return "itemize"
+	}
+
+	for _, item := range items {
+		for len(stack) > item.Level+1 {
+			content.WriteString("\\end{" + env(stack[len(stack)-1]) + "}\n")
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == item.Level+1 && stack[len(stack)-1] != item.Ordered {
+			content.WriteString("\\end{" + env(stack[len(stack)-1]) + "}\n")
+			stack = stack[:len(stack)-1]
+		}
+		for len(stack) < item.Level+1 {
+			content.WriteString("\\begin{" + env(item.Ordered) + "}\n")
+			stack = append(stack, item.Ordered)
+		}
+		content.WriteString(fmt.Sprintf("\\item%s %s\n", item.checkbox("[$\\square$]", "[$\\boxtimes$]"), latexInline(item.Text)))
+	}
+
+	for len(stack) > 0 {
+		content.WriteString("\\end{" + env(stack[len(stack)-1]) + "}\n")
+		stack = stack[:len(stack)-1]
+	}
+
+	return content.String()
+}
+
+// Nested lists are opened inside the parent <li>, which stays open until a sibling or the end.
+// Item text is escaped, so the caller passes it as written
+func htmlList(items []listItem) string {
+	var content strings.Builder
+	var stack []bool
+
+	tag := func(ordered bool) string {
+		if ordered {
+			return "ol"
+		}
+		return "ul"
+	}
+
+	for _, item := range items {
+		for len(stack) > item.Level+1 {
+			content.WriteString("</li>\n</" + tag(stack[len(stack)-1]) + ">\n")
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == item.Level+1 {
+			if stack[len(stack)-1] != item.Ordered {
+				content.WriteString("</li>\n</" + tag(stack[len(stack)-1]) + ">\n")
+				stack = stack[:len(stack)-1]
+			} else {
+				content.WriteString("</li>\n")
+			}
+		}
+		for len(stack) < item.Level+1 {
+			if len(stack) > 0 {
+				content.WriteString("\n")
+			}
+			content.WriteString("<" + tag(item.Ordered) + ">\n")
+			stack = append(stack, item.Ordered)
+		}
+		content.WriteString("<li>" + item.checkbox(`<input type="checkbox" disabled="disabled" /> `, `<input type="checkbox" disabled="disabled" checked="checked" /> `) + html.EscapeString(item.Text))
+	}
+
+	for len(stack) > 0 {
+		content.WriteString("</li>\n</" + tag(stack[len(stack)-1]) + ">\n")
+		stack = stack[:len(stack)-1]
+	}
+
+	return content.String()
+}
+
+// Children are indented to line up with their parent's text, which is what CommonMark expects
+func markdownList(items []listItem) string {
+	var content strings.Builder
+	var offsets []int
+	var counters []int
+
+	for _, item := range items {
+		if item.Level < len(offsets) {
+			offsets = offsets[:item.Level]
+			counters = counters[:item.Level+1]
+		}
+		for len(counters) < item.Level+1 {
+			counters = append(counters, 0)
+		}
+
+		indent := 0
+		if len(offsets) > 0 {
+			indent = offsets[len(offsets)-1]
+		}
+
+		marker := "- "
+		if item.Ordered {
+			counters[item.Level]++
+			marker = fmt.Sprintf("%d. ", counters[item.Level])
+		} else {
+			counters[item.Level] = 0
+		}
+
+		content.WriteString(strings.Repeat(" ", indent) + marker + item.checkbox("[ ] ", "[x] ") + item.Text + "\n")
+		offsets = append(offsets, indent+len(marker))
+	}
+
+	return content.String()
+}
+
+var latexClasses = []string{"article", "report", "book"}
+
+var latexFontSizes = []string{"10pt", "11pt", "12pt"}
+
+// Packages every export loads, with their options
+var latexPackages = []struct{ options, name string }{
+	{"", "amsmath"},
+	{"", "amsfonts"},
+	{"", "amssymb"},
+	{"utf8", "inputenc"},
+	{"", "url"},
+	{"", "hyperref"},
+	{"", "listings"},
+	{"", "xcolor"},
+	{"", "graphicx"},
+}
+
+// \documentclass and the built-in packages. Unknown classes fall back to article and unknown
+// font sizes are left out
+func latexPreamble(class, fontSize string) string {
+	var b strings.Builder
+
+	known := false
+	for _, c := range latexClasses {
+		known = known || c == class
+	}
+	if !known {
+		class = "article"
+	}
+	option := ""
+	for _, size := range latexFontSizes {
+		if size == fontSize {
+			option = "[" + size + "]"
+		}
+	}
+	b.WriteString("\\documentclass" + option + "{" + class + "}\n")
+
+	for _, pkg := range latexPackages {
+		if pkg.options != "" {
+			b.WriteString("\\usepackage[" + pkg.options + "]{" + pkg.name + "}\n")
+		} else {
+			b.WriteString("\\usepackage{" + pkg.name + "}\n")
+		}
+	}
+	return b.String()
+}
+
+// The latexPreamble preference without packages the export already loads. A \usepackage
+// naming several packages keeps just the new ones, LaTeX rejects loading one twice with
+// different options
+func userPreamble(custom string) string {
+	builtin := make(map[string]bool)
+	for _, pkg := range latexPackages {
+		builtin[pkg.name] = true
+	}
+
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(custom), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, "\\usepackage") {
+			lines = append(lines, line)
+			continue
+		}
+
+		rest := trimmed[len("\\usepackage"):]
+		options := ""
+		if strings.HasPrefix(rest, "[") {
+			if end := strings.Index(rest, "]"); end >= 0 {
+				options, rest = rest[:end+1], rest[end+1:]
+			}
+		}
+		names, after, ok := bracedGroup(rest, 0)
+		if !ok {
+			lines = append(lines, line)
+			continue
+		}
+
+		var keep []string
+		for _, name := range strings.Split(names, ",") {
+			if name = strings.TrimSpace(name); name != "" && !builtin[name] {
+				keep = append(keep, name)
+			}
+		}
+		if len(keep) > 0 {
+			lines = append(lines, "\\usepackage"+options+"{"+strings.Join(keep, ",")+"}"+rest[after:])
+		}
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+func (m model) generateLaTeX(blocks []ContentBlock) string {
+	var content strings.Builder
+	content.WriteString(latexPreamble(m.preferences.LaTeXClass, m.preferences.LaTeXFontSize))
+	content.WriteString(fmt.Sprintf("\\lstset{basicstyle=\\ttfamily,breaklines=%t,tabsize=%d}\n", m.preferences.CodeBreakLines, codeTabWidth(m.preferences.CodeTabWidth)))
+	if custom := userPreamble(m.preferences.LaTeXPreamble); custom != "" {
+		content.WriteString(custom + "\n")
+	}
+	content.WriteString("\\begin{document}\n\n")
+
+	notes := collectFootnotes(blocks)
+	refs := footnoteRefs{}
+	for i, block := range blocks {
+		switch block.Type {
+		case blockHeading:
+			level := strings.Count(strings.TrimSpace(block.Content), "#")
+			title := strings.TrimSpace(strings.TrimLeft(block.Content, "#"))
+			
+			if block.Numbered {
+				switch level {
+				case 1:
+					content.WriteString(fmt.Sprintf("\\section{%s}\n", title))
+				case 2:
+					content.WriteString(fmt.Sprintf("\\subsection{%s}\n", title))
+				case 3:
+					content.WriteString(fmt.Sprintf("\\subsubsection{%s}\n", title))
+				default:
+					content.WriteString(fmt.Sprintf("\\paragraph{%s}\n", title))
+				}
+			} else {
+				switch level {
+				case 1:
+					content.WriteString(fmt.Sprintf("\\section*{%s}\n", title))
+				case 2:
+					content.WriteString(fmt.Sprintf("\\subsection*{%s}\n", title))
+				case 3:
+					content.WriteString(fmt.Sprintf("\\subsubsection*{%s}\n", title))
+				default:
+					content.WriteString(fmt.Sprintf("\\paragraph*{%s}\n", title))
+				}
+			}
+		case blockMath:
+			content.WriteString(processDelimiterBasedMath(block.Content))
+		case blockCode:
+			content.WriteString(fmt.Sprintf("\\begin{lstlisting}[%s]\n%s\n\\end{lstlisting}\n", listingOptions(block, m.preferences.CodeBreakLines), block.Content))
+		case blockQuote:
+			quote, author := splitAttribution(block.Content)
+			quote = latexInline(quote)
+			if author != "" {
+				quote += "\n\\hfill--- " + escapeLaTeX(author)
+			}
+			content.WriteString(fmt.Sprintf("\\begin{quote}\n%s\n\\end{quote}\n", quote))
+		case blockList:
+			content.WriteString(latexList(parseListItems(block.Content)))
+		case blockTable:
+			content.WriteString(latexTable(parseTable(block.Content)))
+		case blockImage:
+			content.WriteString(latexImage(parseImage(block.Content)))
+		case blockHR:
+			content.WriteString("\\noindent\\rule{\\linewidth}{0.4pt}\n")
+		case blockRawLaTeX:
+			content.WriteString(block.Content)
+			content.WriteString("\n")
+		default:
+			if block.Type == blockText && block.RawText {
+				content.WriteString(block.Content)
+				content.WriteString("\n")
+				break
+			}
+			text := notes.replace(block.Content, func(label string, number int) string {
+				return refs.latex(label, number, notes.defs[label])
+			})
+			text = latexInline(text)
+			content.WriteString(text)
+			content.WriteString("\n")
+		}
+		
+		if i < len(blocks)-1 {
+			content.WriteString("\\vspace{0.8em}\n\n")
+		}
+	}
+
+	content.WriteString("\\end{document}\n")
+	return content.String()
+}
+
+type inlineSpan struct {
+	Text string
+	Code bool
+}
+
+// Splits text on `code` spans. Math is found first and treated as opaque, so backticks
+// inside $...$ stay part of the formula while a formula between backticks becomes code.
+// An unpaired backtick is kept as a literal
+func splitInlineCode(text string) []inlineSpan {
+	var spans []inlineSpan
+	var literal, code strings.Builder
+	open := false
+
+	flushLiteral := func() {
+		if literal.Len() == 0 {
+			return
+		}
+		if n := len(spans); n > 0 && !spans[n-1].Code {
+			spans[n-1].Text += literal.String()
+		} else {
+			spans = append(spans, inlineSpan{Text: literal.String()})
+		}
+		literal.Reset()
+	}
+	current := func() *strings.Builder {
+		if open {
+			return &code
+		}
+		return &literal
+	}
+
+	for _, segment := range splitMathSegments(text) {
+		switch {
+		case segment.Display:
+			current().WriteString("$$" + segment.Text + "$$")
+			continue
+		case segment.Math:
+			current().WriteString("$" + segment.Text + "$")
+			continue
+		}
+
+		for _, part := range strings.SplitAfter(segment.Text, "`") {
+			if !strings.HasSuffix(part, "`") {
+				current().WriteString(part)
+				continue
+			}
+			current().WriteString(strings.TrimSuffix(part, "`"))
+			if open {
+				spans = append(spans, inlineSpan{Text: code.String(), Code: true})
+				code.Reset()
+			} else {
+				flushLiteral()
+			}
+			open = !open
+		}
+	}
+
+	if open {
+		literal.WriteString("`" + code.String())
+	}
+	flushLiteral()
+	return spans
+}
+
+// Prose for LaTeX: inline code, bold, italics and $math$ converted, everything else escaped
+func latexInline(text string) string {
+	var formatted strings.Builder
+	for _, span := range splitInlineCode(text) {
+		if span.Code {
+			formatted.WriteString(latexCode(span.Text))
+		} else {
+			formatted.WriteString(smartFormatText(convertInlineMath(span.Text)))
+		}
+	}
+	return formatted.String()
+}
+
+// Escapes everything \texttt would otherwise interpret, backslashes included
+func latexCode(code string) string {
+	replacer := strings.NewReplacer(
+		"\\", "\\textbackslash{}",
+		"{", "\\{",
+		"}", "\\}",
+		"$", "\\$",
+		"&", "\\&",
+		"%", "\\%",
+		"#", "\\#",
+		"_", "\\_",
+		"^", "\\^{}",
+		"~", "\\textasciitilde{}",
+	)
+	return "\\texttt{" + replacer.Replace(code) + "}"
+}
+
+func convertInlineMath(text string) string {
+	result := strings.Builder{}
+	inMath := false
+	
+	for i, char := range text {
+		if char == '$' {
+			if i > 0 && text[i-1] == '\\' {
+				result.WriteRune(char)
+				continue
+			}
+			
+			if !inMath {
+				result.WriteString("\\(")
+				inMath = true
+			} else {
+				result.WriteString("\\)")
+				inMath = false
+			}
+		} else {
+			result.WriteRune(char)
+		}
+	}
+	
+	return result.String()
+}
+
+func smartFormatText(text string) string {
+	result := strings.Builder{}
+	literal := strings.Builder{}
+	inMath := false
+	i := 0
+
+	// Literal runs are buffered so escaping never touches the markup we emit
+	flush := func() {
+		result.WriteString(escapeLaTeX(literal.String()))
+		literal.Reset()
+	}
+
+	for i < len(text) {
+		if strings.HasPrefix(text[i:], "\\(") {
+			flush()
+			result.WriteString("\\(")
+			inMath = true
+			i += 2
+			continue
+		}
+		if strings.HasPrefix(text[i:], "\\)") {
+			result.WriteString("\\)")
+			inMath = false
+			i += 2
+			continue
+		}
+		
+		if inMath {
+			result.WriteByte(text[i])
+			i++
+			continue
+		}
+		
+		// Markers are matched by prefix so a bold or italic run can sit flush against either end of the string
+		if strings.HasPrefix(text[i:], "**") {
+			if end := strings.Index(text[i+2:], "**"); end > 0 {
+				content := text[i+2 : i+2+end]
+				flush()
+				result.WriteString("\\textbf{" + smartFormatText(content) + "}")
+				i += 4 + end
+				continue
+			}
+		}
+		
+		if text[i] == '*' && !strings.HasPrefix(text[i:], "**") && (i == 0 || text[i-1] != '*') {
+			end := -1
+			for j := i + 1; j < len(text); j++ {
+				if text[j] != '*' {
+					continue
+				}
+				if strings.HasPrefix(text[j:], "**") {
+					j++
+					continue
+				}
+				end = j
+				break
+			}
+			if end > i+1 {
+				content := text[i+1 : end]
+				flush()
+				result.WriteString("\\textit{" + smartFormatText(content) + "}")
+				i = end + 1
+				continue
+			}
+		}
+		
+		literal.WriteByte(text[i])
+		i++
+	}
+	flush()
+	
+	return result.String()
+}
+
+// A run of text or math from splitMathSegments, Display for $$...$$ math
+type mathSegment struct {
+	Text    string
+	Math    bool
+	Display bool
+}
+
+// Splits content on $$display$$ and $inline$ delimiters. Unclosed delimiters stay as text
+func splitMathSegments(content string) []mathSegment {
+	var segments []mathSegment
+	var text strings.Builder
+
+	flush := func() {
+		if text.Len() > 0 {
+			segments = append(segments, mathSegment{Text: text.String()})
+			text.Reset()
+		}
+	}
+
+	i := 0
+	for i < len(content) {
+		// An escaped \$ is a literal dollar sign, the backslash is kept for the exporters
+		if strings.HasPrefix(content[i:], "\\$") {
+			text.WriteString("\\$")
+			i += 2
+			continue
+		}
+
+		if strings.HasPrefix(content[i:], "$$") {
+			end := indexUnescaped(content[i+2:], "$$")
+			if end != -1 {
+				flush()
+				segments = append(segments, mathSegment{Text: content[i+2 : i+2+end], Math: true, Display: true})
+				i += 4 + end
+				continue
+			}
+		}
+		
+		if content[i] == '$' {
+			end := indexUnescaped(content[i+1:], "$")
+			if end != -1 {
+				flush()
+				segments = append(segments, mathSegment{Text: content[i+1 : i+1+end], Math: true})
+				i += 2 + end
+				continue
+			}
+		}
+		
+		text.WriteByte(content[i])
+		i++
+	}
+	flush()
+
+	return segments
+}
+
+func indexUnescaped(s, sub string) int {
+	for i := 0; i+len(sub) <= len(s); i++ {
+		if s[i] == '\\' {
+			i++
+			continue
+		}
+		if strings.HasPrefix(s[i:], sub) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Renders only the $...$ spans to Unicode so the surrounding prose is left as written
+func (r *renderModel) renderInlineMath(content string) string {
+	var result strings.Builder
+	for _, segment := range splitMathSegments(content) {
+		if segment.Math {
+			result.WriteString(r.renderLaTeX(segment.Text).Unicode)
+		} else {
+			result.WriteString(strings.ReplaceAll(segment.Text, "\\$", "$"))
+		}
+	}
+	return result.String()
+}
+
+// maybe parser based system in due time if i ever read this comment again 
+func processDelimiterBasedMath(rawContent string) string {
+	var result strings.Builder
+	content := strings.TrimSpace(rawContent)
+	
+	result.WriteString("\\vspace{0.5em}\n") 
+	
+	for _, segment := range splitMathSegments(content) {
+		switch {
+		case segment.Display:
+			result.WriteString("\\vspace{0.3em}\n\\begin{equation*}\n" + segment.Text + "\n\\end{equation*}\n\\vspace{0.3em}\n")
+		case segment.Math:
+			result.WriteString("\\(" + segment.Text + "\\)")
+		default:
+			result.WriteString(segment.Text)
+		}
+	}
+	
+	result.WriteString("\\vspace{0.5em}\n") 
+	return result.String()
+}
+
+// Escapes LaTeX specials in literal text. Characters the user already escaped (\&) are left alone,
+// and URLs are wrapped in \url
+func escapeLaTeX(text string) string {
+	replacements := map[byte]string{
+		'&': "\\&",
+		'%': "\\%",
+		'#': "\\#",
+		'_': "\\_",
+		'~': "\\textasciitilde{}",
+	}
+
+	var result strings.Builder
+	i := 0
+	for i < len(text) {
+		if url := urlAt(text, i); url != "" {
+			result.WriteString(latexURL(url))
+			i += len(url)
+			continue
+		}
+
+		if text[i] == '\\' && i < len(text)-1 {
+			result.WriteByte(text[i])
+			result.WriteByte(text[i+1])
+			i += 2
+			continue
+		}
+
+		if escaped, exists := replacements[text[i]]; exists {
+			result.WriteString(escaped)
+		} else {
+			result.WriteByte(text[i])
+		}
+		i++
+	}
+
+	return result.String()
+}
+
+// The http(s) URL starting at i, if a word starts there. Closing punctuation is left for the sentence
+func urlAt(text string, i int) string {
+	if i > 0 && !strings.ContainsRune(" \t\n(", rune(text[i-1])) {
+		return ""
+	}
+	if !strings.HasPrefix(text[i:], "http://") && !strings.HasPrefix(text[i:], "https://") {
+		return ""
+	}
+	end := strings.IndexAny(text[i:], " \t\n")
+	if end == -1 {
+		end = len(text) - i
+	}
+	return strings.TrimRight(text[i:i+end], ".,;:!?)")
+}
+
+// \url copes with _ and ~ itself, but # and % still need escaping inside another command's argument
+func latexURL(url string) string {
+	return "\\url{" + strings.NewReplacer("#", "\\#", "%", "\\%").Replace(url) + "}"
+}
+
+func (m model) generateHTML(blocks []ContentBlock) string {
+	var content strings.Builder
+	content.WriteString("<!DOCTYPE html>\n<html>\n<head>\n")
+	content.WriteString("<meta charset=\"UTF-8\">\n")
+	content.WriteString("<title>Document</title>\n")
+	content.WriteString("<script src=\"https://polyfill.io/v3/polyfill.min.js?features=es6\"></script>\n")
+	content.WriteString("<script id=\"MathJax-script\" async src=\"https://cdn.jsdelivr.net/npm/mathjax@3/es5/tex-mml-chtml.js\"></script>\n")
+	content.WriteString("<link rel=\"stylesheet\" href=\"https://cdnjs.cloudflare.com/ajax/libs/highlight.js/11.8.0/styles/default.min.css\">\n")
+	content.WriteString("<script src=\"https://cdnjs.cloudflare.com/ajax/libs/highlight.js/11.8.0/highlight.min.js\"></script>\n")
+	content.WriteString("<style>\n")
+	content.WriteString("body { font-family: serif; max-width: 800px; margin: 0 auto; padding: 2rem; line-height: 1.6; }\n")
+	content.WriteString("h1, h2, h3 { color: #333; }\n")
+	content.WriteString("code { background-color: #f4f4f4; padding: 2px 4px; border-radius: 3px; }\n")
+	content.WriteString("pre { background-color: #f4f4f4; padding: 1rem; border-radius: 5px; overflow-x: auto; }\n")
+	content.WriteString("blockquote { border-left: 4px solid #ddd; margin: 0; padding-left: 1rem; font-style: italic; }\n")
+	content.WriteString("</style>\n")
+	content.WriteString("</head>\n<body>\n")
+
+	notes := collectFootnotes(blocks)
+	refs := footnoteRefs{}
+	numbers := sectionNumbers(blocks)
+	for i, block := range blocks {
+		switch block.Type {
+		case blockHeading:
+			level := strings.Count(strings.TrimSpace(block.Content), "#")
+			title := strings.TrimSpace(strings.TrimLeft(block.Content, "#"))
+			if numbers[i] != "" {
+				title = fmt.Sprintf("<span class=\"section-number\">%s</span> %s", numbers[i], title)
+			}
+			content.WriteString(fmt.Sprintf("<h%d>%s</h%d>\n", level, title, level))
+		case blockMath:
+			content.WriteString(fmt.Sprintf("<p>\\[%s\\]</p>\n", strings.Trim(block.Content, "$")))
+		case blockCode:
+			language := codeLanguage(block)
+			if language == "" {
+				language = "text"
+			}
+			code := expandLeadingTabs(block.Content, m.preferences.CodeTabWidth)
+			content.WriteString(fmt.Sprintf("<pre><code class=\"language-%s\">%s</code></pre>\n", language, code))
+		case blockQuote:
+			quote, author := splitAttribution(block.Content)
+			quote = html.EscapeString(quote)
+			if author != "" {
+				quote += "<footer>— " + html.EscapeString(author) + "</footer>"
+			}
+			content.WriteString(fmt.Sprintf("<blockquote>%s</blockquote>\n", quote))
+		case blockList:
+			content.WriteString(htmlList(parseListItems(block.Content)))
+		case blockTable:
+			content.WriteString(htmlTable(parseTable(block.Content)))
+		case blockImage:
+			content.WriteString(htmlImage(parseImage(block.Content)))
+		case blockHR:
+			content.WriteString("<hr>\n")
+		case blockRawLaTeX:
+			content.WriteString(fmt.Sprintf("<div class=\"raw-latex\">\\[%s\\]</div>\n", block.Content))
+		default:
+			var paragraph strings.Builder
+			for _, span := range splitInlineCode(block.Content) {
+				if span.Code {
+					paragraph.WriteString("<code>" + html.EscapeString(span.Text) + "</code>")
+					continue
+				}
+
+				paragraph.WriteString(notes.replace(htmlInline(span.Text), refs.html))
+			}
+
+			content.WriteString(fmt.Sprintf("<p>%s</p>\n", paragraph.String()))
+		}
+	}
+
+	content.WriteString(notes.htmlList())
+	content.WriteString("<script>hljs.highlightAll();</script>\n")
+	content.WriteString("</body>\n</html>\n")
+	return content.String()
+}
+
+// Prose for HTML: escaped, with $math$ handed to MathJax and **bold**, *italics* and bare
+// links turned into markup
+func htmlInline(text string) string {
+	var result strings.Builder
+	for _, segment := range splitMathSegments(text) {
+		switch {
+		case segment.Display:
+			result.WriteString("\\[" + html.EscapeString(segment.Text) + "\\]")
+		case segment.Math:
+			result.WriteString("\\(" + html.EscapeString(segment.Text) + "\\)")
+		default:
+			literal := strings.ReplaceAll(segment.Text, "\\$", "$")
+			result.WriteString(htmlEmphasis(html.EscapeString(literal)))
+		}
+	}
+	return result.String()
+}
+
+// Pairs up ** and * markers in already escaped text. A marker without a partner stays as typed
+func htmlEmphasis(text string) string {
+	var result strings.Builder
+	i := 0
+	for i < len(text) {
+		if url := urlAt(text, i); url != "" {
+			result.WriteString("<a href=\"" + url + "\">" + url + "</a>")
+			i += len(url)
+			continue
+		}
+		if strings.HasPrefix(text[i:], "**") {
+			if end := strings.Index(text[i+2:], "**"); end > 0 {
+				result.WriteString("<strong>" + htmlEmphasis(text[i+2:i+2+end]) + "</strong>")
+				i += 4 + end
+				continue
+			}
+		} else if text[i] == '*' {
+			// Bold markers inside the italics don't close them
+			end := -1
+			for j := i + 1; j < len(text); j++ {
+				if strings.HasPrefix(text[j:], "**") {
+					j++
+				} else if text[j] == '*' {
+					end = j
+					break
+				}
+			}
+			if end > i+1 {
+				result.WriteString("<em>" + htmlEmphasis(text[i+1:end]) + "</em>")
+				i = end + 1
+				continue
+			}
+		}
+		result.WriteByte(text[i])
+		i++
+	}
+	return result.String()
+}
+
+// Self-contained variant of generateHTML for reading without a network connection.
+// Math is rendered to Unicode up front instead of being left for MathJax
+func (m model) generateOfflineHTML(blocks []ContentBlock, title string) string {
+	var content strings.Builder
+	content.WriteString("<!DOCTYPE html>\n<html>\n<head>\n")
+	content.WriteString("<meta charset=\"UTF-8\">\n")
+	content.WriteString(fmt.Sprintf("<title>%s</title>\n", html.EscapeString(title)))
+	content.WriteString("<style>\n")
+	content.WriteString("body { font-family: serif; max-width: 800px; margin: 0 auto; padding: 2rem; line-height: 1.6; }\n")
+	content.WriteString("h1, h2, h3 { color: #333; }\n")
+	content.WriteString("code { background-color: #f4f4f4; padding: 2px 4px; border-radius: 3px; }\n")
+	content.WriteString("pre { background-color: #f4f4f4; padding: 1rem; border-radius: 5px; overflow-x: auto; }\n")
+	content.WriteString("blockquote { border-left: 4px solid #ddd; margin: 0; padding-left: 1rem; font-style: italic; }\n")
+	content.WriteString(".math { font-style: italic; white-space: pre; text-align: center; margin: 1rem 0; }\n")
+	content.WriteString("table { border-collapse: collapse; }\n")
+	content.WriteString("th, td { border: 1px solid #ddd; padding: 4px 8px; }\n")
+	content.WriteString("</style>\n")
+	content.WriteString("</head>\n<body>\n")
+
+	notes := collectFootnotes(blocks)
+	refs := footnoteRefs{}
+	numbers := sectionNumbers(blocks)
+	for i, block := range blocks {
+		switch block.Type {
+		case blockHeading:
+			content.WriteString(htmlHeading(block, numbers[i]))
+		case blockMath:
+			rendered := m.document.renderer.renderLaTeX(strings.Trim(block.Content, "$"))
+			content.WriteString(fmt.Sprintf("<div class=\"math\">%s</div>\n", html.EscapeString(renderEnvironments(rendered.Unicode))))
+		case blockText:
+			var paragraph strings.Builder
+			for _, span := range splitInlineCode(block.Content) {
+				if span.Code {
+					paragraph.WriteString("<code>" + html.EscapeString(span.Text) + "</code>")
+					continue
+				}
+				text := html.EscapeString(m.document.renderer.renderInlineMath(span.Text))
+				paragraph.WriteString(notes.replace(text, refs.html))
+			}
+			content.WriteString(fmt.Sprintf("<p>%s</p>\n", paragraph.String()))
+		case blockImage:
+			content.WriteString(htmlImage(parseImage(block.Content)))
+		default:
+			// The EPUB markup is already free of external resources
+			content.WriteString(m.epubBlockXHTML(block))
+		}
+	}
+
+	content.WriteString(notes.htmlList())
+	content.WriteString("</body>\n</html>\n")
+	return content.String()
+}
+
+func (m model) generateUnicode(blocks []ContentBlock) string {
+	var content strings.Builder
+
+	for _, block := range blocks {
+		switch block.Type {
+		case blockCode:
+			content.WriteString("```")
+			if block.Language != "" {
+				content.WriteString(block.Language)
+			}
+			content.WriteString("\n")
+			content.WriteString(block.Content)
+			content.WriteString("\n```\n\n")
+		case blockQuote:
+			lines := strings.Split(block.Content, "\n")
+			for _, line := range lines {
+				content.WriteString("> " + line + "\n")
+			}
+			content.WriteString("\n")
+		case blockTable:
+			content.WriteString(formatTable(parseTable(block.Content), lipgloss.NewStyle()))
+			content.WriteString("\n\n")
+		case blockImage:
+			content.WriteString("[image: " + parseImage(block.Content).label() + "]\n\n")
+		case blockHR:
+			content.WriteString(strings.Repeat("─", 40) + "\n\n")
+		case blockRawLaTeX:
+			rendered := m.document.renderer.renderLaTeX(block.Content)
+			content.WriteString(rendered.Unicode)
+			content.WriteString("\n\n")
+		default:
+			rendered := m.document.renderer.renderLaTeX(block.Content)
+			content.WriteString(renderEnvironments(rendered.Unicode))
+			content.WriteString("\n\n")
+		}
+	}
+
+	return content.String()
+}
+
+// Renders a whole document as one Markdown string, the same text the Markdown export writes
+func DocumentToMarkdown(doc OathDocument, prefs *UserPreferences) string {
+	m := model{preferences: prefs}
+	m.document.created = doc.Created
+	return m.generateMarkdown(doc.Content)
+}
+
+// YAML front matter with the document title and the day it was created. Documents that
+// were never saved have no creation time yet and are dated today
+func markdownFrontMatter(title string, created time.Time) string {
+	if created.IsZero() {
+		created = time.Now()
+	}
+
+	var content strings.Builder
+	content.WriteString("---\n")
+	if title != "" {
+		content.WriteString("title: " + strconv.Quote(title) + "\n")
+	}
+	content.WriteString("date: " + created.Format("2006-01-02") + "\n")
+	content.WriteString("---\n\n")
+	return content.String()
+}
+
+func (m model) generateMarkdown(blocks []ContentBlock) string {
+	var content strings.Builder
+
+	if m.preferences.MarkdownFrontMatter {
+		content.WriteString(markdownFrontMatter(documentTitle(blocks), m.document.created))
+	}
+
+	numbers := sectionNumbers(blocks)
+	for i, block := range blocks {
+		switch block.Type {
+		case blockCode:
+			content.WriteString("```")
+			if block.Language != "" {
+				content.WriteString(block.Language)
+			}
+			content.WriteString("\n")
+			content.WriteString(expandLeadingTabs(block.Content, m.preferences.CodeTabWidth))
+			content.WriteString("\n```\n\n")
+		case blockQuote:
+			lines := strings.Split(block.Content, "\n")
+			for _, line := range lines {
+				content.WriteString("> " + line + "\n")
+			}
+			content.WriteString("\n")
+		case blockList:
+			content.WriteString(markdownList(parseListItems(block.Content)))
+			content.WriteString("\n")
+		case blockTable:
+			content.WriteString(block.Content)
+			content.WriteString("\n\n")
+		case blockImage:
+			image := parseImage(block.Content)
+			content.WriteString(fmt.Sprintf("![%s](%s)\n\n", image.Alt, image.Path))
+		case blockHR:
+			content.WriteString("---\n\n")
+		case blockMath:
+			content.WriteString("$")
+			content.WriteString(strings.Trim(block.Content, "$"))
+			content.WriteString("$\n\n")
+		case blockRawLaTeX:
+			content.WriteString("```latex\n")
+			content.WriteString(block.Content)
+			content.WriteString("\n```\n\n")
+		case blockHeading:
+			number := ""
+			if m.preferences.MarkdownSectionNumbers {
+				number = numbers[i]
+			}
+			content.WriteString(markdownHeading(block, number))
+			content.WriteString("\n\n")
+		case blockText:
+			content.WriteString(strings.TrimRight(block.Content, " \t\n"))
+			content.WriteString("\n\n")
+		default:
+			content.WriteString(block.Content)
+			content.WriteString("\n\n")
+		}
+	}
+
+	return content.String()
+}
+
+// Rewrites the heading with as many #s as its level and a single space before the title.
+// An explicit Level wins over the #s typed into the block
+func markdownHeading(block ContentBlock, number string) string {
+	content := strings.TrimSpace(block.Content)
+	title := strings.TrimLeft(content, "#")
+	level := len(content) - len(title)
+	if block.Level > 0 {
+		level = block.Level
+	}
+	if level < 1 {
+		level = 1
+	} else if level > 6 {
+		level = 6
+	}
+	title = strings.TrimSpace(title)
+	if number != "" {
+		title = number + " " + title
+	}
+	return strings.Repeat("#", level) + " " + title
+}
+
+// Section numbers as LaTeX would print them, indexed like blocks. Only numbered headings
+// advance the counters and, like \paragraph, levels below three are never numbered
+func sectionNumbers(blocks []ContentBlock) []string {
+	numbers := make([]string, len(blocks))
+	var counters [3]int
+	for i, block := range blocks {
+		if block.Type != blockHeading || !block.Numbered {
+			continue
+		}
+		level := strings.Count(strings.TrimSpace(block.Content), "#")
+		if level < 1 {
+			level = 1
+		}
+		if level > len(counters) {
+			continue
+		}
+
+		counters[level-1]++
+		parts := make([]string, level)
+		for j := range counters {
+			if j >= level {
+				counters[j] = 0
+				continue
+			}
+			parts[j] = strconv.Itoa(counters[j])
+		}
+		numbers[i] = strings.Join(parts, ".")
+	}
+	return numbers
+}
+
+func htmlHeading(block ContentBlock, number string) string {
+	level := strings.Count(strings.TrimSpace(block.Content), "#")
+	if level < 1 {
+		level = 1
+	} else if level > 6 {
+		level = 6
+	}
+	title := html.EscapeString(strings.TrimSpace(strings.TrimLeft(block.Content, "#")))
+	if number != "" {
+		title = fmt.Sprintf("<span class=\"section-number\">%s</span> %s", number, title)
+	}
+	return fmt.Sprintf("<h%d>%s</h%d>\n", level, title, level)
+}
+
+// Level one gets an overline as well, deeper levels use progressively lighter underlines
+func rstHeading(title string, level int) string {
+	adornments := []string{"=", "=", "-", "~", "^", "\""}
+	if level < 1 {
+		level = 1
+	} else if level > len(adornments) {
+		level = len(adornments)
+	}
+
+	line := strings.Repeat(adornments[level-1], lipgloss.Width(title))
+	if level == 1 {
+		return line + "\n" + title + "\n" + line + "\n"
+	}
+	return title + "\n" + line + "\n"
+}
+
+func rstIndent(text, indent string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) != "" {
+			lines[i] = indent + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func rstInline(text string) string {
+	var result strings.Builder
+	for _, segment := range splitMathSegments(text) {
+		if segment.Math {
+			result.WriteString(":math:`" + segment.Text + "`")
+		} else {
+			result.WriteString(segment.Text)
+		}
+	}
+	return result.String()
+}
+
+// Nested lists need a blank line on either side and must line up with the parent's text
+func rstList(items []listItem) string {
+	var content strings.Builder
+	var offsets []int
+	var counters []int
+	previousLevel := 0
+
+	for i, item := range items {
+		if item.Level < len(offsets) {
+			offsets = offsets[:item.Level]
+			counters = counters[:item.Level+1]
+		}
+		for len(counters) < item.Level+1 {
+			counters = append(counters, 0)
+		}
+		if i > 0 && item.Level != previousLevel {
+			content.WriteString("\n")
+		}
+		previousLevel = item.Level
+
+		indent := 0
+		if len(offsets) > 0 {
+			indent = offsets[len(offsets)-1]
+		}
+
+		marker := "- "
+		if item.Ordered {
+			counters[item.Level]++
+			marker = fmt.Sprintf("%d. ", counters[item.Level])
+		} else {
+			counters[item.Level] = 0
+		}
+
+		content.WriteString(strings.Repeat(" ", indent) + marker + item.checkbox("☐ ", "☑ ") + rstInline(item.Text) + "\n")
+		offsets = append(offsets, indent+len(marker))
+	}
+
+	return content.String()
+}
+
+func rstTable(table tableData) string {
+	if table.columns() == 0 {
+		return ""
+	}
+
+	var content strings.Builder
+	content.WriteString(".. list-table::\n")
+	rows := table.Rows
+	if table.Header != nil {
+		content.WriteString("   :header-rows: 1\n")
+		rows = append([][]string{table.Header}, rows...)
+	}
+	content.WriteString("\n")
+
+	for _, row := range rows {
+		for i, cell := range row {
+			marker := "     - "
+			if i == 0 {
+				marker = "   * - "
+			}
+			content.WriteString(marker + rstInline(cell) + "\n")
+		}
+	}
+	return content.String()
+}
+
+// Nesting is expressed by repeating the marker, ** for a second level bullet and .. for
+// a second level numbered item
+func asciidocList(items []listItem) string {
+	var content strings.Builder
+	for _, item := range items {
+		marker := "*"
+		if item.Ordered {
+			marker = "."
+		}
+		content.WriteString(strings.Repeat(marker, item.Level+1) + " " + item.checkbox("[ ] ", "[x] ") + item.Text + "\n")
+	}
+	return content.String()
+}
+
+func asciidocTable(table tableData) string {
+	if table.columns() == 0 {
+		return ""
+	}
+
+	var content strings.Builder
+	if table.Header != nil {
+		content.WriteString("[options=\"header\"]\n")
+	}
+	content.WriteString("|===\n")
+	if table.Header != nil {
+		content.WriteString("|" + strings.Join(table.Header, " |") + "\n\n")
+	}
+	for _, row := range table.Rows {
+		content.WriteString("|" + strings.Join(row, " |") + "\n")
+	}
+	content.WriteString("|===\n")
+	return content.String()
+}
+
+// Math uses the latexmath macro and block directly, so the output needs no :stem: attribute
+func asciidocMath(block ContentBlock) string {
+	segments := splitMathSegments(strings.TrimSpace(block.Content))
+	hasMath := false
+	for _, segment := range segments {
+		hasMath = hasMath || segment.Math
+	}
+	if !hasMath {
+		segments = []mathSegment{{Text: strings.TrimSpace(block.Content), Math: true, Display: true}}
+	}
+
+	var content, paragraph strings.Builder
+	for _, segment := range segments {
+		switch {
+		case segment.Display:
+			if text := strings.TrimSpace(paragraph.String()); text != "" {
+				content.WriteString(text + "\n\n")
+			}
+			paragraph.Reset()
+			content.WriteString("[latexmath]\n++++\n" + strings.TrimSpace(segment.Text) + "\n++++\n\n")
+		case segment.Math:
+			paragraph.WriteString("latexmath:[" + segment.Text + "]")
+		default:
+			paragraph.WriteString(segment.Text)
+		}
+	}
+	if text := strings.TrimSpace(paragraph.String()); text != "" {
+		content.WriteString(text + "\n")
+	}
+	return strings.TrimRight(content.String(), "\n") + "\n"
+}
+
+func (m model) generateAsciiDoc(blocks []ContentBlock) string {
+	var content strings.Builder
+
+	for _, block := range blocks {
+		switch block.Type {
+		case blockHeading:
+			level := strings.Count(strings.TrimSpace(block.Content), "#")
+			if level < 1 {
+				level = 1
+			} else if level > 6 {
+				level = 6
+			}
+			title := strings.TrimSpace(strings.TrimLeft(block.Content, "#"))
+			content.WriteString(strings.Repeat("=", level) + " " + title + "\n")
+		case blockCode:
+			content.WriteString("[source")
+			if block.Language != "" {
+				content.WriteString("," + block.Language)
+			}
+			content.WriteString("]\n----\n")
+			content.WriteString(expandLeadingTabs(block.Content, m.preferences.CodeTabWidth))
+			content.WriteString("\n----\n")
+		case blockMath:
+			content.WriteString(asciidocMath(block))
+		case blockQuote:
+			quote, author := splitAttribution(block.Content)
+			if author != "" {
+				// Quoted, or a comma in the name would start the citetitle
+				content.WriteString("[quote, \"" + strings.ReplaceAll(author, "\"", "\\\"") + "\"]\n")
+			}
+			content.WriteString("____\n" + quote + "\n____\n")
+		case blockList:
+			content.WriteString(asciidocList(parseListItems(block.Content)))
+		case blockTable:
+			content.WriteString(asciidocTable(parseTable(block.Content)))
+		case blockImage:
+			image := parseImage(block.Content)
+			if image.Alt != "" {
+				content.WriteString("." + image.Alt + "\n")
+			}
+			content.WriteString(fmt.Sprintf("image::%s[%s]\n", image.Path, image.Alt))
+		case blockHR:
+			content.WriteString("'''\n")
+		case blockRawLaTeX:
+			content.WriteString("[source,latex]\n----\n" + block.Content + "\n----\n")
+		default:
+			content.WriteString(strings.TrimRight(block.Content, " \t\n") + "\n")
+		}
+		content.WriteString("\n")
+	}
+
+	return content.String()
+}
+
+// Title of the first level one heading, used for #+TITLE
+func orgTitle(blocks []ContentBlock) string {
+	for _, block := range blocks {
+		if block.Type != blockHeading {
+			continue
+		}
+		content := strings.TrimSpace(block.Content)
+		title := strings.TrimLeft(content, "#")
+		if len(content)-len(title) <= 1 {
+			return strings.TrimSpace(title)
+		}
+	}
+	return ""
+}
+
+func orgTable(table tableData) string {
+	if table.columns() == 0 {
+		return ""
+	}
+
+	var content strings.Builder
+	row := func(cells []string) {
+		content.WriteString("| " + strings.Join(cells, " | ") + " |\n")
+	}
+	if table.Header != nil {
+		row(table.Header)
+		rules := make([]string, len(table.Header))
+		for i, cell := range table.Header {
+			rules[i] = strings.Repeat("-", lipgloss.Width(cell)+2)
+		}
+		content.WriteString("|" + strings.Join(rules, "+") + "|\n")
+	}
+	for _, cells := range table.Rows {
+		row(cells)
+	}
+	return content.String()
+}
+
+func orgMath(block ContentBlock) string {
+	segments := splitMathSegments(strings.TrimSpace(block.Content))
+	hasMath := false
+	for _, segment := range segments {
+		hasMath = hasMath || segment.Math
+	}
+	if !hasMath {
+		segments = []mathSegment{{Text: strings.TrimSpace(block.Content), Math: true, Display: true}}
+	}
+
+	var content strings.Builder
+	for _, segment := range segments {
+		switch {
+		case segment.Display:
+			content.WriteString("\\[" + strings.TrimSpace(segment.Text) + "\\]")
+		case segment.Math:
+			content.WriteString("$" + segment.Text + "$")
+		default:
+			content.WriteString(segment.Text)
+		}
+	}
+	return strings.TrimSpace(content.String()) + "\n"
+}
+
+func (m model) generateOrg(blocks []ContentBlock) string {
+	var content strings.Builder
+	if title := orgTitle(blocks); title != "" {
+		content.WriteString("#+TITLE: " + title + "\n\n")
+	}
+
+	for _, block := range blocks {
+		switch block.Type {
+		case blockHeading:
+			level := strings.Count(strings.TrimSpace(block.Content), "#")
+			if level < 1 {
+				level = 1
+			}
+			title := strings.TrimSpace(strings.TrimLeft(block.Content, "#"))
+			content.WriteString(strings.Repeat("*", level) + " " + title + "\n")
+		case blockCode:
+			content.WriteString("#+begin_src")
+			if block.Language != "" {
+				content.WriteString(" " + block.Language)
+			}
+			content.WriteString("\n")
+			content.WriteString(expandLeadingTabs(block.Content, m.preferences.CodeTabWidth))
+			content.WriteString("\n#+end_src\n")
+		case blockMath:
+			content.WriteString(orgMath(block))
+		case blockQuote:
+			content.WriteString("#+begin_quote\n" + block.Content + "\n#+end_quote\n")
+		case blockList:
+			content.WriteString(markdownList(parseListItems(block.Content)))
+		case blockTable:
+			content.WriteString(orgTable(parseTable(block.Content)))
+		case blockImage:
+			image := parseImage(block.Content)
+			if image.Alt != "" {
+				content.WriteString("#+CAPTION: " + image.Alt + "\n")
+			}
+			content.WriteString("[[file:" + image.Path + "]]\n")
+		case blockHR:
+			content.WriteString("-----\n")
+		case blockRawLaTeX:
+			content.WriteString("#+begin_export latex\n" + block.Content + "\n#+end_export\n")
+		default:
+			content.WriteString(strings.TrimRight(block.Content, " \t\n") + "\n")
+		}
+		content.WriteString("\n")
+	}
+
+	return content.String()
+}
+
+func (m model) generateRST(blocks []ContentBlock) string {
+	var content strings.Builder
+
+	for _, block := range blocks {
+		switch block.Type {
+		case blockHeading:
+			level := strings.Count(strings.TrimSpace(block.Content), "#")
+			title := strings.TrimSpace(strings.TrimLeft(block.Content, "#"))
+			content.WriteString(rstHeading(title, level))
+		case blockCode:
+			content.WriteString(".. code-block::")
+			if block.Language != "" {
+				content.WriteString(" " + block.Language)
+			}
+			content.WriteString("\n\n")
+			content.WriteString(rstIndent(block.Content, "   "))
+			content.WriteString("\n")
+		case blockMath:
+			segments := splitMathSegments(strings.TrimSpace(block.Content))
+			hasMath := false
+			for _, segment := range segments {
+				hasMath = hasMath || segment.Math
+			}
+
+			// A math block without delimiters is treated as one display equation
+			if !hasMath {
+				segments = []mathSegment{{Text: strings.TrimSpace(block.Content), Math: true, Display: true}}
+			}
+
+			var paragraph strings.Builder
+			for _, segment := range segments {
+				switch {
+				case segment.Display:
+					if strings.TrimSpace(paragraph.String()) != "" {
+						content.WriteString(strings.TrimSpace(paragraph.String()) + "\n\n")
+					}
+					paragraph.Reset()
+					content.WriteString(".. math::\n\n")
+					content.WriteString(rstIndent(strings.TrimSpace(segment.Text), "   "))
+					content.WriteString("\n\n")
+				case segment.Math:
+					paragraph.WriteString(":math:`" + segment.Text + "`")
+				default:
+					paragraph.WriteString(segment.Text)
+				}
+			}
+			if strings.TrimSpace(paragraph.String()) != "" {
+				content.WriteString(strings.TrimSpace(paragraph.String()) + "\n")
+			}
+		case blockQuote:
+			quote, author := splitAttribution(block.Content)
+			if author != "" {
+				quote += "\n\n-- " + author
+			}
+			content.WriteString(rstIndent(rstInline(quote), "    "))
+			content.WriteString("\n")
+		case blockList:
+			content.WriteString(rstList(parseListItems(block.Content)))
+		case blockTable:
+			content.WriteString(rstTable(parseTable(block.Content)))
+		case blockImage:
+			image := parseImage(block.Content)
+			content.WriteString(".. figure:: " + image.Path + "\n")
+			if image.Alt != "" {
+				content.WriteString("   :alt: " + image.Alt + "\n\n")
+				content.WriteString("   " + image.Alt + "\n")
+			}
+		case blockHR:
+			content.WriteString("----\n")
+		case blockRawLaTeX:
+			content.WriteString(".. raw:: latex\n\n")
+			content.WriteString(rstIndent(block.Content, "   "))
+			content.WriteString("\n")
+		default:
+			content.WriteString(rstInline(block.Content))
+			content.WriteString("\n")
+		}
+		content.WriteString("\n")
+	}
+
+	return content.String()
+}
+
+type epubChapter struct {
+	title string
+	body  strings.Builder
+}
+
+func (m model) epubBlockXHTML(block ContentBlock) string {
+	switch block.Type {
+	case blockHeading:
+		return htmlHeading(block, "")
+	case blockMath:
+		// E-readers rarely ship a TeX engine, so math falls back to the Unicode rendering
+		rendered := m.document.renderer.renderLaTeX(strings.Trim(block.Content, "$"))
+		return fmt.Sprintf("<div class=\"math\">%s</div>\n", html.EscapeString(rendered.Unicode))
+	case blockCode:
+		return fmt.Sprintf("<pre><code>%s</code></pre>\n", html.EscapeString(block.Content))
+	case blockQuote:
+		quote, author := splitAttribution(block.Content)
+		if author != "" {
+			return fmt.Sprintf("<blockquote><p>%s</p><footer>— %s</footer></blockquote>\n", html.EscapeString(quote), html.EscapeString(author))
+		}
+		return fmt.Sprintf("<blockquote><p>%s</p></blockquote>\n", html.EscapeString(quote))
+	case blockList:
+		return htmlList(parseListItems(block.Content))
+	case blockHR:
+		return "<hr/>\n"
+	case blockImage:
+		// Images aren't packaged into the archive, so the reader gets the caption instead
+		return fmt.Sprintf("<p>[image: %s]</p>\n", html.EscapeString(parseImage(block.Content).label()))
+	case blockTable:
+		return htmlTable(parseTable(block.Content))
+	case blockRawLaTeX:
+		return fmt.Sprintf("<pre class=\"latex\">%s</pre>\n", html.EscapeString(block.Content))
+	}
+
+	rendered := m.document.renderer.renderLaTeX(block.Content)
+	return fmt.Sprintf("<p>%s</p>\n", html.EscapeString(rendered.Unicode))
+}
+
+// Chapters start at every level one heading. Content before the first one gets its own chapter
+func (m model) epubChapters(blocks []ContentBlock) []*epubChapter {
+	var chapters []*epubChapter
+
+	for _, block := range blocks {
+		isH1 := block.Type == blockHeading && strings.Count(strings.TrimSpace(block.Content), "#") == 1
+		if isH1 || len(chapters) == 0 {
+			title := "Untitled"
+			if isH1 {
+				title = strings.TrimSpace(strings.TrimLeft(block.Content, "#"))
+			}
+			chapters = append(chapters, &epubChapter{title: title})
+		}
+		chapters[len(chapters)-1].body.WriteString(m.epubBlockXHTML(block))
+	}
+
+	if len(chapters) == 0 {
+		chapters = append(chapters, &epubChapter{title: "Untitled"})
+	}
+	return chapters
+}
+
+func (m model) generateEPUB(blocks []ContentBlock, filename string) error {
+	fullPath := filepath.Join(m.browser.currentPath, filename+".epub")
+	file, err := os.Create(fullPath)
+	if err != nil {
+		return fmt.Errorf("failed to create EPUB file: %v", err)
+	}
+
+	if err := m.writeEPUB(file, blocks, filename); err != nil {
+		file.Close()
+		os.Remove(fullPath)
+		return err
+	}
+	// A failed close can lose the end of the archive, so it counts as a failed export
+	if err := file.Close(); err != nil {
+		os.Remove(fullPath)
+		return fmt.Errorf("failed to write EPUB file: %v", err)
+	}
+	return nil
+}
+
+func (m model) writeEPUB(w io.Writer, blocks []ContentBlock, title string) error {
+	archive := zip.NewWriter(w)
+
+	// The spec requires mimetype to be the first entry and stored uncompressed
+	mimetype, err := archive.CreateHeader(&zip.FileHeader{
+		Name:   "mimetype",
+		Method: zip.Store,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := mimetype.Write([]byte("application/epub+zip")); err != nil {
+		return err
+	}
+
+	chapters := m.epubChapters(blocks)
+	if chapters[0].title != "Untitled" {
+		title = chapters[0].title
+	}
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return err
+	}
+	identifier := fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", idBytes[0:4], idBytes[4:6], idBytes[6:8], idBytes[8:10], idBytes[10:])
+
+	var manifest, spine, nav strings.Builder
+	files := map[string]string{}
+	var order []string
+
+	for i, chapter := range chapters {
+		name := fmt.Sprintf("chapter-%d.xhtml", i+1)
+		id := fmt.Sprintf("chapter%d", i+1)
+		manifest.WriteString(fmt.Sprintf("    <item id=\"%s\" href=\"%s\" media-type=\"application/xhtml+xml\"/>\n", id, name))
+		spine.WriteString(fmt.Sprintf("    <itemref idref=\"%s\"/>\n", id))
+		nav.WriteString(fmt.Sprintf("      <li><a href=\"%s\">%s</a></li>\n", name, html.EscapeString(chapter.title)))
+
+		files["OEBPS/"+name] = "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n" +
+			"<!DOCTYPE html>\n" +
+			"<html xmlns=\"http://www.w3.org/1999/xhtml\" xmlns:epub=\"http://www.idpf.org/2007/ops\">\n" +
+			"<head>\n<meta charset=\"UTF-8\"/>\n<title>" + html.EscapeString(chapter.title) + "</title>\n</head>\n" +
+			"<body>\n" + chapter.body.String() + "</body>\n</html>\n"
+		order = append(order, "OEBPS/"+name)
+	}
+
+	files["META-INF/container.xml"] = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`
+
+	files["OEBPS/content.opf"] = `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="bookid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="bookid">` + identifier + `</dc:identifier>
+    <dc:title>` + html.EscapeString(title) + `</dc:title>
+    <dc:language>en</dc:language>
+    <meta property="dcterms:modified">` + time.Now().UTC().Format("2006-01-02T15:04:05Z") + `</meta>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+` + manifest.String() + `  </manifest>
+  <spine>
+` + spine.String() + `  </spine>
+</package>
+`
+
+	files["OEBPS/nav.xhtml"] = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head>
+<meta charset="UTF-8"/>
+<title>` + html.EscapeString(title) + `</title>
+</head>
+<body>
+  <nav epub:type="toc" id="toc">
+    <ol>
+` + nav.String() + `    </ol>
+  </nav>
+</body>
+</html>
+`
+
+	order = append([]string{"META-INF/container.xml", "OEBPS/content.opf", "OEBPS/nav.xhtml"}, order...)
+	for _, name := range order {
+		entry, err := archive.Create(name)
+		if err != nil {
+			return err
+		}
+		if _, err := entry.Write([]byte(files[name])); err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+func (m model) View() string {
+	if m.quitPrompt != quitNone {
+		return m.viewQuitPrompt()
+	}
+	if m.palette.active {
+		return m.viewPalette()
+	}
+	if m.symbols.active {
+		return m.viewSymbols()
+	}
+	if m.search.active {
+		return m.viewSearch()
+	}
+
+	switch m.mode {
+	case modeBrowser:
+		return m.viewBrowser()
+	case modeMenu:
+		return m.viewMenu()
+	case modeEdit:
+		return m.withStatusBar(model.viewEdit)
+	case modeTimer:
+		return m.viewTimer()
+	case modeExport:
+		return m.withStatusBar(model.viewExport)
+	}
+	return ""
+}
+
+const statusBarHeight = 1
+
+// Rows the document views get once the status bar has taken the bottom one
+func (m model) documentHeight() int {
+	return m.height - statusBarHeight
+}
+
+// Lays a document view out above the status bar
+func (m model) withStatusBar(view func(model) string) string {
+	status := renderStatusBar(m)
+	m.height = m.documentHeight()
+	if m.height < 1 {
+		return status
+	}
+	body := lipgloss.NewStyle().Height(m.height).MaxHeight(m.height).Render(view(m))
+	return lipgloss.JoinVertical(lipgloss.Left, body, status)
+}
+
+func (m model) viewQuitPrompt() string {
+	theme := m.getCurrentTheme()
+
+	titleStyle := lipgloss.NewStyle().
+		Bold(true).
+		Foreground(theme.Warning)
+
+	keyStyle := lipgloss.NewStyle().
+		Bold(true).
+		Foreground(theme.Accent)
+
+	boxStyle := lipgloss.NewStyle().
+		Border(lipgloss.RoundedBorder()).
+		BorderForeground(theme.Border).
+		Padding(1, 3)
+
+	name := "Untitled document"
+	if m.document.filepath != "" {
+		name = filepath.Base(m.document.filepath)
+	}
+
+	var content strings.Builder
+	content.WriteString(titleStyle.Render("Unsaved changes"))
+	content.WriteString("\n\n")
+	content.WriteString(name + " has changes that haven't been saved.")
+	content.WriteString("\n\n")
+	content.WriteString(keyStyle.Render("s") + ": save  " + keyStyle.Render("d") + ": discard  " + keyStyle.Render("esc") + ": cancel")
+
+	return lipgloss.Place(m.width, m.height, lipgloss.Center, lipgloss.Center, boxStyle.Render(content.String()))
+}
+
+func (m model) viewBrowser() string {
+	var content strings.Builder
+
+	theme := m.getCurrentTheme()
+	
+	titleStyle := lipgloss.NewStyle().
+		Bold(true).
+		Foreground(theme.Primary).
+		Width(m.width).
+		Align(lipgloss.Center)
+
+	pathStyle := lipgloss.NewStyle().
+		Foreground(theme.Muted)
+
+	selectedStyle := lipgloss.NewStyle().
+		Foreground(theme.Accent).
+		Bold(true)
+
+	dirStyle := lipgloss.NewStyle().
+		Foreground(theme.Primary)
+
+	fileStyle := lipgloss.NewStyle().
+		Foreground(theme.Foreground)
+
+	oathStyle := lipgloss.NewStyle().
+		Foreground(theme.Success).
+		Bold(true)
+
+	helpStyle := lipgloss.NewStyle().
+		Foreground(theme.Muted)
+
+	errorStyle := lipgloss.NewStyle().
+		Foreground(theme.Error)
+
+	content.WriteString(titleStyle.Render("Oathkeeper - File Browser"))
+	content.WriteString("\n\n")
+	if m.browser.showRecent && m.browser.recentDirs {
+		content.WriteString(pathStyle.Render("Recent directories"))
+	} else if m.browser.showRecent {
+		content.WriteString(pathStyle.Render("Recent files"))
+	} else {
+		content.WriteString(pathStyle.Render("Current directory: " + m.browser.currentPath))
+	}
+	content.WriteString("\n\n")
+
+	if m.browser.errorMsg != "" {
+		content.WriteString(errorStyle.Render("Error: " + m.browser.errorMsg))
+		content.WriteString("\n\n")
+	}
+
+	if len(m.keyWarnings) > 0 {
+		content.WriteString(lipgloss.NewStyle().Foreground(theme.Warning).Render(strings.Join(m.keyWarnings, "\n")))
+		content.WriteString("\n\n")
+	}
+
+	if len(m.browser.recoveries) > 0 {
+		recovery := m.browser.recoveries[0]
+		warningStyle := lipgloss.NewStyle().Foreground(theme.Warning).Bold(true)
+		content.WriteString(warningStyle.Render(fmt.Sprintf("Unsaved changes to %s from %s were recovered. r: restore • x: discard",
+			recovery.name(), recovery.Modified.Format("Jan 2 15:04"))))
+		content.WriteString("\n\n")
+	}
+
+	if m.browser.filtering || m.browser.filter.Value() != "" {
+		content.WriteString(pathStyle.Render("Filter: ") + m.browser.filter.View())
+		content.WriteString("\n\n")
+	}
+
+	switch m.browser.pendingOp {
+	case browserOpCreate:
+		content.WriteString(pathStyle.Render("New: ") + m.browser.prompt.View())
+		content.WriteString("\n\n")
+	case browserOpRename:
+		content.WriteString(pathStyle.Render("Rename to: ") + m.browser.prompt.View())
+		content.WriteString("\n\n")
+	case browserOpDelete:
+		target := m.browser.files[m.browser.selected]
+		question := "Move %s to the trash? (y/n)"
+		if m.preferences.PermanentDelete {
+			question = "Delete %s? (y/n)"
+		}
+		content.WriteString(errorStyle.Render(fmt.Sprintf(question, target.Name)))
+		content.WriteString("\n\n")
+	}
+
+	maxVisible := m.height - 8
+	start := 0
+	end := len(m.browser.files)
+
+	if len(m.browser.files) > maxVisible {
+		start = m.browser.selected - maxVisible/2
+		if start < 0 {
+			start = 0
+		}
+		end = start + maxVisible
+		if end > len(m.browser.files) {
+			end = len(m.browser.files)
+			start = end - maxVisible
+		}
+	}
+
+	for i := start; i < end; i++ {
+		file := m.browser.files[i]
+		cursor := "  "
+		if i == m.browser.selected {
+			cursor = "> "
+		}
+
+		var style lipgloss.Style
+		icon := ""
+
+		if file.Err != nil {
+			style = lipgloss.NewStyle().Foreground(theme.Muted)
+			icon = "? "
+		} else if file.IsDir {
+			style = dirStyle
+			icon = "d "
+		} else if strings.HasSuffix(file.Name, ".oath") {
+			style = oathStyle
+			icon = "o "
+		} else {
+			style = fileStyle
+			icon = "f "
+		}
+
+		line := cursor + icon + file.Name
+		if file.Err != nil {
+			line += " (unreadable)"
+		}
+		if i == m.browser.selected {
+			line = selectedStyle.Render(line)
+		} else {
+			line = style.Render(line)
+		}
+
+		content.WriteString(line)
+		content.WriteString("\n")
+	}
+
+	content.WriteString("\n")
+	if m.browser.pendingOp != browserOpNone {
+		content.WriteString(helpStyle.Render("enter: confirm | esc: cancel"))
+	} else if m.browser.filtering {
+		content.WriteString(helpStyle.Render("type to filter | up/down: navigate | enter: keep filter | esc: clear"))
+	} else if m.browser.showRecent && m.browser.recentDirs {
+		content.WriteString(helpStyle.Render("j/k: navigate | enter: go to directory | /: filter | ~: recent files | g: back to directory | space: new document | q: quit"))
+	} else if m.browser.showRecent {
+		content.WriteString(helpStyle.Render("j/k: navigate | enter: open | /: filter | g: recent directories | ~: back to directory | space: new document | q: quit"))
+	} else {
+		content.WriteString(helpStyle.Render("j/k: navigate | enter: select | space: new document | h: toggle hidden | /: filter | a: new | R: rename | D: delete | u: restore deleted | ~: recent | g: recent directories | q: quit"))
+	}
+
+	return content.String()
+}
+
+func (m model) viewMenu() string {
+	var content strings.Builder
+	theme := m.getCurrentTheme()  
+
+	titleStyle := lipgloss.NewStyle().
+		Bold(true).
+		Foreground(theme.Primary).
+		Width(m.width).
+		Align(lipgloss.Center)
+
+	selectedStyle := lipgloss.NewStyle().
+		Foreground(theme.Accent).
+		Bold(true)
+
+	helpStyle := lipgloss.NewStyle().
+		Foreground(theme.Muted)
+
+	vimIndicator := ""
+	if m.document.vim.enabled {
+		vimIndicator = " (Vim: ON)"
+	} else {
+		vimIndicator = " (Vim: OFF)"
+	}
+
+	content.WriteString(titleStyle.Render("Oathkeeper - Document Templates" + vimIndicator))
+	content.WriteString("\n\nSelect a template:\n\n")
+
+	for i, template := range m.menu.templates {
+		cursor := "  "
+		if i == m.menu.selected {
+			cursor = "> "
+		}
+
+		line := cursor + template.Name + " - " + template.Description
+		if i == m.menu.selected {
+			line = selectedStyle.Render(line)
+		}
+		content.WriteString(line)
+		content.WriteString("\n")
+	}
+
+	content.WriteString("\n")
+	if m.menu.input.Focused() {
+		name := m.menu.pendingVars[m.menu.varIndex]
+		content.WriteString(fmt.Sprintf("%s (%d/%d): ", name, m.menu.varIndex+1, len(m.menu.pendingVars)))
+		content.WriteString(m.menu.input.View())
+		content.WriteString("\n\n")
+		content.WriteString(helpStyle.Render("enter: next (empty keeps the default) | esc: cancel"))
+	} else {
+		content.WriteString(helpStyle.Render("j/k: navigate | enter: select | v: toggle vim | t: timer | q: back"))
+	}
+
+	return lipgloss.Place(
+		m.width,
+		m.height,
+		lipgloss.Center,
+		lipgloss.Center,
+		content.String(),
+	)
+}
+
+func (m model) viewEdit() string {
+	if m.document.showDiff {
+		return m.viewDiff()
+	}
+	if m.document.showOutline {
+		return m.viewOutline()
+	}
+	if m.document.showNotes {
+		return m.viewNotes()
+	}
+	if m.document.showComments {
+		return m.viewComments()
+	}
+	if m.document.exportError != "" {
+		return m.viewExportError()
+	}
+
+	theme := m.getCurrentTheme()
+	switch m.document.viewMode {
+	case viewEditorOnly:
+		// Stats sit where the preview would be, the editor stays in view
+		if !m.document.showStats {
+			return m.renderEditor(m.width, m.height)
+		}
+	case viewPreviewOnly:
+		return m.renderPreview(m.width, m.height)
+	case viewSplitPane:
+	default:
+		return ""
+	}
+
+	editorWidth, previewWidth := m.splitWidths()
+
+	editor := m.renderEditor(editorWidth, m.height)
+	preview := m.renderPreview(previewWidth, m.height)
+
+	return lipgloss.JoinHorizontal(
+		lipgloss.Top,
+		editor,
+		lipgloss.NewStyle().
+			Border(lipgloss.NormalBorder(), false, false, false, true).
+			BorderForeground(theme.Border).
+			Height(m.height).
+			Render(preview),
+	)
+}
+
+// File name of the document, an unsaved one is named after its first heading
+func (m model) documentName() string {
+	if m.document.filepath != "" {
+		return filepath.Base(m.document.filepath)
+	}
+	for _, block := range m.document.blocks {
+		if block.Type == blockHeading && strings.TrimSpace(block.Content) != "" {
+			title := strings.TrimSpace(block.Content)
+			title = strings.TrimLeft(title, "#")
+			title = strings.TrimSpace(title)
+			if title != "" && title != "Document Title" {
+				return title + ".oath"
 			}
+			break
 		}
-		
-		if text[i] == '*' && (i == 0 || text[i-1] != '*') && (i == len(text)-1 || text[i+1] != '*') {
-			end := -1
-			for j := i + 1; j < len(text); j++ {
-				if text[j] == '*' && (j == len(text)-1 || text[j+1] != '*') && (j == 0 || text[j-1] != '*') {
-					end = j
-					break
-				}
-			}
-			if end != -1 && end > i+1 { 
-				content := text[i+1 : end]
-				result.WriteString("\\textit{" + content + "}")
-				i = end + 1
-				continue
-			}
+	}
+	return "untitled.oath"
+}
+
+// Bottom line of the document views: path, save state, vim mode, theme, block and clock
+func renderStatusBar(m model) string {
+	theme := m.getCurrentTheme()
+
+	path := m.documentName()
+	if m.document.filepath != "" {
+		path = m.document.filepath
+		if home, err := os.UserHomeDir(); err == nil && strings.HasPrefix(path, home+string(filepath.Separator)) {
+			path = "~" + path[len(home):]
 		}
-		
-		result.WriteByte(text[i])
-		i++
 	}
-	
-	return result.String()
+	if m.document.modified {
+		path += " *"
+	}
+	segments := []string{path}
+
+	if len(m.keyWarnings) > 0 {
+		segments = append(segments, strings.Join(m.keyWarnings, "; "))
+	}
+	if m.document.saveError != "" {
+		segments = append(segments, "save failed: "+m.document.saveError)
+	} else if m.document.showSaved {
+		segments = append(segments, "saved")
+	}
+	if m.document.vim.enabled {
+		switch m.document.vim.mode {
+		case vimNormal:
+			segments = append(segments, "NORMAL")
+		case vimInsert:
+			segments = append(segments, "INSERT")
+		case vimVisual:
+			segments = append(segments, "VISUAL")
+		case vimCommand:
+			segments = append(segments, "COMMAND")
+		}
+	}
+	segments = append(segments, theme.Name)
+
+	left := " " + strings.Join(segments, " │ ")
+	right := fmt.Sprintf("Block %d/%d │ %s ", m.document.currentBlock+1, len(m.document.blocks), time.Now().Format("15:04"))
+
+	gap := m.width - lipgloss.Width(left) - lipgloss.Width(right)
+	if gap < 1 {
+		gap = 1
+	}
+	return lipgloss.NewStyle().
+		Background(theme.Secondary).
+		Foreground(theme.Foreground).
+		Width(m.width).
+		MaxWidth(m.width).
+		Render(left + strings.Repeat(" ", gap) + right)
 }
-// maybe parser based system in due time if i ever read this comment again 
-func processDelimiterBasedMath(rawContent string) string {
-	var result strings.Builder
-	content := strings.TrimSpace(rawContent)
-	
-	result.WriteString("\\vspace{0.5em}\n") 
-	
-	i := 0
-	for i < len(content) {
-		if i < len(content)-1 && content[i:i+2] == "$$" {
-			end := strings.Index(content[i+2:], "$$")
-			if end != -1 {
-				mathContent := content[i+2 : i+2+end]
-				result.WriteString("\\vspace{0.3em}\n\\begin{equation*}\n" + mathContent + "\n\\end{equation*}\n\\vspace{0.3em}\n")
-				i += 4 + end
-				continue
+
+func (m model) renderEditor(width, height int) string {
+	var content strings.Builder
+	theme := m.getCurrentTheme()
+
+	headerStyle := lipgloss.NewStyle().
+		Bold(true).
+		Foreground(theme.Primary).
+		Width(width).
+		Align(lipgloss.Center)
+
+	blockStyle := lipgloss.NewStyle().
+		Border(lipgloss.RoundedBorder()).
+		BorderForeground(theme.Border).
+		Padding(0, 1).
+		Width(width - 4)
+
+	currentBlockStyle := blockStyle.Copy().
+		BorderForeground(theme.Primary)
+
+	selectedBlockStyle := blockStyle.Copy().
+		BorderForeground(theme.Accent)
+
+	helpStyle := lipgloss.NewStyle().
+		Foreground(theme.Muted).
+		Width(width)
+
+	completionStyle := lipgloss.NewStyle().
+		Background(theme.Secondary).
+		Foreground(theme.Foreground).
+		Padding(0, 1)
+
+	selectedCompletionStyle := completionStyle.Copy().
+		Background(theme.Primary).
+		Foreground(theme.Background)
+
+	content.WriteString(headerStyle.Render("Editor - " + m.documentName()))
+	content.WriteString("\n")
+
+	position := fmt.Sprintf("Block %d/%d", m.document.currentBlock+1, len(m.document.blocks))
+	if m.document.editor.Focused() {
+		line, col := editorPosition(m.document.editor)
+		position += fmt.Sprintf(" · Ln %d, Col %d", line, col)
+	}
+	if len(m.document.blocks) > m.document.currentBlock {
+		if block := m.document.blocks[m.document.currentBlock]; block.Type == blockCode {
+			if block.NoWrap || !m.preferences.CodeBreakLines {
+				position += " · no wrap"
 			}
-		}
-		
-		if content[i] == '$' {
-			end := strings.Index(content[i+1:], "$")
-			if end != -1 {
-				mathContent := content[i+1 : i+1+end]
-				result.WriteString("\\(" + mathContent + "\\)")
-				i += 2 + end
-				continue
+			if block.LineNumbers {
+				position += " · line numbers"
 			}
-		}
-		
-		if content[i] == '\n' {
-			if i < len(content)-1 && content[i+1] == '\n' {
-				result.WriteString("\n\n")
-				i += 2
-				continue
-			} else {
-				result.WriteString("\n")
+			if block.Language != "" {
+				position += " · " + block.Language
+			} else if language := detectLanguage(block.Content); language != "" {
+				position += " · " + language + " (detected)"
 			}
-		} else {
-			result.WriteByte(content[i])
+		} else if block.Type == blockText && block.RawText {
+			position += " · raw LaTeX"
 		}
-		i++
-	}
-	
-	result.WriteString("\\vspace{0.5em}\n") 
-	return result.String()
-}
-func escapeLaTeX(text string) string {
-	replacements := map[string]string{
-		"&":  "\\&",
-		"%":  "\\%",
-		"#":  "\\#",
-		"_":  "\\_",
-		"~":  "\\textasciitilde{}",
 	}
-	
-	result := text
-	for char, escaped := range replacements {
-		result = strings.ReplaceAll(result, "\\"+char, "TEMP_ESCAPE_"+char)
-		result = strings.ReplaceAll(result, char, escaped)
-		result = strings.ReplaceAll(result, "TEMP_ESCAPE_"+char, "\\"+char)
+	positionStyle := lipgloss.NewStyle().
+		Foreground(theme.Muted).
+		Width(width).
+		MaxWidth(width).
+		Align(lipgloss.Center)
+	content.WriteString(positionStyle.Render(position))
+	content.WriteString("\n")
+	if m.document.showCache {
+		content.WriteString(positionStyle.Render(cacheSummary(m.document.renderer.cache)))
+		content.WriteString("\n")
 	}
-	
-	return result
-}
+	content.WriteString("\n")
 
-func (m model) generateHTML() string {
-	var content strings.Builder
-	content.WriteString("<!DOCTYPE html>\n<html>\n<head>\n")
-	content.WriteString("<meta charset=\"UTF-8\">\n")
-	content.WriteString("<title>Document</title>\n")
-	content.WriteString("<script src=\"https://polyfill.io/v3/polyfill.min.js?features=es6\"></script>\n")
-	content.WriteString("<script id=\"MathJax-script\" async src=\"https://cdn.jsdelivr.net/npm/mathjax@3/es5/tex-mml-chtml.js\"></script>\n")
-	content.WriteString("<link rel=\"stylesheet\" href=\"https://cdnjs.cloudflare.com/ajax/libs/highlight.js/11.8.0/styles/default.min.css\">\n")
-	content.WriteString("<script src=\"https://cdnjs.cloudflare.com/ajax/libs/highlight.js/11.8.0/highlight.min.js\"></script>\n")
-	content.WriteString("<style>\n")
-	content.WriteString("body { font-family: serif; max-width: 800px; margin: 0 auto; padding: 2rem; line-height: 1.6; }\n")
-	content.WriteString("h1, h2, h3 { color: #333; }\n")
-	content.WriteString("code { background-color: #f4f4f4; padding: 2px 4px; border-radius: 3px; }\n")
-	content.WriteString("pre { background-color: #f4f4f4; padding: 1rem; border-radius: 5px; overflow-x: auto; }\n")
-	content.WriteString("blockquote { border-left: 4px solid #ddd; margin: 0; padding-left: 1rem; font-style: italic; }\n")
-	content.WriteString("</style>\n")
-	content.WriteString("</head>\n<body>\n")
+	numbers := sectionNumbers(m.document.blocks)
+	selLo, selHi := m.document.selectionRange()
+	var sections []string
+	for i, block := range m.document.blocks {
+		var section strings.Builder
+		style := blockStyle
+		if m.document.selecting && i >= selLo && i <= selHi {
+			style = selectedBlockStyle
+		}
+		if i == m.document.currentBlock {
+			style = currentBlockStyle
+		}
 
-	for _, block := range m.document.blocks {
-		switch block.Type {
-		case blockHeading:
-			level := strings.Count(strings.TrimSpace(block.Content), "#")
-			title := strings.TrimSpace(strings.TrimLeft(block.Content, "#"))
-			content.WriteString(fmt.Sprintf("<h%d>%s</h%d>\n", level, title, level))
-		case blockMath:
-			content.WriteString(fmt.Sprintf("<p>\\[%s\\]</p>\n", strings.Trim(block.Content, "$")))
-		case blockCode:
-			language := block.Language
-			if language == "" {
-				language = "text"
+		blockTypeIndicator := blockIndicator(block.Type)
+		if block.Type == blockHeading && block.Numbered {
+			number := numbers[i]
+			if number == "" {
+				number = "#"
 			}
-			content.WriteString(fmt.Sprintf("<pre><code class=\"language-%s\">%s</code></pre>\n", language, block.Content))
-		case blockQuote:
-			content.WriteString(fmt.Sprintf("<blockquote>%s</blockquote>\n", block.Content))
-		case blockList:
-			content.WriteString("<ul>\n")
-			lines := strings.Split(block.Content, "\n")
-			for _, line := range lines {
-				line = strings.TrimSpace(line)
-				if strings.HasPrefix(line, "- ") || strings.HasPrefix(line, "* ") {
-					item := strings.TrimSpace(line[2:])
-					content.WriteString(fmt.Sprintf("<li>%s</li>\n", item))
+			blockTypeIndicator = fmt.Sprintf("[HEAD %s] ", number)
+		}
+		if block.Comment != "" {
+			blockTypeIndicator = "✎ " + blockTypeIndicator
+		}
+
+		blockContent := blockTypeIndicator + block.Content
+		if len(block.Content) == 0 {
+			blockContent = blockTypeIndicator + fmt.Sprintf("[Empty %s block]", block.Type)
+		}
+
+		if i == m.document.currentBlock && m.document.editor.Focused() {
+			editorView := m.editorView()
+
+			if m.document.lsp.showCompletions && len(m.document.lsp.completions) > 0 {
+				var completionBox strings.Builder
+				completionBox.WriteString(editorView)
+				completionBox.WriteString("\n")
+
+				for j, comp := range m.document.lsp.completions {
+					compStyle := completionStyle
+					if j == m.document.lsp.activeCompletion {
+						compStyle = selectedCompletionStyle
+					}
+					completionBox.WriteString(compStyle.Render(comp.Label + " - " + comp.Detail))
+					if comp.Example != "" {
+						completionBox.WriteString("\n" + lipgloss.NewStyle().Foreground(theme.Muted).Render("  Example: " + comp.Example))
+					}
+					completionBox.WriteString("\n")
 				}
+				section.WriteString(style.Render(completionBox.String()))
+			} else {
+				section.WriteString(style.Render(editorView))
 			}
-			content.WriteString("</ul>\n")
-		case blockRawLaTeX:
-			content.WriteString(fmt.Sprintf("<div class=\"raw-latex\">\\[%s\\]</div>\n", block.Content))
-		default:
-			text := block.Content
-			text = strings.ReplaceAll(text, "**", "<strong>")
-			text = strings.ReplaceAll(text, "**", "</strong>")
-			text = strings.ReplaceAll(text, "*", "<em>")
-			text = strings.ReplaceAll(text, "*", "</em>")
-			
-			if strings.Contains(text, "http") {
-				text = strings.ReplaceAll(text, "http", "<a href=\"http")
-				text = strings.ReplaceAll(text, " ", "\"> ")
+		} else if m.document.collapsed[block.ID] {
+			foldStyle := lipgloss.NewStyle().Foreground(theme.Muted).PaddingLeft(1)
+			if i == m.document.currentBlock {
+				foldStyle = foldStyle.Foreground(theme.Primary).Bold(true)
 			}
-			
-			content.WriteString(fmt.Sprintf("<p>%s</p>\n", text))
+			section.WriteString(foldStyle.Render("▸ " + blockSummary(block)))
+		} else {
+			section.WriteString(style.Render(blockContent))
 		}
+		section.WriteString("\n")
+
+		if i == m.document.currentBlock && m.document.showMathPreview {
+			section.WriteString(m.renderQuickPreview(block, width))
+			section.WriteString("\n")
+		} else if i == m.document.currentBlock && m.document.editor.Focused() && m.document.viewMode == viewEditorOnly && hasInlinePreview(block.Type) {
+			inlineStyle := lipgloss.NewStyle().
+				Foreground(theme.Primary).
+				BorderLeft(true).
+				BorderStyle(lipgloss.ThickBorder()).
+				BorderForeground(theme.Muted).
+				PaddingLeft(1)
+			section.WriteString(inlineStyle.Render(m.document.renderer.inlinePreview(m.document.editor.Value(), block.Type, width-4, inlinePreviewLines)))
+			section.WriteString("\n")
+		}
+		sections = append(sections, section.String())
 	}
 
-	content.WriteString("<script>hljs.highlightAll();</script>\n")
-	content.WriteString("</body>\n</html>\n")
-	return content.String()
-}
+	// Everything above the blocks is kept, the footer below them is built next
+	header := content.String()
+	content.Reset()
 
-func (m model) generateUnicode() string {
-	var content strings.Builder
+	if len(m.document.lsp.diagnostics) > 0 {
+		content.WriteString("\n")
+		errorStyle := lipgloss.NewStyle().Foreground(theme.Error)
+		warningStyle := lipgloss.NewStyle().Foreground(theme.Warning)
 
-	for _, block := range m.document.blocks {
-		switch block.Type {
-		case blockCode:
-			content.WriteString("```")
-			if block.Language != "" {
-				content.WriteString(block.Language)
+		for i, diag := range m.document.lsp.diagnostics {
+			style := errorStyle
+			if diag.Severity == "warning" {
+				style = warningStyle
 			}
-			content.WriteString("\n")
-			content.WriteString(block.Content)
-			content.WriteString("\n```\n\n")
-		case blockQuote:
-			lines := strings.Split(block.Content, "\n")
-			for _, line := range lines {
-				content.WriteString("> " + line + "\n")
+			line := fmt.Sprintf("Line %d: %s", diag.Line, diag.Message)
+			if i == m.document.lsp.activeDiagnostic {
+				style = style.Copy().Bold(true)
+				line = "▸ " + line
 			}
+			content.WriteString(style.Render(line))
 			content.WriteString("\n")
-		default:
-			rendered := m.document.renderer.renderLaTeX(block.Content)
-			content.WriteString(rendered.Unicode)
-			content.WriteString("\n\n")
 		}
 	}
 
-	return content.String()
+	k := m.keys
+	help := fmt.Sprintf("ctrl+p: commands | %s/%s: navigate blocks | %s: outline | %s: search | enter: edit | %s: new | %s: new of same type | %s: math | %s: code | %s: list | %s: table | %s: raw | %s: image | %s: rule | %s: cycle type | ctrl+x: split, ctrl+s: symbols, ctrl+]: macro definition, ctrl+r: quick preview, ctrl+g: go to line, ctrl+y: toggle checkbox (while editing)\n",
+		k.NextBlock, k.PrevBlock, k.Outline, k.Search, k.NewBlock, k.SameTypeBlock, k.MathBlock, k.CodeBlock, k.ListBlock, k.TableBlock, k.RawBlock, k.ImageBlock, k.RuleBlock, k.CycleBlockType)
+	help += fmt.Sprintf("%s: fold | %s/%s: fold/unfold all | %s: duplicate | %s/%s: copy/paste | %s: quick preview | %s: pin | %s/%s: comment/comments | %s: number heading | %s/%s: code wrap/numbers | %s: preview wrap (←/→ scroll) | %s: raw text | %s: $EDITOR | %s/%s: save/save as | %s: save template | %s: export | %s: math image | %s: theme | %s: vim | %s/%s/%s: view modes | %s/%s %s/%s: split | %s/%s/%s %s: split presets/reset | %s/%s: scroll | %s: timer | %s: notes | %s: stats | %s: changes | %s/%s: diagnostics | %s: menu",
+		keyLabel(k.ToggleFold), k.FoldAll, k.UnfoldAll, k.DuplicateBlock, k.CopyBlock, k.PasteBlock, k.MathPreview, k.PinBlock, k.Comment, k.Comments, k.NumberHeading, k.ToggleWrap, k.LineNumbers, k.PreviewWrap, k.RawText, k.ExternalEditor, k.SaveDocument, k.SaveAs, k.SaveTemplate, k.Export, k.ExportMath, k.CycleTheme, k.ToggleVim, k.EditorOnly, k.SplitView, k.PreviewOnly,
+		k.GrowSplit, k.ShrinkSplit, k.FineGrowSplit, k.FineShrinkSplit, k.SplitPreset1, k.SplitPreset2, k.SplitPreset3, k.ResetSplit, k.ScrollDown, k.ScrollUp, k.Timer, k.Notes, k.Stats, k.DiffView, k.NextDiagnostic, k.PrevDiagnostic, k.Quit)
+
+	if m.document.selecting {
+		lo, hi := m.document.selectionRange()
+		help = fmt.Sprintf("%d blocks selected | %s/%s: extend | J/K: move | %s/%s/%s/%s/%s: math/code/list/table/raw | %s: delete | %s: export | esc: done",
+			hi-lo+1, k.NextBlock, k.PrevBlock, k.MathBlock, k.CodeBlock, k.ListBlock, k.TableBlock, k.RawBlock, k.DeleteBlock, k.Export)
+	}
+
+	content.WriteString("\n")
+	content.WriteString(helpStyle.Render(help))
+
+	commandStyle := lipgloss.NewStyle().Foreground(theme.Muted)
+	if m.document.linePrompt {
+		content.WriteString("\n")
+		lines := strings.Count(m.document.editor.Value(), "\n") + 1
+		content.WriteString(commandStyle.Render(fmt.Sprintf("Go to line (1-%d, g first, G last): ", lines)) + m.document.command.View())
+	} else if m.document.imagePrompt {
+		content.WriteString("\n")
+		content.WriteString(commandStyle.Render("Image path: ") + m.document.command.View())
+	} else if m.document.commentPrompt {
+		content.WriteString("\n")
+		content.WriteString(commandStyle.Render("Comment: ") + m.document.command.View())
+	} else if m.document.languagePrompt {
+		content.WriteString("\n")
+		content.WriteString(commandStyle.Render("Language: ") + m.document.command.View())
+	} else if m.document.tidyPrompt {
+		content.WriteString("\n")
+		content.WriteString(lipgloss.NewStyle().Foreground(theme.Warning).Render("Remove empty blocks. Merge runs of blocks of the same type as well? (y/n, esc cancels)"))
+	} else if m.document.templatePrompt {
+		content.WriteString("\n")
+		content.WriteString(commandStyle.Render("Template name: ") + m.document.command.View())
+	} else if m.document.templateName != "" {
+		content.WriteString("\n")
+		content.WriteString(lipgloss.NewStyle().Foreground(theme.Warning).Render("Keep the text of each block in the template? (y/n, n keeps headings only)"))
+	} else if m.document.saveAsPrompt {
+		content.WriteString("\n")
+		content.WriteString(commandStyle.Render("Save as: ") + m.document.command.View())
+	} else if m.document.overwritePath != "" {
+		content.WriteString("\n")
+		content.WriteString(lipgloss.NewStyle().Foreground(theme.Warning).Render(m.document.overwritePath + " exists, overwrite? (y/n)"))
+	} else if m.document.vim.enabled && m.document.vim.mode == vimCommand {
+		content.WriteString("\n")
+		content.WriteString(commandStyle.Render(":") + m.document.command.View())
+	} else if m.document.commandError != "" {
+		content.WriteString("\n")
+		content.WriteString(lipgloss.NewStyle().Foreground(theme.Error).Render(m.document.commandError))
+	} else if m.document.notice != "" {
+		content.WriteString("\n")
+		content.WriteString(lipgloss.NewStyle().Foreground(theme.Success).Render(m.document.notice))
+	}
+	footer := content.String()
+
+	// Sections end in a newline, the footer doesn't
+	rows := height - strings.Count(header, "\n") - strings.Count(footer, "\n") - 1
+	heights := make([]int, len(sections))
+	total := 0
+	for i, section := range sections {
+		heights[i] = strings.Count(section, "\n")
+		total += heights[i]
+	}
+	first, last := 0, len(sections)
+	if total > rows {
+		// Two rows go to the counts of blocks above and below
+		first, last = blockWindow(heights, m.document.currentBlock, rows-2)
+	}
+
+	var body strings.Builder
+	body.WriteString(header)
+	hiddenStyle := lipgloss.NewStyle().Foreground(theme.Muted).Width(width).Align(lipgloss.Center)
+	if first > 0 {
+		body.WriteString(hiddenStyle.Render(fmt.Sprintf("↑ %d more %s", first, plural(first, "block", "blocks"))))
+		body.WriteString("\n")
+	}
+	for _, section := range sections[first:last] {
+		body.WriteString(section)
+	}
+	if below := len(sections) - last; below > 0 {
+		body.WriteString(hiddenStyle.Render(fmt.Sprintf("↓ %d more %s", below, plural(below, "block", "blocks"))))
+		body.WriteString("\n")
+	}
+	body.WriteString(footer)
+	return body.String()
 }
 
-func (m model) generateMarkdown() string {
-	var content strings.Builder
+// The blocks [start, end) to draw in rows lines given each block's height, grown outwards
+// from current so it sits as near the middle as the ends of the document allow. The
+// current block is always included, even when it is taller than rows on its own
+func blockWindow(heights []int, current, rows int) (int, int) {
+	if len(heights) == 0 {
+		return 0, 0
+	}
+	if current >= len(heights) {
+		current = len(heights) - 1
+	}
+	if current < 0 {
+		current = 0
+	}
 
-	for _, block := range m.document.blocks {
-		switch block.Type {
-		case blockCode:
-			content.WriteString("```")
-			if block.Language != "" {
-				content.WriteString(block.Language)
-			}
-			content.WriteString("\n")
-			content.WriteString(block.Content)
-			content.WriteString("\n```\n\n")
-		case blockQuote:
-			lines := strings.Split(block.Content, "\n")
-			for _, line := range lines {
-				content.WriteString("> " + line + "\n")
-			}
-			content.WriteString("\n")
-		case blockList:
-			content.WriteString(block.Content)
-			content.WriteString("\n\n")
-		case blockMath:
-			content.WriteString("$")
-			content.WriteString(strings.Trim(block.Content, "$"))
-			content.WriteString("$\n\n")
-		case blockRawLaTeX:
-			content.WriteString("```latex\n")
-			content.WriteString(block.Content)
-			content.WriteString("\n```\n\n")
+	start, end := current, current+1
+	used := heights[current]
+	above, below := 0, 0
+	for {
+		fitsAbove := start > 0 && used+heights[start-1] <= rows
+		fitsBelow := end < len(heights) && used+heights[end] <= rows
+		switch {
+		case fitsAbove && (above <= below || !fitsBelow):
+			start--
+			used += heights[start]
+			above += heights[start]
+		case fitsBelow:
+			used += heights[end]
+			below += heights[end]
+			end++
 		default:
-			content.WriteString(block.Content)
-			content.WriteString("\n\n")
+			return start, end
 		}
 	}
+}
 
-	return content.String()
+// One block through renderLaTeX, the way the preview pane shows it, with the problems found in it
+func (r *renderModel) quickPreview(content string, block blockType, width int) (string, []Diagnostic) {
+	rendered := r.renderLaTeX(content)
+	text := rendered.Unicode
+	if block != blockRawLaTeX {
+		text = renderEnvironments(text)
+	}
+	return truncateLines(text, width), rendered.Errors
 }
 
-func (m model) View() string {
-	switch m.mode {
-	case modeBrowser:
-		return m.viewBrowser()
-	case modeMenu:
-		return m.viewMenu()
-	case modeEdit:
-		return m.viewEdit()
-	case modeTimer:
-		return m.viewTimer()
-	case modeExport:
-		return m.viewExport()
+// Rows the rendered strip under the editor takes at most in editor-only view
+const inlinePreviewLines = 3
+
+// Code, tables, images and rules have nothing for renderLaTeX to show
+func hasInlinePreview(t blockType) bool {
+	switch t {
+	case blockCode, blockTable, blockImage, blockHR:
+		return false
 	}
-	return ""
+	return true
 }
 
-func (m model) viewBrowser() string {
-	var content strings.Builder
+// The quick preview cut down to maxLines rows, the last one counting what was left out
+func (r *renderModel) inlinePreview(content string, block blockType, width, maxLines int) string {
+	text, _ := r.quickPreview(content, block, width)
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	if maxLines > 0 && len(lines) > maxLines {
+		hidden := len(lines) - maxLines + 1
+		lines = append(lines[:maxLines-1], fmt.Sprintf("… %d more %s", hidden, plural(hidden, "line", "lines")))
+	}
+	return strings.Join(lines, "\n")
+}
 
+// Popup under the current block. It reads the editor rather than the block so it keeps up with typing
+func (m model) renderQuickPreview(block ContentBlock, width int) string {
 	theme := m.getCurrentTheme()
-	
-	titleStyle := lipgloss.NewStyle().
-		Bold(true).
-		Foreground(theme.Primary).
-		Width(m.width).
-		Align(lipgloss.Center)
 
-	pathStyle := lipgloss.NewStyle().
-		Foreground(theme.Muted)
+	boxStyle := lipgloss.NewStyle().
+		Border(lipgloss.RoundedBorder()).
+		BorderForeground(theme.Accent).
+		Padding(0, 1).
+		Width(width - 4)
+	titleStyle := lipgloss.NewStyle().Foreground(theme.Accent).Bold(true)
+	mathStyle := lipgloss.NewStyle().Foreground(theme.Primary).Italic(true)
+	mutedStyle := lipgloss.NewStyle().Foreground(theme.Muted)
 
-	selectedStyle := lipgloss.NewStyle().
-		Foreground(theme.Accent).
-		Bold(true)
+	rendered, diagnostics := m.document.renderer.quickPreview(m.document.editor.Value(), block.Type, width-8)
 
-	dirStyle := lipgloss.NewStyle().
-		Foreground(theme.Primary)
+	var content strings.Builder
+	content.WriteString(titleStyle.Render("Quick preview"))
+	content.WriteString("\n")
+	content.WriteString(mathStyle.Render(rendered))
+	content.WriteString("\n")
+	if len(diagnostics) == 0 {
+		content.WriteString(mutedStyle.Render("No problems"))
+	}
+	for i, diag := range diagnostics {
+		style := lipgloss.NewStyle().Foreground(theme.Error)
+		if diag.Severity == "warning" {
+			style = lipgloss.NewStyle().Foreground(theme.Warning)
+		}
+		if i > 0 {
+			content.WriteString("\n")
+		}
+		content.WriteString(style.Render(fmt.Sprintf("Line %d: %s", diag.Line, diag.Message)))
+	}
 
-	fileStyle := lipgloss.NewStyle().
-		Foreground(theme.Foreground)
+	return boxStyle.Render(content.String())
+}
 
-	oathStyle := lipgloss.NewStyle().
-		Foreground(theme.Success).
-		Bold(true)
+func (m model) renderPreview(width, height int) string {
+	if m.document.showStats {
+		return m.renderStats(width, height)
+	}
 
-	helpStyle := lipgloss.NewStyle().
-		Foreground(theme.Muted)
+	var content strings.Builder
+	theme := m.getCurrentTheme()
 
-	errorStyle := lipgloss.NewStyle().
-		Foreground(theme.Error)
+	headerStyle := lipgloss.NewStyle().
+		Bold(true).
+		Foreground(theme.Secondary).
+		Width(width).
+		Align(lipgloss.Center)
 
-	content.WriteString(titleStyle.Render("Oathkeeper - File Browser"))
-	content.WriteString("\n\n")
-	content.WriteString(pathStyle.Render("Current directory: " + m.browser.currentPath))
+	content.WriteString(headerStyle.Render("Preview"))
 	content.WriteString("\n\n")
 
-	if m.browser.errorMsg != "" {
-		content.WriteString(errorStyle.Render("Error: " + m.browser.errorMsg))
-		content.WriteString("\n\n")
+	if pinned := m.renderPinned(width, height); pinned != "" {
+		content.WriteString(pinned)
+		content.WriteString("\n")
 	}
 
-	maxVisible := m.height - 8
-	start := 0
-	end := len(m.browser.files)
+	body, _ := m.renderPreviewBody(width)
+	lines := strings.Split(body, "\n")
+	viewport := m.previewViewport(width, height)
+	offset := clampPreviewOffset(m.document.previewOffset, len(lines), viewport)
 
-	if len(m.browser.files) > maxVisible {
-		start = m.browser.selected - maxVisible/2
-		if start < 0 {
-			start = 0
-		}
-		end = start + maxVisible
-		if end > len(m.browser.files) {
-			end = len(m.browser.files)
-			start = end - maxVisible
-		}
+	end := offset + viewport
+	if end > len(lines) {
+		end = len(lines)
 	}
+	visible := lines[offset:end]
 
-	for i := start; i < end; i++ {
-		file := m.browser.files[i]
-		cursor := "  "
-		if i == m.browser.selected {
-			cursor = "> "
-		}
-
-		var style lipgloss.Style
-		icon := ""
-
-		if file.IsDir {
-			style = dirStyle
-			icon = "d "
-		} else if strings.HasSuffix(file.Name, ".oath") {
-			style = oathStyle
-			icon = "o "
-		} else {
-			style = fileStyle
-			icon = "f "
+	var indicators []string
+	if len(lines) > viewport {
+		indicators = append(indicators, fmt.Sprintf("lines %d-%d of %d", offset+1, end, len(lines)))
+	}
+	if m.document.previewNoWrap {
+		longest := longestLine(lines)
+		column := clampPreviewColumn(m.document.previewColumn, longest, width)
+		visible = append([]string(nil), visible...)
+		for i, line := range visible {
+			visible[i] = ansi.Cut(line, column, column+width)
 		}
-
-		line := cursor + icon + file.Name
-		if i == m.browser.selected {
-			line = selectedStyle.Render(line)
-		} else {
-			line = style.Render(line)
+		if longest > width {
+			indicators = append(indicators, fmt.Sprintf("columns %d-%d of %d", column+1, min(column+width, longest), longest))
 		}
+	}
+	content.WriteString(strings.Join(visible, "\n"))
 
-		content.WriteString(line)
+	if len(indicators) > 0 {
+		scrollStyle := lipgloss.NewStyle().Foreground(theme.Muted)
 		content.WriteString("\n")
+		content.WriteString(scrollStyle.Render(strings.Join(indicators, ", ")))
 	}
 
-	content.WriteString("\n")
-	content.WriteString(helpStyle.Render("j/k: navigate | enter: select | space: new document | h: toggle hidden | q: quit"))
-
 	return content.String()
 }
 
-func (m model) viewMenu() string {
-	var content strings.Builder
-	theme := m.getCurrentTheme()  
+// Header, its blank line and the scroll indicator take three rows
+func previewViewportHeight(height int) int {
+	if height-3 < 1 {
+		return 1
+	}
+	return height - 3
+}
 
-	titleStyle := lipgloss.NewStyle().
-		Bold(true).
-		Foreground(theme.Primary).
-		Width(m.width).
-		Align(lipgloss.Center)
+// Rows left for the scrolling preview once the pinned panel has taken its share
+func (m model) previewViewport(width, height int) int {
+	pinned := m.renderPinned(width, height)
+	if pinned == "" {
+		return previewViewportHeight(height)
+	}
+	return previewViewportHeight(height - lipgloss.Height(pinned) - 1)
+}
 
-	selectedStyle := lipgloss.NewStyle().
-		Foreground(theme.Accent).
-		Bold(true)
+func (m model) pinnedBlock() (ContentBlock, bool) {
+	if m.document.pinnedID == "" {
+		return ContentBlock{}, false
+	}
+	for _, block := range m.document.blocks {
+		if block.ID == m.document.pinnedID {
+			return block, true
+		}
+	}
+	return ContentBlock{}, false
+}
 
-	helpStyle := lipgloss.NewStyle().
-		Foreground(theme.Muted)
+// The pinned block stays on screen above the live preview, capped at a third of the pane
+func (m model) renderPinned(width, height int) string {
+	block, ok := m.pinnedBlock()
+	if !ok {
+		return ""
+	}
+	theme := m.getCurrentTheme()
 
-	vimIndicator := ""
-	if m.document.vim.enabled {
-		vimIndicator = " (Vim: ON)"
-	} else {
-		vimIndicator = " (Vim: OFF)"
+	lines := strings.Split(m.renderPreviewBlock(block, width-4), "\n")
+	if limit := height/3 - 3; len(lines) > limit {
+		if limit < 1 {
+			limit = 1
+		}
+		lines = append(lines[:limit], "…")
 	}
 
-	content.WriteString(titleStyle.Render("Oathkeeper - Document Templates" + vimIndicator))
-	content.WriteString("\n\nSelect a template:\n\n")
+	labelStyle := lipgloss.NewStyle().Foreground(theme.Muted)
+	panelStyle := lipgloss.NewStyle().
+		Border(lipgloss.RoundedBorder()).
+		BorderForeground(theme.Accent).
+		Padding(0, 1).
+		Width(width - 2)
 
-	for i, template := range m.menu.templates {
-		cursor := "  "
-		if i == m.menu.selected {
-			cursor = "> "
-		}
+	return panelStyle.Render(labelStyle.Render("Pinned") + "\n" + strings.Join(lines, "\n"))
+}
 
-		line := cursor + template.Name + " - " + template.Description
-		if i == m.menu.selected {
-			line = selectedStyle.Render(line)
-		}
-		content.WriteString(line)
-		content.WriteString("\n")
+func clampPreviewOffset(offset, contentHeight, viewportHeight int) int {
+	maxOffset := contentHeight - viewportHeight
+	if offset > maxOffset {
+		offset = maxOffset
 	}
+	if offset < 0 {
+		offset = 0
+	}
+	return offset
+}
 
-	content.WriteString("\n")
-	content.WriteString(helpStyle.Render("j/k: navigate | enter: select | v: toggle vim | t: timer | q: back"))
+// Keeps the last column of the longest line against the right edge of the pane
+func clampPreviewColumn(column, longest, width int) int {
+	maxColumn := longest - width
+	if column > maxColumn {
+		column = maxColumn
+	}
+	if column < 0 {
+		column = 0
+	}
+	return column
+}
 
-	return lipgloss.Place(
-		m.width,
-		m.height,
-		lipgloss.Center,
-		lipgloss.Center,
-		content.String(),
-	)
+func longestLine(lines []string) int {
+	longest := 0
+	for _, line := range lines {
+		if w := ansi.StringWidth(line); w > longest {
+			longest = w
+		}
+	}
+	return longest
 }
 
-func (m model) viewEdit() string {
-	theme := m.getCurrentTheme()
+func (m model) previewWidth() int {
 	switch m.document.viewMode {
-	case viewEditorOnly:
-		return m.renderEditor(m.width, m.height)
 	case viewPreviewOnly:
-		return m.renderPreview(m.width, m.height)
+		return m.width
 	case viewSplitPane:
-		editorWidth := int(float64(m.width) * m.document.splitRatio)
-		previewWidth := m.width - editorWidth - 1
-
-		if editorWidth < 20 {
-			editorWidth = 20
-			previewWidth = m.width - 21
-		} else if previewWidth < 20 {
-			previewWidth = 20
-			editorWidth = m.width - 21
-		}
-
-		editor := m.renderEditor(editorWidth, m.height)
-		preview := m.renderPreview(previewWidth, m.height)
-
-		return lipgloss.JoinHorizontal(
-			lipgloss.Top,
-			editor,
-			lipgloss.NewStyle().
-				Border(lipgloss.NormalBorder(), false, false, false, true).
-				BorderForeground(theme.Border).
-				Height(m.height).
-				Render(preview),
-		)
+		_, previewWidth := m.splitWidths()
+		return previewWidth
 	}
-	return ""
+	return 0
 }
 
-func (m model) renderEditor(width, height int) string {
-	var content strings.Builder
-	theme := m.getCurrentTheme()
-
-	headerStyle := lipgloss.NewStyle().
-		Bold(true).
-		Foreground(theme.Primary).
-		Width(width).
-		Align(lipgloss.Center)
+const (
+	defaultSplitRatio = 0.5
+	minSplitRatio     = 0.2
+	maxSplitRatio     = 0.8
+	splitStep         = 0.1
+	fineSplitStep     = 0.05
+)
 
-	blockStyle := lipgloss.NewStyle().
-		Border(lipgloss.RoundedBorder()).
-		BorderForeground(theme.Border).
-		Padding(0, 1).
-		Width(width - 4)
+// Keeps both panes usable, rounded to hundredths so repeated steps don't drift
+func clampSplitRatio(ratio float64) float64 {
+	if ratio < minSplitRatio {
+		ratio = minSplitRatio
+	} else if ratio > maxSplitRatio {
+		ratio = maxSplitRatio
+	}
+	return float64(int(ratio*100+0.5)) / 100
+}
 
-	currentBlockStyle := blockStyle.Copy().
-		BorderForeground(theme.Primary)
+func (m *model) setSplitRatio(ratio float64) {
+	m.document.splitRatio = clampSplitRatio(ratio)
+	m.fitEditor()
+}
 
-	helpStyle := lipgloss.NewStyle().
-		Foreground(theme.Muted).
-		Width(width)
+// Switches view mode, putting the current ratio aside and picking up the one the new mode was
+// left at. A mode that hasn't been used yet keeps the current ratio
+func (m *model) setViewMode(mode viewMode) {
+	if m.document.splitRatios == nil {
+		m.document.splitRatios = make(map[viewMode]float64)
+	}
+	m.document.splitRatios[m.document.viewMode] = m.document.splitRatio
+	m.document.viewMode = mode
+	if ratio, ok := m.document.splitRatios[mode]; ok {
+		m.document.splitRatio = ratio
+	}
+	m.fitEditor()
+}
 
-	completionStyle := lipgloss.NewStyle().
-		Background(theme.Secondary).
-		Foreground(theme.Foreground).
-		Padding(0, 1)
+// The ratios of every view mode for the preferences, the current one included
+func (d documentModel) savedSplitRatios() map[string]float64 {
+	ratios := make(map[string]float64)
+	for mode, ratio := range d.splitRatios {
+		ratios[viewModeNames[mode]] = ratio
+	}
+	ratios[viewModeNames[d.viewMode]] = d.splitRatio
+	return ratios
+}
 
-	selectedCompletionStyle := completionStyle.Copy().
-		Background(theme.Primary).
-		Foreground(theme.Background)
+// Reads the splitRatios preference, dropping unknown modes and clamping the rest
+func loadSplitRatios(saved map[string]float64) map[viewMode]float64 {
+	ratios := make(map[viewMode]float64)
+	for mode, name := range viewModeNames {
+		if ratio, ok := saved[name]; ok {
+			ratios[mode] = clampSplitRatio(ratio)
+		}
+	}
+	return ratios
+}
 
-	modifiedIndicator := ""
-	if m.document.modified {
-		modifiedIndicator = " *"
+// Width of the editor's prompt bar, "┃ "
+const editorPromptWidth = 2
+
+// Columns for line numbers up to lines, with a space either side like the textarea's own
+func gutterWidth(lines int) int {
+	if lines < 1 {
+		lines = 1
 	}
+	return len(strconv.Itoa(lines)) + 2
+}
 
-	filename := "untitled.oath"
-	if m.document.filepath != "" {
-		filename = filepath.Base(m.document.filepath)
+// Sizes the editor to its pane, or to editorWrapWidth when that's narrower, and makes room
+// for the line number gutter. The gutter is sized for the whole block so it keeps its width
+// while the editor scrolls
+func (m *model) fitEditor() {
+	editor := &m.document.editor
+	editor.ShowLineNumbers = false
+	reserved := editorPromptWidth
+	if m.preferences.EditorLineNumbers {
+		reserved += gutterWidth(editor.LineCount())
+		editor.SetPromptFunc(reserved, func(int) string { return "" })
 	} else {
-		for _, block := range m.document.blocks {
-			if block.Type == blockHeading && strings.TrimSpace(block.Content) != "" {
-				title := strings.TrimSpace(block.Content)
-				title = strings.TrimLeft(title, "#")
-				title = strings.TrimSpace(title)
-				if title != "" && title != "Document Title" {
-					filename = title + ".oath"
-				}
-				break
-			}
-		}
+		editor.SetPromptFunc(0, nil)
 	}
-	
-	vimIndicator := ""
-	if m.document.vim.enabled {
-		switch m.document.vim.mode {
-		case vimNormal:
-			vimIndicator = " [NORMAL]"
-		case vimInsert:
-			vimIndicator = " [INSERT]"
-		case vimVisual:
-			vimIndicator = " [VISUAL]"
-		case vimCommand:
-			vimIndicator = " [COMMAND]"
-		}
+
+	editorWidth, _ := m.splitWidths()
+	width := editorWidth - 4
+	if wrap := m.preferences.EditorWrapWidth; wrap > 0 && wrap+reserved < width {
+		width = wrap + reserved
 	}
-	
-	themeName := fmt.Sprintf(" (%s)", theme.Name)
-	content.WriteString(headerStyle.Render("Editor - " + filename + modifiedIndicator + themeName + vimIndicator))
-	content.WriteString("\n\n")
+	editor.SetWidth(width)
+}
 
-	for i, block := range m.document.blocks {
-		style := blockStyle
-		if i == m.document.currentBlock {
-			style = currentBlockStyle
-		}
+// The editor with its line numbers filled in. Numbers go on the first row of each line and
+// wrapped rows get blanks, found by walking a copy of the editor down its rows
+func (m model) editorView() string {
+	editor := m.document.editor
+	if !m.preferences.EditorLineNumbers {
+		return editor.View()
+	}
 
-		blockTypeIndicator := ""
-		switch block.Type {
-		case blockMath:
-			blockTypeIndicator = "[MATH] "
-		case blockCode:
-			blockTypeIndicator = "[CODE] "
-		case blockQuote:
-			blockTypeIndicator = "[QUOTE] "
-		case blockList:
-			blockTypeIndicator = "[LIST] "
-		case blockRawLaTeX:
-			blockTypeIndicator = "[RAW] "
-		case blockHeading:
-			blockTypeIndicator = "[HEAD] "
-		default:
-			blockTypeIndicator = "[TEXT] "
+	walker := editor
+	// Bounded in case the textarea ever stops making progress, there can't be more rows than characters
+	for i := 0; i <= len(editor.Value()) && (walker.Line() > 0 || walker.LineInfo().RowOffset > 0); i++ {
+		walker.CursorUp()
+	}
+
+	width := gutterWidth(editor.LineCount())
+	var labels []string
+	for line := 0; line < editor.LineCount(); line++ {
+		labels = append(labels, fmt.Sprintf("┃  %*d ", width-2, line+1))
+		rows := walker.LineInfo().Height
+		for row := 1; row < rows; row++ {
+			labels = append(labels, "┃ "+strings.Repeat(" ", width))
 		}
+		for i := 0; i <= rows && walker.Line() == line; i++ {
+			walker.CursorDown()
+		}
+	}
 
-		blockContent := blockTypeIndicator + block.Content
-		if len(block.Content) == 0 {
-			blockContent = blockTypeIndicator + fmt.Sprintf("[Empty %s block]", block.Type)
+	editor.SetPromptFunc(editorPromptWidth+width, func(row int) string {
+		if row < len(labels) {
+			return labels[row]
 		}
+		return "┃ " + strings.Repeat(" ", width)
+	})
+	return editor.View()
+}
 
-		if i == m.document.currentBlock && m.document.editor.Focused() {
-			editorView := m.document.editor.View()
+// Presets come from splitPresets in the preferences, a missing one leaves the split alone
+func (m *model) applySplitPreset(index int) {
+	if index < len(m.preferences.SplitPresets) {
+		m.setSplitRatio(m.preferences.SplitPresets[index])
+	}
+}
 
-			if m.document.lsp.showCompletions && len(m.document.lsp.completions) > 0 {
-				var completionBox strings.Builder
-				completionBox.WriteString(editorView)
-				completionBox.WriteString("\n")
+func (m model) splitWidths() (int, int) {
+	editorWidth := int(float64(m.width) * m.document.splitRatio)
+	previewWidth := m.width - editorWidth - 1
 
-				for j, comp := range m.document.lsp.completions {
-					compStyle := completionStyle
-					if j == m.document.lsp.activeCompletion {
-						compStyle = selectedCompletionStyle
-					}
-					completionBox.WriteString(compStyle.Render(comp.Label + " - " + comp.Detail))
-					if comp.Example != "" {
-						completionBox.WriteString("\n" + lipgloss.NewStyle().Foreground(theme.Muted).Render("  Example: " + comp.Example))
-					}
-					completionBox.WriteString("\n")
-				}
-				content.WriteString(style.Render(completionBox.String()))
-			} else {
-				content.WriteString(style.Render(editorView))
-			}
-		} else {
-			content.WriteString(style.Render(blockContent))
-		}
-		content.WriteString("\n")
+	if editorWidth < 20 {
+		editorWidth = 20
+		previewWidth = m.width - 21
+	} else if previewWidth < 20 {
+		previewWidth = 20
+		editorWidth = m.width - 21
 	}
+	return editorWidth, previewWidth
+}
 
-	if len(m.document.lsp.diagnostics) > 0 {
-		content.WriteString("\n")
-		errorStyle := lipgloss.NewStyle().Foreground(theme.Error)
-		warningStyle := lipgloss.NewStyle().Foreground(theme.Warning)
+func (m *model) scrollPreview(delta int) {
+	body, _ := m.renderPreviewBody(m.previewWidth())
+	lines := strings.Count(body, "\n") + 1
+	viewport := m.previewViewport(m.previewWidth(), m.documentHeight())
+	m.document.previewOffset = clampPreviewOffset(m.document.previewOffset+delta, lines, viewport)
+}
 
-		for _, diag := range m.document.lsp.diagnostics {
-			style := errorStyle
-			if diag.Severity == "warning" {
-				style = warningStyle
-			}
-			content.WriteString(style.Render(fmt.Sprintf("Line %d: %s", diag.Line, diag.Message)))
-			content.WriteString("\n")
-		}
+// Columns the unwrapped preview moves per left/right press
+const previewColumnStep = 8
+
+func (m *model) scrollPreviewColumn(delta int) {
+	body, _ := m.renderPreviewBody(m.previewWidth())
+	longest := longestLine(strings.Split(body, "\n"))
+	m.document.previewColumn = clampPreviewColumn(m.document.previewColumn+delta, longest, m.previewWidth())
+}
+
+// Scrolls the least amount needed to bring the current block fully into view
+func (m *model) revealCurrentBlock() {
+	body, starts := m.renderPreviewBody(m.previewWidth())
+	if m.document.currentBlock >= len(starts) {
+		return
 	}
 
-	help := "j/k: navigate blocks | enter: edit | n: new | m: math | c: code | l: list | r: raw\n"
-	help += "s: save | e: export | T: theme | V: vim | 1/2/3: view modes | +/-: split | t: timer | q: menu"
+	lines := strings.Count(body, "\n") + 1
+	viewport := m.previewViewport(m.previewWidth(), m.documentHeight())
+	start := starts[m.document.currentBlock]
+	end := lines
+	if m.document.currentBlock+1 < len(starts) {
+		end = starts[m.document.currentBlock+1]
+	}
 
-	content.WriteString("\n")
-	content.WriteString(helpStyle.Render(help))
+	offset := m.document.previewOffset
+	if end > offset+viewport {
+		offset = end - viewport
+	}
+	if start < offset {
+		offset = start
+	}
+	m.document.previewOffset = clampPreviewOffset(offset, lines, viewport)
+}
 
-	return content.String()
+// A divider spanning the pane, never less than a few characters so it still reads as one
+func horizontalRule(width int) string {
+	if width < 3 {
+		width = 3
+	}
+	return strings.Repeat("─", width)
 }
 
-func (m model) renderPreview(width, height int) string {
+// One block as the preview shows it, before wrapping
+func (m model) renderPreviewBlock(block ContentBlock, width int) string {
 	var content strings.Builder
 	theme := m.getCurrentTheme()
 
-	headerStyle := lipgloss.NewStyle().
-		Bold(true).
-		Foreground(theme.Secondary).
-		Width(width).
-		Align(lipgloss.Center)
-
 	mathStyle := lipgloss.NewStyle().
 		Foreground(theme.Primary).
 		Italic(true)
@@ -2683,69 +11875,133 @@ func (m model) renderPreview(width, height int) string {
 		PaddingLeft(1).
 		Italic(true)
 
-	content.WriteString(headerStyle.Render("Preview"))
-	content.WriteString("\n\n")
+	var rendered RenderedBlock
+	if m.document.needsRefresh || block.Rendered == "" {
+		rendered = m.document.renderer.renderLaTeX(block.Content)
+		// Note: In a full implementation, you'd update the block.Rendered field
+	} else {
+		rendered = RenderedBlock{
+			Unicode: block.Rendered,
+			Errors:  []Diagnostic{},
+		}
+	}
 
-	for i, block := range m.document.blocks {
-		var rendered RenderedBlock
-		if m.document.needsRefresh || block.Rendered == "" {
-			rendered = m.document.renderer.renderLaTeX(block.Content)
-			// Note: In a full implementation, you'd update the block.Rendered field
+	blockContent := rendered.Unicode
+	if block.Type != blockRawLaTeX {
+		blockContent = renderEnvironments(blockContent)
+	}
+	warning := ""
+	if len(rendered.Errors) > 0 {
+		errorStyle := lipgloss.NewStyle().Foreground(theme.Error)
+		var errorMsgs []string
+		for _, err := range rendered.Errors {
+			errorMsgs = append(errorMsgs, err.Message)
+		}
+		warning = "\n" + errorStyle.Render("Warning: " + strings.Join(errorMsgs, ", "))
+		blockContent += warning
+	}
+
+	switch block.Type {
+	case blockHeading:
+		level := strings.Count(strings.TrimSpace(block.Content), "#")
+		title := strings.TrimSpace(strings.TrimLeft(block.Content, "# "))
+		
+		switch level {
+		case 1:
+			content.WriteString(h1Style.Render(title))
+		case 2:
+			content.WriteString(h2Style.Render(title))
+		case 3:
+			content.WriteString(h3Style.Render(title))
+		default:
+			content.WriteString(headingStyle.Render(title))
+		}
+	case blockMath:
+		if m.document.previewNoWrap {
+			content.WriteString(mathStyle.Render(blockContent))
 		} else {
-			rendered = RenderedBlock{
-				Unicode: block.Rendered,
-				Errors:  []Diagnostic{},
-			}
+			content.WriteString(mathStyle.Render(truncateLines(blockContent, width)))
+		}
+	case blockCode:
+		code := expandLeadingTabs(block.Content, m.preferences.CodeTabWidth)
+		if highlighted, ok := m.document.renderer.highlightCode(code, codeLanguage(block), theme); ok {
+			highlightStyle := lipgloss.NewStyle().
+				BorderLeft(true).
+				BorderForeground(theme.Muted).
+				PaddingLeft(1)
+			content.WriteString(highlightStyle.Render(highlighted))
+		} else {
+			content.WriteString(codeStyle.Render(expandLeadingTabs(blockContent, m.preferences.CodeTabWidth)))
+		}
+	case blockQuote:
+		quote, author := splitAttribution(blockContent)
+		content.WriteString(quoteStyle.Render(quote))
+		if author != "" {
+			attributionStyle := lipgloss.NewStyle().Foreground(theme.Muted).Width(width).Align(lipgloss.Right)
+			content.WriteString("\n" + attributionStyle.Render("— "+author))
 		}
+	case blockList:
+		var counters []int
+		for _, item := range parseListItems(blockContent) {
+			if item.Level+1 < len(counters) {
+				counters = counters[:item.Level+1]
+			}
+			for len(counters) < item.Level+1 {
+				counters = append(counters, 0)
+			}
 
-		blockContent := rendered.Unicode
-		if len(rendered.Errors) > 0 {
-			errorStyle := lipgloss.NewStyle().Foreground(theme.Error)
-			var errorMsgs []string
-			for _, err := range rendered.Errors {
-				errorMsgs = append(errorMsgs, err.Message)
+			marker := "• "
+			if item.Ordered {
+				counters[item.Level]++
+				marker = fmt.Sprintf("%d. ", counters[item.Level])
+			} else {
+				counters[item.Level] = 0
+				if item.Task {
+					marker = ""
+				}
 			}
-			blockContent += "\n" + errorStyle.Render("Warning: " + strings.Join(errorMsgs, ", "))
+			content.WriteString(strings.Repeat("  ", item.Level) + marker + item.checkbox("☐ ", "☑ ") + item.Text + "\n")
 		}
-
-		switch block.Type {
-		case blockHeading:
-			level := strings.Count(strings.TrimSpace(block.Content), "#")
-			title := strings.TrimSpace(strings.TrimLeft(block.Content, "# "))
-			
-			switch level {
-			case 1:
-				content.WriteString(h1Style.Render(title))
-			case 2:
-				content.WriteString(h2Style.Render(title))
-			case 3:
-				content.WriteString(h3Style.Render(title))
-			default:
-				content.WriteString(headingStyle.Render(title))
+	case blockTable:
+		content.WriteString(formatTable(parseTable(blockContent), lipgloss.NewStyle().Bold(true).Foreground(theme.Primary)))
+	case blockImage:
+		imageStyle := lipgloss.NewStyle().Foreground(theme.Accent)
+		content.WriteString(imageStyle.Render("[image: " + parseImage(block.Content).label() + "]"))
+	case blockHR:
+		content.WriteString(lipgloss.NewStyle().Foreground(theme.Muted).Render(horizontalRule(width)))
+	case blockRawLaTeX:
+		content.WriteString(mathStyle.Render(blockContent))
+	default:
+		inlineCodeStyle := lipgloss.NewStyle().
+			Background(theme.Muted).
+			Foreground(theme.Background)
+		boldStyle := lipgloss.NewStyle().Bold(true)
+
+		linkStyle := lipgloss.NewStyle().Underline(true).Foreground(theme.Secondary)
+
+		text := collectFootnotes(m.document.blocks).previewText(block.Content)
+		for _, span := range splitInlineCode(text) {
+			if span.Code {
+				content.WriteString(inlineCodeStyle.Render(span.Text))
+				continue
 			}
-		case blockMath:
-			content.WriteString(mathStyle.Render(blockContent))
-		case blockCode:
-			content.WriteString(codeStyle.Render(blockContent))
-		case blockQuote:
-			content.WriteString(quoteStyle.Render(blockContent))
-		case blockList:
-			lines := strings.Split(blockContent, "\n")
-			for _, line := range lines {
-				line = strings.TrimSpace(line)
-				if strings.HasPrefix(line, "- ") || strings.HasPrefix(line, "* ") {
-					content.WriteString("• " + strings.TrimSpace(line[2:]) + "\n")
-				} else if line != "" {
-					content.WriteString("• " + line + "\n")
+
+			for _, piece := range splitLinks(span.Text) {
+				if piece.Link != nil {
+					// A clickable link only needs its text, the address is one click away
+					if m.preferences.PreviewHyperlinks {
+						label := piece.Link.Text
+						if label == "" {
+							label = piece.Link.URL
+						}
+						content.WriteString(hyperlink(piece.Link.URL, linkStyle.Render(label)))
+					} else {
+						content.WriteString(linkStyle.Render(piece.Link.label()))
+					}
+					continue
 				}
-			}
-		case blockRawLaTeX:
-			content.WriteString(mathStyle.Render(blockContent))
-		default:
-			text := blockContent
-			if strings.Contains(text, "**") {
-				boldStyle := lipgloss.NewStyle().Bold(true)
-				parts := strings.Split(text, "**")
+
+				parts := strings.Split(m.document.renderer.renderInlineMath(piece.Text), "**")
 				for i, part := range parts {
 					if i%2 == 1 {
 						content.WriteString(boldStyle.Render(part))
@@ -2753,21 +12009,190 @@ func (m model) renderPreview(width, height int) string {
 						content.WriteString(part)
 					}
 				}
-			} else {
-				content.WriteString(text)
 			}
 		}
+		content.WriteString(warning)
+	}
+
+	return content.String()
+}
+
+// Word wraps rendered preview text to the pane, breaking words that are wider than it.
+// Narrow panes just get short lines, a pane with no room at all is left unwrapped
+func wrapPreview(content string, width int) string {
+	if width < 1 {
+		return content
+	}
+	wrapped := lipgloss.NewStyle().Width(width).Render(content)
+	// Width pads every line out to the pane, which would push the current block marker over the edge
+	lines := strings.Split(wrapped, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Trails the current block in the preview, blocks are wrapped short enough to fit it
+const currentBlockMarker = " ← "
 
+// Returns the rendered blocks and the line each block starts on
+func (m model) renderPreviewBody(width int) (string, []int) {
+	rendered, newlines := m.previewBlocks(width)
+
+	var content strings.Builder
+	starts := make([]int, len(rendered))
+	line := 0
+	for i, block := range rendered {
+		starts[i] = line
+		content.WriteString(block)
 		if i == m.document.currentBlock {
-			content.WriteString(" ← ")
+			content.WriteString(currentBlockMarker)
 		}
 		content.WriteString("\n\n")
+		line += newlines[i] + 2
+	}
+	return content.String(), starts
+}
+
+// Rendered preview blocks with the blocks and settings they were rendered from, so moving
+// between blocks or scrolling doesn't render the whole document again
+type previewCache struct {
+	key      string
+	blocks   []ContentBlock
+	rendered []string
+	newlines []int
+}
+
+func (c *previewCache) clear() {
+	if c != nil {
+		*c = previewCache{}
+	}
+}
+
+// Every block rendered and wrapped to width, with the newlines in each. Reused from the
+// cache until a block or anything else that changes how blocks are drawn changes
+func (m model) previewBlocks(width int) ([]string, []int) {
+	key := fmt.Sprintf("%d %v %s %v %d", width, m.document.previewNoWrap, m.theme.currentTheme,
+		m.preferences.PreviewHyperlinks, m.preferences.CodeTabWidth)
+	cache := m.document.preview
+	if cache != nil && cache.key == key && slices.Equal(cache.blocks, m.document.blocks) {
+		return cache.rendered, cache.newlines
+	}
+
+	blockWidth := width - lipgloss.Width(currentBlockMarker)
+	rendered := make([]string, len(m.document.blocks))
+	newlines := make([]int, len(m.document.blocks))
+	for i, block := range m.document.blocks {
+		text := m.renderPreviewBlock(block, blockWidth)
+		if !m.document.previewNoWrap {
+			text = wrapPreview(text, blockWidth)
+		}
+		rendered[i] = text
+		newlines[i] = strings.Count(text, "\n")
+	}
+
+	if cache != nil {
+		*cache = previewCache{
+			key:      key,
+			blocks:   append([]ContentBlock(nil), m.document.blocks...),
+			rendered: rendered,
+			newlines: newlines,
+		}
+	}
+	return rendered, newlines
+}
+
+// Code blocks and LaTeX commands don't count as words, math blocks are tallied on their own.
+// Characters are every character typed, code and spaces included
+func documentStats(blocks []ContentBlock) Stats {
+	stats := Stats{
+		BlockCounts: make(map[blockType]int),
+	}
+
+	for _, block := range blocks {
+		stats.BlockCounts[block.Type]++
+		stats.Characters += utf8.RuneCountInString(block.Content)
+
+		switch block.Type {
+		case blockCode:
+			continue
+		case blockMath:
+			stats.MathBlocks++
+			continue
+		}
+
+		for _, token := range strings.Fields(block.Content) {
+			if strings.HasPrefix(token, "\\") || strings.Contains(token, "$") {
+				continue
+			}
+			if strings.IndexFunc(token, unicode.IsLetter) == -1 && strings.IndexFunc(token, unicode.IsDigit) == -1 {
+				continue
+			}
+			stats.Words++
+		}
+	}
+
+	stats.ReadingTime = (stats.Words + 199) / 200
+	return stats
+}
+
+func (m model) renderStats(width, height int) string {
+	var content strings.Builder
+	theme := m.getCurrentTheme()
+
+	headerStyle := lipgloss.NewStyle().
+		Bold(true).
+		Foreground(theme.Secondary).
+		Width(width).
+		Align(lipgloss.Center)
+
+	labelStyle := lipgloss.NewStyle().
+		Foreground(theme.Muted).
+		Width(18)
+
+	valueStyle := lipgloss.NewStyle().
+		Foreground(theme.Primary).
+		Bold(true)
+
+	boxStyle := lipgloss.NewStyle().
+		Border(lipgloss.RoundedBorder()).
+		BorderForeground(theme.Accent).
+		Padding(0, 1)
+
+	stats := documentStats(m.document.blocks)
+
+	var rows strings.Builder
+	writeRow := func(label string, value string) {
+		rows.WriteString(labelStyle.Render(label) + valueStyle.Render(value) + "\n")
+	}
+
+	writeRow("Words", fmt.Sprintf("%d", stats.Words))
+	writeRow("Characters", fmt.Sprintf("%d", stats.Characters))
+	writeRow("Math blocks", fmt.Sprintf("%d", stats.MathBlocks))
+	writeRow("Reading time", fmt.Sprintf("%d min", stats.ReadingTime))
+	writeRow("Blocks", fmt.Sprintf("%d", len(m.document.blocks)))
+	if !m.document.created.IsZero() {
+		writeRow("Created", m.document.created.Format("Jan 2 2006 15:04"))
+	}
+	if !m.document.savedAt.IsZero() {
+		writeRow("Last saved", m.document.savedAt.Format("Jan 2 2006 15:04"))
 	}
 
-	if m.document.needsRefresh {
-		m.document.needsRefresh = false
+	types := make([]string, 0, len(stats.BlockCounts))
+	for t := range stats.BlockCounts {
+		types = append(types, string(t))
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		writeRow("  "+t, fmt.Sprintf("%d", stats.BlockCounts[blockType(t)]))
 	}
 
+	content.WriteString(headerStyle.Render("Document Statistics"))
+	content.WriteString("\n\n")
+	content.WriteString(boxStyle.Render(strings.TrimSuffix(rows.String(), "\n")))
+	content.WriteString("\n\n")
+	content.WriteString(lipgloss.NewStyle().Foreground(theme.Muted).Render(m.keys.Stats+": close"))
+
 	return content.String()
 }
 
@@ -2785,7 +12210,7 @@ func (m model) viewTimer() string {
 		if m.input.Focused() {
 			content.WriteString(titleStyle.Render("Set Timer Duration") + "\n")
 			content.WriteString(m.input.View() + "\n\n")
-			content.WriteString(helpStyle.Render("Press enter to start timer."))
+			content.WriteString(helpStyle.Render("Press enter to start timer, or P to start a Pomodoro cycle."))
 		} else {
 			timerStr := formatDuration(m.remaining)
 			timerStyle := lipgloss.NewStyle().
@@ -2798,8 +12223,31 @@ func (m model) viewTimer() string {
 				timerStyle = timerStyle.Foreground(theme.Warning)
 			}
 
-			content.WriteString(timerStyle.Render(timerStr) + "\n\n")
 			help := "p: pause | r: resume | w: edit duration | n: notes | q: back"
+			if m.pomodoro.enabled {
+				phaseColor := theme.Primary
+				switch m.pomodoro.phase {
+				case phaseShortBreak:
+					phaseColor = theme.Success
+				case phaseLongBreak:
+					phaseColor = theme.Accent
+				}
+				phaseStyle := lipgloss.NewStyle().Bold(true).Foreground(phaseColor)
+
+				cycles := m.preferences.PomodoroCycles
+				if cycles < 1 {
+					cycles = 1
+				}
+				label := fmt.Sprintf("%s (%d/%d)", m.pomodoro.phase, m.pomodoro.completed%cycles+1, cycles)
+				if m.pomodoro.phase != phaseWork {
+					label = m.pomodoro.phase.String()
+				}
+				content.WriteString(phaseStyle.Render(label) + "\n")
+				timerStyle = timerStyle.BorderForeground(phaseColor)
+				help = "p: pause | r: resume | s: skip phase | x: reset cycle | n: notes | q: back"
+			}
+
+			content.WriteString(timerStyle.Render(timerStr) + "\n\n")
 			content.WriteString(helpStyle.Render(help))
 		}
 	} else {
@@ -2814,6 +12262,9 @@ func (m model) viewTimer() string {
 		content.WriteString(helpStyle.Render("Press q to return to editor"))
 	}
 
+	if m.notifyError != "" {
+		content.WriteString("\n\n" + lipgloss.NewStyle().Foreground(theme.Error).Render(m.notifyError))
+	}
 	content.WriteString("\n\n" + m.notes.View())
 
 	return lipgloss.Place(
@@ -2842,7 +12293,35 @@ func (m model) viewExport() string {
 	helpStyle := lipgloss.NewStyle().
 		Foreground(theme.Muted)
 
-	content.WriteString(titleStyle.Render("Export Document"))
+	title := "Export Document"
+	if m.export.blocks != nil {
+		title = fmt.Sprintf("Export %d Selected %s", len(m.export.blocks), plural(len(m.export.blocks), "Block", "Blocks"))
+	}
+	content.WriteString(titleStyle.Render(title))
+
+	if m.export.results != nil {
+		content.WriteString("\n\n")
+		successStyle := lipgloss.NewStyle().Foreground(theme.Success)
+		errorStyle := lipgloss.NewStyle().Foreground(theme.Error)
+		skippedStyle := lipgloss.NewStyle().Foreground(theme.Warning)
+		for _, result := range m.export.results {
+			switch {
+			case result.skipped:
+				content.WriteString(skippedStyle.Render(fmt.Sprintf("- %s skipped: %v", result.format, result.err)))
+			case result.err != nil:
+				// Only the first line, a failed PDF carries the tail of its log
+				reason := strings.SplitN(result.err.Error(), "\n", 2)[0]
+				content.WriteString(errorStyle.Render(fmt.Sprintf("✗ %s failed: %s", result.format, reason)))
+			default:
+				content.WriteString(successStyle.Render(fmt.Sprintf("✓ %s → %s", result.format, result.path)))
+			}
+			content.WriteString("\n")
+		}
+		content.WriteString("\n" + selectedStyle.Render(batchSummary(m.export.results)) + "\n\n")
+		content.WriteString(helpStyle.Render("enter/esc: back to the editor"))
+		return lipgloss.Place(m.width, m.height, lipgloss.Center, lipgloss.Center, content.String())
+	}
+
 	content.WriteString("\n\nSelect export format:\n\n")
 
 	for i, format := range m.export.formats {
@@ -2859,7 +12338,14 @@ func (m model) viewExport() string {
 		content.WriteString("\n")
 	}
 
-	if m.export.input.Focused() {
+	if m.export.running {
+		content.WriteString("\n")
+		content.WriteString(selectedStyle.Render(fmt.Sprintf("Exporting %s…", m.export.formats[m.export.selected])))
+	} else if m.export.confirmLarge {
+		content.WriteString("\n")
+		warningStyle := lipgloss.NewStyle().Foreground(theme.Warning)
+		content.WriteString(warningStyle.Render(fmt.Sprintf("%d blocks is a large document, %s may take a long time on it. Export anyway? (y/n)", m.exportBlockCount(), m.preferences.LaTeXEngine)))
+	} else if m.export.input.Focused() {
 		content.WriteString("\nFilename: ")
 		content.WriteString(m.export.input.View())
 		content.WriteString("\n\n")
@@ -2906,7 +12392,28 @@ func main() {
 		}
 	}()
 
-	model := initialModel()
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: oathkeeper [file.oath | notes.md | directory]\n\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "With no argument the file browser opens in the last directory used.\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "A document opens straight in the editor, Markdown is imported as a new document\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "and a directory opens the browser there.\n")
+	}
+	flag.Parse()
+	if flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// lipgloss guesses the background too, but some terminals get it wrong
+	if dark, ok := queryDarkBackground(backgroundQueryTimeout); ok {
+		lipgloss.SetHasDarkBackground(dark)
+	}
+
+	model, err := modelForPath(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "oathkeeper: %v\n", err)
+		os.Exit(1)
+	}
 	p := tea.NewProgram(model, tea.WithAltScreen())
 	
 	if _, err := p.Run(); err != nil {
@@ -0,0 +1,3662 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/bubbles/textarea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/x/ansi"
+)
+
+func TestVimDeletes(t *testing.T) {
+	// Cursors all sit on the second line, which starts at offset 6
+	const content = "first\nfoo bar baz\nlast"
+
+	tests := []struct {
+		name    string
+		del     func(string, int) (string, int, string)
+		content string
+		cursor  int
+		want    string
+		wantPos int
+		deleted string
+	}{
+		{"x mid line", vimDeleteChar, content, 10, "first\nfoo ar baz\nlast", 10, "b"},
+		{"x last character steps back", vimDeleteChar, content, 16, "first\nfoo bar ba\nlast", 15, "z"},
+		{"x on empty line", vimDeleteChar, "first\n\nlast", 6, "first\n\nlast", 6, ""},
+		{"dw start of line", vimDeleteWord, content, 6, "first\nbar baz\nlast", 6, "foo "},
+		{"dw last word stops at newline", vimDeleteWord, content, 14, "first\nfoo bar \nlast", 14, "baz"},
+		{"dd middle line", vimDeleteLine, content, 10, "first\nlast", 6, "foo bar baz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, pos, deleted := tt.del(tt.content, tt.cursor)
+			if got != tt.want || pos != tt.wantPos || deleted != tt.deleted {
+				t.Errorf("got (%q, %d, %q), want (%q, %d, %q)", got, pos, deleted, tt.want, tt.wantPos, tt.deleted)
+			}
+		})
+	}
+}
+
+func TestVimDeleteLastLine(t *testing.T) {
+	got, pos, deleted := vimDeleteLine("first\nsecond", 8)
+	if got != "first" || pos != 0 || deleted != "second" {
+		t.Errorf("got (%q, %d, %q)", got, pos, deleted)
+	}
+}
+
+func TestVimWordMotions(t *testing.T) {
+	content := "one\ntwo, three"
+	if got := vimNextWord(content, 4); got != 7 {
+		t.Errorf("w from two = %d, want 7", got)
+	}
+	if got := vimNextWord(content, 7); got != 9 {
+		t.Errorf("w from comma = %d, want 9", got)
+	}
+	if got := vimPrevWord(content, 9); got != 7 {
+		t.Errorf("b from three = %d, want 7", got)
+	}
+}
+
+func TestLaTeXEscapesTextBlocks(t *testing.T) {
+	m := model{preferences: &UserPreferences{}}
+
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"specials", "50% off A&B and item_1", `50\% off A\&B and item\_1`},
+		{"url", "see https://x.com/a_b#c.", `see \url{https://x.com/a_b\#c}.`},
+		{"url in bold", "**http://x.com/a_b**", `\textbf{\url{http://x.com/a_b}}`},
+		{"url in parentheses", "(http://x.com/a_b)", `(\url{http://x.com/a_b})`},
+		{"not a url", "shttp_x", `shttp\_x`},
+		{"line breaks kept", "first line\nsecond   line", "first line\nsecond   line"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			latex := m.generateLaTeX([]ContentBlock{{Type: blockText, Content: tt.content}})
+			if !strings.Contains(latex, tt.want) {
+				t.Errorf("export lacks %q:\n%s", tt.want, latex)
+			}
+		})
+	}
+}
+
+func TestBrowserEntries(t *testing.T) {
+	dir := t.TempDir()
+
+	file, err := createEntry(dir, "notes.oath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := createEntry(dir, "drafts/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(sub); err != nil || !info.IsDir() {
+		t.Fatalf("drafts/ should create a directory: %v", err)
+	}
+	if _, err := createEntry(dir, "notes.oath"); err == nil {
+		t.Error("creating an existing name should fail")
+	}
+	if _, err := createEntry(dir, "a/b"); err == nil {
+		t.Error("names with a separator should be rejected")
+	}
+
+	renamed, err := renameEntry(file, "ideas.oath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Error("the old name should be gone after a rename")
+	}
+	if _, err := renameEntry(renamed, "drafts"); err == nil {
+		t.Error("renaming onto an existing entry should fail")
+	}
+
+	os.WriteFile(filepath.Join(sub, "inner.oath"), []byte("{}"), 0644)
+	if err := deleteEntry(FileInfo{Name: "drafts", Path: sub, IsDir: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(sub); !os.IsNotExist(err) {
+		t.Error("deleting a directory should remove its contents too")
+	}
+	if err := deleteEntry(FileInfo{Name: "..", Path: filepath.Dir(dir)}); err == nil {
+		t.Error("deleting .. should be refused")
+	}
+}
+
+func TestTrashRestoreRoundTrip(t *testing.T) {
+	dir, trash := t.TempDir(), filepath.Join(t.TempDir(), "trash")
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	path := filepath.Join(dir, "notes.oath")
+	os.WriteFile(path, []byte("first"), 0644)
+	first, err := trashEntry(FileInfo{Name: "notes.oath", Path: path}, trash, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(path, []byte("second"), 0644)
+	second, err := trashEntry(FileInfo{Name: "notes.oath", Path: path}, trash, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Trashed == second.Trashed {
+		t.Fatalf("same name trashed twice should not collide: %s", first.Trashed)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("trashed entry is still in place")
+	}
+
+	if err := restoreEntry(second); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "second" {
+		t.Errorf("restored %q, want the last trashed copy", data)
+	}
+	if err := restoreEntry(first); err == nil {
+		t.Error("restoring over an existing entry should fail")
+	}
+
+	if _, err := trashEntry(FileInfo{Name: "..", Path: dir}, trash, now); err == nil {
+		t.Error("trashing .. should be refused")
+	}
+}
+
+func TestCopyEntryTree(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "drafts")
+	os.MkdirAll(filepath.Join(src, "nested"), 0755)
+	os.WriteFile(filepath.Join(src, "nested", "a.oath"), []byte("a"), 0600)
+	os.Symlink("nested/a.oath", filepath.Join(src, "link"))
+
+	dst := filepath.Join(t.TempDir(), "drafts")
+	if err := copyEntry(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dst, "nested", "a.oath"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("copied mode %v, want 0600", info.Mode().Perm())
+	}
+	if target, _ := os.Readlink(filepath.Join(dst, "link")); target != "nested/a.oath" {
+		t.Errorf("symlink target %q", target)
+	}
+}
+
+func TestRunLaTeXTimeout(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep not available")
+	}
+	start := time.Now()
+	_, err := runLaTeX(t.TempDir(), "sleep", []string{"10"}, 100*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("err = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %s to give up", elapsed)
+	}
+
+	if _, err := runLaTeX(t.TempDir(), "sleep", []string{"0"}, 5*time.Second); err != nil {
+		t.Errorf("a quick run should succeed: %v", err)
+	}
+}
+
+func TestDocumentRoundTrip(t *testing.T) {
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	doc := OathDocument{
+		Version:   documentVersion,
+		Template:  "article",
+		Variables: map[string]string{"author": "Ada"},
+		Created:   created,
+		Modified:  created.Add(time.Hour),
+		Notes:     "todo",
+		Content: []ContentBlock{
+			{ID: "a", Type: blockHeading, Content: "# Title", Numbered: true},
+			{ID: "b", Type: blockCode, Content: "fmt.Println(1)", Language: "go", LineNumbers: true},
+			{ID: "c", Type: blockText, Content: "50% \\emph{raw}", RawText: true, Comment: "check"},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := SaveDocumentToWriter(&buf, doc); err != nil {
+		t.Fatal(err)
+	}
+	got, err := LoadDocumentFromReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Created.Equal(doc.Created) || !got.Modified.Equal(doc.Modified) {
+		t.Errorf("times changed: %v, %v", got.Created, got.Modified)
+	}
+	got.Created, got.Modified = doc.Created, doc.Modified
+	if !reflect.DeepEqual(got, doc) {
+		t.Errorf("round trip changed the document:\n got %+v\nwant %+v", got, doc)
+	}
+}
+
+func TestLoadDocumentFromReaderErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"not json", "{", "invalid document"},
+		{"newer format", `{"version": "99.0"}`, "newer than"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadDocumentFromReader(strings.NewReader(tt.input))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadDocumentFromReaderMigrates(t *testing.T) {
+	doc, err := LoadDocumentFromReader(strings.NewReader(`{"content": [{"id": "a", "content": "hi"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Content[0].Type != blockText || doc.Variables == nil {
+		t.Errorf("old document not migrated: %+v", doc)
+	}
+}
+
+func TestHTMLExportOfSubset(t *testing.T) {
+	m := model{preferences: &UserPreferences{}}
+	m.document.blocks = []ContentBlock{
+		{ID: "a", Type: blockHeading, Content: "# Intro"},
+		{ID: "b", Type: blockText, Content: "left out"},
+		{ID: "c", Type: blockMath, Content: "x^2"},
+	}
+
+	out := m.generateHTML([]ContentBlock{m.document.blocks[0], m.document.blocks[2]})
+	for _, want := range []string{"<h1>Intro</h1>", `\[x^2\]`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("export lacks %q", want)
+		}
+	}
+	if strings.Contains(out, "left out") {
+		t.Error("export includes a block outside the selection")
+	}
+}
+
+func TestParseBackgroundResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		dark, ok bool
+	}{
+		{"4-digit dark, BEL", "\x1b]11;rgb:1e1e/1e1e/2e2e\x07", true, true},
+		{"4-digit light, ST", "\x1b]11;rgb:ffff/ffff/f0f0\x1b\\", false, true},
+		{"2-digit dark, ST", "\x1b]11;rgb:10/10/10\x1b\\", true, true},
+		{"2-digit light, BEL", "\x1b]11;rgb:ee/ee/ee\x07", false, true},
+		{"leading noise", "junk\x1b[?1;2c\x1b]11;rgb:0000/0000/0000\x07", true, true},
+		{"unterminated", "\x1b]11;rgb:ffff/ffff/ffff", false, false},
+		{"two channels", "\x1b]11;rgb:ffff/ffff\x07", false, false},
+		{"not hex", "\x1b]11;rgb:zz/zz/zz\x07", false, false},
+		{"too long", "\x1b]11;rgb:fffff/fffff/fffff\x07", false, false},
+		{"empty channel", "\x1b]11;rgb://ff\x07", false, false},
+		{"garbage", "hello", false, false},
+		{"empty", "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dark, ok := parseBackgroundResponse(tt.response)
+			if dark != tt.dark || ok != tt.ok {
+				t.Errorf("got (%v, %v), want (%v, %v)", dark, ok, tt.dark, tt.ok)
+			}
+		})
+	}
+}
+
+func TestVimPaste(t *testing.T) {
+	const content = "first\nfoo bar\nlast"
+
+	tests := []struct {
+		name    string
+		content string
+		cursor  int
+		text    string
+		before  bool
+		want    string
+		wantPos int
+	}{
+		{"p after cursor", content, 6, "XY", false, "first\nfXYoo bar\nlast", 8},
+		{"P before cursor", content, 6, "XY", true, "first\nXYfoo bar\nlast", 7},
+		{"p on empty line", "first\n\nlast", 6, "XY", false, "first\nXY\nlast", 7},
+		{"p line below", content, 8, "new\n", false, "first\nfoo bar\nnew\nlast", 14},
+		{"P line above", content, 8, "new\n", true, "first\nnew\nfoo bar\nlast", 6},
+		{"p line below the last", content, 16, "new\n", false, "first\nfoo bar\nlast\nnew", 19},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, pos := vimPaste(tt.content, tt.cursor, tt.text, tt.before)
+			if got != tt.want || pos != tt.wantPos {
+				t.Errorf("got (%q, %d), want (%q, %d)", got, pos, tt.want, tt.wantPos)
+			}
+		})
+	}
+}
+
+// A model editing content in Vim normal mode, with an in-memory clipboard
+func editorTestModel(content string, cursor int) model {
+	m := model{preferences: &UserPreferences{}, keys: defaultKeymap(), clipboard: &memoryClipboard{}}
+	m.document.vim = newVimState()
+	m.document.vim.enabled = true
+	m.document.renderer = newRenderModel(0)
+	m.document.lsp = newLSPModel(m.document.renderer.mathSymbols)
+	m.document.editor = textarea.New()
+	m.document.editor.SetWidth(80)
+	m.document.editor.SetValue(content)
+	setEditorCursor(&m.document.editor, cursor)
+	return m
+}
+
+func vimKeys(m model, keys ...string) model {
+	for _, key := range keys {
+		next, _ := m.updateVimNormal(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(key)})
+		m = next.(model)
+	}
+	return m
+}
+
+func TestVimDeleteAndPasteUseClipboard(t *testing.T) {
+	m := editorTestModel("first\nfoo bar\nlast", 6)
+
+	m = vimKeys(m, "d", "d")
+	if got, _ := m.clipboard.Paste(); got != "foo bar\n" {
+		t.Fatalf("dd copied %q", got)
+	}
+	m = vimKeys(m, "p")
+	if got := m.document.editor.Value(); got != "first\nlast\nfoo bar" {
+		t.Errorf("after ddp: %q", got)
+	}
+
+	m = editorTestModel("abc", 0)
+	m = vimKeys(m, "x", "p")
+	if got := m.document.editor.Value(); got != "bac" {
+		t.Errorf("after xp: %q", got)
+	}
+}
+
+func TestBlockCopyPaste(t *testing.T) {
+	m := editorTestModel("", 0)
+	m.document.blocks = []ContentBlock{{ID: "1", Type: blockText, Content: "hello"}}
+
+	next, _ := m.updateEdit(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(m.keys.CopyBlock)})
+	m = next.(model)
+	if got, _ := m.clipboard.Paste(); got != "hello" {
+		t.Fatalf("copied %q", got)
+	}
+
+	m.clipboard.Copy("pasted")
+	next, _ = m.updateEdit(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(m.keys.PasteBlock)})
+	m = next.(model)
+	if len(m.document.blocks) != 2 || m.document.blocks[1].Content != "pasted" || m.document.currentBlock != 1 {
+		t.Errorf("blocks after paste: %+v", m.document.blocks)
+	}
+}
+
+func TestRecoveryIsStale(t *testing.T) {
+	saved := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		backup time.Time
+		exists bool
+		want   bool
+	}{
+		{"newer than the document", saved.Add(time.Minute), true, true},
+		{"older than the document", saved.Add(-time.Minute), true, false},
+		{"same time as the document", saved, true, false},
+		{"document is gone", saved.Add(-time.Minute), false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := recoveryIsStale(tt.backup, saved, tt.exists); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecoveryNames(t *testing.T) {
+	a := recoveryName("/home/me/one/notes.oath")
+	b := recoveryName("/home/me/two/notes.oath")
+	if a == b {
+		t.Errorf("documents in different directories share the backup %s", a)
+	}
+	if !strings.HasSuffix(a, "-notes.oath.bak") {
+		t.Errorf("backup name %s doesn't end in the document name", a)
+	}
+	if a != recoveryName("/home/me/one/../one/notes.oath") {
+		t.Error("the same document should always map to the same backup")
+	}
+	if got := recoveryName(""); got != "untitled.oath.bak" {
+		t.Errorf("untitled backup is %s", got)
+	}
+}
+
+func TestRecoveryWrittenAfterSave(t *testing.T) {
+	dir := t.TempDir()
+	m := editorTestModel("", 0)
+
+	tests := []struct {
+		name       string
+		generation int
+		keep       bool
+	}{
+		{"written before the save", 0, false},
+		{"written after the save", 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "backup.oath.bak")
+			os.WriteFile(path, []byte("{}"), 0644)
+			m.document.recoveryGeneration = 1
+			m.document.lastRecovery = "key"
+
+			next, _ := m.Update(recoveryWrittenMsg{path: path, generation: tt.generation})
+			got := next.(model)
+			_, err := os.Stat(path)
+			if kept := err == nil; kept != tt.keep {
+				t.Errorf("backup kept = %v, want %v", kept, tt.keep)
+			}
+			if !tt.keep && got.document.lastRecovery != "" {
+				t.Error("a discarded backup should be rewritten on the next tick")
+			}
+		})
+	}
+}
+
+func TestSaveKeepsEditsMadeDuringTheWrite(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	saved := []ContentBlock{{ID: "1", Type: blockText, Content: "saved"}}
+
+	tests := []struct {
+		name     string
+		current  string
+		notes    string
+		modified bool
+	}{
+		{"nothing changed", "saved", "", false},
+		{"block edited", "edited", "", true},
+		{"notes edited", "saved", "todo", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := editorTestModel("", 0)
+			m.notes = textarea.New()
+			m.notes.SetValue(tt.notes)
+			m.document.blocks = []ContentBlock{{ID: "1", Type: blockText, Content: tt.current}}
+			m.document.modified = true
+
+			path := filepath.Join(t.TempDir(), "doc.oath")
+			next, _ := m.Update(documentSavedMsg{path: path, blocks: saved})
+			if got := next.(model).document.modified; got != tt.modified {
+				t.Errorf("modified = %v, want %v", got, tt.modified)
+			}
+		})
+	}
+}
+
+func TestHTMLListEscapesItems(t *testing.T) {
+	m := model{preferences: &UserPreferences{}}
+	blocks := []ContentBlock{{Type: blockList, Content: "- a < b & c\n- <script>x</script>"}}
+
+	for name, out := range map[string]string{"html": m.generateHTML(blocks), "epub": m.epubBlockXHTML(blocks[0])} {
+		if strings.Contains(out, "<script>x") {
+			t.Errorf("%s: list item markup was not escaped:\n%s", name, out)
+		}
+		if !strings.Contains(out, "<li>a &lt; b &amp; c") {
+			t.Errorf("%s: list item not escaped exactly once:\n%s", name, out)
+		}
+	}
+}
+
+func TestHTMLTableEscapesCells(t *testing.T) {
+	m := model{preferences: &UserPreferences{}}
+	blocks := []ContentBlock{{Type: blockTable, Content: "| a<b | R&D |\n|---|---|\n| <i>x</i> | 1 |"}}
+
+	for name, out := range map[string]string{"html": m.generateHTML(blocks), "epub": m.epubBlockXHTML(blocks[0])} {
+		for _, want := range []string{"<th>a&lt;b</th>", "<th>R&amp;D</th>", "<td>&lt;i&gt;x&lt;/i&gt;</td>"} {
+			if !strings.Contains(out, want) {
+				t.Errorf("%s: lacks %q:\n%s", name, want, out)
+			}
+		}
+	}
+}
+
+// Counts notifications instead of sending them
+type fakeNotifier struct {
+	sent int
+	err  error
+}
+
+func (n *fakeNotifier) Notify(title, message string) error {
+	n.sent++
+	return n.err
+}
+
+func TestTimerNotifiesOnceAtZero(t *testing.T) {
+	fake := &fakeNotifier{}
+	m := editorTestModel("", 0)
+	m.mode, m.notifier = modeTimer, fake
+	m.remaining = time.Second
+	m.ticker = time.NewTicker(time.Hour)
+
+	next, cmd := m.Update(tickMsg(time.Now()))
+	m = next.(model)
+	if fake.sent != 0 {
+		t.Fatal("the notification should be sent from a command, not during Update")
+	}
+	if cmd == nil {
+		t.Fatal("reaching zero returned no command")
+	}
+	if msg, ok := cmd().(notifyResultMsg); !ok || msg.err != nil {
+		t.Fatalf("command returned %#v", msg)
+	}
+	if fake.sent != 1 {
+		t.Fatalf("sent %d notifications, want 1", fake.sent)
+	}
+
+	for i := 0; i < 3; i++ {
+		next, cmd = m.Update(tickMsg(time.Now()))
+		m = next.(model)
+		if cmd != nil {
+			cmd()
+		}
+	}
+	if fake.sent != 1 {
+		t.Errorf("sent %d notifications after the timer stopped, want 1", fake.sent)
+	}
+}
+
+func TestTimerNotificationFailureIsShown(t *testing.T) {
+	m := editorTestModel("", 0)
+	m.mode, m.notifier = modeTimer, &fakeNotifier{err: errors.New("no display")}
+
+	msg := m.notifyTimerDone()()
+	next, _ := m.Update(msg)
+	m = next.(model)
+	if !strings.Contains(m.notifyError, "no display") {
+		t.Errorf("notifyError = %q", m.notifyError)
+	}
+
+	next, _ = m.Update(notifyResultMsg{})
+	if got := next.(model).notifyError; got != "" {
+		t.Errorf("a later successful notification should clear the error, got %q", got)
+	}
+}
+
+func TestClampSplitRatio(t *testing.T) {
+	tests := []struct {
+		ratio, want float64
+	}{
+		{0.5, 0.5},
+		{0.1, minSplitRatio},
+		{-1, minSplitRatio},
+		{0.95, maxSplitRatio},
+		{0.2, 0.2},
+		{0.8, 0.8},
+		{0.35 + 0.05 + 0.05, 0.45},
+	}
+	for _, tt := range tests {
+		if got := clampSplitRatio(tt.ratio); got != tt.want {
+			t.Errorf("clampSplitRatio(%v) = %v, want %v", tt.ratio, got, tt.want)
+		}
+	}
+}
+
+func TestSplitPresetResizesEditor(t *testing.T) {
+	m := editorTestModel("", 0)
+	m.width = 100
+	m.preferences.SplitPresets = []float64{0.3, 0.5, 0.9}
+
+	// A missing preset leaves the split, and so the editor, as it was
+	tests := []struct {
+		preset int
+		ratio  float64
+		grows  bool
+	}{
+		{0, 0.3, true},
+		{1, 0.5, true},
+		{2, maxSplitRatio, true},
+		{5, maxSplitRatio, false},
+	}
+	width := 0
+	for _, tt := range tests {
+		m.applySplitPreset(tt.preset)
+		if m.document.splitRatio != tt.ratio {
+			t.Errorf("preset %d: ratio %v, want %v", tt.preset, m.document.splitRatio, tt.ratio)
+		}
+		got := m.document.editor.Width()
+		if (got > width) != tt.grows || got < width {
+			t.Errorf("preset %d: editor width %d after %d", tt.preset, got, width)
+		}
+		width = got
+	}
+}
+
+func TestSplitRatioPerViewMode(t *testing.T) {
+	m := editorTestModel("", 0)
+	m.width = 100
+	m.setSplitRatio(0.3)
+
+	m.setViewMode(viewEditorOnly)
+	if m.document.splitRatio != 0.3 {
+		t.Errorf("a mode used for the first time should keep the ratio, got %v", m.document.splitRatio)
+	}
+	m.setSplitRatio(0.7)
+
+	m.setViewMode(viewSplitPane)
+	if m.document.splitRatio != 0.3 {
+		t.Errorf("split view ratio %v, want 0.3", m.document.splitRatio)
+	}
+	m.setViewMode(viewEditorOnly)
+	if m.document.splitRatio != 0.7 {
+		t.Errorf("editor-only ratio %v, want 0.7", m.document.splitRatio)
+	}
+
+	saved := m.document.savedSplitRatios()
+	if saved["split"] != 0.3 || saved["editor"] != 0.7 {
+		t.Errorf("saved ratios %v", saved)
+	}
+	loaded := loadSplitRatios(map[string]float64{"split": 0.3, "editor": 0.95, "bogus": 0.4})
+	if len(loaded) != 2 || loaded[viewSplitPane] != 0.3 || loaded[viewEditorOnly] != maxSplitRatio {
+		t.Errorf("loaded ratios %v", loaded)
+	}
+}
+
+func TestNewBlockKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		current  blockType
+		fallback string
+		sameType bool
+		want     blockType
+	}{
+		{"n makes the default type", blockMath, "", false, blockText},
+		{"n uses the preference", blockText, "math", false, blockMath},
+		{"n ignores an unknown preference", blockText, "video", false, blockText},
+		{"same type after math", blockMath, "", true, blockMath},
+		{"same type after code", blockCode, "math", true, blockCode},
+		{"same type after a rule falls back", blockHR, "quote", true, blockQuote},
+		{"same type after an image falls back", blockImage, "", true, blockText},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := editorTestModel("", 0)
+			m.preferences.DefaultBlockType = tt.fallback
+			m.document.blocks = []ContentBlock{{ID: "1", Type: tt.current}}
+
+			key := m.keys.NewBlock
+			if tt.sameType {
+				key = m.keys.SameTypeBlock
+			}
+			next, _ := m.updateEdit(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(key)})
+			m = next.(model)
+			if len(m.document.blocks) != 2 || m.document.currentBlock != 1 {
+				t.Fatalf("no block appended: %+v", m.document.blocks)
+			}
+			if got := m.document.blocks[1].Type; got != tt.want {
+				t.Errorf("new block is %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreviewBodyOffsets(t *testing.T) {
+	m := editorTestModel("", 0)
+	m.document.preview = &previewCache{}
+	m.document.blocks = []ContentBlock{
+		{ID: "1", Type: blockHeading, Content: "# One"},
+		{ID: "2", Type: blockText, Content: "first line\nsecond line\nthird line"},
+		{ID: "3", Type: blockCode, Content: "a\nb", Language: "go"},
+		{ID: "4", Type: blockText, Content: strings.Repeat("wrapped words ", 20)},
+	}
+
+	// The marker follows the current block's last line, so it shows where each block ends
+	for current := range m.document.blocks {
+		m.document.currentBlock = current
+		body, starts := m.renderPreviewBody(40)
+		lines := strings.Split(body, "\n")
+
+		end := len(lines) - 3
+		if current+1 < len(starts) {
+			end = starts[current+1] - 2
+		}
+		if !strings.HasSuffix(lines[end], currentBlockMarker) {
+			t.Errorf("block %d: marker not on line %d:\n%s", current, end, body)
+		}
+		if starts[0] != 0 {
+			t.Errorf("first block starts on line %d", starts[0])
+		}
+	}
+}
+
+func TestPreviewCache(t *testing.T) {
+	m := editorTestModel("", 0)
+	m.document.preview = &previewCache{}
+	m.document.blocks = []ContentBlock{
+		{ID: "1", Type: blockText, Content: "one"},
+		{ID: "2", Type: blockText, Content: "two"},
+	}
+	cached := func() *string { return &m.document.preview.rendered[0] }
+
+	m.renderPreviewBody(40)
+	first := cached()
+	m.document.currentBlock = 1
+	m.renderPreviewBody(40)
+	if cached() != first {
+		t.Error("moving to another block rendered the preview again")
+	}
+
+	m.document.blocks[1].Content = "changed"
+	body, _ := m.renderPreviewBody(40)
+	if cached() == first || !strings.Contains(body, "changed") {
+		t.Error("an edited block was served from the cache")
+	}
+
+	first = cached()
+	m.renderPreviewBody(50)
+	if cached() == first {
+		t.Error("a new width was served from the cache")
+	}
+}
+
+func TestEPUBExportIsComplete(t *testing.T) {
+	m := model{preferences: &UserPreferences{}}
+	m.document.renderer = newRenderModel(0)
+	m.browser.currentPath = t.TempDir()
+
+	blocks := []ContentBlock{{Type: blockHeading, Content: "# Title"}, {Type: blockText, Content: "body"}}
+	if err := m.generateEPUB(blocks, "book"); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := zip.OpenReader(filepath.Join(m.browser.currentPath, "book.epub"))
+	if err != nil {
+		t.Fatalf("export is not a readable archive: %v", err)
+	}
+	defer archive.Close()
+	if len(archive.File) == 0 || archive.File[0].Name != "mimetype" {
+		t.Errorf("mimetype must be the first entry")
+	}
+}
+
+func TestLaTeXCleanupSparesOtherExports(t *testing.T) {
+	tests := []struct {
+		name        string
+		keepTeX     bool
+		texExisted  bool
+		wantTeXGone bool
+	}{
+		{"tex from this run removed", false, false, true},
+		{"keepTeX keeps the source", true, false, false},
+		{"an earlier LaTeX export is left alone", false, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			siblings := []string{"doc.html", "doc.md", "doc.epub", "doc.bib", "doc.oath"}
+			for _, name := range siblings {
+				os.WriteFile(filepath.Join(dir, name), nil, 0644)
+			}
+			if tt.texExisted {
+				os.WriteFile(filepath.Join(dir, "doc.tex"), nil, 0644)
+			}
+
+			existing := existingAuxFiles(dir, "doc")
+			for _, name := range []string{"doc.tex", "doc.aux", "doc.log", "doc.out", "doc.pdf"} {
+				os.WriteFile(filepath.Join(dir, name), nil, 0644)
+			}
+			paths := latexCleanupPaths(dir, "doc", existing, keptLaTeXFiles(tt.keepTeX, false)...)
+			if slices.Contains(paths, filepath.Join(dir, "doc.tex")) != tt.wantTeXGone {
+				t.Errorf("cleanup list %v", paths)
+			}
+			forceCleanupFiles(paths)
+
+			for _, name := range append(siblings, "doc.pdf") {
+				if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+					t.Errorf("%s was removed", name)
+				}
+			}
+			for _, name := range []string{"doc.aux", "doc.log", "doc.out"} {
+				if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+					t.Errorf("%s was left behind", name)
+				}
+			}
+		})
+	}
+}
+
+func TestLaTeXListEscapesAndNests(t *testing.T) {
+	items := parseListItems("- 50% of A&B\n  1. item_1\n  2. **bold** and `a_b`\n- last")
+	want := "\\begin{itemize}\n" +
+		"\\item 50\\% of A\\&B\n" +
+		"\\begin{enumerate}\n" +
+		"\\item item\\_1\n" +
+		"\\item \\textbf{bold} and \\texttt{a\\_b}\n" +
+		"\\end{enumerate}\n" +
+		"\\item last\n" +
+		"\\end{itemize}\n"
+	if got := latexList(items); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestSplitAttribution(t *testing.T) {
+	tests := []struct {
+		content, quote, author string
+	}{
+		{"To be.\n— Smith, Jr.", "To be.", "Smith, Jr."},
+		{"To be.\n-- Smith", "To be.", "Smith"},
+		{"To be.\n—", "To be.\n—", ""},
+		{"To be.\nor not", "To be.\nor not", ""},
+	}
+	for _, tt := range tests {
+		quote, author := splitAttribution(tt.content)
+		if quote != tt.quote || author != tt.author {
+			t.Errorf("splitAttribution(%q) = (%q, %q), want (%q, %q)", tt.content, quote, author, tt.quote, tt.author)
+		}
+	}
+}
+
+func TestQuoteExports(t *testing.T) {
+	m := model{preferences: &UserPreferences{}}
+	m.document.renderer = newRenderModel(0)
+	attributed := []ContentBlock{{Type: blockQuote, Content: "50% <i>sure</i>\n— Smith & Co, Jr."}}
+	plain := []ContentBlock{{Type: blockQuote, Content: "Just a quote"}}
+
+	tests := []struct {
+		name     string
+		generate func([]ContentBlock) string
+		blocks   []ContentBlock
+		want     []string
+		unwanted []string
+	}{
+		{"latex", m.generateLaTeX, attributed, []string{"50\\% <i>sure</i>", "\\hfill--- Smith \\& Co, Jr."}, nil},
+		{"latex plain", m.generateLaTeX, plain, []string{"\\begin{quote}\nJust a quote\n\\end{quote}"}, []string{"\\hfill"}},
+		{"html", m.generateHTML, attributed, []string{"<footer>— Smith &amp; Co, Jr.</footer>", "&lt;i&gt;sure"}, []string{"<i>sure"}},
+		{"html plain", m.generateHTML, plain, []string{"<blockquote>Just a quote</blockquote>"}, []string{"<footer>"}},
+		{"markdown", m.generateMarkdown, attributed, []string{"> 50% <i>sure</i>\n> — Smith & Co, Jr."}, nil},
+		{"markdown plain", m.generateMarkdown, plain, []string{"> Just a quote"}, nil},
+		{"asciidoc", m.generateAsciiDoc, attributed, []string{"[quote, \"Smith & Co, Jr.\"]\n____\n50% <i>sure</i>\n____"}, nil},
+		{"asciidoc plain", m.generateAsciiDoc, plain, []string{"____\nJust a quote\n____"}, []string{"[quote"}},
+		{"rst", m.generateRST, attributed, []string{"-- Smith & Co, Jr."}, nil},
+		{"rst plain", m.generateRST, plain, []string{"    Just a quote"}, []string{"-- "}},
+		{"epub", func(b []ContentBlock) string { return m.epubBlockXHTML(b[0]) }, attributed, []string{"<footer>— Smith &amp; Co, Jr.</footer>"}, nil},
+		{"epub plain", func(b []ContentBlock) string { return m.epubBlockXHTML(b[0]) }, plain, []string{"<p>Just a quote</p>"}, []string{"<footer>"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := tt.generate(tt.blocks)
+			for _, want := range tt.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("lacks %q:\n%s", want, out)
+				}
+			}
+			for _, unwanted := range tt.unwanted {
+				if strings.Contains(out, unwanted) {
+					t.Errorf("contains %q:\n%s", unwanted, out)
+				}
+			}
+		})
+	}
+}
+
+func TestHTMLParagraphInlineMarkup(t *testing.T) {
+	m := model{preferences: &UserPreferences{}}
+	paragraph := "Run `a*b <c>` with **bold** and *it* for $x_1 * y$ <script>x</script>"
+	out := m.generateHTML([]ContentBlock{{Type: blockText, Content: paragraph}})
+
+	want := "<p>Run <code>a*b &lt;c&gt;</code> with <strong>bold</strong> and <em>it</em> for \\(x_1 * y\\) &lt;script&gt;x&lt;/script&gt;</p>"
+	if !strings.Contains(out, want) {
+		t.Errorf("export lacks\n%s\n%s", want, out)
+	}
+}
+
+func TestBoldAndItalicAtBoundaries(t *testing.T) {
+	tests := []struct {
+		text, latex, html string
+	}{
+		{"**a**", `\textbf{a}`, "<strong>a</strong>"},
+		{"a **b**", `a \textbf{b}`, "a <strong>b</strong>"},
+		{"**a** **b**", `\textbf{a} \textbf{b}`, "<strong>a</strong> <strong>b</strong>"},
+		{"*a*", `\textit{a}`, "<em>a</em>"},
+		{"*a **b** c*", `\textit{a \textbf{b} c}`, "<em>a <strong>b</strong> c</em>"},
+		{"2 * 3 and **open", `2 * 3 and **open`, "2 * 3 and **open"},
+		{"http://x.com/a_b", `\url{http://x.com/a_b}`, `<a href="http://x.com/a_b">http://x.com/a_b</a>`},
+	}
+	for _, tt := range tests {
+		if got := smartFormatText(tt.text); got != tt.latex {
+			t.Errorf("smartFormatText(%q) = %q, want %q", tt.text, got, tt.latex)
+		}
+		if got := htmlInline(tt.text); got != tt.html {
+			t.Errorf("htmlInline(%q) = %q, want %q", tt.text, got, tt.html)
+		}
+	}
+}
+
+func TestParseKeymap(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		want     map[string]string
+		warnings int
+	}{
+		{"merges over defaults", `{"stats":"ctrl+y"}`, map[string]string{"stats": "ctrl+y", "nextBlock": "j", "quit": "q"}, 0},
+		{"swap", `{"nextBlock":"k","prevBlock":"j"}`, map[string]string{"nextBlock": "k", "prevBlock": "j"}, 0},
+		{"clash with a default", `{"nextBlock":"q"}`, map[string]string{"nextBlock": "j", "quit": "q"}, 1},
+		{"clash between overrides", `{"nextBlock":"x","prevBlock":"x"}`, map[string]string{"nextBlock": "j", "prevBlock": "k"}, 2},
+		{"reserved key", `{"nextBlock":"enter"}`, map[string]string{"nextBlock": "j"}, 1},
+		{"unknown action", `{"fly":"f","quit":"Q"}`, map[string]string{"quit": "Q"}, 1},
+		{"malformed file", `{"nextBlock":`, map[string]string{"nextBlock": "j", "prevBlock": "k"}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, warnings := parseKeymap([]byte(tt.data))
+			if len(warnings) != tt.warnings {
+				t.Errorf("warnings = %q, want %d", warnings, tt.warnings)
+			}
+			actions := keys.actions()
+			for name, key := range tt.want {
+				if got := *actions[name]; got != key {
+					t.Errorf("%s = %q, want %q", name, got, key)
+				}
+			}
+		})
+	}
+}
+
+func TestKeymapWarningsClearOnKey(t *testing.T) {
+	m := editorTestModel("text", 0)
+	m.keyWarnings = []string{`keybindings.json: unknown action "fly"`}
+	m.width = 120
+	if !strings.Contains(renderStatusBar(m), "unknown action") {
+		t.Fatal("status bar doesn't show the keymap warning")
+	}
+
+	updated, _ := m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("j")})
+	if got := updated.(model).keyWarnings; got != nil {
+		t.Errorf("warnings after a key = %q, want none", got)
+	}
+}
+
+func TestParseExCommand(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    exCommand
+		wantErr bool
+	}{
+		{":w", exCommand{action: exWrite}, false},
+		{"q", exCommand{action: exQuit}, false},
+		{":wq", exCommand{action: exWriteQuit}, false},
+		{":x", exCommand{action: exWriteQuit}, false},
+		{":q!", exCommand{action: exForceQuit}, false},
+		{":12", exCommand{action: exGotoBlock, block: 12}, false},
+		{":0", exCommand{}, true},
+		{":wqa", exCommand{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseExCommand(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseExCommand(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseExCommand(%q) = %+v, want %+v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestWriteQuitWaitsForSave(t *testing.T) {
+	m := editorTestModel("text", 0)
+	m.mode = modeEdit
+	m.document.blocks = []ContentBlock{{ID: "1", Type: blockText, Content: "text"}}
+	m.document.filepath = filepath.Join(t.TempDir(), "doc.oath")
+	m.document.command.SetValue("wq")
+	m.document.vim.mode = vimCommand
+
+	updated, cmd := m.updateExCommand(tea.KeyMsg{Type: tea.KeyEnter})
+	m = updated.(model)
+	if m.mode != modeEdit || m.pendingQuit != quitToMenu || cmd == nil {
+		t.Fatalf("after :wq mode = %v, pendingQuit = %v, want the edit mode until the save lands", m.mode, m.pendingQuit)
+	}
+
+	failed, _ := m.Update(documentSavedMsg{err: errors.New("disk full")})
+	if got := failed.(model); got.mode != modeEdit || got.pendingQuit != quitNone {
+		t.Errorf("after a failed save mode = %v, pendingQuit = %v, want the document kept open", got.mode, got.pendingQuit)
+	}
+
+	saved, _ := m.Update(documentSavedMsg{path: m.document.filepath, blocks: m.document.blocks})
+	if got := saved.(model); got.mode != modeMenu {
+		t.Errorf("after the save mode = %v, want the menu", got.mode)
+	}
+}
+
+func TestDocumentStats(t *testing.T) {
+	blocks := []ContentBlock{
+		{Type: blockHeading, Content: "# Intro"},
+		{Type: blockText, Content: "See \\cite{x} and $a$, ok?"},
+		{Type: blockCode, Content: "x := 1"},
+		{Type: blockMath, Content: "a^2"},
+		{Type: blockMath, Content: "b"},
+	}
+
+	stats := documentStats(blocks)
+	// Intro, See, and, ok? count, the LaTeX command, math and code don't
+	if stats.Words != 4 {
+		t.Errorf("Words = %d, want 4", stats.Words)
+	}
+	if want := 7 + 25 + 6 + 3 + 1; stats.Characters != want {
+		t.Errorf("Characters = %d, want %d", stats.Characters, want)
+	}
+	if stats.MathBlocks != 2 || stats.BlockCounts[blockMath] != 2 || stats.BlockCounts[blockCode] != 1 {
+		t.Errorf("MathBlocks = %d, BlockCounts = %v", stats.MathBlocks, stats.BlockCounts)
+	}
+	if stats.ReadingTime != 1 {
+		t.Errorf("ReadingTime = %d, want 1", stats.ReadingTime)
+	}
+	if got := documentStats(nil); got.Words != 0 || got.Characters != 0 || got.ReadingTime != 0 {
+		t.Errorf("empty document stats = %+v", got)
+	}
+}
+
+func TestStatsKeepEditorInView(t *testing.T) {
+	m := editorTestModel("editor text", 0)
+	m.mode = modeEdit
+	m.width, m.height = 120, 30
+	m.document.blocks = []ContentBlock{{ID: "1", Type: blockText, Content: "editor text"}}
+	m.document.viewMode = viewEditorOnly
+	m.document.splitRatio = 0.5
+	m.document.showStats = true
+
+	view := m.viewEdit()
+	if !strings.Contains(view, "Document Statistics") || !strings.Contains(view, "editor text") {
+		t.Errorf("editor-only view with stats should show both the editor and the stats:\n%s", view)
+	}
+}
+
+func TestLaTeXImagePath(t *testing.T) {
+	m := editorTestModel("", 0)
+	blocks := []ContentBlock{{ID: "1", Type: blockImage, Content: "figs/my_plot#2~final.png | Growth_rate & more"}}
+
+	out := m.generateLaTeX(blocks)
+	if !strings.Contains(out, `\includegraphics[width=0.8\linewidth]{\detokenize{figs/my_plot#2~final.png}}`) {
+		t.Errorf("image path isn't detokenized:\n%s", out)
+	}
+	if !strings.Contains(out, `\caption{Growth\_rate \& more}`) {
+		t.Errorf("caption isn't escaped:\n%s", out)
+	}
+}
+
+func TestHandleScripts(t *testing.T) {
+	r := newRenderModel(0)
+	tests := []struct {
+		name, in, want string
+	}{
+		{"single", "x_1 + y^2", "x₁ + y²"},
+		{"braced", "x^{10} + a_{ij}", "x¹⁰ + aᵢⱼ"},
+		{"mixed", "x^{2n}", "x²ⁿ"},
+		{"no glyph", "x^{q}", "x^(q)"},
+		{"nested", "e^{x^{2}}", "e^(x^(2))"},
+		{"nested unbraced", "a_{i_1}", "a_(i_(1))"},
+		{"nested without glyph", "x^{y_{q}}", "x^(y_(q))"},
+		{"unclosed", "x^{2", "x^{2"},
+	}
+
+	for _, tt := range tests {
+		if got := r.handleScripts(tt.in); got != tt.want {
+			t.Errorf("%s: handleScripts(%q) = %q, want %q", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRSTHeadingAdornments(t *testing.T) {
+	tests := []struct {
+		level int
+		want  string
+	}{
+		{0, "=====\nTitle\n=====\n"},
+		{1, "=====\nTitle\n=====\n"},
+		{2, "Title\n=====\n"},
+		{3, "Title\n-----\n"},
+		{4, "Title\n~~~~~\n"},
+		{5, "Title\n^^^^^\n"},
+		{6, "Title\n\"\"\"\"\"\n"},
+		{9, "Title\n\"\"\"\"\"\n"},
+	}
+
+	for _, tt := range tests {
+		if got := rstHeading("Title", tt.level); got != tt.want {
+			t.Errorf("rstHeading(level %d) = %q, want %q", tt.level, got, tt.want)
+		}
+	}
+}
+
+func TestRSTExport(t *testing.T) {
+	m := editorTestModel("", 0)
+	blocks := []ContentBlock{
+		{ID: "1", Type: blockHeading, Content: "## Método"},
+		{ID: "2", Type: blockCode, Language: "go", Content: "x := 1\ny := 2"},
+		{ID: "3", Type: blockMath, Content: "E = mc^2"},
+		{ID: "4", Type: blockMath, Content: "where $a$ holds"},
+		{ID: "5", Type: blockList, Content: "- one\n- two"},
+	}
+
+	want := "Método\n======\n\n" +
+		".. code-block:: go\n\n   x := 1\n   y := 2\n\n" +
+		".. math::\n\n   E = mc^2\n\n\n" +
+		"where :math:`a` holds\n\n"
+	got := m.generateRST(blocks)
+	if !strings.HasPrefix(got, want) {
+		t.Errorf("generateRST =\n%q\nwant prefix\n%q", got, want)
+	}
+	if !strings.Contains(got, "- one\n- two\n") {
+		t.Errorf("list missing from\n%s", got)
+	}
+}
+
+func TestSymbolOverridesMergeOverDefaults(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		want map[string]string
+	}{
+		{"partial override", `{"\\alpha": "A", "\\qed": "∎", "plain": "x", "\\blank": ""}`,
+			map[string]string{"\\alpha": "A", "\\qed": "∎", "\\beta": "β", "\\Omega": "Ω", "plain": "", "\\blank": ""}},
+		{"malformed file", `{"\\alpha": `,
+			map[string]string{"\\alpha": "α", "\\beta": "β"}},
+		{"no file", "",
+			map[string]string{"\\alpha": "α", "\\aleph": "ℵ"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home := t.TempDir()
+			t.Setenv("HOME", home)
+			if tt.file != "" {
+				dir := filepath.Join(home, ".oathkeeper")
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(dir, "symbols.json"), []byte(tt.file), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			symbols := newRenderModel(0).mathSymbols
+			for latex, want := range tt.want {
+				if got := symbols[latex]; got != want {
+					t.Errorf("%s = %q, want %q", latex, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFuzzyMatch(t *testing.T) {
+	tests := []struct {
+		query, name string
+		ok          bool
+	}{
+		{"", "anything", true},
+		{"not", "Notes.oath", true},
+		{"tes", "notes.oath", true},
+		{"nts", "notes.oath", true},
+		{"xyz", "notes.oath", false},
+		{"seton", "notes.oath", false},
+	}
+	for _, tt := range tests {
+		if _, ok := fuzzyMatch(tt.query, tt.name); ok != tt.ok {
+			t.Errorf("fuzzyMatch(%q, %q) matched = %v, want %v", tt.query, tt.name, ok, tt.ok)
+		}
+	}
+
+	prefix, _ := fuzzyMatch("not", "notes.oath")
+	contiguous, _ := fuzzyMatch("not", "my notes.oath")
+	scattered, _ := fuzzyMatch("not", "new outline tex.oath")
+	if !(prefix > contiguous && contiguous > scattered) {
+		t.Errorf("scores prefix %d, contiguous %d, scattered %d: want them in that order", prefix, contiguous, scattered)
+	}
+
+	earlier, _ := fuzzyMatch("ote", "notes.oath")
+	later, _ := fuzzyMatch("ote", "my notes.oath")
+	if earlier <= later {
+		t.Errorf("an earlier contiguous match scored %d, a later one %d", earlier, later)
+	}
+}
+
+func TestTableBlockExports(t *testing.T) {
+	const content = "| Name | Qty |\n|---|---|\n| apple | 3 |\n| pear |"
+	table := parseTable(content)
+	want := tableData{Header: []string{"Name", "Qty"}, Rows: [][]string{{"apple", "3"}, {"pear", ""}}}
+	if !reflect.DeepEqual(table, want) {
+		t.Fatalf("parseTable = %+v, want %+v", table, want)
+	}
+
+	m := editorTestModel("", 0)
+	blocks := []ContentBlock{{ID: "1", Type: blockTable, Content: content}}
+	tests := []struct {
+		exporter string
+		got      string
+		want     []string
+	}{
+		{"latex", m.generateLaTeX(blocks), []string{"\\begin{tabular}{|l|l|}", "\\textbf{Name} & \\textbf{Qty} \\\\", "apple & 3 \\\\", "pear &  \\\\"}},
+		{"html", m.generateHTML(blocks), []string{"<th>Name</th><th>Qty</th>", "<td>apple</td><td>3</td>", "<td>pear</td><td></td>"}},
+		{"epub", m.epubBlockXHTML(blocks[0]), []string{"<th>Name</th><th>Qty</th>", "<td>pear</td><td></td>"}},
+		{"markdown", m.generateMarkdown(blocks), []string{content}},
+		{"unicode", m.generateUnicode(blocks), []string{"Name", "apple", "pear"}},
+		{"asciidoc", m.generateAsciiDoc(blocks), []string{"[options=\"header\"]\n|===\n|Name |Qty\n\n|apple |3\n|pear |\n|===\n"}},
+		{"org", m.generateOrg(blocks), []string{"| Name | Qty |\n|------+-----|\n| apple | 3 |\n| pear |  |\n"}},
+		{"rst", m.generateRST(blocks), []string{".. list-table::\n   :header-rows: 1\n\n   * - Name\n     - Qty\n   * - apple\n     - 3\n"}},
+	}
+
+	for _, tt := range tests {
+		for _, fragment := range tt.want {
+			if !strings.Contains(tt.got, fragment) {
+				t.Errorf("%s export is missing %q:\n%s", tt.exporter, fragment, tt.got)
+			}
+		}
+	}
+}
+
+func TestDetectBlockType(t *testing.T) {
+	tests := []struct {
+		name, content string
+		want          blockType
+	}{
+		{"empty", "  \n", blockText},
+		{"plain text", "Just a sentence.", blockText},
+		{"rule", "---", blockHR},
+		{"spaced rule", "* * *", blockHR},
+		{"code fence", "```go\nx := 1\n```", blockCode},
+		{"display math", "$$x^2$$", blockMath},
+		{"heading", "## Results", blockHeading},
+		{"hashtag", "#todo later", blockText},
+		{"too deep for a heading", "####### seven", blockText},
+		{"quote", "> to be or not", blockQuote},
+		{"bullet list", "- one\n* two", blockList},
+		{"numbered list", "1. one\n2. two", blockList},
+		{"mixed list and text", "- one\nnot an item", blockText},
+		{"table", "| a | b |\n|---|---|\n| 1 | 2 |", blockTable},
+		{"pipes without a header", "| a | b |\n| 1 | 2 |", blockText},
+	}
+
+	for _, tt := range tests {
+		if got := detectBlockType(tt.content); got != tt.want {
+			t.Errorf("%s: detectBlockType(%q) = %q, want %q", tt.name, tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestPomodoroNext(t *testing.T) {
+	p := pomodoroState{enabled: true, phase: phaseWork}
+	want := []pomodoroPhase{
+		phaseShortBreak, phaseWork,
+		phaseShortBreak, phaseWork,
+		phaseShortBreak, phaseWork,
+		phaseLongBreak, phaseWork,
+		phaseShortBreak,
+	}
+	for i, phase := range want {
+		p = p.next(4)
+		if p.phase != phase {
+			t.Fatalf("step %d: phase = %v, want %v", i+1, p.phase, phase)
+		}
+	}
+	if p.completed != 5 {
+		t.Errorf("completed = %d, want 5", p.completed)
+	}
+
+	// Fewer than one cycle means every break is a long one
+	p = pomodoroState{phase: phaseWork}.next(0)
+	if p.phase != phaseLongBreak {
+		t.Errorf("with 0 cycles phase = %v, want %v", p.phase, phaseLongBreak)
+	}
+}
+
+func TestOfflineHTMLHasNoExternalResources(t *testing.T) {
+	m := editorTestModel("", 0)
+	blocks := []ContentBlock{
+		{ID: "1", Type: blockHeading, Content: "# Notes"},
+		{ID: "2", Type: blockText, Content: "Inline $x^2$ and `code` with a note[^1]\n[^1]: See https://example.com"},
+		{ID: "3", Type: blockMath, Content: "$$\\frac{a}{b}$$"},
+		{ID: "4", Type: blockCode, Content: "fmt.Println()"},
+		{ID: "5", Type: blockImage, Content: "plot.png|A plot"},
+		{ID: "6", Type: blockTable, Content: "| a |\n|---|\n| 1 |"},
+	}
+
+	out := m.generateOfflineHTML(blocks, "Notes")
+	for _, external := range []string{"<script src=", "<link ", "cdn.", "<script"} {
+		if strings.Contains(out, external) {
+			t.Errorf("offline HTML contains %q:\n%s", external, out)
+		}
+	}
+	if !strings.Contains(out, "<style>") || !strings.Contains(out, "<img src=\"plot.png\"") {
+		t.Errorf("offline HTML is missing its inline style or image:\n%s", out)
+	}
+}
+
+func TestLaTeXCommand(t *testing.T) {
+	for _, engine := range latexEngines {
+		name, args, err := latexCommand(engine, "doc.tex")
+		if err != nil {
+			t.Fatalf("latexCommand(%q): %v", engine, err)
+		}
+		want := []string{"-interaction=nonstopmode", "-halt-on-error", "doc.tex"}
+		if name != engine || !slices.Equal(args, want) {
+			t.Errorf("latexCommand(%q) = %s %q, want %s %q", engine, name, args, engine, want)
+		}
+	}
+
+	if _, _, err := latexCommand("tectonic; rm -rf", "doc.tex"); err == nil {
+		t.Error("an unknown engine should be rejected")
+	}
+}
+
+func TestRunLaTeXRunsInOutputDir(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	dir := t.TempDir()
+	out, err := runLaTeX(dir, "sh", []string{"-c", `pwd; printf '%s\n' "$@"`, "sh", "-interaction=nonstopmode", "doc.tex"}, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolved, _ := filepath.EvalSymlinks(dir)
+	if want := resolved + "\n-interaction=nonstopmode\ndoc.tex\n"; string(out) != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+}
+
+func TestResolveSavePath(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	base := "/docs"
+
+	tests := []struct {
+		input, want string
+	}{
+		{"", ""},
+		{"   ", ""},
+		{"notes", "/docs/notes.oath"},
+		{" notes ", "/docs/notes.oath"},
+		{"paper.md", "/docs/paper.md"},
+		{"drafts/../notes", "/docs/notes.oath"},
+		{"/tmp/x", "/tmp/x.oath"},
+		{"~/thesis", filepath.Join(home, "thesis.oath")},
+	}
+
+	for _, tt := range tests {
+		if got := resolveSavePath(tt.input, base); got != tt.want {
+			t.Errorf("resolveSavePath(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestNeedsOverwriteConfirm(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing.oath")
+	if err := os.WriteFile(existing, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, path, current string
+		want                bool
+	}{
+		{"new file", filepath.Join(dir, "new.oath"), "", false},
+		{"someone else's file", existing, "", true},
+		{"another document's file", existing, filepath.Join(dir, "mine.oath"), true},
+		{"the document's own file", existing, existing, false},
+		{"own file written differently", existing, dir + "/./existing.oath", false},
+	}
+
+	for _, tt := range tests {
+		if got := needsOverwriteConfirm(tt.path, tt.current); got != tt.want {
+			t.Errorf("%s: needsOverwriteConfirm = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCreatedSurvivesSaveAndReload(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	path := filepath.Join(t.TempDir(), "doc.oath")
+	m := editorTestModel("text", 0)
+	m.mode = modeEdit
+	m.document.blocks = []ContentBlock{{ID: "1", Type: blockText, Content: "text"}}
+	m.document.filepath = path
+
+	first := m.saveDocumentAs(path)().(documentSavedMsg)
+	if first.err != nil || first.created.IsZero() {
+		t.Fatalf("first save: err = %v, created = %v", first.err, first.created)
+	}
+	updated, _ := m.Update(first)
+	m = updated.(model)
+
+	time.Sleep(10 * time.Millisecond)
+	second := m.saveDocumentAs(path)().(documentSavedMsg)
+	if !second.created.Equal(first.created) {
+		t.Errorf("created after a second save = %v, want %v", second.created, first.created)
+	}
+
+	doc, err := readDocument(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !doc.Created.Equal(first.created) || !doc.Modified.After(doc.Created) {
+		t.Errorf("reloaded created = %v, modified = %v, want created %v", doc.Created, doc.Modified, first.created)
+	}
+
+	// A document that lost track of its creation time picks it up from its own file
+	if got := documentCreated(time.Time{}, path, time.Now()); !got.Equal(first.created) {
+		t.Errorf("documentCreated from the file = %v, want %v", got, first.created)
+	}
+	now := time.Now()
+	if got := documentCreated(time.Time{}, "", now); !got.Equal(now) {
+		t.Errorf("documentCreated for a save as = %v, want now", got)
+	}
+}
+
+func TestRenderStatusBar(t *testing.T) {
+	base := func() model {
+		m := editorTestModel("", 0)
+		m.width = 100
+		m.document.filepath = "/docs/notes.oath"
+		m.document.blocks = []ContentBlock{{ID: "1"}, {ID: "2"}}
+		m.document.currentBlock = 1
+		return m
+	}
+
+	tests := []struct {
+		name    string
+		setup   func(*model)
+		want    []string
+		notWant []string
+	}{
+		{"saved document", func(m *model) {}, []string{"/docs/notes.oath", "Block 2/2", "NORMAL"}, []string{"*"}},
+		{"modified", func(m *model) { m.document.modified = true }, []string{"/docs/notes.oath *"}, nil},
+		{"insert mode", func(m *model) { m.document.vim.mode = vimInsert }, []string{"INSERT"}, []string{"NORMAL"}},
+		{"vim off", func(m *model) { m.document.vim.enabled = false }, nil, []string{"NORMAL"}},
+		{"save failed", func(m *model) { m.document.saveError = "disk full" }, []string{"save failed: disk full"}, nil},
+		{"just saved", func(m *model) { m.document.showSaved = true }, []string{"saved"}, nil},
+	}
+
+	for _, tt := range tests {
+		m := base()
+		tt.setup(&m)
+		bar := ansi.Strip(renderStatusBar(m))
+		for _, want := range tt.want {
+			if !strings.Contains(bar, want) {
+				t.Errorf("%s: status bar %q is missing %q", tt.name, bar, want)
+			}
+		}
+		for _, notWant := range tt.notWant {
+			if strings.Contains(bar, notWant) {
+				t.Errorf("%s: status bar %q shouldn't contain %q", tt.name, bar, notWant)
+			}
+		}
+	}
+
+	for _, width := range []int{100, 40, 12} {
+		m := base()
+		m.width = width
+		m.document.filepath = "/a/very/long/path/that/goes/on/and/on/for/quite/a/while/notes.oath"
+		if got := lipgloss.Width(renderStatusBar(m)); got != width {
+			t.Errorf("width %d: status bar is %d wide", width, got)
+		}
+	}
+}
+
+func TestTidyBlocks(t *testing.T) {
+	blocks := []ContentBlock{
+		{ID: "a", Type: blockText, Content: "one"},
+		{ID: "b", Type: blockText, Content: "  "},
+		{ID: "c", Type: blockText, Content: "two"},
+		{ID: "d", Type: blockCode, Content: "x := 1", Language: "go"},
+		{ID: "e", Type: blockCode, Content: "y := 2", Language: "go"},
+		{ID: "f", Type: blockHR},
+	}
+
+	tests := []struct {
+		name     string
+		blocks   []ContentBlock
+		merge    bool
+		contents []string
+		ids      map[string]string
+		result   tidyResult
+	}{
+		{"drops empties", blocks, false, []string{"one", "two", "x := 1", "y := 2", ""},
+			map[string]string{"a": "1", "c": "2", "d": "3", "e": "4", "f": "5"}, tidyResult{removed: 1, renumbered: true}},
+		{"merges text but not code", blocks, true, []string{"one\n\ntwo", "x := 1", "y := 2", ""},
+			map[string]string{"a": "1", "c": "1", "d": "2", "e": "3", "f": "4"}, tidyResult{removed: 1, merged: 1, renumbered: true}},
+		{"keeps the only block", []ContentBlock{{ID: "1", Type: blockText}, {ID: "2", Type: blockText, Content: "\n"}}, true, []string{""},
+			map[string]string{"1": "1"}, tidyResult{removed: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tidied, ids, result := tidyBlocks(tt.blocks, tt.merge)
+			var contents []string
+			for _, block := range tidied {
+				contents = append(contents, block.Content)
+			}
+			if !slices.Equal(contents, tt.contents) {
+				t.Errorf("contents = %q, want %q", contents, tt.contents)
+			}
+			if !reflect.DeepEqual(ids, tt.ids) {
+				t.Errorf("ids = %v, want %v", ids, tt.ids)
+			}
+			if result != tt.result {
+				t.Errorf("result = %+v, want %+v", result, tt.result)
+			}
+		})
+	}
+}
+
+func TestParseLineTarget(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    int
+		wantErr bool
+	}{
+		{"3", 3, false},
+		{" 2 ", 2, false},
+		{"0", 1, false},
+		{"-4", 1, false},
+		{"99", 5, false},
+		{"g", 1, false},
+		{"gg", 1, false},
+		{"G", 5, false},
+		{"$", 5, false},
+		{"three", 0, true},
+		{"", 0, true},
+		{"2.5", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseLineTarget(tt.input, 5)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseLineTarget(%q, 5) = %d, %v, want %d (error %v)", tt.input, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestBatchSummary(t *testing.T) {
+	failure := errors.New("no engine")
+	tests := []struct {
+		name    string
+		results []exportResultMsg
+		want    string
+	}{
+		{"all succeed", []exportResultMsg{{}, {}, {}}, "Exported 3 of 3 formats"},
+		{"mixed", []exportResultMsg{{}, {err: failure}, {skipped: true}, {}}, "Exported 2 of 4 formats, 1 failed, 1 skipped"},
+		{"all fail", []exportResultMsg{{err: failure}, {err: failure}}, "Exported 0 of 2 formats, 2 failed"},
+	}
+
+	for _, tt := range tests {
+		if got := batchSummary(tt.results); got != tt.want {
+			t.Errorf("%s: batchSummary = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestClampPreviewColumn(t *testing.T) {
+	tests := []struct {
+		name                   string
+		column, longest, width int
+		want                   int
+	}{
+		{"inside", 8, 100, 40, 8},
+		{"at the last column", 60, 100, 40, 60},
+		{"past the last column", 61, 100, 40, 60},
+		{"negative", -8, 100, 40, 0},
+		{"lines fit", 8, 30, 40, 0},
+		{"exactly fits", 8, 40, 40, 0},
+		{"empty preview", 8, 0, 40, 0},
+	}
+
+	for _, tt := range tests {
+		if got := clampPreviewColumn(tt.column, tt.longest, tt.width); got != tt.want {
+			t.Errorf("%s: clampPreviewColumn(%d, %d, %d) = %d, want %d", tt.name, tt.column, tt.longest, tt.width, got, tt.want)
+		}
+	}
+}
+
+func TestModelForPath(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	dir := t.TempDir()
+
+	var oath bytes.Buffer
+	doc := OathDocument{Version: documentVersion, Content: []ContentBlock{{ID: "1", Type: blockText, Content: "from oath"}}}
+	if err := SaveDocumentToWriter(&oath, doc); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"doc.oath":  oath.String(),
+		"readme.MD": "# Title\n\nfrom markdown\n",
+		"notes.txt": "plain",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		mode     mode
+		contains string
+		wantErr  bool
+	}{
+		{"no path", "", modeBrowser, "", false},
+		{"directory", dir, modeBrowser, "", false},
+		{"oath document", filepath.Join(dir, "doc.oath"), modeEdit, "from oath", false},
+		{"markdown, any case", filepath.Join(dir, "readme.MD"), modeEdit, "from markdown", false},
+		{"unknown extension", filepath.Join(dir, "notes.txt"), modeBrowser, "", true},
+		{"missing file", filepath.Join(dir, "gone.oath"), modeBrowser, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := modelForPath(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if m.mode != tt.mode {
+				t.Errorf("mode = %v, want %v", m.mode, tt.mode)
+			}
+			if tt.contains != "" && !slices.ContainsFunc(m.document.blocks, func(b ContentBlock) bool { return strings.Contains(b.Content, tt.contains) }) {
+				t.Errorf("blocks %+v don't contain %q", m.document.blocks, tt.contains)
+			}
+		})
+	}
+}
+
+func TestBlockWindow(t *testing.T) {
+	even := []int{3, 3, 3, 3, 3, 3, 3, 3, 3, 3}
+	tests := []struct {
+		name          string
+		heights       []int
+		current, rows int
+		start, end    int
+	}{
+		{"start", even, 0, 9, 0, 3},
+		{"middle", even, 5, 9, 4, 7},
+		{"end", even, 9, 9, 7, 10},
+		{"past the end", even, 20, 9, 7, 10},
+		{"everything fits", even, 4, 100, 0, 10},
+		{"current taller than the screen", []int{2, 50, 2}, 1, 10, 1, 2},
+		{"no blocks", nil, 0, 10, 0, 0},
+	}
+
+	for _, tt := range tests {
+		start, end := blockWindow(tt.heights, tt.current, tt.rows)
+		if start != tt.start || end != tt.end {
+			t.Errorf("%s: blockWindow = [%d, %d), want [%d, %d)", tt.name, start, end, tt.start, tt.end)
+		}
+	}
+}
+
+func TestMathStandalone(t *testing.T) {
+	tests := []struct {
+		name, content, body string
+	}{
+		{"bare formula", "  x_1 & y^2 % not a comment \\\\ \n", "\\[x_1 & y^2 % not a comment \\\\\\]\n"},
+		{"environment", "\\begin{align}a &= b_1\\end{align}", "\\begin{align}a &= b_1\\end{align}\n"},
+		{"delimited", "where $x_1$ and $$\\frac{a}{b}$$", "where \\(x_1\\) and \\[\\frac{a}{b}\\]\n"},
+	}
+
+	for _, tt := range tests {
+		out := mathStandalone(tt.content, nil, "")
+		if !strings.HasPrefix(out, "\\documentclass[border=4pt,varwidth]{standalone}\n") {
+			t.Errorf("%s: missing the standalone class:\n%s", tt.name, out)
+		}
+		if want := "\\begin{document}\n" + tt.body + "\\end{document}\n"; !strings.HasSuffix(out, want) {
+			t.Errorf("%s: body is\n%s\nwant\n%s", tt.name, out, want)
+		}
+	}
+
+	macros := []macroDefinition{{Name: "\\R", Expansion: "\\mathbb{R}"}, {Name: "\\norm", Args: 1, Expansion: "\\|#1\\|"}}
+	out := mathStandalone("\\norm{x} \\in \\R", macros, "")
+	for _, want := range []string{"\\DeclareRobustCommand{\\R}{\\mathbb{R}}\n", "\\DeclareRobustCommand{\\norm}[1]{\\|#1\\|}\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing macro %q in\n%s", want, out)
+		}
+	}
+}
+
+func TestEnvironmentCompletions(t *testing.T) {
+	lsp := newLSPModel(newRenderModel(0).mathSymbols)
+
+	tests := []struct {
+		name, content string
+		first         string
+		none          bool
+	}{
+		{"inside the braces", "\\begin{al", "align", false},
+		{"after the brace", "x \\begin{", "", false},
+		{"typing begin", "\\begin", "", false},
+		{"closed", "\\begin{align}", "", true},
+	}
+
+	for _, tt := range tests {
+		completions := lsp.getCompletions(tt.content, len(tt.content))
+		if tt.none {
+			if len(completions) != 0 {
+				t.Errorf("%s: got completions %v", tt.name, completions)
+			}
+			continue
+		}
+		if !slices.ContainsFunc(completions, func(c Completion) bool { return c.Kind == "environment" }) {
+			t.Errorf("%s: no environment among %v", tt.name, completions)
+			continue
+		}
+		if tt.first != "" && completions[0].Label != tt.first {
+			t.Errorf("%s: first completion = %q, want %q", tt.name, completions[0].Label, tt.first)
+		}
+	}
+
+	align := lsp.getCompletions("\\begin{ali", 10)[0]
+	if align.InsertText != "\\begin{align}\n\n\\end{align}" {
+		t.Errorf("scaffold = %q", align.InsertText)
+	}
+	// The cursor lands on the empty line between begin and end
+	if got := align.InsertText[:align.Cursor]; got != "\\begin{align}\n" {
+		t.Errorf("cursor lands after %q", got)
+	}
+}
+
+func TestCompletionPrefix(t *testing.T) {
+	tests := []struct {
+		name, content string
+		cursor        int
+		token         string
+		start         int
+	}{
+		{"end of content", "x + \\al", 7, "\\al", 4},
+		{"mid block", "\\be and \\gamma", 3, "\\be", 0},
+		{"after a space", "\\alpha ", 7, "", -1},
+		{"no backslash", "alpha", 5, "", -1},
+		{"bare backslash", "x \\", 3, "", -1},
+		{"glued to text", "f(\\si", 5, "\\si", 2},
+		{"inside begin braces", "\\begin{eq", 9, "\\begin{eq", 0},
+		{"other braces", "\\frac{a", 7, "", -1},
+		{"closed brace", "\\begin{x}", 9, "", -1},
+		{"cursor past the end", "\\pi", 10, "\\pi", 0},
+		{"cursor at start", "\\pi", 0, "", -1},
+	}
+
+	for _, tt := range tests {
+		token, start := completionPrefix(tt.content, tt.cursor)
+		if token != tt.token || start != tt.start {
+			t.Errorf("%s: completionPrefix(%q, %d) = %q, %d, want %q, %d", tt.name, tt.content, tt.cursor, token, start, tt.token, tt.start)
+		}
+	}
+
+	// Completions follow the cursor, not the last word of the block
+	lsp := newLSPModel(newRenderModel(0).mathSymbols)
+	completions := lsp.getCompletions("\\gam and \\alpha", 4)
+	if len(completions) == 0 || completions[0].Label != "\\gamma" {
+		t.Errorf("completions at the cursor = %v, want \\gamma first", completions)
+	}
+}
+
+func TestParseTheme(t *testing.T) {
+	defaults := themes["default"]
+	tests := []struct {
+		name    string
+		data    string
+		want    func(Theme) bool
+		wantErr bool
+	}{
+		{"light and dark", `{"name": "Ocean", "primary": {"light": "#005f87", "dark": "#87d7ff"}}`,
+			func(th Theme) bool {
+				return th.Name == "Ocean" && th.Primary == lipgloss.AdaptiveColor{Light: "#005f87", Dark: "#87d7ff"}
+			}, false},
+		{"missing colors fall back", `{"error": {"light": "#f00", "dark": "#F00"}}`,
+			func(th Theme) bool {
+				return th.Name == "" && th.Error.Light == "#f00" && th.Border == defaults.Border && th.Muted == defaults.Muted
+			}, false},
+		{"bad hex", `{"primary": {"light": "blue", "dark": "#87d7ff"}}`, nil, true},
+		{"half a color", `{"primary": {"light": "#005f87"}}`,
+			func(th Theme) bool { return th.Primary == lipgloss.AdaptiveColor{Light: "#005f87", Dark: defaults.Primary.Dark} }, false},
+		{"not json", `{"primary": `, nil, true},
+	}
+
+	for _, tt := range tests {
+		theme, err := parseTheme([]byte(tt.data))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.want != nil && !tt.want(theme) {
+			t.Errorf("%s: parsed %+v", tt.name, theme)
+		}
+	}
+}
+
+func TestApplyVariables(t *testing.T) {
+	today := time.Now().Format("2006-01-02")
+	tests := []struct {
+		name    string
+		content string
+		vars    map[string]string
+		want    string
+	}{
+		{"every occurrence", "{{name}} and {{name}} again", map[string]string{"name": "Ada"}, "Ada and Ada again"},
+		{"unresolved left alone", "{{name}} by {{author}}", map[string]string{"name": "Ada"}, "Ada by {{author}}"},
+		{"built-in date", "Written {{date}}", nil, "Written " + today},
+		{"date can be overridden", "{{date}}", map[string]string{"date": "someday"}, "someday"},
+		{"no placeholders", "plain {name}", map[string]string{"name": "Ada"}, "plain {name}"},
+	}
+
+	for _, tt := range tests {
+		blocks := []ContentBlock{{ID: "1", Type: blockText, Content: tt.content}}
+		got := applyVariables(blocks, tt.vars)
+		if got[0].Content != tt.want {
+			t.Errorf("%s: content = %q, want %q", tt.name, got[0].Content, tt.want)
+		}
+		if blocks[0].Content != tt.content {
+			t.Errorf("%s: the input blocks were changed", tt.name)
+		}
+	}
+}
+
+func TestRenderInlineMath(t *testing.T) {
+	r := newRenderModel(0)
+	tests := []struct {
+		in, want string
+	}{
+		{"Let $\\alpha$ be small and **bold**.", "Let α be small and **bold**."},
+		{"$x^2$ and $y_1$", "x² and y₁"},
+		{"costs \\$5, not $\\beta$", "costs $5, not β"},
+		{"unclosed $\\alpha stays", "unclosed $\\alpha stays"},
+		{"no math at all", "no math at all"},
+	}
+
+	for _, tt := range tests {
+		if got := r.renderInlineMath(tt.in); got != tt.want {
+			t.Errorf("renderInlineMath(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSplitBlock(t *testing.T) {
+	block := ContentBlock{ID: "1", Type: blockCode, Language: "go", Content: "one\ntwo", Rendered: "cached"}
+	tests := []struct {
+		name          string
+		at            int
+		first, second string
+	}{
+		{"start", 0, "", "one\ntwo"},
+		{"middle of a line", 2, "on", "e\ntwo"},
+		{"at the line break", 3, "one", "two"},
+		{"after the line break", 4, "one", "two"},
+		{"end", 7, "one\ntwo", ""},
+		{"past the end", 40, "one\ntwo", ""},
+		{"negative", -1, "", "one\ntwo"},
+	}
+
+	for _, tt := range tests {
+		first, second := splitBlock(block, tt.at)
+		if first.Content != tt.first || second.Content != tt.second {
+			t.Errorf("%s: split = %q / %q, want %q / %q", tt.name, first.Content, second.Content, tt.first, tt.second)
+		}
+		if first.Type != blockCode || second.Language != "go" || first.Rendered != "" || second.Rendered != "" {
+			t.Errorf("%s: halves should keep the type and language and drop the cache: %+v %+v", tt.name, first, second)
+		}
+	}
+}
+
+func TestBlockIDsStayUnique(t *testing.T) {
+	tests := []struct {
+		name    string
+		ids     []string
+		want    []string
+		next    int
+		changed bool
+	}{
+		{"already unique", []string{"1", "2", "5"}, []string{"1", "2", "5"}, 6, false},
+		{"duplicates", []string{"1", "2", "2", "1"}, []string{"1", "2", "3", "4"}, 5, true},
+		{"missing and named", []string{"intro", "", "intro"}, []string{"intro", "1", "2"}, 3, true},
+	}
+
+	for _, tt := range tests {
+		blocks := make([]ContentBlock, len(tt.ids))
+		for i, id := range tt.ids {
+			blocks[i].ID = id
+		}
+		result, next, changed := uniqueBlockIDs(blocks)
+		var ids []string
+		for _, block := range result {
+			ids = append(ids, block.ID)
+		}
+		if !slices.Equal(ids, tt.want) || next != tt.next || changed != tt.changed {
+			t.Errorf("%s: uniqueBlockIDs = %q, %d, %v, want %q, %d, %v", tt.name, ids, next, changed, tt.want, tt.next, tt.changed)
+		}
+	}
+
+	// Deleting a middle block and adding new ones never hands out an ID that is in use
+	d := documentModel{blocks: []ContentBlock{{ID: "1"}, {ID: "2"}, {ID: "3"}}}
+	d.blocks = slices.Delete(d.blocks, 1, 2)
+	for i := 0; i < 3; i++ {
+		d.blocks = append(d.blocks, ContentBlock{ID: d.newBlockID()})
+	}
+	seen := make(map[string]bool)
+	for _, block := range d.blocks {
+		if seen[block.ID] {
+			t.Fatalf("duplicate ID %q in %+v", block.ID, d.blocks)
+		}
+		seen[block.ID] = true
+	}
+}
+
+func TestQuitPrompt(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	key := func(s string) tea.KeyMsg { return tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(s)} }
+
+	tests := []struct {
+		name     string
+		modified bool
+		action   quitAction
+		answer   tea.KeyMsg
+		mode     mode
+		quits    bool
+	}{
+		{"clean document leaves", false, quitToMenu, tea.KeyMsg{}, modeMenu, false},
+		{"clean document quits", false, quitApp, tea.KeyMsg{}, modeEdit, true},
+		{"discard leaves", true, quitToMenu, key("d"), modeMenu, false},
+		{"discard quits", true, quitApp, key("d"), modeEdit, true},
+		{"cancel stays", true, quitToMenu, tea.KeyMsg{Type: tea.KeyEsc}, modeEdit, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := editorTestModel("text", 0)
+			m.mode = modeEdit
+			m.document.modified = tt.modified
+
+			updated, cmd := m.requestQuit(tt.action)
+			m = updated.(model)
+			if tt.modified {
+				if m.quitPrompt != tt.action || m.mode != modeEdit || cmd != nil {
+					t.Fatalf("a modified document should be held at the prompt: prompt %v, mode %v", m.quitPrompt, m.mode)
+				}
+				updated, cmd = m.updateQuitPrompt(tt.answer)
+				m = updated.(model)
+			}
+
+			if m.quitPrompt != quitNone || m.mode != tt.mode {
+				t.Errorf("prompt %v, mode %v, want no prompt and mode %v", m.quitPrompt, m.mode, tt.mode)
+			}
+			quit := false
+			if cmd != nil {
+				_, quit = cmd().(tea.QuitMsg)
+			}
+			if quit != tt.quits {
+				t.Errorf("quit = %v, want %v", quit, tt.quits)
+			}
+		})
+	}
+}
+
+func TestRenderEnvironments(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"two-line align", "\\begin{align}x &= 1 \\\\ yy &= 22\\end{align}", "x  = 1\nyy = 22"},
+		{"three cases", "f = \\begin{cases}1 & x > 0 \\\\ 0 & x = 0 \\\\ -1 & \\text{otherwise}\\end{cases}",
+			"f = ⎧ 1   x > 0\n    ⎨ 0   x = 0\n    ⎩ -1  otherwise"},
+		{"equation", "\\begin{equation} E = mc^2 \\end{equation}", "E = mc^2"},
+		{"unknown environment", "\\begin{tikzpicture}x\\end{tikzpicture}", "\\begin{tikzpicture}x\\end{tikzpicture}"},
+		{"unclosed", "\\begin{align}x &= 1", "\\begin{align}x &= 1"},
+	}
+
+	for _, tt := range tests {
+		if got := renderEnvironments(tt.in); got != tt.want {
+			t.Errorf("%s: renderEnvironments = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEditorPosition(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		cursor    int
+		line, col int
+	}{
+		{"start", "first\nsecond\nthird", 0, 1, 1},
+		{"middle line", "first\nsecond\nthird", 9, 2, 4},
+		{"end of last line", "first\nsecond\nthird", 18, 3, 6},
+		{"runes not bytes", "αβγ\nδε", 9, 2, 2},
+	}
+
+	for _, tt := range tests {
+		m := editorTestModel(tt.content, tt.cursor)
+		if line, col := editorPosition(m.document.editor); line != tt.line || col != tt.col {
+			t.Errorf("%s: editorPosition = Ln %d, Col %d, want Ln %d, Col %d", tt.name, line, col, tt.line, tt.col)
+		}
+	}
+}
+
+func TestMatrixLines(t *testing.T) {
+	tests := []struct {
+		name, body, kind string
+		want             []string
+	}{
+		{"2x2 bmatrix", "1 & 20 \\\\ 300 & 4", "bmatrix", []string{"⎡  1   20 ⎤", "⎣ 300  4  ⎦"}},
+		{"pmatrix", "a & b \\\\ c & d", "pmatrix", []string{"⎛ a  b ⎞", "⎝ c  d ⎠"}},
+		{"one row bmatrix", "x & y", "bmatrix", []string{"[ x  y ]"}},
+		{"plain matrix", "a & b \\\\ c & d", "matrix", []string{"a  b", "c  d"}},
+		{"ragged rows", "1 & 2 & 3 \\\\ 4", "bmatrix", []string{"⎡ 1  2  3 ⎤", "⎣ 4       ⎦"}},
+		{"empty", " ", "bmatrix", nil},
+	}
+
+	for _, tt := range tests {
+		if got := matrixLines(tt.body, tt.kind); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: matrixLines = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	if got := truncateLines("⎡  1   20 ⎤\nab", 6); got != "⎡  1 …\nab" {
+		t.Errorf("truncateLines = %q", got)
+	}
+}
+
+func TestBlockFileRoundTrip(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	tests := []struct {
+		name   string
+		block  ContentBlock
+		ext    string
+		edited string
+		want   string
+	}{
+		{"untouched text", ContentBlock{Type: blockText, Content: "hello\nworld"}, ".md", "", "hello\nworld"},
+		{"math gets .tex", ContentBlock{Type: blockMath, Content: "x^2"}, ".tex", "", "x^2"},
+		{"editor's final newline dropped", ContentBlock{Type: blockRawLaTeX, Content: "a"}, ".tex", "b\n", "b"},
+		{"only one newline dropped", ContentBlock{Type: blockText, Content: "a"}, ".md", "b\n\n", "b\n"},
+	}
+
+	for _, tt := range tests {
+		path, err := writeBlockFile(tt.block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Ext(path) != tt.ext {
+			t.Errorf("%s: temp file %s, want a %s file", tt.name, path, tt.ext)
+		}
+		if tt.edited != "" {
+			if err := os.WriteFile(path, []byte(tt.edited), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		got, err := readBlockFile(path)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: readBlockFile = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s: temp file left behind", tt.name)
+		}
+	}
+}
+
+func TestPinBlock(t *testing.T) {
+	m := editorTestModel("", 0)
+	m.document.blocks = []ContentBlock{
+		{ID: "1", Type: blockText, Content: "first"},
+		{ID: "2", Type: blockText, Content: "second"},
+		{ID: "3", Type: blockText, Content: "third"},
+	}
+	m.document.currentBlock = 1
+	pin := tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(m.keys.PinBlock)}
+
+	next, _ := m.updateEdit(pin)
+	m = next.(model)
+	if m.document.pinnedID != "2" {
+		t.Fatalf("pinnedID = %q, want 2", m.document.pinnedID)
+	}
+
+	// Reordering moves the block but the pin follows its ID
+	m.document.blocks[0], m.document.blocks[1], m.document.blocks[2] = m.document.blocks[2], m.document.blocks[0], m.document.blocks[1]
+	if block, ok := m.pinnedBlock(); !ok || block.Content != "second" {
+		t.Errorf("pinned block after reordering = %+v, %v", block, ok)
+	}
+	if pinned := ansi.Strip(m.renderPinned(60, 30)); !strings.Contains(pinned, "second") {
+		t.Errorf("pinned panel doesn't show the block:\n%s", pinned)
+	}
+
+	// Pinning the same block again unpins it
+	m.document.currentBlock = 2
+	next, _ = m.updateEdit(pin)
+	m = next.(model)
+	if _, ok := m.pinnedBlock(); ok || m.renderPinned(60, 30) != "" {
+		t.Errorf("still pinned after pressing %s again: %q", m.keys.PinBlock, m.document.pinnedID)
+	}
+}
+
+func TestBlockSummary(t *testing.T) {
+	long := strings.Repeat("é", foldSummaryLength+5)
+	tests := []struct {
+		name  string
+		block ContentBlock
+		want  string
+	}{
+		{"short", ContentBlock{Type: blockText, Content: "hello"}, "[TEXT] hello"},
+		{"whitespace collapsed", ContentBlock{Type: blockCode, Content: "a :=\n\t1"}, "[CODE] a := 1"},
+		{"exactly the limit", ContentBlock{Type: blockMath, Content: long[:foldSummaryLength*2]}, "[MATH] " + long[:foldSummaryLength*2]},
+		{"truncated by runes", ContentBlock{Type: blockQuote, Content: long}, "[QUOTE] " + long[:foldSummaryLength*2] + "…"},
+		{"empty", ContentBlock{Type: blockList, Content: " \n"}, "[LIST] [Empty list block]"},
+	}
+
+	for _, tt := range tests {
+		if got := blockSummary(tt.block); got != tt.want {
+			t.Errorf("%s: blockSummary = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	d := documentModel{blocks: []ContentBlock{{ID: "1"}, {ID: "2"}}}
+	d.toggleFold("2")
+	if !d.collapsed["2"] || d.collapsed["1"] {
+		t.Errorf("after folding 2: %v", d.collapsed)
+	}
+	d.toggleFold("2")
+	if d.collapsed["2"] {
+		t.Errorf("2 still folded after a second toggle")
+	}
+	d.foldAll(true)
+	if !d.collapsed["1"] || !d.collapsed["2"] {
+		t.Errorf("after fold all: %v", d.collapsed)
+	}
+	d.foldAll(false)
+	if len(d.collapsed) != 0 {
+		t.Errorf("after unfold all: %v", d.collapsed)
+	}
+}
+
+func TestFootnotes(t *testing.T) {
+	blocks := []ContentBlock{
+		{ID: "1", Type: blockText, Content: "Second[^b] then first[^a] and again[^b], lost[^gone]"},
+		{ID: "2", Type: blockCode, Content: "[^a]: not a definition in code"},
+		{ID: "3", Type: blockText, Content: "[^a]: Alpha note\n[^b]: Beta note\n[^unused]: Never cited"},
+	}
+
+	notes := collectFootnotes(blocks)
+	if !slices.Equal(notes.order, []string{"b", "a"}) {
+		t.Errorf("order = %q, want b before a, numbered by first reference", notes.order)
+	}
+	if notes.numbers["b"] != 1 || notes.numbers["a"] != 2 || notes.numbers["unused"] != 0 {
+		t.Errorf("numbers = %v", notes.numbers)
+	}
+	if notes.defs["a"] != "Alpha note" {
+		t.Errorf("definition of a = %q, want the text block's", notes.defs["a"])
+	}
+
+	got := notes.replace(blocks[0].Content, func(label string, n int) string { return fmt.Sprintf("<%d>", n) })
+	if want := "Second<1> then first<2> and again<1>, lost[^gone]"; got != want {
+		t.Errorf("replace = %q, want %q", got, want)
+	}
+
+	diagnostics := footnoteDiagnostics(blocks[0].Content, notes)
+	if len(diagnostics) != 1 || diagnostics[0].Severity != "warning" || !strings.Contains(diagnostics[0].Message, "[^gone]") {
+		t.Fatalf("diagnostics = %+v, want one warning for [^gone]", diagnostics)
+	}
+	if diagnostics[0].Line != 1 || diagnostics[0].Column != strings.Index(blocks[0].Content, "[^gone]")+1 {
+		t.Errorf("warning at %d:%d", diagnostics[0].Line, diagnostics[0].Column)
+	}
+}
+
+func TestPaletteFilterAndSelection(t *testing.T) {
+	noop := func(m model) (tea.Model, tea.Cmd) { return m, nil }
+	entries := []paletteEntry{
+		{Name: "New block", Run: noop},
+		{Name: "Export document", Run: noop},
+		{Name: "Toggle Vim mode", Run: noop},
+		{Name: "Next theme", Run: noop},
+	}
+
+	var p paletteModel
+	p.open(entries)
+	if len(p.matches) != len(entries) {
+		t.Fatalf("an empty filter should list everything, got %d", len(p.matches))
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"ne", []string{"New block", "Next theme"}},
+		{"exp", []string{"Export document"}},
+		{"vim", []string{"Toggle Vim mode"}},
+		{"zzz", nil},
+	}
+	for _, tt := range tests {
+		p.input.SetValue(tt.query)
+		p.filter()
+		var names []string
+		for _, entry := range p.matches {
+			names = append(names, entry.Name)
+		}
+		if !slices.Equal(names, tt.want) {
+			t.Errorf("filter %q = %q, want %q", tt.query, names, tt.want)
+		}
+		if _, ok := p.current(); ok != (len(tt.want) > 0) {
+			t.Errorf("filter %q: current() ok = %v", tt.query, ok)
+		}
+	}
+
+	p.input.SetValue("")
+	p.filter()
+	p.move(2)
+	if entry, _ := p.current(); entry.Name != "Toggle Vim mode" {
+		t.Errorf("after moving down twice: %q", entry.Name)
+	}
+	p.move(10)
+	if p.selected != len(entries)-1 {
+		t.Errorf("moving past the end selects %d", p.selected)
+	}
+	p.move(-10)
+	if p.selected != 0 {
+		t.Errorf("moving past the start selects %d", p.selected)
+	}
+}
+
+func TestExpandLeadingTabs(t *testing.T) {
+	code := "func f() {\n\tif x {\n\t\treturn \"a\tb\"\n\t}\n  \tmixed\n}"
+	tests := []struct {
+		name  string
+		width int
+		want  string
+	}{
+		{"width 4", 4, "func f() {\n    if x {\n        return \"a\tb\"\n    }\n    mixed\n}"},
+		{"width 2", 2, "func f() {\n  if x {\n    return \"a\tb\"\n  }\n    mixed\n}"},
+		{"unset uses 4", 0, "func f() {\n    if x {\n        return \"a\tb\"\n    }\n    mixed\n}"},
+	}
+
+	for _, tt := range tests {
+		if got := expandLeadingTabs(code, tt.width); got != tt.want {
+			t.Errorf("%s: expandLeadingTabs =\n%q\nwant\n%q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDiffBlocks(t *testing.T) {
+	saved := []ContentBlock{
+		{ID: "1", Type: blockHeading, Content: "# Title"},
+		{ID: "2", Type: blockText, Content: "kept"},
+		{ID: "3", Type: blockText, Content: "removed"},
+		{ID: "4", Type: blockCode, Content: "x", Language: "go"},
+	}
+	current := []ContentBlock{
+		{ID: "1", Type: blockHeading, Content: "# New title"},
+		{ID: "2", Type: blockText, Content: "kept"},
+		{ID: "5", Type: blockText, Content: "added"},
+		{ID: "4", Type: blockCode, Content: "x", Language: "python"},
+	}
+
+	type change struct {
+		kind  changeKind
+		id    string
+		index int
+	}
+	want := []change{
+		{blockChanged, "1", 1},
+		{blockAdded, "5", 3},
+		{blockRemoved, "3", 0},
+		{blockChanged, "4", 4},
+	}
+
+	var got []change
+	for _, c := range diffBlocks(saved, current) {
+		got = append(got, change{c.kind, c.block.ID, c.index})
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("diffBlocks = %+v, want %+v", got, want)
+	}
+
+	if changes := diffBlocks(saved, saved); len(changes) != 0 {
+		t.Errorf("an unchanged document has changes %+v", changes)
+	}
+}
+
+func TestLRUCacheStats(t *testing.T) {
+	c := newLRUCache(2)
+	steps := []struct {
+		op      string
+		key     string
+		hit     bool
+		hits    int
+		misses  int
+		entries int
+	}{
+		{"get", "a", false, 0, 1, 0},
+		{"put", "a", false, 0, 1, 1},
+		{"get", "a", true, 1, 1, 1},
+		{"put", "b", false, 1, 1, 2},
+		{"get", "a", true, 2, 1, 2},
+		// b is now the least recently used and goes first
+		{"put", "c", false, 2, 1, 2},
+		{"get", "b", false, 2, 2, 2},
+		{"get", "a", true, 3, 2, 2},
+		{"get", "c", true, 4, 2, 2},
+		{"put", "c", false, 4, 2, 2},
+	}
+
+	for i, step := range steps {
+		switch step.op {
+		case "get":
+			if _, hit := c.Get(step.key); hit != step.hit {
+				t.Errorf("step %d: Get(%q) hit = %v, want %v", i, step.key, hit, step.hit)
+			}
+		case "put":
+			c.Put(step.key, RenderedBlock{Unicode: step.key})
+		}
+		if hits, misses := c.Stats(); hits != step.hits || misses != step.misses || c.Len() != step.entries {
+			t.Errorf("step %d: hits %d, misses %d, len %d, want %d, %d, %d", i, hits, misses, c.Len(), step.hits, step.misses, step.entries)
+		}
+	}
+
+	if got := cacheSummary(c); got != "Cache 2/2 · 67% hits (4 hits, 2 misses)" {
+		t.Errorf("cacheSummary = %q", got)
+	}
+	if got := newRenderModel(0).cache.capacity; got != defaultCacheCapacity {
+		t.Errorf("unset capacity = %d, want %d", got, defaultCacheCapacity)
+	}
+}
+
+func TestListingOptions(t *testing.T) {
+	tests := []struct {
+		name       string
+		block      ContentBlock
+		breakLines bool
+		want       string
+	}{
+		{"defaults", ContentBlock{Language: "go"}, true, "language=go"},
+		{"block turns wrapping off", ContentBlock{Language: "go", NoWrap: true}, true, "language=go,breaklines=false"},
+		{"already off globally", ContentBlock{Language: "go", NoWrap: true}, false, "language=go"},
+		{"line numbers", ContentBlock{Language: "python", LineNumbers: true}, true, "language=python,numbers=left"},
+		{"both", ContentBlock{Language: "c", NoWrap: true, LineNumbers: true}, true, "language=c,breaklines=false,numbers=left"},
+		{"unknown language", ContentBlock{}, true, "language=text"},
+	}
+
+	for _, tt := range tests {
+		if got := listingOptions(tt.block, tt.breakLines); got != tt.want {
+			t.Errorf("%s: listingOptions = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBuildOutline(t *testing.T) {
+	blocks := []ContentBlock{
+		{Type: blockText, Content: "preamble"},
+		{Type: blockHeading, Content: "# Intro"},
+		{Type: blockText, Content: "# not a heading block"},
+		{Type: blockHeading, Content: "### Deep"},
+		{Type: blockHeading, Content: "Plain title", Level: 2},
+		{Type: blockHeading, Content: "No level"},
+	}
+
+	want := []outlineEntry{
+		{index: 1, level: 1, title: "Intro"},
+		{index: 3, level: 3, title: "Deep"},
+		{index: 4, level: 2, title: "Plain title"},
+		{index: 5, level: 1, title: "No level"},
+	}
+	outline := buildOutline(blocks)
+	if !slices.Equal(outline, want) {
+		t.Fatalf("buildOutline = %+v, want %+v", outline, want)
+	}
+
+	sections := []struct{ block, want int }{{0, -1}, {1, 0}, {2, 0}, {3, 1}, {5, 3}}
+	for _, s := range sections {
+		if got := outlineSection(outline, s.block); got != s.want {
+			t.Errorf("outlineSection(block %d) = %d, want %d", s.block, got, s.want)
+		}
+	}
+	if got := buildOutline([]ContentBlock{{Type: blockText, Content: "no headings"}}); len(got) != 0 {
+		t.Errorf("outline without headings = %+v", got)
+	}
+}
+
+func TestMarkdownHeading(t *testing.T) {
+	tests := []struct {
+		name  string
+		block ContentBlock
+		want  string
+	}{
+		{"already markdown", ContentBlock{Content: "## Methods"}, "## Methods"},
+		{"no space after hashes", ContentBlock{Content: "###Results"}, "### Results"},
+		{"extra spaces", ContentBlock{Content: "  #   Title  "}, "# Title"},
+		{"level wins over hashes", ContentBlock{Content: "# Title", Level: 3}, "### Title"},
+		{"no hashes", ContentBlock{Content: "Title"}, "# Title"},
+		{"capped at six", ContentBlock{Content: "######## Deep"}, "###### Deep"},
+	}
+
+	for _, tt := range tests {
+		if got := markdownHeading(tt.block, ""); got != tt.want {
+			t.Errorf("%s: markdownHeading = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSectionNumbers(t *testing.T) {
+	h := func(content string, numbered bool) ContentBlock {
+		return ContentBlock{Type: blockHeading, Content: content, Numbered: numbered}
+	}
+	blocks := []ContentBlock{
+		h("# Intro", true),
+		h("## Background", true),
+		{Type: blockText, Content: "text"},
+		h("## Aside", false),
+		h("## Method", true),
+		h("### Detail", true),
+		h("#### Too deep", true),
+		h("# Results", true),
+		h("### Skips a level", true),
+		h("## Again", true),
+	}
+	want := []string{"1", "1.1", "", "", "1.2", "1.2.1", "", "2", "2.0.1", "2.1"}
+
+	if got := sectionNumbers(blocks); !slices.Equal(got, want) {
+		t.Errorf("sectionNumbers = %q, want %q", got, want)
+	}
+	if got := markdownHeading(blocks[5], "1.2.1"); got != "### 1.2.1 Detail" {
+		t.Errorf("numbered Markdown heading = %q", got)
+	}
+	if got := htmlHeading(blocks[4], "1.2"); got != "<h2><span class=\"section-number\">1.2</span> Method</h2>\n" {
+		t.Errorf("numbered HTML heading = %q", got)
+	}
+}
+
+func TestSelectionBulkChanges(t *testing.T) {
+	newDoc := func(start, end int) documentModel {
+		var blocks []ContentBlock
+		for _, id := range []string{"1", "2", "3", "4", "5"} {
+			blocks = append(blocks, ContentBlock{ID: id, Type: blockText})
+		}
+		return documentModel{blocks: blocks, selectionStart: start, selectionEnd: end, currentBlock: end}
+	}
+	ids := func(d documentModel) string {
+		var s strings.Builder
+		for _, block := range d.blocks {
+			s.WriteString(block.ID)
+		}
+		return s.String()
+	}
+
+	tests := []struct {
+		name       string
+		start, end int
+		types      string
+	}{
+		{"forward range", 1, 3, "tmmmt"},
+		{"backward range", 3, 1, "tmmmt"},
+		{"single block", 4, 4, "ttttm"},
+		{"whole document", 0, 4, "mmmmm"},
+	}
+	for _, tt := range tests {
+		d := newDoc(tt.start, tt.end)
+		d.setSelectionType(blockMath)
+		var types strings.Builder
+		for _, block := range d.blocks {
+			types.WriteByte(string(block.Type)[0])
+		}
+		if types.String() != tt.types {
+			t.Errorf("%s: types = %s, want %s", tt.name, types.String(), tt.types)
+		}
+	}
+
+	d := newDoc(1, 2)
+	if !d.moveSelection(1) || ids(d) != "14235" || d.selectionStart != 2 || d.selectionEnd != 3 {
+		t.Errorf("move down: %s, selection %d-%d", ids(d), d.selectionStart, d.selectionEnd)
+	}
+	if d.moveSelection(2) {
+		t.Error("moving past the end should be refused")
+	}
+	if !d.deleteSelection() || ids(d) != "145" || d.currentBlock != 2 {
+		t.Errorf("delete: %s, current %d", ids(d), d.currentBlock)
+	}
+
+	d = newDoc(4, 0)
+	if d.deleteSelection() || len(d.blocks) != 5 {
+		t.Error("deleting every block should be refused")
+	}
+}
+
+func TestAsciiDocExport(t *testing.T) {
+	m := editorTestModel("", 0)
+	tests := []struct {
+		name  string
+		block ContentBlock
+		want  string
+	}{
+		{"heading", ContentBlock{Type: blockHeading, Content: "## Methods"}, "== Methods\n"},
+		{"code", ContentBlock{Type: blockCode, Language: "go", Content: "x := 1"}, "[source,go]\n----\nx := 1\n----\n"},
+		{"code without language", ContentBlock{Type: blockCode, Content: "x"}, "[source]\n----\nx\n----\n"},
+		{"display math", ContentBlock{Type: blockMath, Content: "E = mc^2"}, "[latexmath]\n++++\nE = mc^2\n++++\n"},
+		{"inline math", ContentBlock{Type: blockMath, Content: "where $a$ holds"}, "where latexmath:[a] holds\n"},
+		{"quote", ContentBlock{Type: blockQuote, Content: "Be brief"}, "____\nBe brief\n____\n"},
+		{"list", ContentBlock{Type: blockList, Content: "- one\n  - two\n1. three"}, "* one\n** two\n. three\n"},
+		{"image", ContentBlock{Type: blockImage, Content: "plot.png|A plot"}, ".A plot\nimage::plot.png[A plot]\n"},
+		{"rule", ContentBlock{Type: blockHR, Content: "---"}, "'''\n"},
+		{"raw latex", ContentBlock{Type: blockRawLaTeX, Content: "\\newpage"}, "[source,latex]\n----\n\\newpage\n----\n"},
+		{"text", ContentBlock{Type: blockText, Content: "Plain text  \n"}, "Plain text\n"},
+	}
+
+	for _, tt := range tests {
+		if got := m.generateAsciiDoc([]ContentBlock{tt.block}); got != tt.want+"\n" {
+			t.Errorf("%s: generateAsciiDoc = %q, want %q", tt.name, got, tt.want+"\n")
+		}
+	}
+}
+
+func TestOrgExport(t *testing.T) {
+	m := editorTestModel("", 0)
+	titles := []struct {
+		name   string
+		blocks []ContentBlock
+		want   string
+	}{
+		{"first level one heading", []ContentBlock{{Type: blockHeading, Content: "## Sub"}, {Type: blockHeading, Content: "# Main"}, {Type: blockHeading, Content: "# Later"}}, "Main"},
+		{"heading without hashes", []ContentBlock{{Type: blockHeading, Content: "Plain"}}, "Plain"},
+		{"only subheadings", []ContentBlock{{Type: blockHeading, Content: "## Sub"}}, ""},
+		{"no headings", []ContentBlock{{Type: blockText, Content: "# text"}}, ""},
+	}
+	for _, tt := range titles {
+		if got := orgTitle(tt.blocks); got != tt.want {
+			t.Errorf("%s: orgTitle = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	blocks := []ContentBlock{
+		{Type: blockHeading, Content: "# Notes"},
+		{Type: blockCode, Language: "python", Content: "def f():\n\treturn 1"},
+		{Type: blockCode, Content: "plain"},
+	}
+	want := "#+TITLE: Notes\n\n* Notes\n\n" +
+		"#+begin_src python\ndef f():\n    return 1\n#+end_src\n\n" +
+		"#+begin_src\nplain\n#+end_src\n\n"
+	if got := m.generateOrg(blocks); got != want {
+		t.Errorf("generateOrg =\n%q\nwant\n%q", got, want)
+	}
+	if got := m.generateOrg(blocks[1:2]); strings.Contains(got, "#+TITLE") {
+		t.Errorf("a document without a title got one:\n%s", got)
+	}
+}
+
+func TestNotesRoundTrip(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	path := filepath.Join(t.TempDir(), "doc.oath")
+	const notes = "remember to cite\nthe second paper"
+
+	m := editorTestModel("", 0)
+	m.notes = textarea.New()
+	m.notes.SetValue(notes)
+	m.document.blocks = []ContentBlock{{ID: "1", Type: blockText, Content: "body"}}
+	if saved := m.saveDocumentAs(path)().(documentSavedMsg); saved.err != nil {
+		t.Fatal(saved.err)
+	}
+
+	doc, err := readDocument(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Notes != notes {
+		t.Errorf("saved notes = %q, want %q", doc.Notes, notes)
+	}
+
+	opened := editorTestModel("", 0)
+	opened.notes = textarea.New()
+	next, _ := opened.openDocument(doc, path)
+	if got := next.(model).notes.Value(); got != notes {
+		t.Errorf("loaded notes = %q, want %q", got, notes)
+	}
+
+	for name, out := range map[string]string{
+		"markdown": m.generateMarkdown(doc.Content),
+		"html":     m.generateHTML(doc.Content),
+		"latex":    m.generateLaTeX(doc.Content),
+	} {
+		if strings.Contains(out, "remember to cite") {
+			t.Errorf("notes leaked into the %s export", name)
+		}
+	}
+}
+
+func TestSymbolGroupsAndFilter(t *testing.T) {
+	symbols := map[string]string{
+		"\\beta": "β", "\\alpha": "α", "\\sum": "∑", "\\le": "≤",
+		"\\in": "∈", "\\forall": "∀", "\\rightarrow": "→", "\\qed": "∎",
+	}
+	entries := symbolGroups(symbols)
+
+	var order []string
+	for _, entry := range entries {
+		order = append(order, entry.Category+" "+entry.Command)
+	}
+	want := []string{"Greek \\alpha", "Greek \\beta", "Operators \\sum", "Relations \\le", "Sets \\in", "Logic \\forall", "Arrows \\rightarrow", "Other \\qed"}
+	if !slices.Equal(order, want) {
+		t.Errorf("symbolGroups order = %q, want %q", order, want)
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"al", []string{"\\alpha", "\\forall"}},
+		{"\\AL", []string{"\\alpha", "\\forall"}},
+		{"greek", []string{"\\alpha", "\\beta"}},
+		{"sets", []string{"\\in"}},
+		{"", []string{"\\alpha", "\\beta", "\\sum", "\\le", "\\in", "\\forall"}},
+		{"nothing", nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, entry := range filterSymbols(entries, tt.query) {
+			got = append(got, entry.Command)
+		}
+		if tt.query == "" {
+			got = got[:len(tt.want)]
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("filterSymbols(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestCommentsStayOutOfExports(t *testing.T) {
+	m := editorTestModel("", 0)
+	blocks := []ContentBlock{
+		{ID: "1", Type: blockHeading, Content: "# Title", Comment: "rename-me"},
+		{ID: "2", Type: blockText, Content: "body"},
+		{ID: "3", Type: blockCode, Content: "x", Comment: "check-this-code"},
+		{ID: "4", Type: blockMath, Content: "x^2", Comment: "simplify-later"},
+	}
+
+	if got := commentedBlocks(blocks); !slices.Equal(got, []int{0, 2, 3}) {
+		t.Errorf("commentedBlocks = %v, want [0 2 3]", got)
+	}
+
+	exports := map[string]string{
+		"markdown": m.generateMarkdown(blocks),
+		"latex":    m.generateLaTeX(blocks),
+		"html":     m.generateHTML(blocks),
+		"offline":  m.generateOfflineHTML(blocks, "t"),
+		"unicode":  m.generateUnicode(blocks),
+		"asciidoc": m.generateAsciiDoc(blocks),
+		"org":      m.generateOrg(blocks),
+		"rst":      m.generateRST(blocks),
+	}
+	for name, out := range exports {
+		for _, block := range blocks {
+			if block.Comment != "" && strings.Contains(out, block.Comment) {
+				t.Errorf("%s export contains the comment %q", name, block.Comment)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := SaveDocumentToWriter(&buf, OathDocument{Version: documentVersion, Content: blocks}); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := LoadDocumentFromReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := commentedBlocks(doc.Content); !slices.Equal(got, []int{0, 2, 3}) || doc.Content[2].Comment != "check-this-code" {
+		t.Errorf("comments after save and load: %+v", doc.Content)
+	}
+}
+
+func TestRawTextBlocks(t *testing.T) {
+	m := editorTestModel("", 0)
+	raw := []ContentBlock{{ID: "1", Type: blockText, Content: "a & b \\textbf{c} 50%", RawText: true}}
+	escaped := []ContentBlock{{ID: "1", Type: blockText, Content: "a & b 50%"}}
+
+	if out := m.generateLaTeX(raw); !strings.Contains(out, "a & b \\textbf{c} 50%\n") {
+		t.Errorf("raw text was escaped in LaTeX:\n%s", out)
+	}
+	if out := m.generateLaTeX(escaped); !strings.Contains(out, "a \\& b 50\\%") {
+		t.Errorf("plain text wasn't escaped in LaTeX:\n%s", out)
+	}
+	if out := m.generateHTML(raw); !strings.Contains(out, "a &amp; b") {
+		t.Errorf("raw text should still be escaped in HTML:\n%s", out)
+	}
+	if out := m.generateMarkdown(raw); !strings.Contains(out, "a & b \\textbf{c} 50%") {
+		t.Errorf("raw text should be literal in Markdown:\n%s", out)
+	}
+
+	m.document.blocks = []ContentBlock{{ID: "1", Type: blockText, Content: "x"}, {ID: "2", Type: blockCode, Content: "y"}}
+	toggle := tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(m.keys.RawText)}
+	next, _ := m.updateEdit(toggle)
+	m = next.(model)
+	if !m.document.blocks[0].RawText || !m.document.modified {
+		t.Error("the toggle should mark a text block raw")
+	}
+	m.document.currentBlock = 1
+	next, _ = m.updateEdit(toggle)
+	if next.(model).document.blocks[1].RawText {
+		t.Error("only text blocks can be raw")
+	}
+}
+
+func TestWrapPreview(t *testing.T) {
+	const text = "the quick brown fox jumps over the lazy dog"
+	for _, width := range []int{80, 20, 10, 3, 1} {
+		got := wrapPreview(text, width)
+		for _, line := range strings.Split(got, "\n") {
+			if w := lipgloss.Width(line); w > width {
+				t.Errorf("width %d: line %q is %d wide", width, line, w)
+			}
+			if strings.HasSuffix(line, " ") {
+				t.Errorf("width %d: line %q keeps its padding", width, line)
+			}
+		}
+		if words := strings.Join(strings.Fields(got), ""); width >= 5 && words != strings.ReplaceAll(text, " ", "") {
+			t.Errorf("width %d: words changed: %q", width, got)
+		}
+	}
+
+	if got := wrapPreview(text, 80); got != text {
+		t.Errorf("text that fits = %q, want it unchanged", got)
+	}
+	if got := wrapPreview("keep\n\nparagraphs", 20); got != "keep\n\nparagraphs" {
+		t.Errorf("line breaks = %q", got)
+	}
+	for _, width := range []int{0, -5} {
+		if got := wrapPreview(text, width); got != text {
+			t.Errorf("width %d = %q, want it left alone", width, got)
+		}
+	}
+}
+
+func TestParseMacros(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []macroDefinition
+	}{
+		{"no arguments", `\newcommand{\R}{\mathbb{R}}`, []macroDefinition{{Name: `\R`, Expansion: `\mathbb{R}`}}},
+		{"unbraced name", `\newcommand\R{x}`, []macroDefinition{{Name: `\R`, Expansion: "x"}}},
+		{"one argument", `\renewcommand{\vec}[1]{\mathbf{#1}}`, []macroDefinition{{Name: `\vec`, Args: 1, Expansion: `\mathbf{#1}`}}},
+		{"optional default", `\newcommand{\pair}[2][x]{(#1, #2)}`, []macroDefinition{{Name: `\pair`, Args: 2, Expansion: "(#1, #2)"}}},
+		{"offsets", "% macros\n\\newcommand{\\a}{1}\n\\newcommand{\\b}{2}", []macroDefinition{
+			{Name: `\a`, Expansion: "1", Offset: 9},
+			{Name: `\b`, Expansion: "2", Offset: 28},
+		}},
+		{"missing body", `\newcommand{\bad}`, nil},
+	}
+	for _, tt := range tests {
+		if got := parseMacros(tt.content); !reflect.DeepEqual(got, tt.want) && (len(got) != 0 || len(tt.want) != 0) {
+			t.Errorf("%s: parseMacros = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		cursor int
+		want   string
+	}{{0, `\norm`}, {3, `\norm`}, {5, `\norm`}, {6, `\x`}, {9, ""}} {
+		if got := macroAt(`\norm{\x}`, tt.cursor); got != tt.want {
+			t.Errorf("macroAt(%d) = %q, want %q", tt.cursor, got, tt.want)
+		}
+	}
+
+	blocks := []ContentBlock{
+		{Type: blockRawLaTeX, Content: `\newcommand{\R}{\mathbb{R}}`},
+		{Type: blockMath, Content: `\newcommand{\R}{x}`},
+		{Type: blockRawLaTeX, Content: "\n\\renewcommand{\\R}{y}"},
+	}
+	if i, offset, ok := findMacroDefinition(blocks, `\R`); !ok || i != 2 || offset != 1 {
+		t.Errorf("findMacroDefinition = %d, %d, %v, want the last raw block", i, offset, ok)
+	}
+	if _, _, ok := findMacroDefinition(blocks[1:2], `\R`); ok {
+		t.Error("a definition in a math block was found")
+	}
+}
+
+func TestExportResultMsg(t *testing.T) {
+	tests := []struct {
+		name       string
+		msg        exportResultMsg
+		wantNotice string
+		wantError  string
+	}{
+		{"success", exportResultMsg{format: "HTML", path: "/tmp/notes.html"}, "Exported HTML to /tmp/notes.html", ""},
+		{"failure", exportResultMsg{format: "PDF", err: errors.New("pdflatex: Undefined control sequence")}, "", "PDF export failed: pdflatex: Undefined control sequence"},
+	}
+	for _, tt := range tests {
+		m := editorTestModel("", 0)
+		m.width, m.height = 100, 30
+		m.mode = modeExport
+		m.export.running = true
+		m.document.notice = "stale"
+
+		next, _ := m.Update(tt.msg)
+		m = next.(model)
+		if m.mode != modeEdit || m.export.running {
+			t.Errorf("%s: mode %v, running %v, want back in edit mode", tt.name, m.mode, m.export.running)
+		}
+		if m.document.notice != tt.wantNotice {
+			t.Errorf("%s: notice = %q, want %q", tt.name, m.document.notice, tt.wantNotice)
+		}
+		if m.document.exportError != tt.wantError {
+			t.Errorf("%s: exportError = %q, want %q", tt.name, m.document.exportError, tt.wantError)
+		}
+		if tt.wantError == "" {
+			continue
+		}
+		if got := ansi.Strip(m.viewExportError()); !strings.Contains(got, "Export failed") || !strings.Contains(got, "Undefined control sequence") {
+			t.Errorf("%s: overlay doesn't show the reason:\n%s", tt.name, got)
+		}
+		next, _ = m.updateEdit(tea.KeyMsg{Type: tea.KeyEsc})
+		if m = next.(model); m.document.exportError != "" {
+			t.Errorf("%s: esc left the overlay open", tt.name)
+		}
+	}
+}
+
+func TestQuickPreview(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		block       blockType
+		width       int
+		want        string
+		diagnostics int
+	}{
+		{"math", `\alpha + \beta`, blockMath, 40, "α + β", 0},
+		{"truncated", `\alpha\alpha\alpha\alpha\alpha\alpha`, blockMath, 4, "ααα…", 0},
+		{"unbalanced", `\frac{1}{2`, blockMath, 40, `\frac{1}{2`, 1},
+		{"equation", `\begin{equation} E = mc^2 \end{equation}`, blockMath, 40, "E = mc²", 0},
+		{"raw latex keeps environments", `\begin{equation} E \end{equation}`, blockRawLaTeX, 40, `\begin{equation} E \end{equation}`, 0},
+	}
+	for _, tt := range tests {
+		r := newRenderModel(0)
+		got, diagnostics := r.quickPreview(tt.content, tt.block, tt.width)
+		if got != tt.want {
+			t.Errorf("%s: preview = %q, want %q", tt.name, got, tt.want)
+		}
+		if len(diagnostics) != tt.diagnostics {
+			t.Errorf("%s: %d diagnostics, want %d: %+v", tt.name, len(diagnostics), tt.diagnostics, diagnostics)
+		}
+	}
+}
+
+func TestDocumentTemplate(t *testing.T) {
+	blocks := []ContentBlock{
+		{ID: "a", Type: blockHeading, Content: "Results", Comment: "rewrite"},
+		{ID: "b", Type: blockMath, Content: `E = mc^2`, Rendered: "E = mc²"},
+	}
+	tests := []struct {
+		name     string
+		blank    bool
+		contents []string
+	}{
+		{"full", false, []string{"Results", "E = mc^2"}},
+		{"outline", true, []string{"Results", ""}},
+	}
+	for _, tt := range tests {
+		template := documentTemplate("Lab report", blocks, map[string]string{"course": "PHYS 101"}, tt.blank)
+		if template.Name != "Lab report" || template.Variables["course"] != "PHYS 101" {
+			t.Errorf("%s: template = %+v", tt.name, template)
+		}
+		for i, block := range template.Content {
+			if block.Type != blocks[i].Type || block.Content != tt.contents[i] {
+				t.Errorf("%s: block %d = %s %q, want %s %q", tt.name, i, block.Type, block.Content, blocks[i].Type, tt.contents[i])
+			}
+			if block.Comment != "" || block.Rendered != "" {
+				t.Errorf("%s: block %d kept %q and %q", tt.name, i, block.Comment, block.Rendered)
+			}
+		}
+	}
+	if blocks[0].Comment == "" || blocks[1].Content == "" {
+		t.Error("documentTemplate changed the document's blocks")
+	}
+
+	t.Setenv("HOME", t.TempDir())
+	builtin := builtinTemplates()
+	if _, err := saveUserTemplate(documentTemplate(builtin[0].Name, blocks, nil, false)); err != nil {
+		t.Fatal(err)
+	}
+	merged := getDefaultTemplates()
+	if len(merged) != len(builtin)+1 {
+		t.Fatalf("%d templates, want %d built in and the saved one", len(merged), len(builtin))
+	}
+	for i, template := range builtin {
+		if !reflect.DeepEqual(merged[i], template) {
+			t.Errorf("built in template %d = %q, want %q", i, merged[i].Name, template.Name)
+		}
+	}
+	if saved := merged[len(builtin)]; saved.Name != builtin[0].Name || len(saved.Content) != len(blocks) {
+		t.Errorf("saved template = %+v", saved)
+	}
+}
+
+func TestHorizontalRuleExports(t *testing.T) {
+	m := editorTestModel("", 0)
+	blocks := []ContentBlock{
+		{ID: "1", Type: blockText, Content: "Above"},
+		{ID: "2", Type: blockHR, Content: "---"},
+		{ID: "3", Type: blockText, Content: "Below"},
+	}
+	tests := []struct {
+		exporter string
+		got      string
+		want     string
+	}{
+		{"latex", m.generateLaTeX(blocks), "\\noindent\\rule{\\linewidth}{0.4pt}\n"},
+		{"html", m.generateHTML(blocks), "<hr>\n"},
+		{"epub", m.epubBlockXHTML(blocks[1]), "<hr/>\n"},
+		{"markdown", m.generateMarkdown(blocks), "\n---\n\n"},
+		{"unicode", m.generateUnicode(blocks), strings.Repeat("─", 40) + "\n"},
+		{"asciidoc", m.generateAsciiDoc(blocks), "'''\n"},
+		{"org", m.generateOrg(blocks), "-----\n"},
+		{"rst", m.generateRST(blocks), "----\n"},
+	}
+	for _, tt := range tests {
+		if !strings.Contains(tt.got, tt.want) {
+			t.Errorf("%s export is missing %q:\n%s", tt.exporter, tt.want, tt.got)
+		}
+	}
+
+	for _, width := range []int{60, 3, 0} {
+		if got, want := lipgloss.Width(horizontalRule(width)), max(width, 3); got != want {
+			t.Errorf("horizontalRule(%d) is %d wide, want %d", width, got, want)
+		}
+	}
+}
+
+func TestJumpToDiagnostic(t *testing.T) {
+	m := editorTestModel("", 0)
+	m.document.blocks = []ContentBlock{
+		{ID: "a", Type: blockMath, Content: `\frac{1}{2`},
+		{ID: "b", Type: blockText, Content: "first\nsecond line"},
+	}
+	m.document.lsp.diagnostics = []Diagnostic{
+		{BlockID: "b", Line: 2, Column: 3, Message: "second"},
+		{BlockID: "deleted", Line: 1, Column: 1, Message: "gone"},
+		{BlockID: "a", Line: 1, Column: 99, Message: "past the end"},
+	}
+	steps := []struct {
+		delta  int
+		active int
+		block  int
+		cursor int
+	}{
+		{1, 0, 1, 8},
+		{1, 2, 0, 10},
+		{1, 0, 1, 8},
+		{-1, 2, 0, 10},
+		{-1, 0, 1, 8},
+	}
+	for i, step := range steps {
+		m.jumpToDiagnostic(step.delta)
+		if m.document.lsp.activeDiagnostic != step.active || m.document.currentBlock != step.block {
+			t.Fatalf("step %d: diagnostic %d in block %d, want %d in block %d",
+				i, m.document.lsp.activeDiagnostic, m.document.currentBlock, step.active, step.block)
+		}
+		if got := editorCursorIndex(m.document.editor); got != step.cursor {
+			t.Errorf("step %d: cursor at %d, want %d", i, got, step.cursor)
+		}
+	}
+
+	m.document.lsp.diagnostics = m.document.lsp.diagnostics[1:2]
+	m.jumpToDiagnostic(1)
+	if m.document.commandError != "No diagnostics" {
+		t.Errorf("only a stale diagnostic left: error %q", m.document.commandError)
+	}
+}
+
+func TestDetectLanguage(t *testing.T) {
+	tests := []struct {
+		name, content, want string
+	}{
+		{"python", "import os\n\ndef main():\n    print(os.getcwd())\n\nif __name__ == \"__main__\":\n    main()", "python"},
+		{"go", "package main\n\nfunc main() {\n\tdata, err := os.ReadFile(\"x\")\n\tif err != nil {\n\t\treturn\n\t}\n\tfmt.Println(data)\n}", "go"},
+		{"javascript", "const add = (a, b) => a + b;\nlet total = add(1, 2);\nconsole.log(total === 3);", "javascript"},
+		{"bash", "cd build && make\nif [ -f out ]; then\n  echo done\nfi", "bash"},
+		{"python shebang", "#!/usr/bin/env python3\nx = 1", "python"},
+		{"node shebang", "#!/usr/bin/env node\nx = 1", "javascript"},
+		{"sh shebang", "#!/bin/sh\nx=1", "bash"},
+		{"prose", "nothing to see here", ""},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		if got := detectLanguage(tt.content); got != tt.want {
+			t.Errorf("%s: detectLanguage = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	block := ContentBlock{Type: blockCode, Content: "package main", Language: "rust"}
+	if got := codeLanguage(block); got != "rust" {
+		t.Errorf("codeLanguage ignored the override: %q", got)
+	}
+	block.Language = ""
+	if got := codeLanguage(block); got != "go" {
+		t.Errorf("codeLanguage without an override = %q, want go", got)
+	}
+}
+
+func TestFuzzyCompletionRanking(t *testing.T) {
+	lsp := newLSPModel(newRenderModel(0).mathSymbols)
+	tests := []struct {
+		typed string
+		// Labels that must lead the list, in any order
+		first []string
+		also  []string
+	}{
+		{`\al`, []string{`\alpha`, `\aleph`}, []string{`\forall`, `\partial`}},
+		{`\alph`, []string{`\alpha`}, []string{`\aleph`}},
+		{`\inty`, []string{`\infty`}, nil},
+		{`\zzqx`, nil, nil},
+	}
+	for _, tt := range tests {
+		var labels []string
+		for _, completion := range lsp.getCompletions(tt.typed, len(tt.typed)) {
+			labels = append(labels, completion.Label)
+		}
+		if len(labels) < len(tt.first) {
+			t.Errorf("%s: completions %v, want %v first", tt.typed, labels, tt.first)
+			continue
+		}
+		if leading := labels[:len(tt.first)]; !slices.Equal(slices.Sorted(slices.Values(leading)), slices.Sorted(slices.Values(tt.first))) {
+			t.Errorf("%s: completions %v, want %v first", tt.typed, labels, tt.first)
+		}
+		for _, label := range tt.also {
+			if !slices.Contains(labels[len(tt.first):], label) {
+				t.Errorf("%s: completions %v, want %s after the prefix matches", tt.typed, labels, label)
+			}
+		}
+	}
+
+	if got := lsp.getCompletions(`\a`, 2); len(got) != maxCompletions {
+		t.Errorf(`\a gave %d completions, want the top %d`, len(got), maxCompletions)
+	}
+}
+
+func TestSplitLinks(t *testing.T) {
+	tests := []struct {
+		name, in string
+		want     []linkSpan
+	}{
+		{"href", `see \href{https://go.dev}{Go} now`, []linkSpan{
+			{Text: "see "},
+			{Link: &link{URL: "https://go.dev", Text: "Go"}},
+			{Text: " now"},
+		}},
+		{"url", `\url{https://example.com}`, []linkSpan{{Link: &link{URL: "https://example.com"}}}},
+		{"missing text group", `\href{https://go.dev} plain`, []linkSpan{{Text: `\href{https://go.dev} plain`}}},
+		{"no links", "just text", []linkSpan{{Text: "just text"}}},
+	}
+	for _, tt := range tests {
+		if got := splitLinks(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: splitLinks = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+
+	labels := []struct {
+		l    link
+		want string
+	}{
+		{link{URL: "https://go.dev", Text: "Go"}, "Go (https://go.dev)"},
+		{link{URL: "https://go.dev"}, "https://go.dev"},
+		{link{URL: "https://go.dev", Text: "https://go.dev"}, "https://go.dev"},
+	}
+	for _, tt := range labels {
+		if got := tt.l.label(); got != tt.want {
+			t.Errorf("label of %+v = %q, want %q", tt.l, got, tt.want)
+		}
+	}
+
+	if got, want := hyperlink("https://go.dev", "Go"), "\x1b]8;;https://go.dev\x1b\\Go\x1b]8;;\x1b\\"; got != want {
+		t.Errorf("hyperlink = %q, want %q", got, want)
+	}
+	if got := ansi.Strip(hyperlink("https://go.dev", "Go")); got != "Go" {
+		t.Errorf("hyperlink shows %q, want only the text", got)
+	}
+
+	protected, links := protectLinks(`a \url{x} b \href{y}{z}`)
+	if got := restoreLinks(protected, links); got != "a x b z (y)" {
+		t.Errorf("protect and restore = %q", got)
+	}
+}
+
+func TestBlockPlaceholder(t *testing.T) {
+	tests := []struct {
+		block blockType
+		want  string
+	}{
+		{blockText, "Start writing"},
+		{blockMath, "$ ... $"},
+		{blockCode, "// code here"},
+		{blockList, "- item"},
+		{blockQuote, "quoted text"},
+		{blockHeading, "# Title"},
+		{blockTable, "| a | b |"},
+		{blockImage, "path|alt text"},
+		{blockRawLaTeX, "\\begin{...}"},
+		{blockType("unknown"), "Start writing"},
+	}
+	for _, tt := range tests {
+		if got := blockPlaceholder(tt.block); got != tt.want {
+			t.Errorf("blockPlaceholder(%s) = %q, want %q", tt.block, got, tt.want)
+		}
+
+		m := editorTestModel("", 0)
+		next, _ := m.appendBlock(tt.block)
+		if got := next.(model).document.editor.Placeholder; got != tt.want {
+			t.Errorf("new %s block placeholder = %q, want %q", tt.block, got, tt.want)
+		}
+	}
+}
+
+func TestPushRecentDir(t *testing.T) {
+	var many []string
+	for i := 0; i < maxRecentFiles; i++ {
+		many = append(many, fmt.Sprintf("/dir%d", i))
+	}
+	tests := []struct {
+		name   string
+		recent []string
+		push   string
+		want   []string
+	}{
+		{"empty", nil, "/a", []string{"/a"}},
+		{"new goes first", []string{"/a", "/b"}, "/c", []string{"/c", "/a", "/b"}},
+		{"repeat moves to the front", []string{"/a", "/b", "/c"}, "/b", []string{"/b", "/a", "/c"}},
+		{"already first", []string{"/a", "/b"}, "/a", []string{"/a", "/b"}},
+		{"cleaned before comparing", []string{"/a", "/b"}, "/b/../b/", []string{"/b", "/a"}},
+		{"capped", many, "/new", append([]string{"/new"}, many[:maxRecentFiles-1]...)},
+	}
+	for _, tt := range tests {
+		prefs := &UserPreferences{RecentDirs: tt.recent}
+		prefs.pushRecentDir(tt.push)
+		if !slices.Equal(prefs.RecentDirs, tt.want) {
+			t.Errorf("%s: RecentDirs = %v, want %v", tt.name, prefs.RecentDirs, tt.want)
+		}
+	}
+}
+
+// A directory entry whose Info fails, like one removed or locked between listing and stat
+type fakeDirEntry struct {
+	name string
+	dir  bool
+	err  error
+}
+
+func (e fakeDirEntry) Name() string               { return e.name }
+func (e fakeDirEntry) IsDir() bool                { return e.dir }
+func (e fakeDirEntry) Type() os.FileMode          { return 0 }
+func (e fakeDirEntry) Info() (os.FileInfo, error) { return nil, e.err }
+
+func TestListEntriesKeepsUnreadable(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "notes.oath"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	readable, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := append(readable,
+		fakeDirEntry{name: "locked", dir: true, err: os.ErrPermission},
+		fakeDirEntry{name: "vanished.oath", err: os.ErrNotExist},
+		fakeDirEntry{name: ".hidden", err: os.ErrPermission},
+	)
+
+	files := listEntries(dir, entries, false)
+	tests := []struct {
+		name     string
+		dir      bool
+		err      error
+		errorMsg string
+	}{
+		{"..", true, nil, ""},
+		{"locked", true, os.ErrPermission, "Permission denied: " + filepath.Join(dir, "locked")},
+		{"notes.oath", false, nil, ""},
+		{"vanished.oath", false, os.ErrNotExist, os.ErrNotExist.Error()},
+	}
+	if len(files) != len(tests) {
+		t.Fatalf("listed %d entries, want %d: %+v", len(files), len(tests), files)
+	}
+	for i, tt := range tests {
+		file := files[i]
+		if file.Name != tt.name || file.IsDir != tt.dir || !errors.Is(file.Err, tt.err) {
+			t.Errorf("entry %d = %q dir %v err %v, want %q dir %v err %v", i, file.Name, file.IsDir, file.Err, tt.name, tt.dir, tt.err)
+			continue
+		}
+		if file.Err != nil {
+			if got := accessError(file.Path, file.Err); got != tt.errorMsg {
+				t.Errorf("%s: accessError = %q, want %q", tt.name, got, tt.errorMsg)
+			}
+		}
+	}
+	if files[2].Size != 2 {
+		t.Errorf("readable file size = %d, want 2", files[2].Size)
+	}
+}
+
+func TestLaTeXPreamble(t *testing.T) {
+	tests := []struct {
+		name, class, fontSize, custom string
+		documentclass                 string
+		want                          string
+		absent                        []string
+	}{
+		{"defaults", "", "", "", `\documentclass{article}`, "", nil},
+		{"report at 12pt", "report", "12pt", "", `\documentclass[12pt]{report}`, "", nil},
+		{"unknown class and size", "memoir", "13pt", "", `\documentclass{article}`, "", []string{"13pt"}},
+		{"new package", "book", "", `\usepackage{tikz}`, `\documentclass{book}`, `\usepackage{tikz}`, nil},
+		{"built-in package dropped", "", "", "\\usepackage[dvipsnames]{xcolor}\n\\newcommand{\\R}{\\mathbb{R}}", `\documentclass{article}`, `\newcommand{\R}{\mathbb{R}}`, []string{"dvipsnames"}},
+		{"mixed package list", "", "", `\usepackage{amsmath,tikz,siunitx}`, `\documentclass{article}`, `\usepackage{tikz,siunitx}`, nil},
+	}
+	for _, tt := range tests {
+		m := editorTestModel("", 0)
+		m.preferences.LaTeXClass = tt.class
+		m.preferences.LaTeXFontSize = tt.fontSize
+		m.preferences.LaTeXPreamble = tt.custom
+		got := m.generateLaTeX(nil)
+		preamble, _, found := strings.Cut(got, "\\begin{document}")
+		if !found {
+			t.Fatalf("%s: no \\begin{document}:\n%s", tt.name, got)
+		}
+
+		if !strings.HasPrefix(preamble, tt.documentclass+"\n") {
+			t.Errorf("%s: preamble starts %q, want %s", tt.name, strings.SplitN(preamble, "\n", 2)[0], tt.documentclass)
+		}
+		if tt.want != "" && !strings.HasSuffix(preamble, tt.want+"\n") {
+			t.Errorf("%s: custom preamble isn't last before \\begin{document}:\n%s", tt.name, preamble)
+		}
+		for _, fragment := range tt.absent {
+			if strings.Contains(preamble, fragment) {
+				t.Errorf("%s: preamble contains %q:\n%s", tt.name, fragment, preamble)
+			}
+		}
+		for _, pkg := range latexPackages {
+			if n := strings.Count(preamble, "{"+pkg.name+"}") + strings.Count(preamble, ","+pkg.name+"}") + strings.Count(preamble, "{"+pkg.name+","); n != 1 {
+				t.Errorf("%s: %s loaded %d times", tt.name, pkg.name, n)
+			}
+		}
+	}
+}
+
+func TestChecklistItems(t *testing.T) {
+	parsed := []struct {
+		line string
+		want listItem
+	}{
+		{"- [ ] buy milk", listItem{Text: "buy milk", Task: true}},
+		{"- [x] done", listItem{Text: "done", Task: true, Done: true}},
+		{"* [X] shouted", listItem{Text: "shouted", Task: true, Done: true}},
+		{"1. [ ] numbered", listItem{Ordered: true, Text: "numbered", Task: true}},
+		{"- plain", listItem{Text: "plain"}},
+		{"- [link] text", listItem{Text: "[link] text"}},
+		{"- [y] not a box", listItem{Text: "[y] not a box"}},
+	}
+	for _, tt := range parsed {
+		items := parseListItems(tt.line)
+		if len(items) != 1 || items[0] != tt.want {
+			t.Errorf("parseListItems(%q) = %+v, want %+v", tt.line, items, tt.want)
+		}
+	}
+
+	toggles := []struct {
+		name, content string
+		cursor        int
+		want          string
+		wantCursor    int
+		ok            bool
+	}{
+		{"tick", "- [ ] a\n- [ ] b", 10, "- [ ] a\n- [x] b", 10, true},
+		{"untick", "- [x] a", 0, "- [ ] a", 0, true},
+		{"plain item gets a box", "- a", 2, "- [ ] a", 6, true},
+		{"cursor before the box stays", "  - a", 1, "  - [ ] a", 1, true},
+		{"numbered", "1. [ ] a", 7, "1. [x] a", 7, true},
+		{"not a list line", "text\n- [ ] a", 2, "text\n- [ ] a", 2, false},
+	}
+	for _, tt := range toggles {
+		got, cursor, ok := toggleChecklistItem(tt.content, tt.cursor)
+		if got != tt.want || cursor != tt.wantCursor || ok != tt.ok {
+			t.Errorf("%s: toggleChecklistItem = %q, %d, %v, want %q, %d, %v", tt.name, got, cursor, ok, tt.want, tt.wantCursor, tt.ok)
+		}
+	}
+}
+
+func TestFindMatches(t *testing.T) {
+	long := strings.Repeat("a", 30) + " needle " + strings.Repeat("b", 30)
+	blocks := []ContentBlock{
+		{Type: blockHeading, Content: "Needle in a haystack"},
+		{Type: blockText, Content: "no match here"},
+		{Type: blockMath, Content: "needle\nneedle"},
+		{Type: blockText, Content: long},
+	}
+	type found struct {
+		block   int
+		start   int
+		context string
+	}
+	tests := []struct {
+		name          string
+		query         string
+		caseSensitive bool
+		want          []found
+	}{
+		{"ignoring case", "needle", false, []found{
+			{0, 0, "Needle in a haystack"},
+			{2, 0, "needle needle"},
+			{2, 7, "needle needle"},
+			{3, 31, "…" + strings.Repeat("a", 19) + " needle " + strings.Repeat("b", 19) + "…"},
+		}},
+		{"case sensitive", "Needle", true, []found{{0, 0, "Needle in a haystack"}}},
+		{"empty query", "", false, nil},
+	}
+	for _, tt := range tests {
+		var got []found
+		for _, match := range findMatches(blocks, tt.query, tt.caseSensitive) {
+			if match.Type != blocks[match.Block].Type {
+				t.Errorf("%s: match in block %d has type %s", tt.name, match.Block, match.Type)
+			}
+			if highlighted := match.Context[match.Before:match.After]; !strings.EqualFold(highlighted, tt.query) {
+				t.Errorf("%s: highlighted %q in %q", tt.name, highlighted, match.Context)
+			}
+			got = append(got, found{match.Block, match.Start, match.Context})
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: findMatches = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+
+	var starts []int
+	for _, match := range findMatches([]ContentBlock{{Content: "aaaaa"}}, "aa", true) {
+		starts = append(starts, match.Start)
+	}
+	if !slices.Equal(starts, []int{0, 2}) {
+		t.Errorf("overlapping matches start at %v, want [0 2]", starts)
+	}
+}
+
+func TestGutterWidth(t *testing.T) {
+	tests := []struct {
+		lines, want int
+	}{
+		{0, 3},
+		{1, 3},
+		{9, 3},
+		{10, 4},
+		{99, 4},
+		{100, 5},
+	}
+	for _, tt := range tests {
+		if got := gutterWidth(tt.lines); got != tt.want {
+			t.Errorf("gutterWidth(%d) = %d, want %d", tt.lines, got, tt.want)
+		}
+	}
+
+	var lines []string
+	for i := 1; i <= 12; i++ {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+	m := editorTestModel(strings.Join(lines, "\n"), 0)
+	m.preferences.EditorLineNumbers = true
+	m.width, m.height = 100, 30
+	m.document.editor.SetHeight(4)
+	m.fitEditor()
+	// Numbers keep their width once the editor has scrolled down to two digits
+	top := ansi.Strip(m.editorView())
+	m.document.editor.Focus()
+	m.document.editor, _ = m.document.editor.Update(tea.KeyMsg{Type: tea.KeyCtrlEnd})
+	bottom := ansi.Strip(m.editorView())
+	if !strings.Contains(top, "┃   1 line 1") || !strings.Contains(bottom, "┃  12 line 12") {
+		t.Errorf("gutter shifted between\n%s\nand\n%s", top, bottom)
+	}
+}
+
+func TestOpenTemplateRenumbersBlocks(t *testing.T) {
+	tests := []Template{
+		{Name: "duplicated", Content: []ContentBlock{{ID: "1"}, {ID: "1"}, {ID: "2"}}},
+		{Name: "named", Content: []ContentBlock{{ID: "intro"}, {ID: ""}, {ID: "9"}}},
+		{Name: "empty"},
+	}
+	tests = append(tests, builtinTemplates()...)
+
+	for _, template := range tests {
+		m := editorTestModel("", 0)
+		m.notes = textarea.New()
+		next, _ := m.openTemplate(template, nil)
+		m = next.(model)
+
+		for i, block := range m.document.blocks {
+			if want := fmt.Sprint(i + 1); block.ID != want {
+				t.Errorf("%s: block %d has ID %q, want %q", template.Name, i, block.ID, want)
+			}
+		}
+		want := fmt.Sprint(len(template.Content) + 1)
+		if id := m.document.newBlockID(); id != want {
+			t.Errorf("%s: next new block ID = %q, want %q", template.Name, id, want)
+		}
+	}
+
+	template := tests[0]
+	if template.Content[1].ID != "1" {
+		t.Error("opening a template renumbered the template itself")
+	}
+}
+
+func TestTokenizeGo(t *testing.T) {
+	golang, ok := lookupSyntax("golang")
+	if !ok {
+		t.Fatal("no syntax for golang")
+	}
+	tests := []struct {
+		name, code string
+		want       []codeToken
+	}{
+		{"keywords, strings, comments and numbers", "func main() {\n\ts := \"hi\" // greet\n\treturn 42\n}", []codeToken{
+			{tokenKeyword, "func"},
+			{tokenPlain, " main() {\n\ts := "},
+			{tokenString, `"hi"`},
+			{tokenPlain, " "},
+			{tokenComment, "// greet"},
+			{tokenPlain, "\n\t"},
+			{tokenKeyword, "return"},
+			{tokenPlain, " "},
+			{tokenNumber, "42"},
+			{tokenPlain, "\n}"},
+		}},
+		{"keyword inside a word", "funcs", []codeToken{{tokenPlain, "funcs"}}},
+		{"raw string spans lines", "x := `raw\nline`", []codeToken{{tokenPlain, "x := "}, {tokenString, "`raw\nline`"}}},
+		{"quoted string ends at the line", "s := \"open\nnext", []codeToken{{tokenPlain, "s := "}, {tokenString, `"open`}, {tokenPlain, "\nnext"}}},
+		{"unterminated block comment", "/* open", []codeToken{{tokenComment, "/* open"}}},
+	}
+	for _, tt := range tests {
+		if got := tokenizeCode(tt.code, golang); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: tokenizeCode = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+
+	r := newRenderModel(0)
+	theme := editorTestModel("", 0).getCurrentTheme()
+	// lipgloss renders tabs as four spaces
+	code := strings.ReplaceAll(tests[0].code, "\t", "    ")
+	highlighted, ok := r.highlightCode(code, "go", theme)
+	if !ok || ansi.Strip(highlighted) != code {
+		t.Errorf("highlightCode changed the text: %q", ansi.Strip(highlighted))
+	}
+	if _, ok := r.highlightCode(code, "brainfuck", theme); ok {
+		t.Error("an unknown language was highlighted")
+	}
+}
+
+func TestEnvironmentDiagnostics(t *testing.T) {
+	type found struct {
+		line, column int
+		message      string
+	}
+	tests := []struct {
+		name, content string
+		want          []found
+	}{
+		{"balanced", "\\begin{align}\n\\begin{cases}x\\end{cases}\n\\end{align}", nil},
+		{"unmatched begin", "x\n  \\begin{align}\ny = 1", []found{{2, 3, `\begin{align} is never closed`}}},
+		{"stray end", "y = 1\n\\end{equation}", []found{{2, 1, `\end{equation} without a matching \begin`}}},
+		{"mismatched nesting", "\\begin{align}\n\\begin{cases}\n\\end{align}", []found{{2, 1, `\begin{cases} is not closed before \end{align}`}}},
+		{"crossed", "\\begin{a}\\begin{b}\\end{a}\\end{b}", []found{
+			{1, 10, `\begin{b} is not closed before \end{a}`},
+			{1, 26, `\end{b} without a matching \begin`},
+		}},
+		{"unfinished name", `\begin{align`, nil},
+	}
+	for _, tt := range tests {
+		var got []found
+		for _, d := range environmentDiagnostics(strings.Split(tt.content, "\n")) {
+			if d.Severity != "error" {
+				t.Errorf("%s: %q has severity %q", tt.name, d.Message, d.Severity)
+			}
+			got = append(got, found{d.Line, d.Column, d.Message})
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: environmentDiagnostics = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAutoIndentPrefix(t *testing.T) {
+	tests := []struct {
+		name, line string
+		block      blockType
+		want       string
+	}{
+		{"bullet", "- milk", blockList, "- "},
+		{"star", "* eggs", blockList, "* "},
+		{"nested bullet", "    - deep", blockList, "    - "},
+		{"numbered", "1. first", blockList, "2. "},
+		{"numbered past nine", "\t9) ninth", blockList, "\t10) "},
+		{"checklist", "- [x] done", blockList, "- [ ] "},
+		{"list continuation text", "  wrapped text", blockList, "  "},
+		{"code indent", "\t\tif x {", blockCode, "\t\t"},
+		{"code spaces", "    return", blockCode, "    "},
+		{"code marker isn't a list", "- not a list", blockCode, ""},
+		{"unindented code", "x := 1", blockCode, ""},
+	}
+	for _, tt := range tests {
+		if got := autoIndentPrefix(tt.line, tt.block); got != tt.want {
+			t.Errorf("%s: autoIndentPrefix(%q) = %q, want %q", tt.name, tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestInlinePreview(t *testing.T) {
+	const five = "\\alpha\n\\beta\n\\gamma\n\\delta\n\\epsilon"
+	tests := []struct {
+		name, content   string
+		width, maxLines int
+		want            string
+	}{
+		{"fits", "\\alpha\n\\beta", 40, 3, "α\nβ"},
+		{"too many lines", five, 40, 3, "α\nβ\n… 3 more lines"},
+		{"one line over", "\\alpha\n\\beta\n\\gamma\n\\delta", 40, 3, "α\nβ\n… 2 more lines"},
+		{"no limit", five, 40, 0, "α\nβ\nγ\nδ\nε"},
+		{"narrow", "\\alpha\\alpha\\alpha\\alpha", 3, 3, "αα…"},
+	}
+	for _, tt := range tests {
+		r := newRenderModel(0)
+		if got := r.inlinePreview(tt.content, blockMath, tt.width, tt.maxLines); got != tt.want {
+			t.Errorf("%s: inlinePreview = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	for block, want := range map[blockType]bool{blockMath: true, blockText: true, blockRawLaTeX: true, blockCode: false, blockTable: false, blockImage: false, blockHR: false} {
+		if got := hasInlinePreview(block); got != want {
+			t.Errorf("hasInlinePreview(%s) = %v, want %v", block, got, want)
+		}
+	}
+}
+
+func TestMarkdownFrontMatter(t *testing.T) {
+	created := time.Date(2024, 3, 9, 15, 4, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		frontMatter bool
+		blocks      []ContentBlock
+		want        string
+	}{
+		{"first heading titles it", true, []ContentBlock{
+			{ID: "1", Type: blockHeading, Content: "# Document Title"},
+			{ID: "2", Type: blockHeading, Content: "## Field \"Notes\""},
+			{ID: "3", Type: blockText, Content: "Body"},
+		}, "---\ntitle: \"Field \\\"Notes\\\"\"\ndate: 2024-03-09\n---\n\n"},
+		{"untitled", true, []ContentBlock{{ID: "1", Type: blockText, Content: "Body"}}, "---\ndate: 2024-03-09\n---\n\n"},
+		{"off", false, []ContentBlock{{ID: "1", Type: blockHeading, Content: "# Results"}}, ""},
+	}
+	for _, tt := range tests {
+		doc := OathDocument{Created: created, Content: tt.blocks}
+		got := DocumentToMarkdown(doc, &UserPreferences{MarkdownFrontMatter: tt.frontMatter})
+		body := DocumentToMarkdown(doc, &UserPreferences{})
+		if got != tt.want+body {
+			t.Errorf("%s: DocumentToMarkdown = %q, want %q before the body %q", tt.name, got, tt.want, body)
+		}
+		if strings.HasPrefix(body, "---") {
+			t.Errorf("%s: front matter without the preference: %q", tt.name, body)
+		}
+	}
+
+	if got, want := markdownFrontMatter("", time.Time{}), "date: "+time.Now().Format("2006-01-02"); !strings.Contains(got, want) {
+		t.Errorf("unsaved document front matter = %q, want %q", got, want)
+	}
+}
+
+func TestNextBlockType(t *testing.T) {
+	tests := []struct {
+		from, want blockType
+	}{
+		{blockText, blockHeading},
+		{blockHeading, blockMath},
+		{blockMath, blockCode},
+		{blockCode, blockQuote},
+		{blockQuote, blockList},
+		{blockList, blockRawLaTeX},
+		{blockRawLaTeX, blockText},
+		{blockTable, blockText},
+		{blockImage, blockText},
+	}
+	for _, tt := range tests {
+		if got := nextBlockType(tt.from); got != tt.want {
+			t.Errorf("nextBlockType(%s) = %s, want %s", tt.from, got, tt.want)
+		}
+	}
+
+	m := editorTestModel("", 0)
+	m.document.blocks = []ContentBlock{{ID: "1", Type: blockText}}
+	for range blockTypeCycle {
+		next, _ := m.updateEdit(tea.KeyMsg{Type: tea.KeyTab})
+		m = next.(model)
+	}
+	if got := m.document.blocks[0].Type; got != blockText || !m.document.modified {
+		t.Errorf("after a full cycle the block is %s, modified %v", got, m.document.modified)
+	}
+}